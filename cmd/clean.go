@@ -1,22 +1,45 @@
 package cmd
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
-	tea "github.com/charmbracelet/bubbletea"
 	"github.com/spf13/cobra"
 
 	"bleach/internal/processor"
 	"bleach/internal/tui"
+	"bleach/pkg/imgutil"
 )
 
 var (
 	cleanInPlace     bool
 	cleanOutputDir   string
 	cleanPreserveICC bool
+	cleanKeepTrailer bool
+	cleanFormat      string
+	cleanPolicy      string
+	cleanRewriteExif bool
+	cleanExifAllow   []string
+	cleanOrient      bool
+	cleanCoarsenGPS  string
+	cleanTime        string
+	cleanSet         []string
+	cleanVault       string
+	cleanJournal     string
+	cleanVerify      bool
+	cleanReencode    []string
+	cleanJPEGQuality int
+	cleanPNGLevel    string
+	cleanNoise       int
+	cleanPreset      string
+	cleanPresetsFile string
+	cleanTimes       string
+	cleanXattrs      string
+	cleanRename      string
+	cleanFlatten     bool
+	cleanRenameMap   string
 )
 
 var cleanCmd = &cobra.Command{
@@ -25,9 +48,15 @@ var cleanCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		path := args[0]
+		if err := validateFormat(cleanFormat); err != nil {
+			return err
+		}
 		if cleanInPlace && cleanOutputDir != "" {
 			return fmt.Errorf("--inplace cannot be used with --output")
 		}
+		if cleanJournal != "" && !cleanInPlace {
+			return fmt.Errorf("--journal only applies to --inplace")
+		}
 
 		outputDir := cleanOutputDir
 		if !cleanInPlace && outputDir == "" {
@@ -40,25 +69,208 @@ var cleanCmd = &cobra.Command{
 			}
 		}
 
-		updates := make(chan processor.ProgressUpdate, 64)
-		model := tui.NewModel(updates)
-		program := tea.NewProgram(model)
+		if cleanCoarsenGPS != "" {
+			if err := processor.ValidateGPSPrecision(cleanCoarsenGPS); err != nil {
+				return err
+			}
+		}
+
+		var timeRewrite *processor.TimeRewrite
+		if cleanTime != "" {
+			parsed, err := processor.ParseTimeRewrite(cleanTime)
+			if err != nil {
+				return err
+			}
+			timeRewrite = parsed
+		}
+
+		var times *processor.FileTimes
+		if cleanTimes != "" {
+			parsed, err := processor.ParseFileTimes(cleanTimes)
+			if err != nil {
+				return err
+			}
+			times = parsed
+		}
+		if cleanXattrs != "strip" && cleanXattrs != "preserve" {
+			return fmt.Errorf("invalid --xattrs %q (want strip or preserve)", cleanXattrs)
+		}
+
+		var rename *processor.Rename
+		if cleanRename != "" {
+			if cleanInPlace {
+				return fmt.Errorf("--rename cannot be used with --inplace")
+			}
+			parsed, err := processor.ParseRename(cleanRename)
+			if err != nil {
+				return err
+			}
+			if cleanRenameMap == "" {
+				return fmt.Errorf("--rename needs --rename-map, or the renamed files could not be traced back to their originals")
+			}
+			parsed.Flatten = cleanFlatten
+			rename = parsed
+		} else if cleanFlatten || cleanRenameMap != "" {
+			return fmt.Errorf("--flatten and --rename-map only apply to --rename")
+		}
+		if cleanRenameMap != "" {
+			mapAbs, err := filepath.Abs(cleanRenameMap)
+			if err != nil {
+				return err
+			}
+			outAbs, err := filepath.Abs(outputDir)
+			if err != nil {
+				return err
+			}
+			if rel, err := filepath.Rel(outAbs, mapAbs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("--rename-map must be outside the output folder, or it would ship with the files it anonymizes")
+			}
+		}
+
+		var reencode *processor.Reencode
+		if len(cleanReencode) > 0 {
+			formats, err := processor.ParseReencodeFormats(cleanReencode)
+			if err != nil {
+				return err
+			}
+			level, err := processor.ParsePNGCompression(cleanPNGLevel)
+			if err != nil {
+				return err
+			}
+			reencode = &processor.Reencode{Formats: formats, JPEGQuality: cleanJPEGQuality, PNGCompression: level, Noise: cleanNoise}
+			if err := reencode.Validate(); err != nil {
+				return err
+			}
+		}
 
-		uiDone := make(chan struct{})
-		go func() {
-			_, _ = program.Run()
-			close(uiDone)
-		}()
+		var preset *processor.Preset
+		if cleanPreset != "" {
+			loaded, err := loadPreset(cleanPreset, cleanPresetsFile)
+			if err != nil {
+				return err
+			}
+			if cleanInPlace && loaded.Format != imgutil.KindUnknown {
+				return fmt.Errorf("preset %q converts images to %s and cannot be used with --inplace", cleanPreset, loaded.Format)
+			}
+			preset = &loaded
+		}
+		if reencode == nil && (preset == nil || !preset.Reencodes()) {
+			for _, name := range []string{"jpeg-quality", "png-compression", "noise"} {
+				if cmd.Flags().Changed(name) {
+					return fmt.Errorf("--%s only applies to --reencode or a re-encoding --preset", name)
+				}
+			}
+		}
 
-		summary, _, err := processor.Run(context.Background(), path, processor.Options{
-			Mode:        processor.ModeClean,
-			InPlace:     cleanInPlace,
-			OutputDir:   outputDir,
-			PreserveICC: cleanPreserveICC,
-		}, updates)
+		stamp := processor.Stamp{}
+		for _, field := range cleanSet {
+			if err := stamp.Set(field); err != nil {
+				return err
+			}
+		}
 
-		close(updates)
-		<-uiDone
+		var policy *processor.Policy
+		if cleanPolicy != "" {
+			loaded, err := processor.LoadPolicy(cleanPolicy)
+			if err != nil {
+				return err
+			}
+			policy = loaded
+		}
+
+		var vault *processor.Vault
+		if cleanVault != "" {
+			_, statErr := os.Stat(cleanVault)
+			passphrase, err := readVaultPassphrase(os.IsNotExist(statErr))
+			if err != nil {
+				return err
+			}
+			if vault, err = processor.OpenVault(cleanVault, passphrase); err != nil {
+				return err
+			}
+			defer vault.Close()
+		}
+
+		var journal *processor.Journal
+		if cleanJournal != "" {
+			var err error
+			if journal, err = processor.OpenJournal(cleanJournal); err != nil {
+				return err
+			}
+			defer journal.Close()
+		}
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+		cmd.SilenceUsage = true
+
+		opts := processor.Options{
+			Mode:         processor.ModeClean,
+			InPlace:      cleanInPlace,
+			OutputDir:    outputDir,
+			PreserveICC:  cleanPreserveICC,
+			KeepTrailers: cleanKeepTrailer,
+			Policy:       policy,
+			RewriteExif:  cleanRewriteExif,
+			ExifAllow:    cleanExifAllow,
+			CoarsenGPS:   cleanCoarsenGPS,
+			Time:         timeRewrite,
+			Reencode:     reencode,
+			Stamp:        stamp,
+			Vault:        vault,
+			Journal:      journal,
+			Verify:       cleanVerify,
+			Times:        times,
+			Rename:       rename,
+
+			ApplyOrientation: cleanOrient,
+			PreserveXattrs:   cleanXattrs == "preserve",
+		}
+		if preset != nil {
+			preset.Apply(&opts)
+			if opts.Reencode != nil && reencode == nil {
+				// Encoder flags refine the preset's re-encoding.
+				if cmd.Flags().Changed("jpeg-quality") {
+					opts.Reencode.JPEGQuality = cleanJPEGQuality
+				}
+				if cmd.Flags().Changed("png-compression") {
+					level, err := processor.ParsePNGCompression(cleanPNGLevel)
+					if err != nil {
+						return err
+					}
+					opts.Reencode.PNGCompression = level
+				}
+				opts.Reencode.Noise = cleanNoise
+			}
+			if opts.Reencode != nil {
+				if err := opts.Reencode.Validate(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if cleanFormat != formatText {
+			writer := newResultWriter(os.Stdout, cleanFormat)
+			summary, _, err := runBatch(ctx, cancel, path, opts, cleanFormat, writer)
+			if mapErr := writeRenameMap(rename); err == nil {
+				err = mapErr
+			}
+			if err != nil {
+				return err
+			}
+			if err := writer.finish(summary); err != nil {
+				return err
+			}
+			if summary.Canceled {
+				return errInterrupted
+			}
+			return nil
+		}
+
+		summary, _, err := runBatch(ctx, cancel, path, opts, cleanFormat, nil)
+		if mapErr := writeRenameMap(rename); err == nil {
+			err = mapErr
+		}
 		if err != nil {
 			return err
 		}
@@ -68,8 +280,16 @@ var cleanCmd = &cobra.Command{
 			{Label: "Privacy leaks plugged", Value: fmt.Sprintf("%d", summary.Leaks)},
 			{Label: "Space saved (bytes)", Value: fmt.Sprintf("%d", summary.BytesSaved)},
 		}
+		if summary.Errors > 0 {
+			rows = append(rows, tui.SummaryRow{Label: "Files with errors", Value: fmt.Sprintf("%d", summary.Errors)})
+		}
+		if summary.Canceled {
+			rows = append(rows, tui.SummaryRow{Label: "Files not processed", Value: fmt.Sprintf("%d", len(summary.Unprocessed))})
+		}
 		fmt.Fprintln(os.Stdout, tui.RenderSummary(rows))
-		if cleanInPlace {
+		if summary.Canceled {
+			fmt.Fprintln(os.Stdout, "Clean interrupted; processed files are complete, the rest were left untouched.")
+		} else if cleanInPlace {
 			fmt.Fprintln(os.Stdout, "In-place clean complete.")
 		} else {
 			outPath := outputDir
@@ -79,15 +299,85 @@ var cleanCmd = &cobra.Command{
 			fmt.Fprintf(os.Stdout, "Cleaned files written to: %s\n", outPath)
 			fmt.Fprintln(os.Stdout, "Note: originals are unchanged unless --inplace is used.")
 		}
+		if rename != nil {
+			fmt.Fprintf(os.Stdout, "Rename mapping written to: %s\n", cleanRenameMap)
+		}
+		if journal != nil && journal.Recorded() > 0 {
+			fmt.Fprintf(os.Stdout, "Undo with: bleach restore --journal %s --run %s\n", cleanJournal, journal.Run())
+		}
+		printWarnings(os.Stderr, summary.Warnings)
+		printFailures(os.Stderr, summary.Failures)
+		if summary.Canceled {
+			printUnprocessed(os.Stderr, summary)
+			return errInterrupted
+		}
 
 		return nil
 	},
 }
 
+// writeRenameMap saves the mapping of the files renamed so far, also after
+// a failed or interrupted run, so every renamed file can be traced back.
+func writeRenameMap(rename *processor.Rename) error {
+	if rename == nil {
+		return nil
+	}
+	return rename.WriteMapping(cleanRenameMap)
+}
+
+// loadPreset looks name up among the built-in presets and those of the
+// presets file, which must exist when given explicitly.
+func loadPreset(name, file string) (processor.Preset, error) {
+	required := file != ""
+	if !required {
+		var err error
+		if file, err = processor.DefaultPresetsFile(); err != nil {
+			file = ""
+		}
+	}
+	presets := processor.BuiltinPresets
+	if file != "" {
+		var err error
+		if presets, err = processor.LoadPresets(file, required); err != nil {
+			return processor.Preset{}, err
+		}
+	}
+	preset, ok := presets[name]
+	if !ok {
+		return processor.Preset{}, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(processor.PresetNames(presets), ", "))
+	}
+	return preset, nil
+}
+
 func init() {
 	cleanCmd.Flags().BoolVarP(&cleanInPlace, "inplace", "i", false, "modify files in place")
 	cleanCmd.Flags().StringVarP(&cleanOutputDir, "output", "o", "", "destination folder for sanitized copies")
 	cleanCmd.Flags().BoolVar(&cleanPreserveICC, "preserve-icc", false, "preserve ICC color profiles")
+	cleanCmd.Flags().BoolVar(&cleanKeepTrailer, "keep-trailers", false, "keep data appended after the JPEG EOI or PNG IEND marker")
+
+	cleanCmd.Flags().BoolVar(&cleanRewriteExif, "rewrite-exif", false, "rebuild EXIF with only allowed tags instead of removing it")
+	cleanCmd.Flags().StringSliceVar(&cleanExifAllow, "exif-allow", nil, "EXIF tags kept by --rewrite-exif (default Orientation,ColorSpace,XResolution,YResolution,ResolutionUnit)")
+	cleanCmd.Flags().StringVar(&cleanCoarsenGPS, "coarsen-gps", "", "keep GPS position rounded to 100m, 1km, 10km or 100km instead of removing it")
+	cleanCmd.Flags().BoolVar(&cleanOrient, "apply-orientation", false, "rotate JPEG and PNG pixels to match their EXIF orientation, then strip it")
+	cleanCmd.Flags().StringSliceVar(&cleanReencode, "reencode", nil, "re-encode pixel data with bleach's encoder settings: jpeg, png or all")
+	cleanCmd.Flags().Lookup("reencode").NoOptDefVal = "all"
+	cleanCmd.Flags().IntVar(&cleanJPEGQuality, "jpeg-quality", processor.DefaultJPEGQuality, "quality of re-encoded JPEGs (1-100)")
+	cleanCmd.Flags().StringVar(&cleanPNGLevel, "png-compression", "default", "compression of re-encoded PNGs: default, none, fast or best")
+	cleanCmd.Flags().IntVar(&cleanNoise, "noise", 0, fmt.Sprintf("add up to ±N levels of random noise to re-encoded pixels (0-%d)", processor.MaxReencodeNoise))
+	cleanCmd.Flags().StringVar(&cleanPreset, "preset", "", "apply a named bundle of clean options: web, social, evidence or one from the presets file")
+	cleanCmd.Flags().StringVar(&cleanPresetsFile, "presets", "", "YAML or JSON file with user presets (default bleach/presets.yaml in the user config dir)")
+	cleanCmd.Flags().StringArrayVar(&cleanSet, "set", nil, "write Key=Value into cleaned files (repeatable), e.g. Copyright=..., xmpRights:WebStatement=...; HEIF files are left unstamped with a warning")
+	cleanCmd.Flags().StringVar(&cleanTime, "time", "", "keep timestamps rewritten: date-only, shift:<duration> or randomize-within:<window>")
+	cleanCmd.Flags().StringVar(&cleanTimes, "times", "", "set file times of cleaned files: preserve, exif (DateTimeOriginal) or epoch[:<time>]")
+	cleanCmd.Flags().StringVar(&cleanXattrs, "xattrs", "strip", "extended attributes of cleaned files: strip or preserve")
+	cleanCmd.Flags().StringVar(&cleanRename, "rename", "", "rename cleaned files: hash, sequence or template:<pattern> with {seq} or {hash}")
+	cleanCmd.Flags().BoolVar(&cleanFlatten, "flatten", false, "with --rename, write every file directly into the output folder")
+	cleanCmd.Flags().StringVar(&cleanRenameMap, "rename-map", "", "with --rename (required), write the original-to-new name mapping to this CSV or .json file")
+	cleanCmd.Flags().BoolVar(&cleanVerify, "verify", false, "check every cleaned file (no findings left, valid structure, same pixels) before writing it")
+	cleanCmd.Flags().StringVar(&cleanVault, "vault", "", "save removed metadata to this encrypted file for bleach restore")
+	cleanCmd.Flags().StringVar(&cleanJournal, "journal", "", "with --inplace, record how to undo the clean in this directory")
+	cleanCmd.Flags().StringVar(&cleanPolicy, "policy", "", "YAML or JSON file with keep/strip rules")
+	cleanCmd.Flags().StringVar(&cleanFormat, "format", formatText, "output format: text, json or ndjson")
 
 	rootCmd.AddCommand(cleanCmd)
 }
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"bleach/internal/processor"
+)
+
+var journalOlderThan string
+
+var journalCmd = &cobra.Command{
+	Use:   "journal",
+	Short: "Manage undo journals written by clean --inplace --journal",
+}
+
+var journalPruneCmd = &cobra.Command{
+	Use:   "prune [flags] <dir>",
+	Short: "Remove journal runs older than --older-than",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		age, err := processor.ParseJournalAge(journalOlderThan)
+		if err != nil {
+			return err
+		}
+		cmd.SilenceUsage = true
+
+		pruned, err := processor.PruneJournal(args[0], time.Now().Add(-age))
+		for _, run := range pruned {
+			if verbose {
+				fmt.Fprintf(os.Stderr, "pruned  %s\n", run)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "Pruned %d journal runs from %s\n", len(pruned), args[0])
+		return nil
+	},
+}
+
+func init() {
+	journalPruneCmd.Flags().StringVar(&journalOlderThan, "older-than", "30d", "remove runs last written longer ago than this, e.g. 7d or 12h")
+	journalCmd.AddCommand(journalPruneCmd)
+	rootCmd.AddCommand(journalCmd)
+}
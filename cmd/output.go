@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/charmbracelet/lipgloss"
+
+	"bleach/internal/processor"
+	"bleach/internal/tui"
+)
+
+const (
+	formatText   = "text"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+func validateFormat(format string) error {
+	switch format {
+	case formatText, formatJSON, formatNDJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown --format %q (want text, json or ndjson)", format)
+	}
+}
+
+type fileRecord struct {
+	Type       string                  `json:"type"`
+	Path       string                  `json:"path"`
+	Kind       string                  `json:"kind"`
+	Findings   []processor.Finding     `json:"findings"`
+	Insights   []processor.ScanInsight `json:"insights,omitempty"`
+	Leaks      int                     `json:"leaks"`
+	BytesSaved int64                   `json:"bytes_saved"`
+	Error      *processor.FileError    `json:"error,omitempty"`
+	Warnings   []processor.FileError   `json:"warnings,omitempty"`
+}
+
+type summaryRecord struct {
+	Type string `json:"type"`
+	processor.Summary
+}
+
+type jsonDocument struct {
+	Files   []fileRecord      `json:"files"`
+	Summary processor.Summary `json:"summary"`
+}
+
+// resultWriter renders results as JSON. NDJSON records are written as soon as
+// they arrive; JSON output is buffered into a single document.
+type resultWriter struct {
+	format string
+	enc    *json.Encoder
+	files  []fileRecord
+	err    error
+}
+
+func newResultWriter(w io.Writer, format string) *resultWriter {
+	enc := json.NewEncoder(w)
+	if format == formatJSON {
+		enc.SetIndent("", "  ")
+	}
+	return &resultWriter{format: format, enc: enc}
+}
+
+func (rw *resultWriter) write(res processor.Result) {
+	record := fileRecord{
+		Type:       "file",
+		Path:       res.Display,
+		Kind:       res.Kind.String(),
+		Findings:   res.Findings,
+		Insights:   res.Insights,
+		Leaks:      res.Leaks,
+		BytesSaved: res.BytesSaved,
+		Warnings:   res.Warnings,
+	}
+	if record.Findings == nil {
+		record.Findings = []processor.Finding{}
+	}
+	if res.Err != nil {
+		var fileErr *processor.FileError
+		if !errors.As(res.Err, &fileErr) {
+			fileErr = &processor.FileError{Path: res.Display, Cause: processor.CauseOther, Message: res.Err.Error()}
+		}
+		record.Error = fileErr
+	}
+
+	if rw.format == formatNDJSON {
+		if rw.err == nil {
+			rw.err = rw.enc.Encode(record)
+		}
+		return
+	}
+	rw.files = append(rw.files, record)
+}
+
+func (rw *resultWriter) finish(summary processor.Summary) error {
+	if rw.err != nil {
+		return rw.err
+	}
+	if rw.format == formatNDJSON {
+		return rw.enc.Encode(summaryRecord{Type: "summary", Summary: summary})
+	}
+	if rw.files == nil {
+		rw.files = []fileRecord{}
+	}
+	return rw.enc.Encode(jsonDocument{Files: rw.files, Summary: summary})
+}
+
+var (
+	failureTitleStyle = lipgloss.NewStyle().Bold(true).Foreground(tui.ColorWarn)
+	failurePathStyle  = lipgloss.NewStyle().Foreground(tui.ColorInk)
+	failureDimStyle   = lipgloss.NewStyle().Foreground(tui.ColorDim)
+)
+
+// printFailures lists the files that could not be processed.
+func printFailures(w io.Writer, failures []processor.FileError) {
+	printFileErrors(w, "Errors", failures)
+}
+
+// printWarnings lists the steps skipped for files that were processed.
+func printWarnings(w io.Writer, warnings []processor.FileError) {
+	printFileErrors(w, "Warnings", warnings)
+}
+
+func printFileErrors(w io.Writer, title string, failures []processor.FileError) {
+	if len(failures) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s\n", failureTitleStyle.Render(fmt.Sprintf("%s (%d):", title, len(failures))))
+	for _, failure := range failures {
+		fmt.Fprintf(w, "  %s %s %s %s\n",
+			failureDimStyle.Render("-"),
+			failurePathStyle.Render(failure.Path),
+			failureDimStyle.Render(fmt.Sprintf("[%s, %s]", failure.Stage, failure.Cause)),
+			failure.Message,
+		)
+	}
+}
+
+const maxListedUnprocessed = 20
+
+// printUnprocessed lists the files skipped after a cancellation.
+func printUnprocessed(w io.Writer, summary processor.Summary) {
+	if !summary.Canceled {
+		return
+	}
+	fmt.Fprintf(w, "%s\n", failureTitleStyle.Render(fmt.Sprintf("Interrupted: %d files not processed", len(summary.Unprocessed))))
+	for i, path := range summary.Unprocessed {
+		if i == maxListedUnprocessed {
+			fmt.Fprintf(w, "  %s\n", failureDimStyle.Render(fmt.Sprintf("... and %d more (use --format json for the full list)", len(summary.Unprocessed)-i)))
+			break
+		}
+		fmt.Fprintf(w, "  %s %s\n", failureDimStyle.Render("-"), failurePathStyle.Render(path))
+	}
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mattn/go-isatty"
+
+	"bleach/internal/processor"
+	"bleach/internal/tui"
+)
+
+type progressMode int
+
+const (
+	progressNone progressMode = iota
+	progressPlain
+	progressTUI
+)
+
+const plainProgressInterval = 2 * time.Second
+
+// selectProgress picks how progress is shown. The TUI needs an interactive
+// terminal on stdin and stderr; anywhere else progress is printed as plain
+// lines on stderr, or not at all with --quiet.
+func selectProgress(format string) progressMode {
+	switch {
+	case quiet:
+		return progressNone
+	case format != formatText:
+		if verbose {
+			return progressPlain
+		}
+		return progressNone
+	case noTUI || !isTerminal(os.Stdin) || !isTerminal(os.Stderr):
+		return progressPlain
+	default:
+		return progressTUI
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// startProgress starts the consumer for mode and returns the channel to pass
+// to processor.Run, plus a function that closes it and waits for the
+// consumer to finish. The channel is nil for progressNone.
+func startProgress(mode progressMode, cancel func()) (chan<- processor.ProgressUpdate, func()) {
+	if mode == progressNone {
+		return nil, func() {}
+	}
+
+	updates := make(chan processor.ProgressUpdate, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if mode == progressTUI {
+			program := tea.NewProgram(tui.NewModel(updates, cancel), tea.WithOutput(os.Stderr), tea.WithoutSignalHandler())
+			_, _ = program.Run()
+		} else {
+			plainProgress(os.Stderr, updates)
+		}
+		// Keep draining if the consumer exits early so workers never block.
+		for range updates {
+		}
+	}()
+
+	return updates, func() {
+		close(updates)
+		<-done
+	}
+}
+
+type progressTotals struct {
+	total      int
+	processed  int
+	errors     int
+	leaks      int
+	bytesSaved int64
+}
+
+func (t *progressTotals) add(update processor.ProgressUpdate) {
+	t.total += update.TotalDelta
+	t.processed += update.ProcessedDelta
+	t.errors += update.ErrorDelta
+	t.leaks += update.LeakDelta
+	t.bytesSaved += update.BytesSavedDelta
+}
+
+func (t progressTotals) String() string {
+	return fmt.Sprintf("progress: %d/%d files, %d errors, %d leaks, %d bytes saved", t.processed, t.total, t.errors, t.leaks, t.bytesSaved)
+}
+
+// plainProgress prints a status line at most every plainProgressInterval and
+// once more when updates is closed.
+func plainProgress(w io.Writer, updates <-chan processor.ProgressUpdate) {
+	var totals progressTotals
+	ticker := time.NewTicker(plainProgressInterval)
+	defer ticker.Stop()
+
+	changed := false
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				fmt.Fprintln(w, totals)
+				return
+			}
+			totals.add(update)
+			changed = true
+		case <-ticker.C:
+			if changed {
+				fmt.Fprintln(w, totals)
+				changed = false
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/charmbracelet/x/term"
+	"github.com/spf13/cobra"
+
+	"bleach/internal/processor"
+	"bleach/internal/tui"
+)
+
+// vaultPassphraseEnv names the environment variable that supplies the vault
+// passphrase when bleach is not run from a terminal.
+const vaultPassphraseEnv = "BLEACH_VAULT_PASSPHRASE"
+
+var (
+	restoreVault     string
+	restoreJournal   string
+	restoreRun       string
+	restoreInPlace   bool
+	restoreOutputDir string
+	restoreFormat    string
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore (--vault <file> | --journal <dir>) [flags] [path]",
+	Short: "Rebuild original files from a metadata vault or undo journal",
+	Long: "Rebuild original files from a metadata vault or undo journal.\n\n" +
+		"With --vault, every cleaned file under path is restored. With --journal, files are\n" +
+		"restored in place: the journaled files under path, or every file of a run\n" +
+		"(--run, default the latest) when no path is given.",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateFormat(restoreFormat); err != nil {
+			return err
+		}
+		if (restoreVault == "") == (restoreJournal == "") {
+			return fmt.Errorf("give one of --vault or --journal")
+		}
+		if restoreInPlace && restoreOutputDir != "" {
+			return fmt.Errorf("--inplace cannot be used with --output")
+		}
+		if restoreJournal != "" && restoreOutputDir != "" {
+			return fmt.Errorf("--journal restores in place and cannot be used with --output")
+		}
+		if restoreVault != "" && len(args) == 0 {
+			return fmt.Errorf("--vault needs the path of the cleaned files")
+		}
+		if restoreRun != "" && restoreJournal == "" {
+			return fmt.Errorf("--run only applies to --journal")
+		}
+
+		inPlace := restoreInPlace || restoreJournal != ""
+		outputDir := restoreOutputDir
+		if !inPlace && outputDir == "" {
+			outputDir = "restored"
+		}
+
+		opts := processor.Options{
+			Mode:      processor.ModeRestore,
+			InPlace:   inPlace,
+			OutputDir: outputDir,
+		}
+		var files []string
+		if restoreVault != "" {
+			passphrase, err := readVaultPassphrase(false)
+			if err != nil {
+				return err
+			}
+			if opts.Vault, err = processor.ReadVault(restoreVault, passphrase); err != nil {
+				return err
+			}
+		} else {
+			run := restoreRun
+			if run == "" && len(args) == 0 {
+				runs, err := processor.JournalRuns(restoreJournal)
+				if err != nil {
+					return err
+				}
+				if len(runs) == 0 {
+					return fmt.Errorf("journal %s has no runs", restoreJournal)
+				}
+				run = runs[len(runs)-1]
+				fmt.Fprintf(os.Stderr, "Restoring journal run %s\n", run)
+			}
+			journal, err := processor.ReadJournal(restoreJournal, run)
+			if err != nil {
+				return err
+			}
+			opts.Journal = journal
+			if len(args) == 0 {
+				files = journal.Paths()
+			}
+		}
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+		cmd.SilenceUsage = true
+
+		batch := func(format string, writer *resultWriter) (processor.Summary, []processor.ScanReport, error) {
+			if len(args) > 0 {
+				return runBatch(ctx, cancel, args[0], opts, format, writer)
+			}
+			return runBatchWith(ctx, cancel, func(opts processor.Options, updates chan<- processor.ProgressUpdate) (processor.Summary, []processor.ScanReport, error) {
+				return processor.RunFiles(ctx, files, opts, updates)
+			}, opts, format, writer)
+		}
+
+		if restoreFormat != formatText {
+			writer := newResultWriter(os.Stdout, restoreFormat)
+			summary, _, err := batch(restoreFormat, writer)
+			if err != nil {
+				return err
+			}
+			if err := writer.finish(summary); err != nil {
+				return err
+			}
+			if summary.Canceled {
+				return errInterrupted
+			}
+			return nil
+		}
+
+		summary, _, err := batch(restoreFormat, nil)
+		if err != nil {
+			return err
+		}
+
+		rows := []tui.SummaryRow{
+			{Label: "Files restored", Value: fmt.Sprintf("%d", summary.Processed-summary.Errors)},
+		}
+		if summary.Errors > 0 {
+			rows = append(rows, tui.SummaryRow{Label: "Files with errors", Value: fmt.Sprintf("%d", summary.Errors)})
+		}
+		if summary.Canceled {
+			rows = append(rows, tui.SummaryRow{Label: "Files not processed", Value: fmt.Sprintf("%d", len(summary.Unprocessed))})
+		}
+		fmt.Fprintln(os.Stdout, tui.RenderSummary(rows))
+		if !inPlace && !summary.Canceled {
+			outPath := outputDir
+			if abs, absErr := filepath.Abs(outputDir); absErr == nil {
+				outPath = abs
+			}
+			fmt.Fprintf(os.Stdout, "Restored files written to: %s\n", outPath)
+		}
+		printFailures(os.Stderr, summary.Failures)
+		if summary.Canceled {
+			printUnprocessed(os.Stderr, summary)
+			return errInterrupted
+		}
+		return nil
+	},
+}
+
+// readVaultPassphrase takes the passphrase from BLEACH_VAULT_PASSPHRASE or,
+// failing that, prompts for it on the terminal. confirm asks twice, for
+// vaults that are about to be created.
+func readVaultPassphrase(confirm bool) ([]byte, error) {
+	if env := os.Getenv(vaultPassphraseEnv); env != "" {
+		return []byte(env), nil
+	}
+	if !isTerminal(os.Stdin) {
+		return nil, fmt.Errorf("set %s or run bleach from a terminal to enter the vault passphrase", vaultPassphraseEnv)
+	}
+
+	prompt := func(label string) ([]byte, error) {
+		fmt.Fprint(os.Stderr, label)
+		defer fmt.Fprintln(os.Stderr)
+		return term.ReadPassword(os.Stdin.Fd())
+	}
+	passphrase, err := prompt("Vault passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty vault passphrase")
+	}
+	if confirm {
+		again, err := prompt("Repeat passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(passphrase) {
+			return nil, errors.New("vault passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreVault, "vault", "", "vault written by clean --vault")
+	restoreCmd.Flags().StringVar(&restoreJournal, "journal", "", "journal directory written by clean --inplace --journal")
+	restoreCmd.Flags().StringVar(&restoreRun, "run", "", "journal run to restore (default: all runs with a path, the latest without)")
+	restoreCmd.Flags().BoolVarP(&restoreInPlace, "inplace", "i", false, "replace cleaned files with their originals")
+	restoreCmd.Flags().StringVarP(&restoreOutputDir, "output", "o", "", "destination folder for restored files")
+	restoreCmd.Flags().StringVar(&restoreFormat, "format", formatText, "output format: text, json or ndjson")
+	rootCmd.AddCommand(restoreCmd)
+}
@@ -1,8 +1,12 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -13,6 +17,13 @@ var rootCmd = &cobra.Command{
 	Long:  "bleach 🧼 is a concurrency-safe CLI for stripping EXIF, XMP, and IPTC metadata from images.",
 }
 
+var errInterrupted = errors.New("interrupted before all files were processed")
+
+// interruptContext returns a context that is canceled on SIGINT or SIGTERM.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -20,6 +31,16 @@ func Execute() {
 	}
 }
 
+var (
+	noTUI   bool
+	quiet   bool
+	verbose bool
+)
+
 func init() {
 	rootCmd.SetHelpCommand(&cobra.Command{Hidden: true})
+	rootCmd.PersistentFlags().BoolVar(&noTUI, "no-tui", false, "print plain progress lines instead of the interactive view")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "show no progress")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "log every file to stderr")
+	rootCmd.MarkFlagsMutuallyExclusive("quiet", "verbose")
 }
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"bleach/internal/processor"
+)
+
+// runBatch runs the processor over path with the progress consumer that
+// fits the environment. Per-file results go to writer, when set, and to
+// stderr with --verbose.
+func runBatch(ctx context.Context, cancel func(), path string, opts processor.Options, format string, writer *resultWriter) (processor.Summary, []processor.ScanReport, error) {
+	return runBatchWith(ctx, cancel, func(opts processor.Options, updates chan<- processor.ProgressUpdate) (processor.Summary, []processor.ScanReport, error) {
+		return processor.Run(ctx, path, opts, updates)
+	}, opts, format, writer)
+}
+
+// runBatchWith is runBatch for any processor entry point, such as
+// processor.RunFiles.
+func runBatchWith(ctx context.Context, cancel func(), run func(processor.Options, chan<- processor.ProgressUpdate) (processor.Summary, []processor.ScanReport, error), opts processor.Options, format string, writer *resultWriter) (processor.Summary, []processor.ScanReport, error) {
+	var results chan processor.Result
+	resultsDone := make(chan struct{})
+	if writer != nil || verbose {
+		results = make(chan processor.Result, 64)
+		opts.Results = results
+		go func() {
+			defer close(resultsDone)
+			for res := range results {
+				if writer != nil {
+					writer.write(res)
+				}
+				if verbose {
+					logResult(os.Stderr, opts.Mode, res)
+				}
+			}
+		}()
+	} else {
+		close(resultsDone)
+	}
+
+	updates, stopProgress := startProgress(selectProgress(format), cancel)
+	summary, reports, err := run(opts, updates)
+	stopProgress()
+	if results != nil {
+		close(results)
+	}
+	<-resultsDone
+	return summary, reports, err
+}
+
+func logResult(w io.Writer, mode processor.Mode, res processor.Result) {
+	switch {
+	case res.Err != nil:
+		fmt.Fprintf(w, "failed  %v\n", res.Err)
+	case mode == processor.ModeClean:
+		fmt.Fprintf(w, "cleaned %s (%s): %d leaks, %d bytes saved\n", res.Display, res.Kind, res.Leaks, res.BytesSaved)
+	case mode == processor.ModeRestore:
+		fmt.Fprintf(w, "restored %s (%s)\n", res.Display, res.Kind)
+	case mode == processor.ModeVerify:
+		fmt.Fprintf(w, "verified %s (%s)\n", res.Display, res.Kind)
+	default:
+		fmt.Fprintf(w, "scanned %s (%s): %d leaks\n", res.Display, res.Kind, res.Leaks)
+	}
+}
@@ -1,11 +1,9 @@
 package cmd
 
 import (
-	"context"
 	"fmt"
 	"os"
 
-	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/spf13/cobra"
 
@@ -19,22 +17,35 @@ var scanCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		path := args[0]
-		updates := make(chan processor.ProgressUpdate, 64)
-		model := tui.NewModel(updates)
-		program := tea.NewProgram(model)
+		if err := validateFormat(scanFormat); err != nil {
+			return err
+		}
 
-		uiDone := make(chan struct{})
-		go func() {
-			_, _ = program.Run()
-			close(uiDone)
-		}()
+		ctx, cancel := interruptContext()
+		defer cancel()
+		cmd.SilenceUsage = true
 
-		summary, reports, err := processor.Run(context.Background(), path, processor.Options{
+		opts := processor.Options{
 			Mode:     processor.ModeScan,
 			Insights: scanInsights,
-		}, updates)
-		close(updates)
-		<-uiDone
+		}
+
+		if scanFormat != formatText {
+			writer := newResultWriter(os.Stdout, scanFormat)
+			summary, _, err := runBatch(ctx, cancel, path, opts, scanFormat, writer)
+			if err != nil {
+				return err
+			}
+			if err := writer.finish(summary); err != nil {
+				return err
+			}
+			if summary.Canceled {
+				return errInterrupted
+			}
+			return nil
+		}
+
+		summary, reports, err := runBatch(ctx, cancel, path, opts, scanFormat, nil)
 		if err != nil {
 			return err
 		}
@@ -44,20 +55,24 @@ var scanCmd = &cobra.Command{
 				fmt.Fprintln(os.Stdout)
 			}
 			fmt.Fprintf(os.Stdout, "%s\n", scanFileStyle.Render(report.Path))
-			if len(report.Details) == 0 {
+			if report.Err != nil {
+				fmt.Fprintf(os.Stdout, "  %s %s\n",
+					scanBulletStyle.Render("-"),
+					scanDimStyle.Render("not scanned (see errors below)"),
+				)
+				continue
+			}
+			if len(report.Findings) == 0 {
 				fmt.Fprintf(os.Stdout, "  %s %s\n",
 					scanBulletStyle.Render("-"),
 					scanDimStyle.Render("none"),
 				)
 				continue
 			}
-			for _, detail := range report.Details {
-				if len(detail.Values) == 0 {
-					continue
-				}
-				fmt.Fprintf(os.Stdout, "  %s\n", scanCategoryStyle.Render(detail.Category+":"))
-				for _, value := range detail.Values {
-					fmt.Fprintf(os.Stdout, "    %s %s\n", scanBulletStyle.Render("-"), scanValueStyle.Render(value))
+			for _, group := range processor.GroupFindings(report.Findings) {
+				fmt.Fprintf(os.Stdout, "  %s\n", scanCategoryStyle.Render(group.Category+":"))
+				for _, finding := range group.Findings {
+					fmt.Fprintf(os.Stdout, "    %s %s\n", scanBulletStyle.Render("-"), scanValueStyle.Render(finding.String()))
 				}
 			}
 			if len(report.Insights) > 0 {
@@ -68,12 +83,24 @@ var scanCmd = &cobra.Command{
 			}
 		}
 
-		_ = summary
+		if len(summary.Failures) > 0 {
+			if len(reports) > 0 {
+				fmt.Fprintln(os.Stderr)
+			}
+			printFailures(os.Stderr, summary.Failures)
+		}
+		if summary.Canceled {
+			printUnprocessed(os.Stderr, summary)
+			return errInterrupted
+		}
 		return nil
 	},
 }
 
-var scanInsights bool
+var (
+	scanInsights bool
+	scanFormat   string
+)
 
 var (
 	scanFileStyle         = lipgloss.NewStyle().Bold(true).Foreground(tui.ColorAccent)
@@ -87,6 +114,7 @@ var (
 
 func init() {
 	scanCmd.Flags().BoolVar(&scanInsights, "insights", false, "explain what metadata could reveal about you")
+	scanCmd.Flags().StringVar(&scanFormat, "format", formatText, "output format: text, json or ndjson")
 	rootCmd.AddCommand(scanCmd)
 }
 
@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"bleach/internal/processor"
+	"bleach/internal/tui"
+)
+
+var (
+	verifyPolicy      string
+	verifyOrient      bool
+	verifyFormat      string
+	verifyPreserveICC bool
+	verifyKeepTrailer bool
+	verifyRewriteExif bool
+	verifyExifAllow   []string
+	verifyCoarsenGPS  string
+	verifyTime        string
+	verifyReencode    []string
+	verifyPreset      string
+	verifyPresetsFile string
+	verifyRenameMap   string
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [flags] <original> <cleaned>",
+	Short: "Check that cleaned files are clean and show the same pixels as their originals",
+	Long: "Check that cleaned files are clean and show the same pixels as their originals.\n\n" +
+		"original and cleaned are two files, or two folders matched by relative path\n" +
+		"(such as a folder and the output of clean -o).\n\n" +
+		"Pass the flags the clean used that change what it keeps or where it writes,\n" +
+		"so kept metadata is not reported and renamed or converted files are found.",
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateFormat(verifyFormat); err != nil {
+			return err
+		}
+		if _, err := os.Stat(args[1]); err != nil {
+			return err
+		}
+
+		var policy *processor.Policy
+		if verifyPolicy != "" {
+			loaded, err := processor.LoadPolicy(verifyPolicy)
+			if err != nil {
+				return err
+			}
+			policy = loaded
+		}
+		if verifyCoarsenGPS != "" {
+			if err := processor.ValidateGPSPrecision(verifyCoarsenGPS); err != nil {
+				return err
+			}
+		}
+		var timeRewrite *processor.TimeRewrite
+		if verifyTime != "" {
+			parsed, err := processor.ParseTimeRewrite(verifyTime)
+			if err != nil {
+				return err
+			}
+			timeRewrite = parsed
+		}
+		var reencode *processor.Reencode
+		if len(verifyReencode) > 0 {
+			formats, err := processor.ParseReencodeFormats(verifyReencode)
+			if err != nil {
+				return err
+			}
+			reencode = &processor.Reencode{Formats: formats}
+		}
+		var rename *processor.Rename
+		if verifyRenameMap != "" {
+			loaded, err := processor.LoadRenameMapping(verifyRenameMap)
+			if err != nil {
+				return err
+			}
+			rename = loaded
+		}
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+		cmd.SilenceUsage = true
+
+		opts := processor.Options{
+			Mode:         processor.ModeVerify,
+			OutputDir:    args[1],
+			Policy:       policy,
+			PreserveICC:  verifyPreserveICC,
+			KeepTrailers: verifyKeepTrailer,
+			RewriteExif:  verifyRewriteExif,
+			ExifAllow:    verifyExifAllow,
+			CoarsenGPS:   verifyCoarsenGPS,
+			Time:         timeRewrite,
+			Reencode:     reencode,
+			Rename:       rename,
+
+			ApplyOrientation: verifyOrient,
+		}
+		if verifyPreset != "" {
+			preset, err := loadPreset(verifyPreset, verifyPresetsFile)
+			if err != nil {
+				return err
+			}
+			preset.Apply(&opts)
+		}
+
+		if verifyFormat != formatText {
+			writer := newResultWriter(os.Stdout, verifyFormat)
+			summary, _, err := runBatch(ctx, cancel, args[0], opts, verifyFormat, writer)
+			if err != nil {
+				return err
+			}
+			if err := writer.finish(summary); err != nil {
+				return err
+			}
+			if summary.Canceled {
+				return errInterrupted
+			}
+			return verifyResult(summary)
+		}
+
+		summary, _, err := runBatch(ctx, cancel, args[0], opts, verifyFormat, nil)
+		if err != nil {
+			return err
+		}
+
+		rows := []tui.SummaryRow{
+			{Label: "Files verified", Value: fmt.Sprintf("%d", summary.Processed-summary.Errors)},
+		}
+		if summary.Errors > 0 {
+			rows = append(rows, tui.SummaryRow{Label: "Files failing verification", Value: fmt.Sprintf("%d", summary.Errors)})
+		}
+		if summary.Canceled {
+			rows = append(rows, tui.SummaryRow{Label: "Files not processed", Value: fmt.Sprintf("%d", len(summary.Unprocessed))})
+		}
+		fmt.Fprintln(os.Stdout, tui.RenderSummary(rows))
+		printFailures(os.Stderr, summary.Failures)
+		if summary.Canceled {
+			printUnprocessed(os.Stderr, summary)
+			return errInterrupted
+		}
+		return verifyResult(summary)
+	},
+}
+
+// verifyResult fails the command when any file failed, so scripts can rely
+// on the exit status.
+func verifyResult(summary processor.Summary) error {
+	if summary.Errors > 0 {
+		return fmt.Errorf("%d of %d files failed verification", summary.Errors, summary.Processed)
+	}
+	return nil
+}
+
+func init() {
+	verifyCmd.Flags().StringVar(&verifyPolicy, "policy", "", "policy the files were cleaned with, so kept metadata is not reported")
+	verifyCmd.Flags().BoolVar(&verifyOrient, "apply-orientation", false, "the files were cleaned with --apply-orientation")
+	verifyCmd.Flags().BoolVar(&verifyPreserveICC, "preserve-icc", false, "the files were cleaned with --preserve-icc")
+	verifyCmd.Flags().BoolVar(&verifyKeepTrailer, "keep-trailers", false, "the files were cleaned with --keep-trailers")
+	verifyCmd.Flags().BoolVar(&verifyRewriteExif, "rewrite-exif", false, "the files were cleaned with --rewrite-exif")
+	verifyCmd.Flags().StringSliceVar(&verifyExifAllow, "exif-allow", nil, "the --exif-allow tags the files were cleaned with")
+	verifyCmd.Flags().StringVar(&verifyCoarsenGPS, "coarsen-gps", "", "the --coarsen-gps precision the files were cleaned with")
+	verifyCmd.Flags().StringVar(&verifyTime, "time", "", "the --time rewrite the files were cleaned with")
+	verifyCmd.Flags().StringSliceVar(&verifyReencode, "reencode", nil, "the files were cleaned with --reencode: only check that re-encoded pixels decode")
+	verifyCmd.Flags().Lookup("reencode").NoOptDefVal = "all"
+	verifyCmd.Flags().StringVar(&verifyPreset, "preset", "", "the --preset the files were cleaned with")
+	verifyCmd.Flags().StringVar(&verifyPresetsFile, "presets", "", "YAML or JSON file with user presets (default bleach/presets.yaml in the user config dir)")
+	verifyCmd.Flags().StringVar(&verifyRenameMap, "rename-map", "", "the --rename-map of a renaming clean, to find the renamed files")
+	verifyCmd.Flags().StringVar(&verifyFormat, "format", formatText, "output format: text, json or ndjson")
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -2,6 +2,7 @@ package processor
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -11,87 +12,159 @@ import (
 	exifcommon "github.com/dsoprea/go-exif/v3/common"
 )
 
-type ExifAnalysis struct {
-	HasGPS          bool
-	GPSCount        int
-	HasModel        bool
-	HasTimestamp    bool
-	SerialCount     int
-	GPSValues       []string
-	ModelValues     []string
-	TimestampValues []string
-	SerialValues    []string
+type exifTagKey struct {
+	ifdPath string
+	tagID   uint16
 }
 
-func analyzeExif(rs io.ReadSeeker) (ExifAnalysis, error) {
-	analysis := ExifAnalysis{}
+type exifTagLocation struct {
+	offset int64
+	length int64
+}
 
+// analyzeExif reports the privacy-relevant EXIF tags in rs. Offsets are
+// relative to the start of rs.
+func analyzeExif(rs io.ReadSeeker) ([]Finding, error) {
 	if _, err := rs.Seek(0, io.SeekStart); err != nil {
-		return analysis, err
+		return nil, err
 	}
-
-	header := make([]byte, 4)
-	if _, err := io.ReadFull(rs, header); err != nil {
-		return analysis, err
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return nil, err
 	}
-	if _, err := rs.Seek(0, io.SeekStart); err != nil {
-		return analysis, err
-	}
-
-	var tags []exif.ExifTag
-	var err error
-	if isTIFFHeader(header) {
-		tags, _, err = exif.GetFlatExifDataUniversalSearchWithReadSeeker(rs, nil, true)
-	} else {
-		rawExif, exifErr := exif.SearchAndExtractExifWithReader(rs)
-		if exifErr != nil {
-			if errorsIsNoExif(exifErr) {
-				return analysis, nil
+
+	tiffStart := 0
+	if !isTIFFHeader(data) {
+		rawExif, err := exif.SearchAndExtractExif(data)
+		if err != nil {
+			if errorsIsNoExif(err) {
+				return nil, nil
 			}
-			return analysis, exifErr
+			return nil, fmt.Errorf("%w EXIF block: %w", errMalformed, err)
 		}
-		tags, _, err = exif.GetFlatExifDataUniversalSearchWithReadSeeker(bytes.NewReader(rawExif), nil, true)
+		tiffStart = len(data) - len(rawExif)
 	}
+	tiff := data[tiffStart:]
+
+	tags, _, err := exif.GetFlatExifDataUniversalSearchWithReadSeeker(bytes.NewReader(tiff), nil, true)
 	if err != nil {
 		if errorsIsNoExif(err) {
-			return analysis, nil
+			return nil, nil
 		}
-		return analysis, err
+		return nil, fmt.Errorf("%w EXIF block: %w", errMalformed, err)
 	}
 
+	locations := exifTagLocations(tiff)
+	var findings []Finding
 	for _, tag := range tags {
-		name := tag.TagName
-		lower := strings.ToLower(name)
-		value := exifValueString(tag)
-
-		if strings.HasPrefix(name, "GPS") || strings.Contains(tag.IfdPath, "GPS") {
-			analysis.HasGPS = true
-			analysis.GPSCount++
-			if value != "" {
-				analysis.GPSValues = appendUnique(analysis.GPSValues, fmtKeyValue(name, value))
-			}
+		category := classifyExifTag(tag.TagName, tag.IfdPath)
+		if category == "" {
+			continue
 		}
-		if name == "Model" || name == "CameraModelName" || name == "Make" {
-			analysis.HasModel = true
-			if value != "" {
-				analysis.ModelValues = appendUnique(analysis.ModelValues, fmtKeyValue(name, value))
-			}
+		value := sanitizeValue(exifValueString(tag))
+		if value == "" {
+			continue
 		}
-		if name == "DateTimeOriginal" || name == "DateTimeDigitized" || name == "DateTime" {
-			analysis.HasTimestamp = true
-			if value != "" {
-				analysis.TimestampValues = appendUnique(analysis.TimestampValues, fmtKeyValue(name, value))
-			}
+
+		finding := Finding{
+			Container: tag.IfdPath,
+			TagID:     int(tag.TagId),
+			TagName:   tag.TagName,
+			RawValue:  value,
+			Value:     decodeExifValue(tag.TagName, value),
+			Offset:    -1,
+			Category:  category,
+		}
+		if loc, ok := locations[exifTagKey{ifdPath: tag.IfdPath, tagID: tag.TagId}]; ok {
+			finding.Offset = int64(tiffStart) + loc.offset
+			finding.Length = loc.length
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+func classifyExifTag(name string, ifdPath string) string {
+	switch {
+	case strings.HasPrefix(name, "GPS") || strings.Contains(ifdPath, "GPS"):
+		return CategoryGPS
+	case name == "Model" || name == "CameraModelName" || name == "Make":
+		return CategoryDevice
+	case name == "DateTimeOriginal" || name == "DateTimeDigitized" || name == "DateTime":
+		return CategoryTimestamp
+	case strings.Contains(strings.ToLower(name), "serial"):
+		return CategorySerial
+	default:
+		return ""
+	}
+}
+
+func decodeExifValue(name string, raw string) string {
+	switch name {
+	case "GPSLatitude", "GPSLongitude":
+		if coord, ok := parseGPSCoordinate(raw); ok {
+			return fmt.Sprintf("%.6f", coord)
+		}
+	case "DateTime", "DateTimeOriginal", "DateTimeDigitized":
+		return replaceFirstN(raw, ":", "-", 2)
+	}
+	return raw
+}
+
+// exifTagLocations walks the IFDs of a TIFF block and records where each
+// tag's value is stored, keyed by the same IFD paths go-exif reports.
+func exifTagLocations(tiff []byte) map[exifTagKey]exifTagLocation {
+	locations := map[exifTagKey]exifTagLocation{}
+	if len(tiff) < 8 {
+		return locations
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if tiff[0] == 'I' {
+		order = binary.LittleEndian
+	}
+
+	visited := map[uint32]bool{}
+	var walk func(offset uint32, path string) uint32
+	walk = func(offset uint32, path string) uint32 {
+		if offset == 0 || visited[offset] || uint64(offset)+2 > uint64(len(tiff)) {
+			return 0
 		}
-		if strings.Contains(lower, "serial") {
-			analysis.SerialCount++
-			if value != "" {
-				analysis.SerialValues = appendUnique(analysis.SerialValues, fmtKeyValue(name, value))
+		visited[offset] = true
+
+		count := int(order.Uint16(tiff[offset : offset+2]))
+		end := int(offset) + 2 + count*12
+		if end+4 > len(tiff) {
+			return 0
+		}
+		for i := 0; i < count; i++ {
+			raw := tiff[int(offset)+2+i*12 : int(offset)+2+(i+1)*12]
+			tag := order.Uint16(raw[0:2])
+			size := int64(tiffTypeSizes[order.Uint16(raw[2:4])]) * int64(order.Uint32(raw[4:8]))
+			loc := exifTagLocation{offset: int64(offset) + 2 + int64(i)*12 + 8, length: size}
+			if size > 4 {
+				loc.offset = int64(order.Uint32(raw[8:12]))
+			}
+			locations[exifTagKey{ifdPath: path, tagID: tag}] = loc
+
+			switch tag {
+			case tiffTagExifIFD:
+				walk(order.Uint32(raw[8:12]), path+"/Exif")
+			case tiffTagGPSIFD:
+				walk(order.Uint32(raw[8:12]), path+"/GPSInfo")
+			case tiffTagInteropIFD:
+				walk(order.Uint32(raw[8:12]), path+"/Iop")
 			}
 		}
+		return order.Uint32(tiff[end : end+4])
 	}
 
-	return analysis, nil
+	next := walk(order.Uint32(tiff[4:8]), "IFD")
+	for i := 1; next != 0; i++ {
+		next = walk(next, fmt.Sprintf("IFD%d", i))
+	}
+	return locations
 }
 
 func errorsIsNoExif(err error) bool {
@@ -121,18 +194,6 @@ func exifValueString(tag exif.ExifTag) string {
 	return strings.TrimSpace(fmt.Sprint(tag.Value))
 }
 
-func appendUnique(values []string, value string) []string {
-	if value == "" {
-		return values
-	}
-	for _, existing := range values {
-		if existing == value {
-			return values
-		}
-	}
-	return append(values, value)
-}
-
 func fmtKeyValue(key string, value string) string {
 	value = sanitizeValue(value)
 	if key == "" {
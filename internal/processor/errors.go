@@ -0,0 +1,119 @@
+package processor
+
+import (
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+
+	"golang.org/x/image/tiff"
+)
+
+const (
+	StageOpen     = "open"
+	StageSniff    = "sniff"
+	StageScan     = "scan"
+	StageStrip    = "strip"
+	StageReencode = "reencode"
+	StageStamp    = "stamp"
+	StageReplace  = "replace"
+	StageVault    = "vault"
+	StageJournal  = "journal"
+	StageRestore  = "restore"
+	StageVerify   = "verify"
+)
+
+const (
+	CauseTruncated   = "truncated"
+	CauseMalformed   = "malformed"
+	CausePermission  = "permission"
+	CauseUnsupported = "unsupported"
+	CauseNotFound    = "not found"
+	CauseUnverified  = "unverified"
+	CauseOther       = "other"
+)
+
+// Errors about a file's contents wrap one of these, which classifyError maps
+// to a cause. Their text starts or ends the message, as in "truncated JPEG
+// segment".
+var (
+	errTruncated   = errors.New("truncated")
+	errMalformed   = errors.New("invalid")
+	errUnsupported = errors.New("unsupported")
+)
+
+// FileError records where processing a file failed and why.
+type FileError struct {
+	Path    string `json:"path"`
+	Stage   string `json:"stage"`
+	Cause   string `json:"cause"`
+	Message string `json:"message"`
+	Err     error  `json:"-"`
+}
+
+func (e *FileError) Error() string {
+	return e.Path + ": " + e.Stage + " (" + e.Cause + "): " + e.Message
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+func newFileError(path string, stage string, err error) *FileError {
+	return &FileError{Path: path, Stage: stage, Cause: classifyError(err), Message: err.Error(), Err: err}
+}
+
+// stageError tags an error from cleanFile with the stage it happened in, so
+// the worker can tell a failed strip from a failed write.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+func withStage(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stageError{stage: stage, err: err}
+}
+
+// fileErrorFor converts err into a FileError, preferring a stage recorded by
+// withStage over the fallback.
+func fileErrorFor(path string, fallback string, err error) *FileError {
+	var staged *stageError
+	if errors.As(err, &staged) {
+		return newFileError(path, staged.stage, staged.err)
+	}
+	return newFileError(path, fallback, err)
+}
+
+func classifyError(err error) string {
+	switch {
+	case errors.Is(err, errVerify):
+		return CauseUnverified
+	case errors.Is(err, fs.ErrPermission):
+		return CausePermission
+	case errors.Is(err, fs.ErrNotExist):
+		return CauseNotFound
+	case errors.Is(err, errTruncated), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return CauseTruncated
+	case errors.Is(err, errUnsupported), errors.As(err, new(jpeg.UnsupportedError)),
+		errors.As(err, new(png.UnsupportedError)), errors.As(err, new(tiff.UnsupportedError)):
+		return CauseUnsupported
+	case errors.Is(err, errMalformed), errors.Is(err, image.ErrFormat), errors.As(err, new(jpeg.FormatError)),
+		errors.As(err, new(png.FormatError)), errors.As(err, new(tiff.FormatError)):
+		return CauseMalformed
+	default:
+		return CauseOther
+	}
+}
@@ -0,0 +1,142 @@
+package processor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	gpsTagVersionID    = 0x0000
+	gpsTagLatitudeRef  = 0x0001
+	gpsTagLatitude     = 0x0002
+	gpsTagLongitudeRef = 0x0003
+	gpsTagLongitude    = 0x0004
+	gpsTagTimeStamp    = 0x0007
+	gpsTagMapDatum     = 0x0012
+	gpsTagDateStamp    = 0x001d
+)
+
+// GPSPrecisions lists the grids a GPS position can be coarsened to, finest
+// first. A degree of latitude is about 111 km, so each step drops one
+// decimal place.
+var GPSPrecisions = []string{"100m", "1km", "10km", "100km"}
+
+var gpsPrecisionDecimals = map[string]int{"100m": 3, "1km": 2, "10km": 1, "100km": 0}
+
+// coarseGPSTags are the GPS IFD tags a coarsened position is made of.
+var coarseGPSTags = map[string]bool{
+	"GPSVersionID":    true,
+	"GPSLatitudeRef":  true,
+	"GPSLatitude":     true,
+	"GPSLongitudeRef": true,
+	"GPSLongitude":    true,
+	"GPSMapDatum":     true,
+}
+
+// ValidateGPSPrecision reports whether precision is one of GPSPrecisions.
+func ValidateGPSPrecision(precision string) error {
+	if _, ok := gpsPrecisionDecimals[precision]; !ok {
+		return fmt.Errorf("unknown GPS precision %q (want one of %s)", precision, strings.Join(GPSPrecisions, ", "))
+	}
+	return nil
+}
+
+// coarsenGPS replaces the block's GPS IFD with a coarsened position.
+func (b *exifBlock) coarsenGPS(decimals int) {
+	var rest, gps []exifEntry
+	for _, entry := range b.entries {
+		if entry.IFD == exifPathGPS {
+			gps = append(gps, entry)
+		} else {
+			rest = append(rest, entry)
+		}
+	}
+	b.entries = append(rest, coarsenGPSEntries(b.order, gps, decimals)...)
+}
+
+// coarsenGPSEntries returns the version, datum and position of a GPS IFD
+// with latitude and longitude rounded to decimals places of a degree. It
+// returns nil when the IFD has no usable position.
+func coarsenGPSEntries(order binary.ByteOrder, entries []exifEntry, decimals int) []exifEntry {
+	byTag := map[uint16]exifEntry{}
+	for _, entry := range entries {
+		byTag[entry.Tag] = entry
+	}
+	lat, okLat := gpsEntryCoordinate(order, byTag[gpsTagLatitude], byTag[gpsTagLatitudeRef], "S")
+	lon, okLon := gpsEntryCoordinate(order, byTag[gpsTagLongitude], byTag[gpsTagLongitudeRef], "W")
+	if !okLat || !okLon {
+		return nil
+	}
+
+	var out []exifEntry
+	for _, tag := range []uint16{gpsTagVersionID, gpsTagMapDatum} {
+		if entry, ok := byTag[tag]; ok {
+			out = append(out, entry)
+		}
+	}
+	out = append(out, coarseGPSCoordinate(order, gpsTagLatitudeRef, gpsTagLatitude, lat, decimals, "N", "S")...)
+	return append(out, coarseGPSCoordinate(order, gpsTagLongitudeRef, gpsTagLongitude, lon, decimals, "E", "W")...)
+}
+
+// gpsEntryCoordinate reads a signed coordinate through parseGPSCoordinate,
+// the same math scan uses for its location insight.
+func gpsEntryCoordinate(order binary.ByteOrder, value exifEntry, ref exifEntry, negative string) (float64, bool) {
+	if value.Type != tiffTypeRational || value.Count == 0 {
+		return 0, false
+	}
+	coord, ok := parseGPSCoordinate(exifRationalString(order, value.Value))
+	if !ok || math.IsNaN(coord) || math.IsInf(coord, 0) {
+		return 0, false
+	}
+	if strings.HasPrefix(string(ref.Value), negative) {
+		coord = -coord
+	}
+	return coord, true
+}
+
+func exifRationalString(order binary.ByteOrder, value []byte) string {
+	var parts []string
+	for i := 0; i+8 <= len(value); i += 8 {
+		parts = append(parts, fmt.Sprintf("%d/%d", order.Uint32(value[i:i+4]), order.Uint32(value[i+4:i+8])))
+	}
+	return strings.Join(parts, " ")
+}
+
+// coarseGPSCoordinate encodes a rounded coordinate as decimal degrees
+// (n/10^decimals, 0/1, 0/1) plus its reference letter.
+func coarseGPSCoordinate(order binary.ByteOrder, refTag, tag uint16, coord float64, decimals int, positive, negative string) []exifEntry {
+	scale := math.Pow10(decimals)
+	scaled := math.Round(math.Abs(coord) * scale)
+	ref := positive
+	if coord < 0 && scaled != 0 {
+		ref = negative
+	}
+
+	value := make([]byte, 24)
+	order.PutUint32(value[0:4], uint32(scaled))
+	order.PutUint32(value[4:8], uint32(scale))
+	order.PutUint32(value[12:16], 1)
+	order.PutUint32(value[20:24], 1)
+	return []exifEntry{
+		{IFD: exifPathGPS, Tag: refTag, Type: tiffTypeASCII, Count: 2, Value: []byte{ref[0], 0}},
+		{IFD: exifPathGPS, Tag: tag, Type: tiffTypeRational, Count: 3, Value: value},
+	}
+}
+
+// gpsPrecisionLabel returns the coarsest of GPSPrecisions both coordinates
+// sit on, or "" when they are finer than all of them.
+func gpsPrecisionLabel(lat, lon float64) string {
+	onGrid := func(v float64, decimals int) bool {
+		scaled := v * math.Pow10(decimals)
+		return math.Abs(scaled-math.Round(scaled)) < 1e-6
+	}
+	for i := len(GPSPrecisions) - 1; i >= 0; i-- {
+		decimals := gpsPrecisionDecimals[GPSPrecisions[i]]
+		if onGrid(lat, decimals) && onGrid(lon, decimals) {
+			return GPSPrecisions[i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,262 @@
+package processor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	exif "github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+)
+
+const (
+	exifPathIFD0 = "IFD"
+	exifPathExif = "IFD/Exif"
+	exifPathGPS  = "IFD/GPSInfo"
+)
+
+// DefaultExifAllow lists the tags kept by an EXIF rewrite when no allow list
+// is given: the ones needed to display the image correctly.
+var DefaultExifAllow = []string{"Orientation", "ColorSpace", "XResolution", "YResolution", "ResolutionUnit"}
+
+// exifSubIFDs are the sub-IFDs an EXIF rewrite carries over, keyed by the
+// IFD0 tag that points to them.
+var exifSubIFDs = []struct {
+	tag  uint16
+	path string
+}{
+	{tiffTagExifIFD, exifPathExif},
+	{tiffTagGPSIFD, exifPathGPS},
+}
+
+var exifIdentities = map[string]*exifcommon.IfdIdentity{
+	exifPathIFD0: exifcommon.IfdStandardIfdIdentity,
+	exifPathExif: exifcommon.IfdExifStandardIfdIdentity,
+	exifPathGPS:  exifcommon.IfdGpsInfoStandardIfdIdentity,
+}
+
+// The tag index loads its tables lazily and not thread-safely, so it is
+// loaded once up front.
+var exifTagIndex = sync.OnceValue(func() *exif.TagIndex {
+	ti := exif.NewTagIndex()
+	_ = exif.LoadStandardTags(ti)
+	return ti
+})
+
+func exifTagName(ifdPath string, tag uint16) string {
+	identity, ok := exifIdentities[ifdPath]
+	if !ok {
+		return ""
+	}
+	it, err := exifTagIndex().Get(identity, tag)
+	if err != nil {
+		return ""
+	}
+	return it.Name
+}
+
+type exifEntry struct {
+	IFD   string
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+// exifBlock holds the entries of IFD0 and its Exif and GPS sub-IFDs, with
+// values in the block's original byte order. Thumbnails (IFD1), Interop IFDs
+// and pointers are not carried over.
+type exifBlock struct {
+	order   binary.ByteOrder
+	entries []exifEntry
+}
+
+func parseExifBlock(tiff []byte) (*exifBlock, error) {
+	if !isTIFFHeader(tiff) || len(tiff) < 8 {
+		return nil, fmt.Errorf("%w EXIF TIFF header", errMalformed)
+	}
+	block := &exifBlock{order: binary.BigEndian}
+	if tiff[0] == 'I' {
+		block.order = binary.LittleEndian
+	}
+	order := block.order
+
+	visited := map[uint32]bool{}
+	var walk func(offset uint32, path string) error
+	walk = func(offset uint32, path string) error {
+		if visited[offset] {
+			return fmt.Errorf("%w EXIF IFD: loop at offset %d", errMalformed, offset)
+		}
+		visited[offset] = true
+		if uint64(offset)+2 > uint64(len(tiff)) {
+			return fmt.Errorf("%w EXIF IFD offset: out of range", errMalformed)
+		}
+		count := int(order.Uint16(tiff[offset : offset+2]))
+		if int(offset)+2+count*12 > len(tiff) {
+			return fmt.Errorf("%w EXIF IFD", errTruncated)
+		}
+		for i := 0; i < count; i++ {
+			raw := tiff[int(offset)+2+i*12 : int(offset)+2+(i+1)*12]
+			tag := order.Uint16(raw[0:2])
+			if path == exifPathIFD0 {
+				if sub := exifSubIFDPath(tag); sub != "" {
+					if err := walk(order.Uint32(raw[8:12]), sub); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if tag == tiffTagInteropIFD {
+				continue
+			}
+
+			entry := exifEntry{IFD: path, Tag: tag, Type: order.Uint16(raw[2:4]), Count: order.Uint32(raw[4:8])}
+			size, ok := tiffTypeSizes[entry.Type]
+			if !ok {
+				continue
+			}
+			total := uint64(size) * uint64(entry.Count)
+			if total <= 4 {
+				entry.Value = append([]byte{}, raw[8:8+total]...)
+			} else {
+				valueOffset := uint64(order.Uint32(raw[8:12]))
+				if valueOffset+total > uint64(len(tiff)) {
+					return fmt.Errorf("%w EXIF tag %#04x: value out of range", errMalformed, tag)
+				}
+				entry.Value = append([]byte{}, tiff[valueOffset:valueOffset+total]...)
+			}
+			block.entries = append(block.entries, entry)
+		}
+		return nil
+	}
+
+	if err := walk(order.Uint32(tiff[4:8]), exifPathIFD0); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func exifSubIFDPath(tag uint16) string {
+	for _, sub := range exifSubIFDs {
+		if sub.tag == tag {
+			return sub.path
+		}
+	}
+	return ""
+}
+
+// filter keeps the entries for which keep returns true.
+func (b *exifBlock) filter(keep func(entry exifEntry) bool) {
+	kept := b.entries[:0]
+	for _, entry := range b.entries {
+		if keep(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	b.entries = kept
+}
+
+// encode serializes the block as a TIFF structure with IFD0 first and the
+// Exif and GPS IFDs after it. It returns nil when no entries are left.
+func (b *exifBlock) encode() []byte {
+	byIFD := map[string][]exifEntry{}
+	for _, entry := range b.entries {
+		byIFD[entry.IFD] = append(byIFD[entry.IFD], entry)
+	}
+
+	ifd0 := append([]exifEntry{}, byIFD[exifPathIFD0]...)
+	for _, sub := range exifSubIFDs {
+		if len(byIFD[sub.path]) > 0 {
+			ifd0 = append(ifd0, exifEntry{IFD: exifPathIFD0, Tag: sub.tag, Type: tiffTypeLong, Count: 1, Value: make([]byte, 4)})
+		}
+	}
+	if len(ifd0) == 0 {
+		return nil
+	}
+
+	out := make([]byte, 8)
+	if b.order == binary.LittleEndian {
+		copy(out, "II")
+	} else {
+		copy(out, "MM")
+	}
+	b.order.PutUint16(out[2:4], 42)
+	b.order.PutUint32(out[4:8], 8)
+
+	var pointers map[uint16]int
+	out, pointers = b.appendIFD(out, ifd0)
+	for _, sub := range exifSubIFDs {
+		if entries := byIFD[sub.path]; len(entries) > 0 {
+			b.order.PutUint32(out[pointers[sub.tag]:], uint32(len(out)))
+			out, _ = b.appendIFD(out, entries)
+		}
+	}
+	return out
+}
+
+// appendIFD writes one IFD and its out-of-line values to out, which must end
+// on a word boundary. It returns the position of each entry's value field.
+func (b *exifBlock) appendIFD(out []byte, entries []exifEntry) ([]byte, map[uint16]int) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Tag < entries[j].Tag })
+
+	start := len(out)
+	dataPos := start + 2 + len(entries)*12 + 4
+	ifd := make([]byte, dataPos-start)
+	b.order.PutUint16(ifd[0:2], uint16(len(entries)))
+
+	positions := make(map[uint16]int, len(entries))
+	var extra []byte
+	for i, entry := range entries {
+		raw := ifd[2+i*12 : 2+(i+1)*12]
+		b.order.PutUint16(raw[0:2], entry.Tag)
+		b.order.PutUint16(raw[2:4], entry.Type)
+		b.order.PutUint32(raw[4:8], entry.Count)
+		positions[entry.Tag] = start + 2 + i*12 + 8
+		if len(entry.Value) <= 4 {
+			copy(raw[8:12], entry.Value)
+			continue
+		}
+		b.order.PutUint32(raw[8:12], uint32(dataPos+len(extra)))
+		extra = append(extra, entry.Value...)
+		if len(extra)%2 != 0 {
+			extra = append(extra, 0)
+		}
+	}
+
+	out = append(out, ifd...)
+	return append(out, extra...), positions
+}
+
+// rewriteExif rebuilds a TIFF-structured EXIF block with only the tags the
+// policy keeps. It returns nil when nothing is kept.
+func rewriteExif(tiff []byte, policy *Policy) ([]byte, error) {
+	block, err := parseExifBlock(tiff)
+	if err != nil {
+		return nil, err
+	}
+	if decimals, ok := policy.gpsDecimals(); ok {
+		block.coarsenGPS(decimals)
+	}
+	if r := policy.timeRewrite(); r != nil {
+		block.entries = r.rewriteExifEntries(block.order, block.entries)
+	}
+	block.filter(func(entry exifEntry) bool {
+		return policy.keepExifTag(entry.IFD, exifTagName(entry.IFD, entry.Tag))
+	})
+	return block.encode(), nil
+}
+
+// rewriteExifPayload is rewriteExif for blocks that may carry the JPEG
+// "Exif\0\0" prefix, which is preserved.
+func rewriteExifPayload(payload []byte, policy *Policy) ([]byte, error) {
+	prefix := 0
+	if hasPrefix(payload, jpegExifHeader) {
+		prefix = len(jpegExifHeader)
+	}
+	tiff, err := rewriteExif(payload[prefix:], policy)
+	if err != nil || tiff == nil {
+		return nil, err
+	}
+	return append(append([]byte{}, payload[:prefix]...), tiff...), nil
+}
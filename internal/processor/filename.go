@@ -0,0 +1,220 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// CategoryFilename is the category of what file and directory names reveal.
+const CategoryFilename = "Filename"
+
+// Tag names of filename findings. buildInsights falls back to them when a
+// file has no EXIF device or capture time.
+const (
+	tagFilenameDevice = "FilenameDevice"
+	tagFilenameTime   = "FilenameTime"
+	tagFilenameSource = "FilenameSource"
+	tagUsername       = "Username"
+	tagHomePath       = "HomePath"
+)
+
+// filenameScheme is a naming scheme of a camera, phone or screenshot tool.
+// Its pattern may capture "date" and "time" groups, which are read as
+// digits only: YYYYMMDD and HHMMSS, and an "ampm" group for 12-hour times.
+type filenameScheme struct {
+	pattern *regexp.Regexp
+	device  string
+	source  string
+}
+
+var filenameSchemes = []filenameScheme{
+	{regexp.MustCompile(`^PXL_(?P<date>\d{8})_(?P<time>\d{6})`), "Google Pixel", ""},
+	{regexp.MustCompile(`^(?:IMG|VID)-(?P<date>\d{8})-WA\d+`), "", "WhatsApp"},
+	{regexp.MustCompile(`^(?:IMG|VID|PANO|MVIMG|BURST\d*)_(?P<date>\d{8})_(?P<time>\d{6})`), "Android phone", ""},
+	{regexp.MustCompile(`^Screenshot_(?P<date>\d{8})[-_](?P<time>\d{6})`), "Android phone", "screenshot"},
+	{regexp.MustCompile(`^Screen ?[Ss]hot (?P<date>\d{4}-\d{2}-\d{2}) at (?P<time>\d{1,2}\.\d{2}\.\d{2})(?:[ \x{202f}](?P<ampm>[AP]M))?`), "Mac", "screenshot"},
+	{regexp.MustCompile(`^Screenshot from (?P<date>\d{4}-\d{2}-\d{2}) (?P<time>\d{2}-\d{2}-\d{2})`), "Linux (GNOME)", "screenshot"},
+	{regexp.MustCompile(`^Screenshot (?P<date>\d{4}-\d{2}-\d{2}) (?P<time>\d{6})`), "Windows", "screenshot"},
+	{regexp.MustCompile(`^DJI_(?P<date>\d{8})(?P<time>\d{6})_\d+`), "DJI drone", ""},
+	{regexp.MustCompile(`^DJI_\d{4}$`), "DJI drone", ""},
+	{regexp.MustCompile(`^(?:GOPR|GP\d{2}|G[HX]\d{2})\d{4}$`), "GoPro", ""},
+	{regexp.MustCompile(`^(?:DSC_|_DSC)\d{4}$`), "Nikon or Sony camera", ""},
+	{regexp.MustCompile(`^DSCN\d{4}$`), "Nikon Coolpix", ""},
+	{regexp.MustCompile(`^DSCF\d{4}$`), "Fujifilm camera", ""},
+	{regexp.MustCompile(`^_?MG_\d{4}$`), "Canon camera", ""},
+	{regexp.MustCompile(`^IMG_\d{4}$`), "iPhone or Canon camera", ""},
+	{regexp.MustCompile(`^P\d{7}$`), "Panasonic or Olympus camera", ""},
+	{regexp.MustCompile(`^(?P<date>\d{8})_(?P<time>\d{6})$`), "Samsung phone", ""},
+}
+
+// filenameDate finds a date anywhere in a name, such as a folder called
+// "2024-01-03 Lisbon".
+var filenameDate = regexp.MustCompile(`(?:^|\D)(?P<date>(?:19|20)\d{2}[-_.]?(?:0[1-9]|1[0-2])[-_.]?(?:0[1-9]|[12]\d|3[01]))(?:\D|$)`)
+
+var homePath = regexp.MustCompile(`(?i)(?:^|/)((?:home|Users|Documents and Settings)/[^/]+)(?:/|$)`)
+
+// filenameFindings reports what the components of a relative path reveal:
+// camera and screenshot naming schemes, dates, the current user's name and
+// home directories.
+func filenameFindings(relPath string) []Finding {
+	var findings []Finding
+	add := func(component, tag, raw, value string) {
+		findings = append(findings, Finding{
+			Container: component,
+			TagID:     NoTagID,
+			TagName:   tag,
+			RawValue:  raw,
+			Value:     value,
+			Offset:    -1,
+			Category:  CategoryFilename,
+		})
+	}
+
+	slashed := filepath.ToSlash(relPath)
+	if m := homePath.FindStringSubmatch(slashed); m != nil {
+		add(m[1], tagHomePath, m[1], m[1])
+	}
+
+	components := strings.Split(slashed, "/")
+	for i, component := range components {
+		name := component
+		if i == len(components)-1 {
+			name = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		matched := false
+		for _, scheme := range filenameSchemes {
+			m := scheme.pattern.FindStringSubmatch(name)
+			if m == nil {
+				continue
+			}
+			// A scheme whose digits are not a real date is a coincidence.
+			raw, value, dated := schemeTime(scheme.pattern, m)
+			if !dated && scheme.pattern.SubexpIndex("date") >= 0 {
+				continue
+			}
+			matched = true
+			if scheme.device != "" {
+				add(component, tagFilenameDevice, scheme.device, scheme.device)
+			}
+			if scheme.source != "" {
+				add(component, tagFilenameSource, scheme.source, scheme.source)
+			}
+			if dated {
+				add(component, tagFilenameTime, raw, value)
+			}
+			break
+		}
+		if !matched {
+			if m := filenameDate.FindStringSubmatch(name); m != nil {
+				if raw, value, ok := schemeTime(filenameDate, m); ok {
+					add(component, tagFilenameTime, raw, value)
+				}
+			}
+		}
+		for _, username := range currentUsernames() {
+			if hasToken(name, username) {
+				add(component, tagUsername, username, username)
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// schemeTime reads the date and time groups of a match as an EXIF style
+// raw value and a readable value. A match without a valid date has none.
+func schemeTime(pattern *regexp.Regexp, m []string) (string, string, bool) {
+	var date, clock, ampm string
+	for i, group := range pattern.SubexpNames() {
+		switch group {
+		case "date":
+			date = digitsOnly(m[i])
+		case "time":
+			clock = digitsOnly(m[i])
+		case "ampm":
+			ampm = m[i]
+		}
+	}
+	if len(clock) == 5 {
+		clock = "0" + clock
+	}
+	if len(clock) == 6 && ampm != "" {
+		hour := (int(clock[0]-'0')*10 + int(clock[1]-'0')) % 12
+		if ampm == "PM" {
+			hour += 12
+		}
+		clock = fmt.Sprintf("%02d", hour) + clock[2:]
+	}
+	if len(date) != 8 {
+		return "", "", false
+	}
+	if len(clock) != 6 {
+		t, err := time.Parse("20060102", date)
+		if err != nil {
+			return "", "", false
+		}
+		return t.Format("2006:01:02"), t.Format("2006-01-02"), true
+	}
+	t, err := time.Parse("20060102150405", date+clock)
+	if err != nil {
+		return "", "", false
+	}
+	return t.Format(exifDateLayout), t.Format("2006-01-02 15:04:05"), true
+}
+
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// hasToken reports whether word appears in name as a whole word, ignoring
+// case.
+func hasToken(name, word string) bool {
+	for _, token := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if strings.EqualFold(token, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// currentUsernames are the names of the account running bleach, as the OS
+// and the environment know them. Names shorter than three letters match
+// too much to report.
+var currentUsernames = sync.OnceValue(func() []string {
+	candidates := []string{os.Getenv("USER"), os.Getenv("USERNAME")}
+	if u, err := user.Current(); err == nil {
+		candidates = append(candidates, u.Username)
+	}
+	var names []string
+	for _, name := range candidates {
+		if i := strings.LastIndexByte(name, '\\'); i >= 0 {
+			name = name[i+1:]
+		}
+		if len(name) < 3 || containsFold(names, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+})
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
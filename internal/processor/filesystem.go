@@ -0,0 +1,153 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CategoryFilesystem is the category of metadata the filesystem keeps next
+// to a file's contents, such as extended attributes.
+const CategoryFilesystem = "Filesystem"
+
+// TimesMode says how clean sets the times of the files it writes.
+type TimesMode int
+
+const (
+	// TimesPreserve copies the access and modification times of the
+	// original.
+	TimesPreserve TimesMode = iota
+	// TimesFixed sets both to FileTimes.Fixed.
+	TimesFixed
+	// TimesCapture sets both to the original's DateTimeOriginal, and leaves
+	// files without one at the time they were written.
+	TimesCapture
+)
+
+// FileTimes sets the access and modification times of cleaned files.
+type FileTimes struct {
+	Mode  TimesMode
+	Fixed time.Time
+}
+
+// ParseFileTimes parses "preserve", "exif" or "epoch[:<time>]", where time
+// is Unix seconds, RFC 3339 or a YYYY-MM-DD date in UTC. A bare "epoch" is
+// 1970-01-01T00:00:00Z.
+func ParseFileTimes(spec string) (*FileTimes, error) {
+	mode, arg, hasArg := strings.Cut(spec, ":")
+	switch {
+	case mode == "preserve" && !hasArg:
+		return &FileTimes{Mode: TimesPreserve}, nil
+	case mode == "exif" && !hasArg:
+		return &FileTimes{Mode: TimesCapture}, nil
+	case mode == "epoch" && !hasArg:
+		return &FileTimes{Mode: TimesFixed, Fixed: time.Unix(0, 0).UTC()}, nil
+	case mode == "epoch":
+		if seconds, err := strconv.ParseInt(arg, 10, 64); err == nil {
+			return &FileTimes{Mode: TimesFixed, Fixed: time.Unix(seconds, 0).UTC()}, nil
+		}
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			if t, err := time.Parse(layout, arg); err == nil {
+				return &FileTimes{Mode: TimesFixed, Fixed: t}, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid epoch %q (want Unix seconds, RFC 3339 or YYYY-MM-DD)", arg)
+	}
+	return nil, fmt.Errorf("invalid times mode %q (want preserve, exif or epoch[:<time>])", spec)
+}
+
+// times returns the access and modification times for a cleaned file, and
+// false when it should keep the time it was written.
+func (t *FileTimes) times(src os.FileInfo, findings []Finding) (time.Time, time.Time, bool) {
+	switch t.Mode {
+	case TimesPreserve:
+		return fileAtime(src), src.ModTime(), true
+	case TimesFixed:
+		return t.Fixed, t.Fixed, true
+	}
+	captured, ok := captureTime(findings)
+	return captured, captured, ok
+}
+
+// captureTime finds DateTimeOriginal in EXIF or XMP, or XMP DateCreated.
+// Times without a zone are taken as local time, like the camera's clock.
+func captureTime(findings []Finding) (time.Time, bool) {
+	for _, name := range []string{"DateTimeOriginal", "DateCreated"} {
+		for _, f := range findings {
+			if f.TagName != name {
+				continue
+			}
+			for _, layout := range textTimeLayouts {
+				if t, err := time.ParseInLocation(layout, strings.TrimSpace(f.RawValue), time.Local); err == nil {
+					return t, true
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// xattrFindings reports the extended attributes of path. Filesystems
+// without extended attributes have none to report.
+func xattrFindings(path, format string) ([]Finding, error) {
+	attrs, err := listXattrs(path)
+	if errors.Is(err, errXattrUnsupported) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	findings := make([]Finding, 0, len(attrs))
+	for _, attr := range attrs {
+		value := xattrValueString(attr.value)
+		findings = append(findings, Finding{
+			Format:    format,
+			Container: "xattr",
+			TagID:     NoTagID,
+			TagName:   attr.name,
+			RawValue:  value,
+			Value:     value,
+			Offset:    -1,
+			Category:  CategoryFilesystem,
+		})
+	}
+	return findings, nil
+}
+
+// copyXattrs copies the extended attributes of src that scan reports onto
+// dst.
+func copyXattrs(src, dst string) error {
+	attrs, err := listXattrs(src)
+	if errors.Is(err, errXattrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		if err := setXattr(dst, attr.name, attr.value); err != nil {
+			return fmt.Errorf("copy extended attribute %s: %w", attr.name, err)
+		}
+	}
+	return nil
+}
+
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// xattrValueString shows text values as text and anything else, such as
+// binary property lists, by its size.
+func xattrValueString(value []byte) string {
+	text := strings.TrimRight(string(value), "\x00")
+	if !utf8.ValidString(text) || strings.IndexFunc(text, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return fmt.Sprintf("(%d bytes)", len(value))
+	}
+	return sanitizeValue(text)
+}
@@ -0,0 +1,109 @@
+package processor
+
+const (
+	CategoryGPS       = "GPS"
+	CategoryDevice    = "Device Model"
+	CategoryTimestamp = "Timestamp"
+	CategorySerial    = "Serial Number"
+	CategorySegment   = "JPEG Segment"
+	CategoryEmbedded  = "Embedded Image"
+	CategoryTrailer   = "Trailer"
+)
+
+// NoTagID marks findings that do not come from a numbered tag.
+const NoTagID = -1
+
+// Finding is a single piece of metadata located in a file. Offset and Length
+// locate the value in the file, or the enclosing block when the value has no
+// fixed position of its own (XMP properties, PNG text chunks). Offset is -1
+// when the position is unknown.
+type Finding struct {
+	Format    string `json:"format"`
+	Container string `json:"container"`
+	TagID     int    `json:"tag_id"`
+	TagName   string `json:"tag_name"`
+	RawValue  string `json:"raw_value"`
+	Value     string `json:"value"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	Category  string `json:"category"`
+}
+
+func (f Finding) String() string {
+	return fmtKeyValue(f.TagName, f.RawValue)
+}
+
+// Leak reports whether removing the finding plugs a privacy leak. Embedded
+// images and zero padding are structural, and file names are not in the
+// file, so they are only reported for context.
+func (f Finding) Leak() bool {
+	switch f.Category {
+	case CategoryEmbedded, CategoryFilename:
+		return false
+	case CategoryTrailer:
+		return f.TagName != paddingTagName
+	default:
+		return true
+	}
+}
+
+type FindingGroup struct {
+	Category string
+	Findings []Finding
+}
+
+// GroupFindings groups findings by category in the order the categories
+// first appear, dropping findings that would print identically.
+func GroupFindings(findings []Finding) []FindingGroup {
+	var groups []FindingGroup
+	index := map[string]int{}
+	seen := map[string]bool{}
+	for _, finding := range findings {
+		key := finding.Category + "\x00" + finding.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		i, ok := index[finding.Category]
+		if !ok {
+			i = len(groups)
+			index[finding.Category] = i
+			groups = append(groups, FindingGroup{Category: finding.Category})
+		}
+		groups[i].Findings = append(groups[i].Findings, finding)
+	}
+	return groups
+}
+
+func countFindingLeaks(findings []Finding) int {
+	total := 0
+	for _, finding := range findings {
+		if finding.Leak() {
+			total++
+		}
+	}
+	return total
+}
+
+// relocateFindings prefixes the container of findings extracted from an
+// embedded block and shifts their offsets by the block's position. A
+// negative base marks the block's position as unknown.
+func relocateFindings(findings []Finding, container string, base int64) []Finding {
+	for i := range findings {
+		if container != "" {
+			if findings[i].Container == "" {
+				findings[i].Container = container
+			} else {
+				findings[i].Container = container + "/" + findings[i].Container
+			}
+		}
+		switch {
+		case base < 0:
+			findings[i].Offset = -1
+		case findings[i].Offset >= 0:
+			findings[i].Offset += base
+		}
+	}
+	return findings
+}
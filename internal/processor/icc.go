@@ -0,0 +1,333 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+
+	"bleach/pkg/imgutil"
+)
+
+// iccProfile is the matrix/TRC model of an RGB display profile: a tone curve
+// per channel and the XYZ (D50) colorants of the linear channels. It is all
+// clean needs to convert pixels to sRGB.
+type iccProfile struct {
+	colorants [3][3]float64 // rows X, Y, Z; columns R, G, B
+	curves    [3]iccCurve
+}
+
+// iccCurve is a curv or para tone curve, mapping encoded values in [0, 1]
+// to linear light.
+type iccCurve struct {
+	table  []float64
+	gamma  float64
+	params []float64
+	kind   int // -1 for table or gamma, else the para function type
+}
+
+// srgbColorants are the sRGB primaries adapted to D50, as found in the
+// common sRGB profiles.
+var srgbColorants = [3][3]float64{
+	{0.4361, 0.3851, 0.1431},
+	{0.2225, 0.7169, 0.0606},
+	{0.0139, 0.0971, 0.7141},
+}
+
+// xyzD50ToSRGB maps D50 XYZ to linear sRGB (Bradford adapted).
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+var errICCUnsupported = fmt.Errorf("%w ICC profile: only matrix/TRC RGB profiles can be converted to sRGB", errUnsupported)
+
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 {
+		return nil, fmt.Errorf("%w ICC profile", errTruncated)
+	}
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, errICCUnsupported
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:132]))
+	for i := 0; i < count; i++ {
+		at := 132 + i*12
+		if at+12 > len(data) {
+			return nil, fmt.Errorf("%w ICC tag table", errTruncated)
+		}
+		offset := int(binary.BigEndian.Uint32(data[at+4 : at+8]))
+		size := int(binary.BigEndian.Uint32(data[at+8 : at+12]))
+		if offset < 0 || size < 0 || offset > len(data) || size > len(data)-offset {
+			return nil, fmt.Errorf("%w ICC tag: out of range", errMalformed)
+		}
+		tags[string(data[at:at+4])] = data[offset : offset+size]
+	}
+
+	p := &iccProfile{}
+	for c, names := range [3][2]string{{"rXYZ", "rTRC"}, {"gXYZ", "gTRC"}, {"bXYZ", "bTRC"}} {
+		xyz, ok := tags[names[0]]
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, errICCUnsupported
+		}
+		for row := 0; row < 3; row++ {
+			p.colorants[row][c] = s15Fixed16(xyz[8+row*4:])
+		}
+		curve, err := parseICCCurve(tags[names[1]])
+		if err != nil {
+			return nil, err
+		}
+		p.curves[c] = curve
+	}
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// paraParams is the number of parameters of each para function type.
+var paraParams = []int{1, 3, 4, 5, 7}
+
+func parseICCCurve(data []byte) (iccCurve, error) {
+	if len(data) < 12 {
+		return iccCurve{}, errICCUnsupported
+	}
+	switch string(data[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(data[8:12]))
+		if len(data) < 12+2*n {
+			return iccCurve{}, fmt.Errorf("%w ICC curve", errTruncated)
+		}
+		switch n {
+		case 0:
+			return iccCurve{gamma: 1, kind: -1}, nil
+		case 1:
+			return iccCurve{gamma: float64(binary.BigEndian.Uint16(data[12:])) / 256, kind: -1}, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(data[12+2*i:])) / 65535
+		}
+		return iccCurve{table: table, kind: -1}, nil
+	case "para":
+		kind := int(binary.BigEndian.Uint16(data[8:10]))
+		if kind >= len(paraParams) || len(data) < 12+4*paraParams[kind] {
+			return iccCurve{}, errICCUnsupported
+		}
+		params := make([]float64, paraParams[kind])
+		for i := range params {
+			params[i] = s15Fixed16(data[12+4*i:])
+		}
+		return iccCurve{params: params, kind: kind}, nil
+	}
+	return iccCurve{}, errICCUnsupported
+}
+
+// linear maps an encoded value in [0, 1] to linear light.
+func (c iccCurve) linear(x float64) float64 {
+	if c.kind < 0 {
+		if c.table == nil {
+			return math.Pow(x, c.gamma)
+		}
+		pos := x * float64(len(c.table)-1)
+		i := min(int(pos), len(c.table)-2)
+		return c.table[i] + (c.table[i+1]-c.table[i])*(pos-float64(i))
+	}
+	p := c.params
+	g := p[0]
+	switch c.kind {
+	case 0:
+		return math.Pow(x, g)
+	case 1:
+		if x >= -p[2]/p[1] {
+			return math.Pow(p[1]*x+p[2], g)
+		}
+		return 0
+	case 2:
+		if x >= -p[2]/p[1] {
+			return math.Pow(p[1]*x+p[2], g) + p[3]
+		}
+		return p[3]
+	case 3:
+		if x >= p[4] {
+			return math.Pow(p[1]*x+p[2], g)
+		}
+		return p[3] * x
+	default:
+		if x >= p[4] {
+			return math.Pow(p[1]*x+p[2], g) + p[5]
+		}
+		return p[3]*x + p[6]
+	}
+}
+
+func srgbLinear(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+func srgbEncode(x float64) float64 {
+	if x <= 0.0031308 {
+		return 12.92 * x
+	}
+	return 1.055*math.Pow(x, 1/2.4) - 0.055
+}
+
+// isSRGB reports whether the profile describes sRGB, within the rounding of
+// the many sRGB profiles in circulation.
+func (p *iccProfile) isSRGB() bool {
+	for row := range p.colorants {
+		for c := range p.colorants[row] {
+			if math.Abs(p.colorants[row][c]-srgbColorants[row][c]) > 0.003 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for _, x := range []float64{0.02, 0.1, 0.25, 0.5, 0.75, 0.9} {
+			if math.Abs(curve.linear(x)-srgbLinear(x)) > 0.005 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toSRGB converts img from the profile's color space to sRGB, clipping
+// out-of-gamut colors. Alpha is kept; 16-bit sources stay 16-bit.
+func (p *iccProfile) toSRGB(img image.Image) image.Image {
+	var m [3][3]float64
+	for i := range 3 {
+		for j := range 3 {
+			for k := range 3 {
+				m[i][j] += xyzD50ToSRGB[i][k] * p.colorants[k][j]
+			}
+		}
+	}
+
+	b := img.Bounds()
+	var out draw.Image
+	var pix []byte
+	depth := 1
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		n := image.NewNRGBA64(b)
+		out, pix, depth = n, n.Pix, 2
+	default:
+		n := image.NewNRGBA(b)
+		out, pix = n, n.Pix
+	}
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	levels := 1<<(8*depth) - 1
+	var decode [3][]float64
+	for c := range decode {
+		decode[c] = make([]float64, levels+1)
+		for v := range decode[c] {
+			decode[c][v] = p.curves[c].linear(float64(v) / float64(levels))
+		}
+	}
+	const encodeSteps = 1 << 14
+	encode := make([]int, encodeSteps+1)
+	for i := range encode {
+		encode[i] = int(math.Round(srgbEncode(float64(i)/encodeSteps) * float64(levels)))
+	}
+
+	var in, lin [3]float64
+	for i := 0; i < len(pix); i += 4 * depth {
+		for c := range 3 {
+			v := int(pix[i+c*depth])
+			if depth == 2 {
+				v = v<<8 | int(pix[i+c*depth+1])
+			}
+			in[c] = decode[c][v]
+		}
+		for c := range 3 {
+			lin[c] = m[c][0]*in[0] + m[c][1]*in[1] + m[c][2]*in[2]
+			v := encode[int(math.Round(min(max(lin[c], 0), 1)*encodeSteps))]
+			if depth == 2 {
+				pix[i+c*depth], pix[i+c*depth+1] = byte(v>>8), byte(v)
+			} else {
+				pix[i+c] = byte(v)
+			}
+		}
+	}
+	return out
+}
+
+// extractICC returns the ICC profile embedded in a JPEG, PNG or WebP file,
+// or nil when it has none.
+func extractICC(kind imgutil.Kind, data []byte) ([]byte, error) {
+	switch kind {
+	case imgutil.KindJPEG:
+		img, err := parseJPEG(data)
+		if err != nil {
+			return nil, err
+		}
+		var parts [][]byte
+		for _, seg := range img.Segments {
+			if seg.Marker != 0xe2 || !hasPrefix(seg.Payload, jpegICCHeader) || len(seg.Payload) < len(jpegICCHeader)+2 {
+				continue
+			}
+			seq := int(seg.Payload[len(jpegICCHeader)])
+			for len(parts) < seq {
+				parts = append(parts, nil)
+			}
+			if seq > 0 {
+				parts[seq-1] = seg.Payload[len(jpegICCHeader)+2:]
+			}
+		}
+		if len(parts) == 0 {
+			return nil, nil
+		}
+		return bytes.Join(parts, nil), nil
+	case imgutil.KindPNG:
+		chunks, _, err := splitPNGChunks(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			if chunk.name != "iCCP" {
+				continue
+			}
+			_, rest, ok := bytes.Cut(chunk.data, []byte{0})
+			if !ok || len(rest) < 1 || rest[0] != 0 {
+				return nil, fmt.Errorf("%w PNG iCCP chunk", errMalformed)
+			}
+			return inflate(rest[1:])
+		}
+	case imgutil.KindWebP:
+		chunks, err := readWebPChunks(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			if chunk.Name == "ICCP" {
+				return chunk.Data, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// jpegICCSegments splits a profile into APP2 ICC_PROFILE payloads.
+func jpegICCSegments(profile []byte) ([][]byte, error) {
+	const room = 0xffff - 2 - 14
+	count := (len(profile) + room - 1) / room
+	if count > 255 {
+		return nil, fmt.Errorf("%w ICC profile: too large for JPEG (%d bytes)", errUnsupported, len(profile))
+	}
+	var segments [][]byte
+	for i := 0; i < count; i++ {
+		part := profile[i*room : min((i+1)*room, len(profile))]
+		payload := append(append([]byte{}, jpegICCHeader...), byte(i+1), byte(count))
+		segments = append(segments, append(payload, part...))
+	}
+	return segments, nil
+}
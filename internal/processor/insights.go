@@ -8,27 +8,36 @@ import (
 	"bleach/pkg/imgutil"
 )
 
-func buildInsights(kind imgutil.Kind, details []ScanDetail) []ScanInsight {
-	if len(details) == 0 {
+func buildInsights(kind imgutil.Kind, findings []Finding) []ScanInsight {
+	if len(findings) == 0 {
 		return nil
 	}
 
-	values := flattenDetails(details)
+	values := flattenFindings(findings)
 	insights := []ScanInsight{}
 
-	if gps := buildGPSInsight(values); gps != nil {
+	if gps, coarse := buildGPSInsight(values); gps != nil {
 		insights = append(insights, *gps)
-		insights = append(insights, ScanInsight{
-			Kind:    "Location",
-			Message: "Exact coordinates can reveal home, workplace, or travel patterns.",
-		})
+		message := "Exact coordinates can reveal home, workplace, or travel patterns."
+		if coarse {
+			message = "Coarsened coordinates still reveal the surrounding area."
+		}
+		insights = append(insights, ScanInsight{Kind: "Location", Message: message})
 	}
 
-	if device := buildDeviceInsight(values); device != nil {
+	device := buildDeviceInsight(values)
+	if device == nil {
+		device = buildFilenameDeviceInsight(values)
+	}
+	if device != nil {
 		insights = append(insights, *device)
 	}
 
-	if ts := buildTimestampInsight(values); ts != nil {
+	ts := buildTimestampInsight(values)
+	if ts == nil {
+		ts = buildFilenameTimestampInsight(values)
+	}
+	if ts != nil {
 		insights = append(insights, *ts)
 		insights = append(insights, ScanInsight{
 			Kind:    "Timeline",
@@ -40,28 +49,35 @@ func buildInsights(kind imgutil.Kind, details []ScanDetail) []ScanInsight {
 		insights = append(insights, *serial)
 	}
 
+	if source := firstValue(values, tagFilenameSource); source != "" {
+		insights = append(insights, ScanInsight{Kind: "Source", Message: fmt.Sprintf("File name follows the %s naming scheme.", source)})
+	}
+
+	if identity := buildIdentityInsight(values); identity != nil {
+		insights = append(insights, *identity)
+	}
+
 	return insights
 }
 
-func flattenDetails(details []ScanDetail) map[string][]string {
+func flattenFindings(findings []Finding) map[string][]string {
 	values := make(map[string][]string)
-	for _, detail := range details {
-		for _, entry := range detail.Values {
-			key, value := splitKeyValue(entry)
-			if key == "" {
-				continue
-			}
-			values[key] = append(values[key], value)
+	for _, finding := range findings {
+		if finding.TagName == "" {
+			continue
 		}
+		values[finding.TagName] = append(values[finding.TagName], finding.RawValue)
 	}
 	return values
 }
 
-func buildGPSInsight(values map[string][]string) *ScanInsight {
+// buildGPSInsight reports the position and, for positions that sit on one
+// of the GPSPrecisions grids, the precision they were coarsened to.
+func buildGPSInsight(values map[string][]string) (*ScanInsight, bool) {
 	latRaw := firstValue(values, "GPSLatitude")
 	lonRaw := firstValue(values, "GPSLongitude")
 	if latRaw == "" || lonRaw == "" {
-		return nil
+		return nil, false
 	}
 
 	latRef := firstValue(values, "GPSLatitudeRef")
@@ -69,7 +85,7 @@ func buildGPSInsight(values map[string][]string) *ScanInsight {
 	lat, okLat := parseGPSCoordinate(latRaw)
 	lon, okLon := parseGPSCoordinate(lonRaw)
 	if !okLat || !okLon {
-		return nil
+		return nil, false
 	}
 
 	if latRef == "S" {
@@ -79,8 +95,12 @@ func buildGPSInsight(values map[string][]string) *ScanInsight {
 		lon = -lon
 	}
 
+	if precision := gpsPrecisionLabel(lat, lon); precision != "" {
+		msg := fmt.Sprintf("Approx location: %.*f, %.*f (coarsened to ~%s)", gpsPrecisionDecimals[precision], lat, gpsPrecisionDecimals[precision], lon, precision)
+		return &ScanInsight{Kind: "Location", Message: msg}, true
+	}
 	msg := fmt.Sprintf("Approx location: %.5f, %.5f", lat, lon)
-	return &ScanInsight{Kind: "Location", Message: msg}
+	return &ScanInsight{Kind: "Location", Message: msg}, false
 }
 
 func buildDeviceInsight(values map[string][]string) *ScanInsight {
@@ -120,6 +140,39 @@ func buildTimestampInsight(values map[string][]string) *ScanInsight {
 	return &ScanInsight{Kind: "Timeline", Message: fmt.Sprintf("Captured: %s (timezone unknown)", formatted)}
 }
 
+// buildFilenameDeviceInsight reads the device from a camera or phone naming
+// scheme, for files whose EXIF does not name it.
+func buildFilenameDeviceInsight(values map[string][]string) *ScanInsight {
+	device := firstValue(values, tagFilenameDevice)
+	if device == "" {
+		return nil
+	}
+	msg := fmt.Sprintf("Device: %s (from file name)", device)
+	if deviceType := inferDeviceType(strings.ToLower(device)); deviceType != "" && !strings.Contains(strings.ToLower(device), deviceType) {
+		msg = fmt.Sprintf("Device: %s (%s, from file name)", device, deviceType)
+	}
+	return &ScanInsight{Kind: "Device", Message: msg}
+}
+
+func buildFilenameTimestampInsight(values map[string][]string) *ScanInsight {
+	ts := firstValue(values, tagFilenameTime)
+	if ts == "" {
+		return nil
+	}
+	formatted := replaceFirstN(ts, ":", "-", 2)
+	return &ScanInsight{Kind: "Timeline", Message: fmt.Sprintf("Captured: %s (from file name, timezone unknown)", formatted)}
+}
+
+func buildIdentityInsight(values map[string][]string) *ScanInsight {
+	if home := firstValue(values, tagHomePath); home != "" {
+		return &ScanInsight{Kind: "Identity", Message: fmt.Sprintf("Path includes the home directory %s.", home)}
+	}
+	if username := firstValue(values, tagUsername); username != "" {
+		return &ScanInsight{Kind: "Identity", Message: fmt.Sprintf("Path includes the username %s.", username)}
+	}
+	return nil
+}
+
 func buildSerialInsight(values map[string][]string) *ScanInsight {
 	for key, vals := range values {
 		if strings.Contains(strings.ToLower(key), "serial") && len(vals) > 0 {
@@ -129,14 +182,6 @@ func buildSerialInsight(values map[string][]string) *ScanInsight {
 	return nil
 }
 
-func splitKeyValue(entry string) (string, string) {
-	parts := strings.SplitN(entry, "=", 2)
-	if len(parts) != 2 {
-		return "", ""
-	}
-	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
-}
-
 func firstValue(values map[string][]string, key string) string {
 	if list, ok := values[key]; ok && len(list) > 0 {
 		return list[0]
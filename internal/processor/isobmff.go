@@ -0,0 +1,424 @@
+package processor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+type bmffBox struct {
+	Type       string
+	Start      int
+	HeaderSize int
+	End        int
+}
+
+func (b bmffBox) payloadStart() int {
+	return b.Start + b.HeaderSize
+}
+
+type heifItem struct {
+	ID          uint32
+	Type        string
+	ContentType string
+	Raw         []byte
+}
+
+type heifExtent struct {
+	Index  uint64
+	Offset uint64
+	Length uint64
+}
+
+type heifLocation struct {
+	ItemID             uint32
+	ConstructionMethod uint8
+	DataRefIndex       uint16
+	BaseOffset         uint64
+	Extents            []heifExtent
+}
+
+type heifFile struct {
+	data        []byte
+	boxes       []bmffBox
+	meta        bmffBox
+	metaHeader  []byte
+	children    []bmffBox
+	items       []heifItem
+	iinfVersion uint8
+	locations   []heifLocation
+	ilocVersion uint8
+	indexSize   int
+	idat        *bmffBox
+}
+
+var errNoHEIFMeta = fmt.Errorf("%w HEIF file: meta box not found", errMalformed)
+
+func readBMFFBoxes(data []byte, start, end int) ([]bmffBox, error) {
+	var boxes []bmffBox
+	pos := start
+	for pos < end {
+		if end-pos < 8 {
+			return nil, fmt.Errorf("%w box header at offset %d", errTruncated, pos)
+		}
+		size := uint64(binary.BigEndian.Uint32(data[pos : pos+4]))
+		boxType := string(data[pos+4 : pos+8])
+		headerSize := 8
+		switch size {
+		case 0:
+			size = uint64(end - pos)
+		case 1:
+			if end-pos < 16 {
+				return nil, fmt.Errorf("%w large box header at offset %d", errTruncated, pos)
+			}
+			size = binary.BigEndian.Uint64(data[pos+8 : pos+16])
+			headerSize = 16
+		}
+		if size < uint64(headerSize) || size > uint64(end-pos) {
+			return nil, fmt.Errorf("%w size for box %q at offset %d", errMalformed, boxType, pos)
+		}
+		boxes = append(boxes, bmffBox{Type: boxType, Start: pos, HeaderSize: headerSize, End: pos + int(size)})
+		pos += int(size)
+	}
+	return boxes, nil
+}
+
+func parseHEIF(data []byte) (*heifFile, error) {
+	boxes, err := readBMFFBoxes(data, 0, len(data))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &heifFile{data: data, boxes: boxes}
+	found := false
+	for _, box := range boxes {
+		if box.Type == "meta" {
+			f.meta = box
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errNoHEIFMeta
+	}
+
+	// meta is a FullBox: version and flags precede its children.
+	childStart := f.meta.payloadStart() + 4
+	if childStart > f.meta.End {
+		return nil, fmt.Errorf("%w HEIF meta box", errTruncated)
+	}
+	f.metaHeader = data[f.meta.Start:childStart]
+	f.children, err = readBMFFBoxes(data, childStart, f.meta.End)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, child := range f.children {
+		switch child.Type {
+		case "iinf":
+			if err := f.parseIINF(child); err != nil {
+				return nil, err
+			}
+		case "iloc":
+			if err := f.parseILOC(child); err != nil {
+				return nil, err
+			}
+		case "idat":
+			f.idat = &f.children[i]
+		}
+	}
+
+	return f, nil
+}
+
+func (f *heifFile) parseIINF(box bmffBox) error {
+	r := bmffReader{data: f.data[box.payloadStart():box.End]}
+	f.iinfVersion = r.u8()
+	r.skip(3)
+	if f.iinfVersion == 0 {
+		r.u16()
+	} else {
+		r.u32()
+	}
+	if r.err != nil {
+		return fmt.Errorf("%w iinf box: %w", errMalformed, r.err)
+	}
+
+	start := box.payloadStart() + r.pos
+	entries, err := readBMFFBoxes(f.data, start, box.End)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type != "infe" {
+			continue
+		}
+		item, err := parseINFE(f.data[entry.Start:entry.End], entry.HeaderSize)
+		if err != nil {
+			return err
+		}
+		f.items = append(f.items, item)
+	}
+	return nil
+}
+
+func parseINFE(raw []byte, headerSize int) (heifItem, error) {
+	item := heifItem{Raw: raw}
+	r := bmffReader{data: raw[headerSize:]}
+	version := r.u8()
+	r.skip(3)
+	if version < 2 {
+		// Legacy entries carry no item type and are never metadata items.
+		item.ID = uint32(r.u16())
+		return item, r.err
+	}
+	if version == 2 {
+		item.ID = uint32(r.u16())
+	} else {
+		item.ID = r.u32()
+	}
+	r.u16()
+	item.Type = string(r.bytes(4))
+	r.cstring()
+	if item.Type == "mime" {
+		item.ContentType = r.cstring()
+	}
+	if r.err != nil {
+		return item, fmt.Errorf("%w infe box: %w", errMalformed, r.err)
+	}
+	return item, nil
+}
+
+func (f *heifFile) parseILOC(box bmffBox) error {
+	r := bmffReader{data: f.data[box.payloadStart():box.End]}
+	f.ilocVersion = r.u8()
+	r.skip(3)
+	sizes := r.u8()
+	offsetSize := int(sizes >> 4)
+	lengthSize := int(sizes & 0x0f)
+	sizes = r.u8()
+	baseOffsetSize := int(sizes >> 4)
+	if f.ilocVersion == 1 || f.ilocVersion == 2 {
+		f.indexSize = int(sizes & 0x0f)
+	}
+
+	var count uint32
+	if f.ilocVersion < 2 {
+		count = uint32(r.u16())
+	} else {
+		count = r.u32()
+	}
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		loc := heifLocation{}
+		if f.ilocVersion < 2 {
+			loc.ItemID = uint32(r.u16())
+		} else {
+			loc.ItemID = r.u32()
+		}
+		if f.ilocVersion == 1 || f.ilocVersion == 2 {
+			loc.ConstructionMethod = uint8(r.u16() & 0x0f)
+		}
+		loc.DataRefIndex = r.u16()
+		loc.BaseOffset = r.uint(baseOffsetSize)
+		extents := int(r.u16())
+		for j := 0; j < extents && r.err == nil; j++ {
+			extent := heifExtent{}
+			if f.indexSize > 0 {
+				extent.Index = r.uint(f.indexSize)
+			}
+			extent.Offset = r.uint(offsetSize)
+			extent.Length = r.uint(lengthSize)
+			loc.Extents = append(loc.Extents, extent)
+		}
+		f.locations = append(f.locations, loc)
+	}
+	if r.err != nil {
+		return fmt.Errorf("%w iloc box: %w", errMalformed, r.err)
+	}
+	return nil
+}
+
+func (f *heifFile) location(id uint32) (heifLocation, bool) {
+	for _, loc := range f.locations {
+		if loc.ItemID == id {
+			return loc, true
+		}
+	}
+	return heifLocation{}, false
+}
+
+func (f *heifFile) itemData(id uint32) ([]byte, error) {
+	loc, ok := f.location(id)
+	if !ok {
+		return nil, fmt.Errorf("%w HEIF item %d: no location", errMalformed, id)
+	}
+
+	var source []byte
+	switch loc.ConstructionMethod {
+	case 0:
+		source = f.data
+	case 1:
+		if f.idat == nil {
+			return nil, fmt.Errorf("%w HEIF item %d: references missing idat", errMalformed, id)
+		}
+		source = f.data[f.idat.payloadStart():f.idat.End]
+	default:
+		return nil, fmt.Errorf("%w HEIF item %d construction method %d", errUnsupported, id, loc.ConstructionMethod)
+	}
+
+	var out []byte
+	for _, extent := range loc.Extents {
+		start := loc.BaseOffset + extent.Offset
+		end := uint64(len(source))
+		if extent.Length > 0 {
+			end = start + extent.Length
+		}
+		if start > end || end > uint64(len(source)) {
+			return nil, fmt.Errorf("%w HEIF item %d extent: out of range", errMalformed, id)
+		}
+		out = append(out, source[start:end]...)
+	}
+	return out, nil
+}
+
+// itemOffset maps an offset within an item's data to an absolute file
+// offset. Only single-extent items have a meaningful mapping; -1 is
+// returned for anything else.
+func (f *heifFile) itemOffset(id uint32, offset int64) int64 {
+	loc, ok := f.location(id)
+	if !ok || len(loc.Extents) != 1 {
+		return -1
+	}
+	start := int64(loc.BaseOffset + loc.Extents[0].Offset)
+	switch loc.ConstructionMethod {
+	case 0:
+		return start + offset
+	case 1:
+		if f.idat != nil {
+			return int64(f.idat.payloadStart()) + start + offset
+		}
+	}
+	return -1
+}
+
+func isHEIFExifItem(item heifItem) bool {
+	return item.Type == "Exif"
+}
+
+func isHEIFXMPItem(item heifItem) bool {
+	return item.Type == "mime" && strings.Contains(strings.ToLower(item.ContentType), "rdf+xml")
+}
+
+type bmffReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bmffReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("%w box", errTruncated)
+		return nil
+	}
+	out := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return out
+}
+
+func (r *bmffReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *bmffReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *bmffReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *bmffReader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *bmffReader) uint(size int) uint64 {
+	switch size {
+	case 0:
+		return 0
+	case 4:
+		return uint64(r.u32())
+	case 8:
+		if b := r.bytes(8); b != nil {
+			return binary.BigEndian.Uint64(b)
+		}
+		return 0
+	default:
+		r.err = fmt.Errorf("%w field size %d", errUnsupported, size)
+		return 0
+	}
+}
+
+func (r *bmffReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	idx := indexByte(r.data[r.pos:], 0)
+	if idx < 0 {
+		// Some writers omit the final terminator.
+		s := string(r.data[r.pos:])
+		r.pos = len(r.data)
+		return s
+	}
+	s := string(r.data[r.pos : r.pos+idx])
+	r.pos += idx + 1
+	return s
+}
+
+func putUint(buf []byte, size int, value uint64) []byte {
+	switch size {
+	case 4:
+		return binary.BigEndian.AppendUint32(buf, uint32(value))
+	case 8:
+		return binary.BigEndian.AppendUint64(buf, value)
+	default:
+		return buf
+	}
+}
+
+// appendBoxLike appends a box with the same header form as box, so that a
+// largesize box keeps its 16-byte header and what follows does not move.
+func appendBoxLike(buf []byte, box bmffBox, payload []byte) []byte {
+	if box.HeaderSize != 16 {
+		return appendBox(buf, box.Type, payload)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, 1)
+	buf = append(buf, box.Type...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)+16))
+	return append(buf, payload...)
+}
+
+func appendBox(buf []byte, boxType string, payload []byte) []byte {
+	size := uint64(len(payload) + 8)
+	if size > 0xffffffff {
+		buf = binary.BigEndian.AppendUint32(buf, 1)
+		buf = append(buf, boxType...)
+		buf = binary.BigEndian.AppendUint64(buf, size+8)
+	} else {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(size))
+		buf = append(buf, boxType...)
+	}
+	return append(buf, payload...)
+}
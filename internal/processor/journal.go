@@ -0,0 +1,211 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bleach/pkg/imgutil"
+)
+
+// A journal directory holds one file per in-place clean run, named by the
+// run's start time so that names sort in run order. Each line is a
+// vaultRecord keyed by the file's absolute path.
+const (
+	journalExt       = ".jsonl"
+	journalRunLayout = "20060102T150405.000000000Z"
+)
+
+// Journal records how to undo an in-place clean. Unlike a Vault it is not
+// encrypted, so its directory is created readable by the owner only.
+type Journal struct {
+	mu       sync.Mutex
+	file     *os.File
+	run      string
+	recorded int
+	records  map[string][]vaultRecord
+}
+
+// OpenJournal starts a new run in the journal directory dir, creating it
+// when needed.
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	for {
+		run := time.Now().UTC().Format(journalRunLayout)
+		file, err := os.OpenFile(filepath.Join(dir, run+journalExt), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Journal{file: file, run: run}, nil
+	}
+}
+
+// JournalRuns lists the runs in dir, oldest first.
+func JournalRuns(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var runs []string
+	for _, entry := range entries {
+		if run, ok := strings.CutSuffix(entry.Name(), journalExt); ok && entry.Type().IsRegular() {
+			runs = append(runs, run)
+		}
+	}
+	sort.Strings(runs)
+	return runs, nil
+}
+
+// ReadJournal loads the records of one run, or of every run when run is
+// empty.
+func ReadJournal(dir, run string) (*Journal, error) {
+	runs := []string{run}
+	if run == "" {
+		var err error
+		if runs, err = JournalRuns(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	j := &Journal{run: run, records: map[string][]vaultRecord{}}
+	for _, name := range runs {
+		data, err := os.ReadFile(filepath.Join(dir, name+journalExt))
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+		for scanner.Scan() {
+			var record vaultRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return nil, fmt.Errorf("invalid journal record in run %s: %w", name, err)
+			}
+			j.records[record.Path] = append(j.records[record.Path], record)
+		}
+	}
+	return j, nil
+}
+
+// PruneJournal removes the runs in dir last written before cutoff and
+// returns their names.
+func PruneJournal(dir string, cutoff time.Time) ([]string, error) {
+	runs, err := JournalRuns(dir)
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for _, run := range runs {
+		path := filepath.Join(dir, run+journalExt)
+		info, err := os.Stat(path)
+		if err != nil {
+			return pruned, err
+		}
+		if !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, run)
+	}
+	return pruned, nil
+}
+
+// ParseJournalAge parses an age for PruneJournal, such as "30d" or "12h".
+func ParseJournalAge(s string) (time.Duration, error) {
+	if strings.HasPrefix(s, "-") {
+		return 0, fmt.Errorf("invalid age %q: must be positive", s)
+	}
+	return parseTimeDuration(s)
+}
+
+// Run names the journal's run.
+func (j *Journal) Run() string {
+	return j.run
+}
+
+// Recorded counts the files added to the run so far.
+func (j *Journal) Recorded() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.recorded
+}
+
+// Paths lists the files the journal can restore, sorted.
+func (j *Journal) Paths() []string {
+	paths := make([]string, 0, len(j.records))
+	for path := range j.records {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Close closes a journal opened with OpenJournal, removing the run when
+// nothing was recorded.
+func (j *Journal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if j.Recorded() == 0 {
+		return os.Remove(j.file.Name())
+	}
+	return nil
+}
+
+// add records how to rebuild original from cleaned, synced to disk before
+// clean replaces the file.
+func (j *Journal) add(kind imgutil.Kind, path string, original, cleaned []byte) error {
+	if bytes.Equal(original, cleaned) {
+		return nil
+	}
+	line, err := json.Marshal(newVaultRecord(kind, path, original, cleaned))
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.recorded++
+	return nil
+}
+
+// has reports whether the journal holds records for path.
+func (j *Journal) has(path string) bool {
+	return len(j.records[path]) > 0
+}
+
+// restore rebuilds the original of the cleaned file at path. Later runs
+// win when the same content was journaled more than once.
+func (j *Journal) restore(kind imgutil.Kind, path string, cleaned []byte) ([]byte, error) {
+	records := j.records[path]
+	sum := sha256Hex(cleaned)
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Cleaned == sum {
+			return records[i].rebuild(kind, cleaned)
+		}
+	}
+	return nil, errors.New("file changed since it was cleaned; journal has no matching record")
+}
@@ -0,0 +1,381 @@
+package processor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var jpegMPFHeader = []byte("MPF\x00")
+
+const mpTagEntry = 0xb002
+
+type jpegSegment struct {
+	Marker  byte
+	Start   int
+	End     int
+	Payload []byte
+}
+
+type jpegImage struct {
+	Segments []jpegSegment
+	End      int
+}
+
+type mpEntry struct {
+	Attribute uint32
+	Size      uint32
+	Offset    uint32
+	entryPos  int
+}
+
+type mpIndex struct {
+	order   binary.ByteOrder
+	entries []mpEntry
+}
+
+// parseJPEG walks the marker segments of the JPEG image starting at data[0].
+// Entropy-coded data following an SOS header is attached to that segment,
+// and End points just past the EOI marker.
+func parseJPEG(data []byte) (jpegImage, error) {
+	img := jpegImage{}
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return img, fmt.Errorf("%w JPEG SOI", errMalformed)
+	}
+	img.Segments = append(img.Segments, jpegSegment{Marker: 0xd8, Start: 0, End: 2})
+
+	pos := 2
+	for {
+		for pos < len(data) && data[pos] != 0xff {
+			pos++
+		}
+		for pos+1 < len(data) && data[pos+1] == 0xff {
+			pos++
+		}
+		if pos+1 >= len(data) {
+			return img, fmt.Errorf("%w JPEG: no EOI", errTruncated)
+		}
+
+		start := pos
+		marker := data[pos+1]
+		pos += 2
+
+		if marker == 0xd9 {
+			img.Segments = append(img.Segments, jpegSegment{Marker: marker, Start: start, End: pos})
+			img.End = pos
+			return img, nil
+		}
+
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			img.Segments = append(img.Segments, jpegSegment{Marker: marker, Start: start, End: pos})
+			continue
+		}
+
+		if pos+2 > len(data) {
+			return img, fmt.Errorf("%w JPEG segment header", errTruncated)
+		}
+		segLen := int(binary.BigEndian.Uint16(data[pos : pos+2]))
+		if segLen < 2 {
+			return img, fmt.Errorf("%w JPEG segment length", errMalformed)
+		}
+		if pos+segLen > len(data) {
+			return img, fmt.Errorf("%w JPEG segment", errTruncated)
+		}
+		payload := data[pos+2 : pos+segLen]
+		pos += segLen
+
+		if marker == 0xda {
+			pos = skipEntropyData(data, pos)
+			if pos >= len(data) {
+				// Truncated scans are kept as-is rather than rejected.
+				img.Segments = append(img.Segments, jpegSegment{Marker: marker, Start: start, End: len(data), Payload: payload})
+				img.End = len(data)
+				return img, nil
+			}
+		}
+
+		img.Segments = append(img.Segments, jpegSegment{Marker: marker, Start: start, End: pos, Payload: payload})
+	}
+}
+
+func skipEntropyData(data []byte, pos int) int {
+	for pos+1 < len(data) {
+		if data[pos] != 0xff {
+			pos++
+			continue
+		}
+		next := data[pos+1]
+		if next == 0x00 || next == 0xff || (next >= 0xd0 && next <= 0xd7) {
+			pos += 2
+			continue
+		}
+		return pos
+	}
+	return len(data)
+}
+
+func parseMPF(payload []byte) (*mpIndex, bool) {
+	if !hasPrefix(payload, jpegMPFHeader) {
+		return nil, false
+	}
+	tiff := payload[len(jpegMPFHeader):]
+	if len(tiff) < 8 {
+		return nil, false
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case tiff[0] == 'I' && tiff[1] == 'I':
+		order = binary.LittleEndian
+	case tiff[0] == 'M' && tiff[1] == 'M':
+		order = binary.BigEndian
+	default:
+		return nil, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return nil, false
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < count; i++ {
+		raw := ifd + 2 + i*12
+		if raw+12 > len(tiff) {
+			return nil, false
+		}
+		if order.Uint16(tiff[raw:raw+2]) != mpTagEntry {
+			continue
+		}
+		size := int(order.Uint32(tiff[raw+4 : raw+8]))
+		offset := int(order.Uint32(tiff[raw+8 : raw+12]))
+		if size%16 != 0 || offset+size > len(tiff) {
+			return nil, false
+		}
+
+		index := &mpIndex{order: order}
+		for pos := offset; pos < offset+size; pos += 16 {
+			index.entries = append(index.entries, mpEntry{
+				Attribute: order.Uint32(tiff[pos : pos+4]),
+				Size:      order.Uint32(tiff[pos+4 : pos+8]),
+				Offset:    order.Uint32(tiff[pos+8 : pos+12]),
+				entryPos:  len(jpegMPFHeader) + pos,
+			})
+		}
+		return index, true
+	}
+	return nil, false
+}
+
+func mpImageType(attribute uint32) string {
+	switch attribute & 0x00ffffff {
+	case 0x030000:
+		return "primary image"
+	case 0x010001:
+		return "large thumbnail (VGA)"
+	case 0x010002:
+		return "large thumbnail (Full HD)"
+	case 0x020001:
+		return "multi-frame panorama"
+	case 0x020002:
+		return "disparity image"
+	case 0x020003:
+		return "multi-angle image"
+	default:
+		return "embedded image"
+	}
+}
+
+type mpImage struct {
+	Number int
+	Entry  mpEntry
+	Start  int
+	End    int
+}
+
+// mpSecondaryImages resolves the MP entries after the primary image to
+// absolute ranges within data. base is the offset of the MPF TIFF header.
+func mpSecondaryImages(data []byte, index *mpIndex, base int, primaryEnd int) ([]mpImage, error) {
+	var images []mpImage
+	for i, entry := range index.entries {
+		if i == 0 || entry.Offset == 0 || entry.Size == 0 {
+			continue
+		}
+		start := base + int(entry.Offset)
+		end := start + int(entry.Size)
+		if start < primaryEnd || end > len(data) {
+			return nil, fmt.Errorf("%w MP entry %d: out of range", errMalformed, i+1)
+		}
+		images = append(images, mpImage{Number: i + 1, Entry: entry, Start: start, End: end})
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Start < images[j].Start })
+	for i := 1; i < len(images); i++ {
+		if images[i].Start < images[i-1].End {
+			return nil, fmt.Errorf("%w MP entries: %d and %d overlap", errMalformed, images[i-1].Number, images[i].Number)
+		}
+	}
+	return images, nil
+}
+
+// findMPF returns the MP index of a parsed JPEG and the absolute offset of
+// its TIFF header, which MP entry offsets are relative to.
+func findMPF(img jpegImage) (*mpIndex, int, bool) {
+	for _, seg := range img.Segments {
+		if seg.Marker != 0xe2 {
+			continue
+		}
+		if index, ok := parseMPF(seg.Payload); ok {
+			return index, seg.Start + 4 + len(jpegMPFHeader), true
+		}
+	}
+	return nil, 0, false
+}
+
+// replaceJPEGPrimary swaps the primary image of data (parsed as img) for
+// primary. MPF secondary images are passed through secondary, or copied as
+// they are when it is nil, and the MPF index in primary is patched to their
+// new sizes and offsets.
+func replaceJPEGPrimary(data []byte, img jpegImage, primary []byte, secondary func([]byte) ([]byte, error)) ([]byte, error) {
+	index, origBase, ok := findMPF(img)
+	if !ok || len(index.entries) < 2 {
+		return append(primary, data[img.End:]...), nil
+	}
+
+	images, err := mpSecondaryImages(data, index, origBase, img.End)
+	if err != nil {
+		return nil, err
+	}
+	newImg, err := parseJPEG(primary)
+	if err != nil {
+		return nil, err
+	}
+	newIndex, mpfBase, ok := findMPF(newImg)
+	if !ok {
+		return nil, errors.New("MPF index missing from rewritten primary image")
+	}
+
+	out := primary
+	pos := img.End
+	for _, image := range images {
+		out = append(out, data[pos:image.Start]...)
+		part := data[image.Start:image.End]
+		if secondary != nil {
+			if part, err = secondary(part); err != nil {
+				return nil, err
+			}
+		}
+		newOffset := len(out) - mpfBase
+		out = append(out, part...)
+		patchMPEntry(out, newIndex, mpfBase, image.Number-1, uint32(len(part)), uint32(newOffset))
+		pos = image.End
+	}
+	out = append(out, data[pos:]...)
+	patchMPEntry(out, newIndex, mpfBase, 0, uint32(len(primary)), 0)
+	return out, nil
+}
+
+var jpegSegmentNames = map[string]string{
+	"JFXX":                               "JFXX thumbnail",
+	"Ducky":                              "Ducky (Save for Web)",
+	"Photoshop 3.0":                      "Photoshop IRB (IPTC)",
+	"FLIR":                               "FLIR thermal data",
+	"FPXR":                               "FlashPix extension",
+	"Meta":                               "Meta/Exif vendor block",
+	"http://ns.adobe.com/xmp/extension/": "Extended XMP",
+	"AROT":                               "Apple rotation data",
+	"HPQ-Capture":                        "HP capture data",
+	"SCRNNAIL":                           "Samsung screennail",
+	"QVCI":                               "Casio QVCI",
+	"PIC":                                "Agfa PIC",
+	"GoPro":                              "GoPro vendor block",
+	"AVI1":                               "AVI1 motion JPEG",
+}
+
+// isStandardJPEGSegment reports whether a segment is either structural or
+// already covered by the EXIF/XMP analysis.
+func isStandardJPEGSegment(marker byte, payload []byte) bool {
+	switch marker {
+	case 0xe0:
+		return hasPrefix(payload, jpegJFIFHeader)
+	case 0xe1:
+		return hasPrefix(payload, jpegExifHeader) || hasPrefix(payload, jpegXmpHeader)
+	case 0xe2:
+		return hasPrefix(payload, jpegICCHeader) || hasPrefix(payload, jpegMPFHeader)
+	case 0xee:
+		return hasPrefix(payload, jpegAdobe)
+	case 0xfe:
+		return false
+	default:
+		return marker < 0xe0 || marker > 0xef
+	}
+}
+
+// describeJPEGSegment names a comment or application segment and summarizes
+// its contents.
+func describeJPEGSegment(marker byte, payload []byte) (string, string) {
+	if marker == 0xfe {
+		text := sanitizeValue(string(payload))
+		if len(text) > 60 {
+			text = text[:60] + "..."
+		}
+		return "COM", fmt.Sprintf("%q, %d bytes", text, len(payload))
+	}
+
+	ident := jpegSegmentIdentifier(payload)
+	name, ok := jpegSegmentNames[ident]
+	switch {
+	case ok:
+	case ident != "":
+		name = ident
+	default:
+		name = "unknown"
+	}
+	return fmt.Sprintf("APP%d", marker-0xe0), fmt.Sprintf("%s, %d bytes", name, len(payload))
+}
+
+func jpegSegmentIdentifier(payload []byte) string {
+	end := indexByte(payload, 0)
+	if end < 0 || end > 40 {
+		end = len(payload)
+		if end > 40 {
+			end = 0
+		}
+	}
+	ident := payload[:end]
+	for _, b := range ident {
+		if b < 0x20 || b > 0x7e {
+			return ""
+		}
+	}
+	return string(ident)
+}
+
+// jpegSegmentRuleNames lists the policy container names of an APPn segment,
+// from most to least specific: "APP1:Exif", "APP1", then a format-neutral
+// name such as "Exif", "XMP", "ICC" or "IPTC" where one applies.
+func jpegSegmentRuleNames(marker byte, payload []byte) []string {
+	app := fmt.Sprintf("APP%d", marker-0xe0)
+	var ident, generic string
+	switch {
+	case marker == 0xe1 && hasPrefix(payload, jpegExifHeader):
+		ident, generic = "Exif", "Exif"
+	case marker == 0xe1 && hasPrefix(payload, jpegXmpHeader):
+		ident, generic = "XMP", "XMP"
+	case marker == 0xe2 && hasPrefix(payload, jpegICCHeader):
+		ident, generic = "ICC", "ICC"
+	case marker == 0xed && hasPrefix(payload, jpegPhotoshop):
+		ident, generic = "Photoshop", "IPTC"
+	default:
+		ident = jpegSegmentIdentifier(payload)
+	}
+
+	var names []string
+	if ident != "" {
+		names = append(names, app+":"+ident)
+	}
+	names = append(names, app)
+	if generic != "" {
+		names = append(names, generic)
+	}
+	return names
+}
@@ -0,0 +1,822 @@
+package processor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// jpegUnzig maps zigzag order to natural (row-major) coefficient order.
+var jpegUnzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+var errJPEGUnsupportedCoding = fmt.Errorf("%w JPEG coding process", errUnsupported)
+
+type jpegComponent struct {
+	id      byte
+	h, v    int
+	tq      byte
+	blocksW int
+	blocksH int
+	coeffs  []int32
+}
+
+func (c *jpegComponent) block(bx, by int) []int32 {
+	i := (by*c.blocksW + bx) * 64
+	return c.coeffs[i : i+64]
+}
+
+// jpegCoefficients is a JPEG image decoded to quantized DCT coefficients.
+// Each component stores the full MCU-padded block grid.
+type jpegCoefficients struct {
+	precision byte
+	width     int
+	height    int
+	comps     []jpegComponent
+	hmax      int
+	vmax      int
+	mcusX     int
+	mcusY     int
+}
+
+// compBlocks returns the number of blocks a non-interleaved scan covers for
+// a component, which can be less than the padded grid.
+func (f *jpegCoefficients) compBlocks(c *jpegComponent) (int, int) {
+	w := (f.width*c.h + f.hmax - 1) / f.hmax
+	h := (f.height*c.v + f.vmax - 1) / f.vmax
+	return (w + 7) / 8, (h + 7) / 8
+}
+
+type jpegHuffman struct {
+	maxcode [18]int32
+	valptr  [17]int32
+	mincode [17]int32
+	vals    []byte
+}
+
+func newJPEGHuffman(counts []byte, vals []byte) *jpegHuffman {
+	t := &jpegHuffman{vals: vals}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		if n == 0 {
+			t.maxcode[l] = -1
+		} else {
+			t.valptr[l] = k
+			t.mincode[l] = code
+			code += n
+			k += n
+			t.maxcode[l] = code - 1
+		}
+		code <<= 1
+	}
+	t.maxcode[17] = 0x7fffffff
+	return t
+}
+
+type jpegBitReader struct {
+	data   []byte
+	pos    int
+	acc    uint32
+	nbits  int
+	marker bool
+}
+
+func (r *jpegBitReader) fill() {
+	for r.nbits <= 24 {
+		b := byte(0)
+		if !r.marker && r.pos < len(r.data) {
+			b = r.data[r.pos]
+			if b == 0xff {
+				if r.pos+1 < len(r.data) && r.data[r.pos+1] == 0x00 {
+					r.pos += 2
+				} else {
+					// A marker ends the entropy data; pad with zeros.
+					r.marker = true
+					b = 0
+				}
+			} else {
+				r.pos++
+			}
+		}
+		r.acc |= uint32(b) << (24 - r.nbits)
+		r.nbits += 8
+	}
+}
+
+func (r *jpegBitReader) bits(n int) int32 {
+	if n == 0 {
+		return 0
+	}
+	if r.nbits < n {
+		r.fill()
+	}
+	v := int32(r.acc >> (32 - n))
+	r.acc <<= n
+	r.nbits -= n
+	return v
+}
+
+func (r *jpegBitReader) bit() int32 {
+	return r.bits(1)
+}
+
+func (r *jpegBitReader) decode(t *jpegHuffman) (byte, error) {
+	if t == nil {
+		return 0, fmt.Errorf("%w JPEG: missing Huffman table", errMalformed)
+	}
+	code := r.bit()
+	for l := 1; l <= 16; l++ {
+		if code <= t.maxcode[l] {
+			i := t.valptr[l] + code - t.mincode[l]
+			if int(i) >= len(t.vals) {
+				break
+			}
+			return t.vals[i], nil
+		}
+		code = code<<1 | r.bit()
+	}
+	return 0, fmt.Errorf("%w JPEG Huffman code", errMalformed)
+}
+
+func (r *jpegBitReader) receiveExtend(s int) int32 {
+	if s == 0 {
+		return 0
+	}
+	v := r.bits(s)
+	if v < 1<<(s-1) {
+		v += -(1 << s) + 1
+	}
+	return v
+}
+
+// restart discards buffered bits and skips the RSTn marker that follows.
+func (r *jpegBitReader) restart() error {
+	r.acc, r.nbits, r.marker = 0, 0, false
+	for r.pos < len(r.data) && r.data[r.pos] != 0xff {
+		r.pos++
+	}
+	if r.pos+1 >= len(r.data) || r.data[r.pos+1] < 0xd0 || r.data[r.pos+1] > 0xd7 {
+		return fmt.Errorf("%w JPEG: missing restart marker", errMalformed)
+	}
+	r.pos += 2
+	return nil
+}
+
+type jpegScanComp struct {
+	comp *jpegComponent
+	dc   *jpegHuffman
+	ac   *jpegHuffman
+	pred int32
+}
+
+type jpegScan struct {
+	comps          []*jpegScanComp
+	ss, se, ah, al int
+	restart        int
+}
+
+// decodeJPEGCoefficients decodes a baseline, extended or progressive
+// Huffman-coded JPEG into its quantized DCT coefficients.
+func decodeJPEGCoefficients(data []byte, img jpegImage) (*jpegCoefficients, error) {
+	var frame *jpegCoefficients
+	dcTables := map[byte]*jpegHuffman{}
+	acTables := map[byte]*jpegHuffman{}
+	restart := 0
+
+	for _, seg := range img.Segments {
+		switch seg.Marker {
+		case 0xc0, 0xc1, 0xc2:
+			if frame != nil {
+				return nil, fmt.Errorf("%w JPEG: multiple frames", errMalformed)
+			}
+			f, err := parseJPEGFrame(seg.Payload)
+			if err != nil {
+				return nil, err
+			}
+			frame = f
+		case 0xc3, 0xc5, 0xc6, 0xc7, 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf:
+			return nil, errJPEGUnsupportedCoding
+		case 0xc4:
+			if err := parseJPEGHuffmanTables(seg.Payload, dcTables, acTables); err != nil {
+				return nil, err
+			}
+		case 0xdd:
+			if len(seg.Payload) < 2 {
+				return nil, fmt.Errorf("%w JPEG DRI segment", errMalformed)
+			}
+			restart = int(binary.BigEndian.Uint16(seg.Payload))
+		case 0xdc:
+			return nil, fmt.Errorf("%w JPEG DNL marker", errUnsupported)
+		case 0xda:
+			if frame == nil {
+				return nil, fmt.Errorf("%w JPEG: scan before frame header", errMalformed)
+			}
+			scan, err := parseJPEGScan(seg.Payload, frame, dcTables, acTables)
+			if err != nil {
+				return nil, err
+			}
+			scan.restart = restart
+			entropy := data[seg.Start+4+len(seg.Payload) : seg.End]
+			if err := frame.decodeScan(scan, entropy); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if frame == nil {
+		return nil, fmt.Errorf("%w JPEG: frame header not found", errMalformed)
+	}
+	return frame, nil
+}
+
+func parseJPEGFrame(payload []byte) (*jpegCoefficients, error) {
+	if len(payload) < 6 {
+		return nil, fmt.Errorf("%w JPEG frame header", errMalformed)
+	}
+	f := &jpegCoefficients{
+		precision: payload[0],
+		height:    int(binary.BigEndian.Uint16(payload[1:3])),
+		width:     int(binary.BigEndian.Uint16(payload[3:5])),
+	}
+	n := int(payload[5])
+	if f.width == 0 || f.height == 0 || n == 0 || n > 4 || len(payload) < 6+3*n {
+		return nil, fmt.Errorf("%w JPEG frame header", errMalformed)
+	}
+	f.hmax, f.vmax = 1, 1
+	for i := 0; i < n; i++ {
+		p := payload[6+3*i:]
+		c := jpegComponent{id: p[0], h: int(p[1] >> 4), v: int(p[1] & 0x0f), tq: p[2]}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 {
+			return nil, fmt.Errorf("%w JPEG sampling factors", errMalformed)
+		}
+		f.hmax = max(f.hmax, c.h)
+		f.vmax = max(f.vmax, c.v)
+		f.comps = append(f.comps, c)
+	}
+	f.mcusX = (f.width + 8*f.hmax - 1) / (8 * f.hmax)
+	f.mcusY = (f.height + 8*f.vmax - 1) / (8 * f.vmax)
+	for i := range f.comps {
+		c := &f.comps[i]
+		c.blocksW = f.mcusX * c.h
+		c.blocksH = f.mcusY * c.v
+		c.coeffs = make([]int32, c.blocksW*c.blocksH*64)
+	}
+	return f, nil
+}
+
+func parseJPEGHuffmanTables(payload []byte, dc, ac map[byte]*jpegHuffman) error {
+	for len(payload) > 0 {
+		if len(payload) < 17 {
+			return fmt.Errorf("%w JPEG DHT segment", errMalformed)
+		}
+		class, id := payload[0]>>4, payload[0]&0x0f
+		counts := payload[1:17]
+		total := 0
+		for _, n := range counts {
+			total += int(n)
+		}
+		if len(payload) < 17+total || total > 256 {
+			return fmt.Errorf("%w JPEG DHT segment", errMalformed)
+		}
+		table := newJPEGHuffman(counts, payload[17:17+total])
+		if class == 0 {
+			dc[id] = table
+		} else {
+			ac[id] = table
+		}
+		payload = payload[17+total:]
+	}
+	return nil
+}
+
+func parseJPEGScan(payload []byte, f *jpegCoefficients, dc, ac map[byte]*jpegHuffman) (*jpegScan, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("%w JPEG scan header", errMalformed)
+	}
+	n := int(payload[0])
+	if n < 1 || n > 4 || len(payload) < 1+2*n+3 {
+		return nil, fmt.Errorf("%w JPEG scan header", errMalformed)
+	}
+	scan := &jpegScan{}
+	for i := 0; i < n; i++ {
+		id, tables := payload[1+2*i], payload[2+2*i]
+		var comp *jpegComponent
+		for j := range f.comps {
+			if f.comps[j].id == id {
+				comp = &f.comps[j]
+			}
+		}
+		if comp == nil {
+			return nil, fmt.Errorf("%w JPEG scan: unknown component %d", errMalformed, id)
+		}
+		scan.comps = append(scan.comps, &jpegScanComp{comp: comp, dc: dc[tables>>4], ac: ac[tables&0x0f]})
+	}
+	p := payload[1+2*n:]
+	scan.ss, scan.se = int(p[0]), int(p[1])
+	scan.ah, scan.al = int(p[2]>>4), int(p[2]&0x0f)
+	if scan.ss > scan.se || scan.se > 63 || (scan.ss > 0 && n != 1) {
+		return nil, fmt.Errorf("%w JPEG spectral selection", errMalformed)
+	}
+	return scan, nil
+}
+
+func (f *jpegCoefficients) decodeScan(scan *jpegScan, entropy []byte) error {
+	r := &jpegBitReader{data: entropy}
+	eobrun := 0
+
+	var units [][2]int
+	var mcus int
+	single := len(scan.comps) == 1
+	if single {
+		bw, bh := f.compBlocks(scan.comps[0].comp)
+		mcus = bw * bh
+		units = [][2]int{{bw, bh}}
+	} else {
+		mcus = f.mcusX * f.mcusY
+	}
+
+	for m := 0; m < mcus; m++ {
+		if scan.restart > 0 && m > 0 && m%scan.restart == 0 {
+			if err := r.restart(); err != nil {
+				return err
+			}
+			for _, sc := range scan.comps {
+				sc.pred = 0
+			}
+			eobrun = 0
+		}
+
+		if single {
+			bw := units[0][0]
+			sc := scan.comps[0]
+			if err := f.decodeBlock(r, scan, sc, sc.comp.block(m%bw, m/bw), &eobrun); err != nil {
+				return err
+			}
+			continue
+		}
+		mx, my := m%f.mcusX, m/f.mcusX
+		for _, sc := range scan.comps {
+			for by := 0; by < sc.comp.v; by++ {
+				for bx := 0; bx < sc.comp.h; bx++ {
+					block := sc.comp.block(mx*sc.comp.h+bx, my*sc.comp.v+by)
+					if err := f.decodeBlock(r, scan, sc, block, &eobrun); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *jpegCoefficients) decodeBlock(r *jpegBitReader, scan *jpegScan, sc *jpegScanComp, block []int32, eobrun *int) error {
+	switch {
+	case scan.ss == 0 && scan.ah == 0:
+		// DC first (or sequential) pass.
+		s, err := r.decode(sc.dc)
+		if err != nil {
+			return err
+		}
+		if s > 16 {
+			return fmt.Errorf("%w JPEG DC coefficient", errMalformed)
+		}
+		sc.pred += r.receiveExtend(int(s))
+		block[0] = sc.pred << scan.al
+		if scan.se == 0 {
+			return nil
+		}
+		if scan.ss == 0 && scan.se == 63 && scan.al == 0 {
+			return decodeACSequential(r, sc.ac, block)
+		}
+		return fmt.Errorf("%w JPEG scan parameters", errMalformed)
+	case scan.ss == 0:
+		// DC refinement.
+		if r.bit() != 0 {
+			block[0] |= 1 << scan.al
+		}
+		return nil
+	case scan.ah == 0:
+		return decodeACFirst(r, scan, sc.ac, block, eobrun)
+	default:
+		return decodeACRefine(r, scan, sc.ac, block, eobrun)
+	}
+}
+
+func decodeACSequential(r *jpegBitReader, ac *jpegHuffman, block []int32) error {
+	for k := 1; k < 64; {
+		rs, err := r.decode(ac)
+		if err != nil {
+			return err
+		}
+		run, size := int(rs>>4), int(rs&0x0f)
+		if size == 0 {
+			if run != 15 {
+				return nil
+			}
+			k += 16
+			continue
+		}
+		k += run
+		if k > 63 {
+			return fmt.Errorf("%w JPEG AC coefficient", errMalformed)
+		}
+		block[jpegUnzig[k]] = r.receiveExtend(size)
+		k++
+	}
+	return nil
+}
+
+func decodeACFirst(r *jpegBitReader, scan *jpegScan, ac *jpegHuffman, block []int32, eobrun *int) error {
+	if *eobrun > 0 {
+		*eobrun--
+		return nil
+	}
+	for k := scan.ss; k <= scan.se; {
+		rs, err := r.decode(ac)
+		if err != nil {
+			return err
+		}
+		run, size := int(rs>>4), int(rs&0x0f)
+		if size == 0 {
+			if run < 15 {
+				*eobrun = (1 << run) - 1
+				if run > 0 {
+					*eobrun += int(r.bits(run))
+				}
+				return nil
+			}
+			k += 16
+			continue
+		}
+		k += run
+		if k > 63 {
+			return fmt.Errorf("%w JPEG AC coefficient", errMalformed)
+		}
+		block[jpegUnzig[k]] = r.receiveExtend(size) << scan.al
+		k++
+	}
+	return nil
+}
+
+// decodeACRefine follows the successive-approximation refinement procedure
+// of ITU T.81 G.1.2.3.
+func decodeACRefine(r *jpegBitReader, scan *jpegScan, ac *jpegHuffman, block []int32, eobrun *int) error {
+	p1 := int32(1) << scan.al
+	m1 := int32(-1) << scan.al
+
+	refine := func(z int) {
+		coef := &block[jpegUnzig[z]]
+		if r.bit() != 0 && *coef&p1 == 0 {
+			if *coef >= 0 {
+				*coef += p1
+			} else {
+				*coef += m1
+			}
+		}
+	}
+
+	k := scan.ss
+	if *eobrun == 0 {
+		for ; k <= scan.se; k++ {
+			rs, err := r.decode(ac)
+			if err != nil {
+				return err
+			}
+			run, size := int(rs>>4), int(rs&0x0f)
+			var value int32
+			if size == 0 {
+				if run < 15 {
+					*eobrun = 1 << run
+					if run > 0 {
+						*eobrun += int(r.bits(run))
+					}
+					break
+				}
+			} else {
+				if size != 1 {
+					return fmt.Errorf("%w JPEG refinement coefficient", errMalformed)
+				}
+				if r.bit() != 0 {
+					value = p1
+				} else {
+					value = m1
+				}
+			}
+
+			for ; k <= scan.se; k++ {
+				if block[jpegUnzig[k]] != 0 {
+					refine(k)
+				} else {
+					if run == 0 {
+						break
+					}
+					run--
+				}
+			}
+			if value != 0 && k <= scan.se {
+				block[jpegUnzig[k]] = value
+			}
+		}
+	}
+
+	if *eobrun > 0 {
+		for ; k <= scan.se; k++ {
+			if block[jpegUnzig[k]] != 0 {
+				refine(k)
+			}
+		}
+		*eobrun--
+	}
+	return nil
+}
+
+type jpegBitWriter struct {
+	out   []byte
+	acc   uint32
+	nbits int
+}
+
+func (w *jpegBitWriter) write(code uint32, n int) {
+	for n > 0 {
+		take := min(n, 24-w.nbits)
+		w.acc |= ((code >> (n - take)) & (1<<take - 1)) << (24 - w.nbits - take)
+		w.nbits += take
+		n -= take
+		for w.nbits >= 8 {
+			b := byte(w.acc >> 16)
+			w.out = append(w.out, b)
+			if b == 0xff {
+				w.out = append(w.out, 0)
+			}
+			w.acc = (w.acc << 8) & 0xffffff
+			w.nbits -= 8
+		}
+	}
+}
+
+func (w *jpegBitWriter) flush() {
+	if w.nbits > 0 {
+		w.write(1<<(8-w.nbits)-1, 8-w.nbits)
+	}
+}
+
+type jpegHuffmanEncoder struct {
+	codes [256]uint32
+	sizes [256]int
+	// bits and vals are the DHT representation.
+	bits [16]byte
+	vals []byte
+}
+
+// newOptimalJPEGHuffman builds a table for the given symbol frequencies,
+// following ITU T.81 K.2 with code lengths limited to 16 bits.
+func newOptimalJPEGHuffman(freq [256]int) *jpegHuffmanEncoder {
+	var f [257]int
+	copy(f[:], freq[:])
+	// A reserved symbol keeps any code from being all ones.
+	f[256] = 1
+
+	var codesize [257]int
+	others := [257]int{}
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		c1, c2 := -1, -1
+		v := int(^uint(0) >> 1)
+		for i := 0; i <= 256; i++ {
+			if f[i] > 0 && f[i] <= v {
+				v, c1 = f[i], i
+			}
+		}
+		v = int(^uint(0) >> 1)
+		for i := 0; i <= 256; i++ {
+			if f[i] > 0 && f[i] <= v && i != c1 {
+				v, c2 = f[i], i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		f[c1] += f[c2]
+		f[c2] = 0
+		codesize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codesize[c1]++
+		}
+		others[c1] = c2
+		codesize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codesize[c2]++
+		}
+	}
+
+	var bits [33]int
+	for i := 0; i <= 256; i++ {
+		if codesize[i] > 0 {
+			bits[codesize[i]]++
+		}
+	}
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	// Drop the reserved symbol's code.
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+
+	type symbol struct {
+		value byte
+		size  int
+	}
+	var symbols []symbol
+	for v := 0; v < 256; v++ {
+		if codesize[v] > 0 {
+			symbols = append(symbols, symbol{value: byte(v), size: codesize[v]})
+		}
+	}
+	sort.SliceStable(symbols, func(a, b int) bool { return symbols[a].size < symbols[b].size })
+
+	enc := &jpegHuffmanEncoder{}
+	for l := 1; l <= 16; l++ {
+		enc.bits[l-1] = byte(bits[l])
+	}
+	// Code lengths were adjusted above, so assign symbols to lengths in
+	// order of their original size.
+	pos := 0
+	code := uint32(0)
+	for l := 1; l <= 16; l++ {
+		for n := 0; n < bits[l]; n++ {
+			s := symbols[pos]
+			enc.vals = append(enc.vals, s.value)
+			enc.codes[s.value] = code
+			enc.sizes[s.value] = l
+			code++
+			pos++
+		}
+		code <<= 1
+	}
+	return enc
+}
+
+func (e *jpegHuffmanEncoder) emit(w *jpegBitWriter, symbol byte) {
+	w.write(e.codes[symbol], e.sizes[symbol])
+}
+
+func jpegMagnitude(v int32) (int, uint32) {
+	a := v
+	if a < 0 {
+		a = -a
+	}
+	n := 0
+	for a > 0 {
+		n++
+		a >>= 1
+	}
+	bits := uint32(v)
+	if v < 0 {
+		bits = uint32(v - 1)
+	}
+	return n, bits & (1<<n - 1)
+}
+
+// encodeJPEGScan writes every component into a single sequential scan using
+// optimal Huffman tables, one set for the first component and one shared by
+// the rest. It returns the DHT and SOS payloads and the entropy-coded data.
+func (f *jpegCoefficients) encodeScan() ([]byte, []byte, []byte) {
+	tableFor := func(i int) int {
+		if i == 0 {
+			return 0
+		}
+		return 1
+	}
+
+	var dcFreq, acFreq [2][256]int
+	f.walkBlocks(func(i int, block []int32, pred *int32) {
+		t := tableFor(i)
+		size, _ := jpegMagnitude(block[0] - *pred)
+		*pred = block[0]
+		dcFreq[t][size]++
+		run := 0
+		for k := 1; k < 64; k++ {
+			v := block[jpegUnzig[k]]
+			if v == 0 {
+				run++
+				continue
+			}
+			for run > 15 {
+				acFreq[t][0xf0]++
+				run -= 16
+			}
+			size, _ := jpegMagnitude(v)
+			acFreq[t][run<<4|size]++
+			run = 0
+		}
+		if run > 0 {
+			acFreq[t][0x00]++
+		}
+	})
+
+	tables := 1
+	if len(f.comps) > 1 {
+		tables = 2
+	}
+	var dc, ac [2]*jpegHuffmanEncoder
+	var dht []byte
+	for t := 0; t < tables; t++ {
+		dc[t] = newOptimalJPEGHuffman(dcFreq[t])
+		ac[t] = newOptimalJPEGHuffman(acFreq[t])
+		dht = append(dht, byte(t))
+		dht = append(dht, dc[t].bits[:]...)
+		dht = append(dht, dc[t].vals...)
+		dht = append(dht, 0x10|byte(t))
+		dht = append(dht, ac[t].bits[:]...)
+		dht = append(dht, ac[t].vals...)
+	}
+
+	w := &jpegBitWriter{}
+	f.walkBlocks(func(i int, block []int32, pred *int32) {
+		t := tableFor(i)
+		size, bits := jpegMagnitude(block[0] - *pred)
+		*pred = block[0]
+		dc[t].emit(w, byte(size))
+		w.write(bits, size)
+		run := 0
+		for k := 1; k < 64; k++ {
+			v := block[jpegUnzig[k]]
+			if v == 0 {
+				run++
+				continue
+			}
+			for run > 15 {
+				ac[t].emit(w, 0xf0)
+				run -= 16
+			}
+			size, bits := jpegMagnitude(v)
+			ac[t].emit(w, byte(run<<4|size))
+			w.write(bits, size)
+			run = 0
+		}
+		if run > 0 {
+			ac[t].emit(w, 0x00)
+		}
+	})
+	w.flush()
+
+	sos := []byte{byte(len(f.comps))}
+	for i, c := range f.comps {
+		t := byte(tableFor(i))
+		sos = append(sos, c.id, t<<4|t)
+	}
+	sos = append(sos, 0, 63, 0)
+	return dht, sos, w.out
+}
+
+// walkBlocks visits blocks in the order of a single sequential scan over all
+// components, with a running DC predictor per component.
+func (f *jpegCoefficients) walkBlocks(visit func(comp int, block []int32, pred *int32)) {
+	preds := make([]int32, len(f.comps))
+	if len(f.comps) == 1 {
+		c := &f.comps[0]
+		bw, bh := f.compBlocks(c)
+		for by := 0; by < bh; by++ {
+			for bx := 0; bx < bw; bx++ {
+				visit(0, c.block(bx, by), &preds[0])
+			}
+		}
+		return
+	}
+	for my := 0; my < f.mcusY; my++ {
+		for mx := 0; mx < f.mcusX; mx++ {
+			for i := range f.comps {
+				c := &f.comps[i]
+				for by := 0; by < c.v; by++ {
+					for bx := 0; bx < c.h; bx++ {
+						visit(i, c.block(mx*c.h+bx, my*c.v+by), &preds[i])
+					}
+				}
+			}
+		}
+	}
+}
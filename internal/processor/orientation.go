@@ -0,0 +1,448 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+
+	"bleach/pkg/imgutil"
+)
+
+// orientTransform describes how an EXIF orientation maps stored pixels to
+// display pixels: an optional transpose followed by flips of the result.
+type orientTransform struct {
+	transpose bool
+	flipX     bool
+	flipY     bool
+}
+
+var orientTransforms = map[int]orientTransform{
+	2: {flipX: true},
+	3: {flipX: true, flipY: true},
+	4: {flipY: true},
+	5: {transpose: true},
+	6: {transpose: true, flipX: true},
+	7: {transpose: true, flipX: true, flipY: true},
+	8: {transpose: true, flipY: true},
+}
+
+// exifOrientation returns the IFD0 Orientation of a TIFF-structured EXIF
+// block, or 1 when there is none.
+func exifOrientation(tiff []byte) int {
+	block, err := parseExifBlock(tiff)
+	if err != nil {
+		return 1
+	}
+	for _, entry := range block.entries {
+		if entry.IFD == exifPathIFD0 && entry.Tag == tiffTagOrientation && entry.Type == 3 && len(entry.Value) >= 2 {
+			return int(block.order.Uint16(entry.Value))
+		}
+	}
+	return 1
+}
+
+// orientFile applies the EXIF orientation of a JPEG or PNG to its pixels.
+// Other formats, and images that are already upright, are returned as-is.
+func orientFile(kind imgutil.Kind, data []byte) ([]byte, error) {
+	switch kind {
+	case imgutil.KindJPEG:
+		return orientJPEG(data)
+	case imgutil.KindPNG:
+		return orientPNG(data)
+	default:
+		return data, nil
+	}
+}
+
+// orientationPolicy adjusts the strip policy of a file cleaned with
+// ApplyOrientation. Once JPEG and PNG pixels are upright their Orientation
+// tag must go; WebP pixels cannot be re-encoded here, so WebP keeps the tag
+// in a rewritten EXIF block. TIFF and HEIF keep their orientation anyway.
+func orientationPolicy(kind imgutil.Kind, policy *Policy) *Policy {
+	switch kind {
+	case imgutil.KindJPEG, imgutil.KindPNG:
+		return policy.withTagRule("Orientation", ActionStrip)
+	case imgutil.KindWebP:
+		return policy.withExifRewrite(nil).withTagRule("Orientation", ActionKeep)
+	default:
+		return policy
+	}
+}
+
+// orientJPEG rotates the primary image and any MPF secondary images in the
+// DCT domain, so no image data is re-quantized.
+func orientJPEG(data []byte) ([]byte, error) {
+	img, err := parseJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	for _, seg := range img.Segments {
+		if seg.Marker == 0xe1 && hasPrefix(seg.Payload, jpegExifHeader) {
+			orientation = exifOrientation(seg.Payload[len(jpegExifHeader):])
+			break
+		}
+	}
+	t, ok := orientTransforms[orientation]
+	if !ok {
+		return data, nil
+	}
+
+	primary, err := transformJPEG(data[:img.End], img, t)
+	if err != nil {
+		return nil, err
+	}
+	return replaceJPEGPrimary(data, img, primary, func(part []byte) ([]byte, error) {
+		partImg, err := parseJPEG(part)
+		if err != nil {
+			return nil, err
+		}
+		transformed, err := transformJPEG(part[:partImg.End], partImg, t)
+		if err != nil {
+			return nil, err
+		}
+		return append(transformed, part[partImg.End:]...), nil
+	})
+}
+
+// transformJPEG rewrites a single JPEG image with its coefficients
+// transposed and flipped. Flipping an axis whose size is not a whole number
+// of MCUs would move the partial edge MCU to the opposite side, so that edge
+// is trimmed, as jpegtran -trim does. The result is a baseline (or extended
+// sequential) JPEG with optimized Huffman tables and no restart markers.
+func transformJPEG(data []byte, img jpegImage, t orientTransform) ([]byte, error) {
+	src, err := decodeJPEGCoefficients(data, img)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := src.transform(t)
+	if err != nil {
+		return nil, err
+	}
+	dht, sos, entropy := dst.encodeScan()
+
+	extended := src.precision != 8
+	for _, seg := range img.Segments {
+		if seg.Marker == 0xdb && len(seg.Payload) > 0 && seg.Payload[0]>>4 != 0 {
+			extended = true
+		}
+	}
+
+	var out bytes.Buffer
+	scanned := false
+	for _, seg := range img.Segments {
+		switch {
+		case seg.Marker == 0xda:
+			scanned = true
+		case seg.Marker == 0xdb:
+			// Tables defined between progressive scans move ahead of the
+			// single sequential scan.
+			if t.transpose {
+				payload, err := transposeJPEGQuantTables(seg.Payload)
+				if err != nil {
+					return nil, err
+				}
+				out.Write(jpegSegmentBytes(seg.Marker, payload))
+			} else {
+				out.Write(data[seg.Start:seg.End])
+			}
+		case scanned, seg.Marker == 0xd9, seg.Marker == 0xc4, seg.Marker == 0xdd:
+		case seg.Marker >= 0xc0 && seg.Marker <= 0xc2:
+			marker := byte(0xc0)
+			if extended {
+				marker = 0xc1
+			}
+			out.Write(jpegSegmentBytes(marker, dst.frameHeader()))
+		case seg.Marker == 0xe0 && hasPrefix(seg.Payload, jpegJFIFHeader) && t.transpose && len(seg.Payload) >= 12:
+			jfif := append([]byte{}, seg.Payload...)
+			copy(jfif[8:10], seg.Payload[10:12])
+			copy(jfif[10:12], seg.Payload[8:10])
+			out.Write(jpegSegmentBytes(seg.Marker, jfif))
+		default:
+			out.Write(data[seg.Start:seg.End])
+		}
+	}
+	out.Write(jpegSegmentBytes(0xc4, dht))
+	out.Write(jpegSegmentBytes(0xda, sos))
+	out.Write(entropy)
+	out.Write([]byte{0xff, 0xd9})
+	return out.Bytes(), nil
+}
+
+// transposeJPEGQuantTables transposes every table of a DQT payload to
+// match transposed coefficients.
+func transposeJPEGQuantTables(payload []byte) ([]byte, error) {
+	var zigzag [64]int
+	for k, n := range jpegUnzig {
+		zigzag[n] = k
+	}
+	out := append([]byte{}, payload...)
+	for pos := 0; pos < len(out); {
+		size := 1
+		if out[pos]>>4 != 0 {
+			size = 2
+		}
+		if pos+1+64*size > len(out) {
+			return nil, fmt.Errorf("%w JPEG DQT segment", errMalformed)
+		}
+		table := payload[pos+1 : pos+1+64*size]
+		for k, n := range jpegUnzig {
+			src := zigzag[(n%8)*8+n/8]
+			copy(out[pos+1+k*size:pos+1+(k+1)*size], table[src*size:(src+1)*size])
+		}
+		pos += 1 + 64*size
+	}
+	return out, nil
+}
+
+func (f *jpegCoefficients) frameHeader() []byte {
+	out := []byte{f.precision}
+	out = binary.BigEndian.AppendUint16(out, uint16(f.height))
+	out = binary.BigEndian.AppendUint16(out, uint16(f.width))
+	out = append(out, byte(len(f.comps)))
+	for _, c := range f.comps {
+		out = append(out, c.id, byte(c.h<<4|c.v), c.tq)
+	}
+	return out
+}
+
+// transform returns the coefficients of the oriented image. A flip in the
+// DCT domain negates the odd frequencies along its axis; a transpose swaps
+// rows and columns of every block and the sampling factors of every
+// component.
+func (f *jpegCoefficients) transform(t orientTransform) (*jpegCoefficients, error) {
+	// Flips of the output act on the source axis the transpose maps there.
+	flipSrcX, flipSrcY := t.flipX, t.flipY
+	if t.transpose {
+		flipSrcX, flipSrcY = t.flipY, t.flipX
+	}
+	width, height, mcusX, mcusY := f.width, f.height, f.mcusX, f.mcusY
+	if flipSrcX {
+		mcusX = width / (8 * f.hmax)
+		width = mcusX * 8 * f.hmax
+	}
+	if flipSrcY {
+		mcusY = height / (8 * f.vmax)
+		height = mcusY * 8 * f.vmax
+	}
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("%w lossless transform: image smaller than one MCU", errUnsupported)
+	}
+
+	dst := &jpegCoefficients{precision: f.precision, width: width, height: height,
+		hmax: f.hmax, vmax: f.vmax, mcusX: mcusX, mcusY: mcusY}
+	if t.transpose {
+		dst.width, dst.height = height, width
+		dst.hmax, dst.vmax = f.vmax, f.hmax
+		dst.mcusX, dst.mcusY = mcusY, mcusX
+	}
+
+	for _, c := range f.comps {
+		d := jpegComponent{id: c.id, h: c.h, v: c.v, tq: c.tq}
+		if t.transpose {
+			d.h, d.v = c.v, c.h
+		}
+		d.blocksW = dst.mcusX * d.h
+		d.blocksH = dst.mcusY * d.v
+		d.coeffs = make([]int32, d.blocksW*d.blocksH*64)
+
+		for dy := 0; dy < d.blocksH; dy++ {
+			for dx := 0; dx < d.blocksW; dx++ {
+				ax, ay := dx, dy
+				if t.flipX {
+					ax = d.blocksW - 1 - dx
+				}
+				if t.flipY {
+					ay = d.blocksH - 1 - dy
+				}
+				sx, sy := ax, ay
+				if t.transpose {
+					sx, sy = ay, ax
+				}
+				in, out := c.block(sx, sy), d.block(dx, dy)
+				for r := 0; r < 8; r++ {
+					for col := 0; col < 8; col++ {
+						v := in[r*8+col]
+						if t.transpose {
+							v = in[col*8+r]
+						}
+						if (t.flipX && col%2 == 1) != (t.flipY && r%2 == 1) {
+							v = -v
+						}
+						out[r*8+col] = v
+					}
+				}
+			}
+		}
+		dst.comps = append(dst.comps, d)
+	}
+	return dst, nil
+}
+
+// orientPNG decodes the image, applies the orientation from its eXIf chunk
+// and re-encodes it. Ancillary chunks that do not depend on the pixel
+// encoding are carried over.
+func orientPNG(data []byte) ([]byte, error) {
+	chunks, trailer, err := splitPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	for _, chunk := range chunks {
+		switch chunk.name {
+		case "eXIf":
+			orientation = exifOrientation(chunk.data)
+		case "acTL":
+			return nil, fmt.Errorf("%w animated PNG orientation", errUnsupported)
+		}
+	}
+	t, ok := orientTransforms[orientation]
+	if !ok {
+		return data, nil
+	}
+
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return replacePNGPixels(chunks, trailer, orientImage(decoded, t), &png.Encoder{}, t.transpose)
+}
+
+// replacePNGPixels encodes img with enc in place of the image data of the
+// PNG split into chunks and trailer. Ancillary chunks that do not depend on
+// the pixel encoding are carried over; transpose swaps the pHYs axes.
+func replacePNGPixels(chunks []pngChunk, trailer []byte, img image.Image, enc *png.Encoder, transpose bool) ([]byte, error) {
+	var encoded bytes.Buffer
+	if err := enc.Encode(&encoded, img); err != nil {
+		return nil, err
+	}
+	pixels, _, err := splitPNGChunks(encoded.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, pngSignature...)
+	out = append(out, pngChunkBytes(pixels[0].name, pixels[0].data)...)
+	var after [][]byte
+	seenIDAT := false
+	for _, chunk := range chunks {
+		switch chunk.name {
+		case "IDAT":
+			seenIDAT = true
+			continue
+		case "IHDR", "PLTE", "IEND", "tRNS", "bKGD", "hIST", "sBIT":
+			// These are rewritten by the encoder or tied to the original
+			// color type.
+			continue
+		case "pHYs":
+			if transpose && len(chunk.data) == 9 {
+				phys := append([]byte{}, chunk.data[4:8]...)
+				phys = append(phys, chunk.data[0:4]...)
+				chunk.data = append(phys, chunk.data[8])
+			}
+		}
+		if seenIDAT {
+			after = append(after, pngChunkBytes(chunk.name, chunk.data))
+		} else {
+			out = append(out, pngChunkBytes(chunk.name, chunk.data)...)
+		}
+	}
+	for _, chunk := range pixels[1:] {
+		if chunk.name == "IEND" {
+			break
+		}
+		out = append(out, pngChunkBytes(chunk.name, chunk.data)...)
+	}
+	for _, chunk := range after {
+		out = append(out, chunk...)
+	}
+	out = append(out, pngChunkBytes("IEND", nil)...)
+	return append(out, trailer...), nil
+}
+
+type pngChunk struct {
+	name string
+	data []byte
+}
+
+// splitPNGChunks returns the chunks up to and including IEND and the bytes
+// that follow it.
+func splitPNGChunks(data []byte) ([]pngChunk, []byte, error) {
+	if !hasPrefix(data, pngSignature) {
+		return nil, nil, fmt.Errorf("%w PNG signature", errMalformed)
+	}
+	var chunks []pngChunk
+	pos := len(pngSignature)
+	for {
+		if pos+8 > len(data) {
+			return nil, nil, fmt.Errorf("%w PNG chunk header", errTruncated)
+		}
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		name := string(data[pos+4 : pos+8])
+		end := pos + 8 + length + 4
+		if length < 0 || end > len(data) {
+			return nil, nil, fmt.Errorf("%w PNG chunk", errTruncated)
+		}
+		chunks = append(chunks, pngChunk{name: name, data: data[pos+8 : pos+8+length]})
+		pos = end
+		if name == "IEND" {
+			return chunks, data[pos:], nil
+		}
+	}
+}
+
+// orientImage returns a copy of img with the transform applied, keeping its
+// pixel type so the PNG encoder writes the same bit depth.
+func orientImage(img image.Image, t orientTransform) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if t.transpose {
+		w, h = h, w
+	}
+	rect := image.Rect(0, 0, w, h)
+
+	var dst interface {
+		image.Image
+		Set(x, y int, c color.Color)
+	}
+	switch src := img.(type) {
+	case *image.Paletted:
+		dst = image.NewPaletted(rect, src.Palette)
+	case *image.Gray:
+		dst = image.NewGray(rect)
+	case *image.Gray16:
+		dst = image.NewGray16(rect)
+	case *image.RGBA:
+		dst = image.NewRGBA(rect)
+	case *image.RGBA64:
+		dst = image.NewRGBA64(rect)
+	case *image.NRGBA:
+		dst = image.NewNRGBA(rect)
+	default:
+		dst = image.NewNRGBA64(rect)
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			ax, ay := x, y
+			if t.flipX {
+				ax = w - 1 - x
+			}
+			if t.flipY {
+				ay = h - 1 - y
+			}
+			if t.transpose {
+				ax, ay = ay, ax
+			}
+			if p, ok := dst.(*image.Paletted); ok {
+				p.SetColorIndex(x, y, img.(*image.Paletted).ColorIndexAt(b.Min.X+ax, b.Min.Y+ay))
+				continue
+			}
+			dst.Set(x, y, img.At(b.Min.X+ax, b.Min.Y+ay))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,372 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"bleach/pkg/imgutil"
+)
+
+type Action string
+
+const (
+	ActionKeep  Action = "keep"
+	ActionStrip Action = "strip"
+)
+
+// policyAllFormats is the Containers key whose rules apply to every format.
+const policyAllFormats = "all"
+
+// Policy overrides the built-in keep/strip decisions of the strippers. Rules
+// are matched from most to least specific: tag name, category, then
+// container. Anything no rule matches falls back to the built-in behaviour.
+//
+// Tag and category rules only apply where individual values can be removed:
+// PNG text chunks, TIFF tags and EXIF blocks, which clean rewrites whenever
+// such a rule keeps something. XMP blocks and HEIF EXIF items are kept or
+// stripped as a whole through container rules.
+type Policy struct {
+	Categories map[string]Action            `yaml:"categories"`
+	Tags       map[string]Action            `yaml:"tags"`
+	Containers map[string]map[string]Action `yaml:"containers"`
+	Exif       *ExifRewrite                 `yaml:"exif"`
+	Time       *TimeRewrite                 `yaml:"time"`
+}
+
+// ExifRewrite asks the strippers to rebuild EXIF blocks with only the allowed
+// tags instead of dropping them. An empty Allow means DefaultExifAllow.
+//
+// GPS, when set, keeps the position rounded to one of GPSPrecisions instead
+// of dropping the GPS IFD; altitude, direction, speed and GPS timestamps are
+// still removed.
+type ExifRewrite struct {
+	Allow []string `yaml:"allow"`
+	GPS   string   `yaml:"gps"`
+}
+
+var policyCategories = []string{
+	CategoryGPS,
+	CategoryDevice,
+	CategoryTimestamp,
+	CategorySerial,
+}
+
+// LoadPolicy reads a YAML or JSON policy file.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+// ParsePolicy parses a YAML or JSON policy. Tag names and categories are
+// matched case-insensitively; container names are not, since PNG chunk
+// names are case-sensitive.
+func ParsePolicy(data []byte) (*Policy, error) {
+	var raw Policy
+	if err := yaml.UnmarshalStrict(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+
+	p := &Policy{
+		Categories: map[string]Action{},
+		Tags:       map[string]Action{},
+		Containers: map[string]map[string]Action{},
+		Exif:       raw.Exif,
+		Time:       raw.Time,
+	}
+	if p.Exif != nil && p.Exif.GPS != "" {
+		if err := ValidateGPSPrecision(p.Exif.GPS); err != nil {
+			return nil, fmt.Errorf("invalid policy: %w", err)
+		}
+	}
+	for name, action := range raw.Categories {
+		if err := validateAction("category "+name, action); err != nil {
+			return nil, err
+		}
+		category, ok := lookupCategory(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid policy: unknown category %q (want one of %s)", name, strings.Join(policyCategories, ", "))
+		}
+		p.Categories[category] = action
+	}
+	for name, action := range raw.Tags {
+		if err := validateAction("tag "+name, action); err != nil {
+			return nil, err
+		}
+		p.Tags[strings.ToLower(name)] = action
+	}
+	for format, rules := range raw.Containers {
+		format = strings.ToLower(format)
+		if !isPolicyFormat(format) {
+			return nil, fmt.Errorf("invalid policy: unknown format %q in containers", format)
+		}
+		if p.Containers[format] == nil {
+			p.Containers[format] = map[string]Action{}
+		}
+		for name, action := range rules {
+			if err := validateAction("container "+format+"/"+name, action); err != nil {
+				return nil, err
+			}
+			p.Containers[format][name] = action
+		}
+	}
+	return p, nil
+}
+
+func validateAction(what string, action Action) error {
+	switch action {
+	case ActionKeep, ActionStrip:
+		return nil
+	default:
+		return fmt.Errorf("invalid policy: %s has action %q (want keep or strip)", what, action)
+	}
+}
+
+func lookupCategory(name string) (string, bool) {
+	for _, category := range policyCategories {
+		if strings.EqualFold(category, name) {
+			return category, true
+		}
+	}
+	return "", false
+}
+
+func isPolicyFormat(format string) bool {
+	switch format {
+	case policyAllFormats,
+		imgutil.KindJPEG.String(), imgutil.KindPNG.String(), imgutil.KindTIFF.String(),
+		imgutil.KindWebP.String(), imgutil.KindHEIF.String():
+		return true
+	default:
+		return false
+	}
+}
+
+// clone returns a shallow copy of p whose Containers map can be modified.
+func (p *Policy) clone() *Policy {
+	out := &Policy{Containers: map[string]map[string]Action{}}
+	if p != nil {
+		out.Categories = p.Categories
+		out.Tags = p.Tags
+		out.Exif = p.Exif
+		out.Time = p.Time
+		for format, rules := range p.Containers {
+			out.Containers[format] = rules
+		}
+	}
+	return out
+}
+
+// withContainerRule returns a copy of p with a rule added for every format,
+// unless p already has one.
+func (p *Policy) withContainerRule(name string, action Action) *Policy {
+	out := p.clone()
+	all := map[string]Action{}
+	for k, v := range out.Containers[policyAllFormats] {
+		all[k] = v
+	}
+	if _, ok := all[name]; !ok {
+		all[name] = action
+	}
+	out.Containers[policyAllFormats] = all
+	return out
+}
+
+// withTagRule returns a copy of p with a tag rule that replaces any rule p
+// has for the same tag.
+func (p *Policy) withTagRule(name string, action Action) *Policy {
+	out := p.clone()
+	tags := map[string]Action{}
+	for k, v := range out.Tags {
+		tags[k] = v
+	}
+	tags[strings.ToLower(name)] = action
+	out.Tags = tags
+	return out
+}
+
+// withExifRewrite returns a copy of p that rewrites EXIF blocks. A non-empty
+// allow replaces the policy's own allow list.
+func (p *Policy) withExifRewrite(allow []string) *Policy {
+	out := p.clone()
+	rewrite := &ExifRewrite{}
+	if out.Exif != nil {
+		*rewrite = *out.Exif
+	}
+	if len(allow) > 0 {
+		rewrite.Allow = allow
+	}
+	out.Exif = rewrite
+	return out
+}
+
+// withGPSPrecision returns a copy of p that rewrites EXIF blocks and keeps a
+// GPS position rounded to precision.
+func (p *Policy) withGPSPrecision(precision string) *Policy {
+	out := p.withExifRewrite(nil)
+	out.Exif.GPS = precision
+	return out
+}
+
+// withTimeRewrite returns a copy of p that rewrites timestamps with r. Since
+// rewritten dates are meant to be kept, it also rewrites EXIF blocks and
+// keeps the Timestamp category (and, when shifting, SubSecTime*) unless p
+// says otherwise.
+func (p *Policy) withTimeRewrite(r *TimeRewrite) *Policy {
+	out := p.withExifRewrite(nil)
+	out.Time = r
+	if _, ok := out.Categories[CategoryTimestamp]; !ok {
+		categories := map[string]Action{CategoryTimestamp: ActionKeep}
+		for k, v := range out.Categories {
+			categories[k] = v
+		}
+		out.Categories = categories
+	}
+	if !r.DateOnly {
+		for _, name := range []string{"SubSecTime", "SubSecTimeOriginal", "SubSecTimeDigitized"} {
+			if _, ok := out.Tags[strings.ToLower(name)]; !ok {
+				out = out.withTagRule(name, ActionKeep)
+			}
+		}
+	}
+	return out
+}
+
+func (p *Policy) timeRewrite() *TimeRewrite {
+	if p == nil {
+		return nil
+	}
+	return p.Time
+}
+
+func (p *Policy) rewritesExif() bool {
+	return p != nil && p.Exif != nil
+}
+
+// gpsDecimals returns the number of decimal places of a degree GPS
+// coordinates are rounded to, and false when GPS is not coarsened.
+func (p *Policy) gpsDecimals() (int, bool) {
+	if !p.rewritesExif() || p.Exif.GPS == "" {
+		return 0, false
+	}
+	decimals, ok := gpsPrecisionDecimals[p.Exif.GPS]
+	return decimals, ok
+}
+
+// keepExifTag decides a single tag during an EXIF rewrite: tag and category
+// rules first, then the coarsened GPS tags, then the allow list.
+func (p *Policy) keepExifTag(ifdPath string, name string) bool {
+	if name == "" {
+		return false
+	}
+	if action, ok := p.itemRule(name, classifyExifTag(name, ifdPath)); ok {
+		return action == ActionKeep
+	}
+	if _, ok := p.gpsDecimals(); ok && ifdPath == exifPathGPS {
+		return coarseGPSTags[name]
+	}
+	allow := DefaultExifAllow
+	if p.rewritesExif() && len(p.Exif.Allow) > 0 {
+		allow = p.Exif.Allow
+	}
+	for _, allowed := range allow {
+		if strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) containerRule(format imgutil.Kind, names []string) (Action, bool) {
+	if p == nil {
+		return "", false
+	}
+	for _, key := range []string{format.String(), policyAllFormats} {
+		rules := p.Containers[key]
+		for _, name := range names {
+			if action, ok := rules[name]; ok {
+				return action, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (p *Policy) itemRule(tagName string, category string) (Action, bool) {
+	if p == nil {
+		return "", false
+	}
+	if action, ok := p.Tags[strings.ToLower(tagName)]; ok && tagName != "" {
+		return action, true
+	}
+	if action, ok := p.Categories[category]; ok && category != "" {
+		return action, true
+	}
+	return "", false
+}
+
+// keepBlock reports whether a whole segment, chunk or item survives. names
+// identify the block from most to least specific; keep is the built-in
+// decision.
+func (p *Policy) keepBlock(format imgutil.Kind, keep bool, names ...string) bool {
+	if action, ok := p.containerRule(format, names); ok {
+		return action == ActionKeep
+	}
+	return keep
+}
+
+// keepItem reports whether a single named value survives, consulting tag
+// and category rules before the container rules for names.
+func (p *Policy) keepItem(format imgutil.Kind, tagName string, category string, keep bool, names ...string) bool {
+	if action, ok := p.itemRule(tagName, category); ok {
+		return action == ActionKeep
+	}
+	return p.keepBlock(format, keep, names...)
+}
+
+// keepsItems reports whether a tag or category rule keeps anything, which
+// needs EXIF blocks rewritten rather than dropped.
+func (p *Policy) keepsItems() bool {
+	if p == nil {
+		return false
+	}
+	for _, rules := range []map[string]Action{p.Tags, p.Categories} {
+		for _, action := range rules {
+			if action == ActionKeep {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// strippedFindings drops the findings p keeps, so clean and verify only
+// count what clean actually removes: those a tag or category rule keeps,
+// and those keepsFinding keeps. Findings in blocks that are kept or dropped
+// whole, XMP and HEIF EXIF items, stay counted unless a container rule
+// keeps the block.
+func (p *Policy) strippedFindings(kind imgutil.Kind, findings []Finding) []Finding {
+	if p == nil {
+		return findings
+	}
+	var out []Finding
+	for _, f := range findings {
+		if action, ok := p.itemRule(f.TagName, f.Category); ok && action == ActionKeep && kind != imgutil.KindHEIF && !isXMPFinding(f) {
+			continue
+		}
+		if p.keepsFinding(kind, f) {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+func isXMPFinding(f Finding) bool {
+	return f.Container == "XMP" || strings.HasSuffix(f.Container, "/XMP")
+}
@@ -0,0 +1,224 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"bleach/pkg/imgutil"
+)
+
+// ICCMode says what a preset does with embedded ICC profiles.
+type ICCMode string
+
+const (
+	ICCStrip ICCMode = "strip"
+	ICCKeep  ICCMode = "keep"
+	// ICCSRGB converts pixels to sRGB and drops the profile.
+	ICCSRGB ICCMode = "srgb"
+)
+
+// Preset bundles the clean options for one kind of publication.
+type Preset struct {
+	// Policy replaces the built-in strip rules; nil keeps them.
+	Policy *Policy
+	// MaxDimension scales images down so neither side exceeds it; 0 keeps
+	// their size.
+	MaxDimension int
+	// Format converts images to JPEG or PNG; KindUnknown keeps their format.
+	Format      imgutil.Kind
+	ICC         ICCMode
+	JPEGQuality int
+
+	ApplyOrientation bool
+	Verify           bool
+}
+
+// BuiltinPresets are the presets available without a presets file.
+var BuiltinPresets = map[string]Preset{
+	"web": {
+		MaxDimension:     2048,
+		Format:           imgutil.KindJPEG,
+		ICC:              ICCSRGB,
+		JPEGQuality:      85,
+		ApplyOrientation: true,
+	},
+	"social": {
+		MaxDimension:     1080,
+		Format:           imgutil.KindJPEG,
+		ICC:              ICCSRGB,
+		JPEGQuality:      80,
+		ApplyOrientation: true,
+	},
+	"evidence": {
+		ICC:    ICCKeep,
+		Verify: true,
+	},
+}
+
+// DefaultPresetsFile is where user presets are read from when no other
+// file is given: bleach/presets.yaml in the user's config directory.
+func DefaultPresetsFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bleach", "presets.yaml"), nil
+}
+
+// LoadPresets returns the built-in presets plus those in the presets file
+// at path, which replace built-ins of the same name. A missing file is only
+// an error when required is set.
+func LoadPresets(path string, required bool) (map[string]Preset, error) {
+	presets := map[string]Preset{}
+	for name, preset := range BuiltinPresets {
+		presets[name] = preset
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return presets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := ParsePresets(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, preset := range loaded {
+		presets[name] = preset
+	}
+	return presets, nil
+}
+
+type presetFile struct {
+	Presets map[string]struct {
+		Policy           interface{} `yaml:"policy"`
+		MaxDimension     int         `yaml:"max_dimension"`
+		Format           string      `yaml:"format"`
+		ICC              string      `yaml:"icc"`
+		JPEGQuality      int         `yaml:"jpeg_quality"`
+		ApplyOrientation bool        `yaml:"apply_orientation"`
+		Verify           bool        `yaml:"verify"`
+	} `yaml:"presets"`
+}
+
+// ParsePresets parses a YAML or JSON presets file: a "presets" map of
+// names to presets, whose policy takes the same rules as a policy file.
+func ParsePresets(data []byte) (map[string]Preset, error) {
+	var raw presetFile
+	if err := yaml.UnmarshalStrict(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid presets: %w", err)
+	}
+	presets := map[string]Preset{}
+	for name, r := range raw.Presets {
+		p := Preset{
+			MaxDimension:     r.MaxDimension,
+			ICC:              ICCMode(strings.ToLower(r.ICC)),
+			JPEGQuality:      r.JPEGQuality,
+			ApplyOrientation: r.ApplyOrientation,
+			Verify:           r.Verify,
+		}
+		if p.ICC == "" {
+			p.ICC = ICCStrip
+		}
+		switch strings.ToLower(r.Format) {
+		case "", "keep":
+		case "jpeg", "jpg":
+			p.Format = imgutil.KindJPEG
+		case "png":
+			p.Format = imgutil.KindPNG
+		default:
+			return nil, fmt.Errorf("preset %q: invalid format %q (want jpeg, png or keep)", name, r.Format)
+		}
+		if r.Policy != nil {
+			policy, err := yaml.Marshal(r.Policy)
+			if err != nil {
+				return nil, err
+			}
+			if p.Policy, err = ParsePolicy(policy); err != nil {
+				return nil, fmt.Errorf("preset %q: %w", name, err)
+			}
+		}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("preset %q: %w", name, err)
+		}
+		presets[name] = p
+	}
+	return presets, nil
+}
+
+func (p Preset) validate() error {
+	switch p.ICC {
+	case ICCStrip, ICCKeep, ICCSRGB:
+	default:
+		return fmt.Errorf("invalid icc %q (want strip, keep or srgb)", p.ICC)
+	}
+	if p.MaxDimension < 0 {
+		return fmt.Errorf("invalid max_dimension %d", p.MaxDimension)
+	}
+	if p.JPEGQuality < 0 || p.JPEGQuality > 100 {
+		return fmt.Errorf("invalid jpeg_quality %d: must be 1 to 100", p.JPEGQuality)
+	}
+	return nil
+}
+
+// PresetNames returns the names of presets, sorted.
+func PresetNames(presets map[string]Preset) []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reencodes reports whether the preset regenerates pixel data.
+func (p Preset) Reencodes() bool {
+	return p.MaxDimension > 0 || p.Format != imgutil.KindUnknown || p.ICC == ICCSRGB
+}
+
+// Apply folds the preset into opts. Options already set take precedence:
+// an explicit policy, and an explicit Reencode, whose formats, quality,
+// compression and noise are kept.
+func (p Preset) Apply(opts *Options) {
+	if opts.Policy == nil {
+		opts.Policy = p.Policy
+	}
+	if p.ICC == ICCKeep || p.ICC == ICCSRGB {
+		// sRGB conversion needs the profile to survive the strip.
+		opts.PreserveICC = true
+	}
+	opts.ApplyOrientation = opts.ApplyOrientation || p.ApplyOrientation
+	opts.Verify = opts.Verify || p.Verify
+
+	if !p.Reencodes() {
+		return
+	}
+	var r Reencode
+	if opts.Reencode != nil {
+		r = *opts.Reencode
+	} else {
+		r = Reencode{
+			Formats:        []imgutil.Kind{imgutil.KindJPEG, imgutil.KindPNG},
+			JPEGQuality:    p.JPEGQuality,
+			PNGCompression: png.DefaultCompression,
+		}
+		if r.JPEGQuality == 0 {
+			r.JPEGQuality = DefaultJPEGQuality
+		}
+		if p.Format != imgutil.KindUnknown {
+			r.Formats = append(r.Formats, imgutil.KindWebP, imgutil.KindTIFF)
+		}
+	}
+	r.MaxDimension = p.MaxDimension
+	r.Format = p.Format
+	r.ToSRGB = p.ICC == ICCSRGB
+	opts.Reencode = &r
+}
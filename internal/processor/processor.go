@@ -1,6 +1,7 @@
 package processor
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 
@@ -16,22 +18,19 @@ import (
 )
 
 func Run(ctx context.Context, root string, opts Options, updates chan<- ProgressUpdate) (Summary, []ScanReport, error) {
-	summary := Summary{}
-	var reports []ScanReport
-
 	info, err := os.Stat(root)
 	if err != nil {
-		return summary, nil, err
+		return Summary{}, nil, err
 	}
 
 	absRoot, err := filepath.Abs(root)
 	if err != nil {
-		return summary, nil, err
+		return Summary{}, nil, err
 	}
 
 	var outputAbs string
 	var outputInsideRoot bool
-	if opts.Mode == ModeClean && !opts.InPlace && opts.OutputDir != "" {
+	if opts.Mode != ModeScan && !opts.InPlace && opts.OutputDir != "" {
 		if absOut, outErr := filepath.Abs(opts.OutputDir); outErr == nil {
 			outputAbs = absOut
 			absRootClean := filepath.Clean(absRoot)
@@ -42,16 +41,80 @@ func Run(ctx context.Context, root string, opts Options, updates chan<- Progress
 		}
 	}
 
+	return run(ctx, opts, updates, func(sendJob func(Job)) error {
+		if !info.IsDir() {
+			sendJob(Job{
+				Path:    absRoot,
+				RelPath: filepath.Base(absRoot),
+				Display: filepath.Base(absRoot),
+			})
+			return nil
+		}
+
+		fsys := os.DirFS(absRoot)
+		return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, walkErr error) error {
+			if walkErr != nil {
+				return walkErr
+			}
+			if d.IsDir() {
+				if outputInsideRoot {
+					fullDir := filepath.Join(absRoot, path)
+					if isWithin(fullDir, outputAbs) {
+						return fs.SkipDir
+					}
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			sendJob(Job{
+				Path:    filepath.Join(absRoot, path),
+				RelPath: path,
+				Display: path,
+			})
+			return nil
+		})
+	})
+}
+
+// RunFiles is Run over a list of files rather than a tree. Each file's
+// RelPath is its base name, so it is meant for in-place work.
+func RunFiles(ctx context.Context, paths []string, opts Options, updates chan<- ProgressUpdate) (Summary, []ScanReport, error) {
+	return run(ctx, opts, updates, func(sendJob func(Job)) error {
+		for _, path := range paths {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			sendJob(Job{Path: abs, RelPath: filepath.Base(abs), Display: path})
+		}
+		return nil
+	})
+}
+
+// run feeds the jobs produce sends to the worker pool and collects the
+// results.
+func run(ctx context.Context, opts Options, updates chan<- ProgressUpdate, produce func(sendJob func(Job)) error) (Summary, []ScanReport, error) {
+	summary := Summary{}
+	var reports []ScanReport
+
 	jobs := make(chan Job)
 	results := make(chan Result)
 
+	var numbering *sequence
+	if opts.Rename.numbers() {
+		numbering = newSequence()
+	}
+
 	workers := runtime.NumCPU()
 	var wg sync.WaitGroup
 	wg.Add(workers)
 	for i := 0; i < workers; i++ {
 		go func() {
 			defer wg.Done()
-			worker(ctx, jobs, results, opts, updates)
+			worker(ctx, jobs, results, opts, updates, numbering)
 		}()
 	}
 
@@ -59,6 +122,10 @@ func Run(ctx context.Context, root string, opts Options, updates chan<- Progress
 	go func() {
 		defer close(collectorDone)
 		for res := range results {
+			if res.Skipped {
+				summary.Unprocessed = append(summary.Unprocessed, res.Display)
+				continue
+			}
 			if res.Supported {
 				summary.Total++
 				summary.Processed++
@@ -68,10 +135,15 @@ func Run(ctx context.Context, root string, opts Options, updates chan<- Progress
 			}
 			if res.Err != nil {
 				summary.Errors++
+				var fileErr *FileError
+				if errors.As(res.Err, &fileErr) {
+					summary.Failures = append(summary.Failures, *fileErr)
+				}
 				if updates != nil {
 					updates <- ProgressUpdate{ErrorDelta: 1}
 				}
 			}
+			summary.Warnings = append(summary.Warnings, res.Warnings...)
 			if res.Leaks > 0 {
 				summary.Leaks += res.Leaks
 				if updates != nil {
@@ -84,8 +156,11 @@ func Run(ctx context.Context, root string, opts Options, updates chan<- Progress
 					updates <- ProgressUpdate{BytesSavedDelta: res.BytesSaved}
 				}
 			}
-			if len(res.Report) > 0 || len(res.Insights) > 0 || res.Supported {
-				reports = append(reports, ScanReport{Path: res.Display, Details: res.Report, Insights: res.Insights})
+			if (res.Supported || res.Err != nil) && opts.Results != nil {
+				opts.Results <- res
+			}
+			if len(res.Findings) > 0 || len(res.Insights) > 0 || res.Supported {
+				reports = append(reports, ScanReport{Path: res.Display, Findings: res.Findings, Insights: res.Insights, Err: res.Err})
 			}
 		}
 	}()
@@ -94,60 +169,14 @@ func Run(ctx context.Context, root string, opts Options, updates chan<- Progress
 	go func() {
 		defer close(jobs)
 
-		sendJob := func(job Job) error {
-			if ctx == nil {
-				jobs <- job
-				return nil
-			}
-			select {
-			case jobs <- job:
-				return nil
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
-
-		if !info.IsDir() {
-			job := Job{
-				Path:    absRoot,
-				RelPath: filepath.Base(absRoot),
-				Display: filepath.Base(absRoot),
-			}
-			producerErr <- sendJob(job)
-			return
-		}
-
-		fsys := os.DirFS(absRoot)
-		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, walkErr error) error {
-			if walkErr != nil {
-				return walkErr
-			}
-			if d.IsDir() {
-				if outputInsideRoot {
-					fullDir := filepath.Join(absRoot, path)
-					if isWithin(fullDir, outputAbs) {
-						return fs.SkipDir
-					}
-				}
-				return nil
-			}
-			if !d.Type().IsRegular() {
-				return nil
-			}
-
-			fullPath := filepath.Join(absRoot, path)
-			display := path
-
-			if err := sendJob(Job{
-				Path:    fullPath,
-				RelPath: path,
-				Display: display,
-			}); err != nil {
-				return err
-			}
-			return nil
+		// Jobs keep flowing after cancellation so that workers can report
+		// every remaining file as unprocessed.
+		index := 0
+		producerErr <- produce(func(job Job) {
+			job.index = index
+			index++
+			jobs <- job
 		})
-		producerErr <- err
 	}()
 
 	wg.Wait()
@@ -159,74 +188,119 @@ func Run(ctx context.Context, root string, opts Options, updates chan<- Progress
 	}
 
 	if ctx != nil {
-		if err := ctx.Err(); err != nil && !errors.Is(err, context.Canceled) {
-			return summary, reports, err
+		if err := ctx.Err(); err != nil {
+			summary.Canceled = true
+			sort.Strings(summary.Unprocessed)
+			if !errors.Is(err, context.Canceled) {
+				return summary, reports, err
+			}
 		}
 	}
 
 	return summary, reports, nil
 }
 
-func worker(ctx context.Context, jobs <-chan Job, results chan<- Result, opts Options, updates chan<- ProgressUpdate) {
+// worker processes jobs until the channel closes. numbering, when not nil,
+// gives every job that turns out to be an image its {seq} number; each job
+// must be settled with it exactly once.
+func worker(ctx context.Context, jobs <-chan Job, results chan<- Result, opts Options, updates chan<- ProgressUpdate, numbering *sequence) {
 	for job := range jobs {
-		if ctx != nil {
-			if err := ctx.Err(); err != nil {
-				return
+		res := Result{Path: job.Path, RelPath: job.RelPath, Display: job.Display}
+		// A journal restore leaves files it has no record of alone.
+		if opts.Mode == ModeRestore && opts.Journal != nil && !opts.Journal.has(job.Path) {
+			numbering.settle(job.index, false)
+			continue
+		}
+		if ctx != nil && ctx.Err() != nil {
+			numbering.settle(job.index, false)
+			// Files the normal path would pass over are not listed as
+			// unprocessed either.
+			if kind, err := sniffPath(job.Path); err == nil && kind == imgutil.KindUnknown {
+				continue
 			}
+			res.Skipped = true
+			results <- res
+			continue
 		}
 
-		res := Result{Path: job.Path, RelPath: job.RelPath, Display: job.Display}
-
 		file, err := os.Open(job.Path)
 		if err != nil {
-			res.Err = err
+			numbering.settle(job.index, false)
+			res.Err = newFileError(job.Display, StageOpen, err)
 			results <- res
 			continue
 		}
 
 		kind, err := imgutil.SniffReader(file)
 		if err != nil {
+			numbering.settle(job.index, false)
 			_ = file.Close()
-			res.Err = err
+			res.Err = newFileError(job.Display, StageSniff, err)
 			results <- res
 			continue
 		}
 
+		// Only images take a number, so the sequence has no gaps for
+		// sidecars and other files clean skips.
+		job.Seq = numbering.settle(job.index, kind != imgutil.KindUnknown)
 		if kind == imgutil.KindUnknown {
 			_ = file.Close()
 			continue
 		}
 
 		res.Supported = true
+		res.Kind = kind
 		if updates != nil {
 			updates <- ProgressUpdate{TotalDelta: 1}
 		}
 
 		switch opts.Mode {
 		case ModeScan:
-			report, err := scanFile(file, kind)
+			findings, err := scanFile(file, kind)
 			_ = file.Close()
+			if err == nil {
+				var attrs []Finding
+				attrs, err = xattrFindings(job.Path, kind.String())
+				findings = append(findings, attrs...)
+			}
+			for _, f := range filenameFindings(job.RelPath) {
+				f.Format = kind.String()
+				findings = append(findings, f)
+			}
 			if err != nil {
-				res.Err = err
+				res.Err = newFileError(job.Display, StageScan, err)
 				results <- res
 				continue
 			}
-			res.Report = report
+			res.Findings = findings
+			res.Leaks = countFindingLeaks(findings)
 			if opts.Insights {
-				res.Insights = buildInsights(kind, report)
+				res.Insights = buildInsights(kind, findings)
 			}
 		case ModeClean:
-			leaks, err := countLeaks(file, kind)
+			findings, err := scanFile(file, kind)
 			if err != nil {
 				_ = file.Close()
-				res.Err = err
+				res.Err = newFileError(job.Display, StageScan, err)
 				results <- res
 				continue
 			}
-			res.Leaks = leaks
+			res.Findings = findings
+			res.Leaks = countFindingLeaks(opts.stripPolicy().strippedFindings(kind, findings))
+			if !opts.PreserveXattrs {
+				attrs, err := xattrFindings(job.Path, kind.String())
+				if err != nil {
+					_ = file.Close()
+					res.Err = newFileError(job.Display, StageScan, err)
+					results <- res
+					continue
+				}
+				res.Findings = append(res.Findings, attrs...)
+				res.Leaks += countFindingLeaks(attrs)
+			}
 			if _, err := file.Seek(0, io.SeekStart); err != nil {
 				_ = file.Close()
-				res.Err = err
+				res.Err = newFileError(job.Display, StageStrip, err)
 				results <- res
 				continue
 			}
@@ -234,14 +308,40 @@ func worker(ctx context.Context, jobs <-chan Job, results chan<- Result, opts Op
 			saved, err := cleanFile(file, job, kind, opts)
 			_ = file.Close()
 			if err != nil {
-				res.Err = err
+				res.Err = fileErrorFor(job.Display, StageStrip, err)
 				results <- res
 				continue
 			}
 			res.BytesSaved = saved
+			if outKind := opts.cleanedKind(kind); len(opts.Stamp) > 0 && !canStamp(outKind) {
+				err := fmt.Errorf("%w metadata stamping for %s; file left unstamped", errUnsupported, outKind)
+				res.Warnings = append(res.Warnings, *newFileError(job.Display, StageStamp, err))
+			}
+		case ModeRestore:
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				_ = file.Close()
+				res.Err = newFileError(job.Display, StageRestore, err)
+				results <- res
+				continue
+			}
+			err := restoreFile(file, job, kind, opts)
+			_ = file.Close()
+			if err != nil {
+				res.Err = fileErrorFor(job.Display, StageRestore, err)
+				results <- res
+				continue
+			}
+		case ModeVerify:
+			err := verifyFile(file, job, kind, opts)
+			_ = file.Close()
+			if err != nil {
+				res.Err = fileErrorFor(job.Display, StageVerify, err)
+				results <- res
+				continue
+			}
 		default:
 			_ = file.Close()
-			res.Err = fmt.Errorf("unknown mode")
+			res.Err = newFileError(job.Display, StageScan, fmt.Errorf("unknown mode"))
 			results <- res
 			continue
 		}
@@ -250,179 +350,336 @@ func worker(ctx context.Context, jobs <-chan Job, results chan<- Result, opts Op
 	}
 }
 
-func scanFile(file *os.File, kind imgutil.Kind) ([]ScanDetail, error) {
+func sniffPath(path string) (imgutil.Kind, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return imgutil.KindUnknown, err
+	}
+	defer file.Close()
+	return imgutil.SniffReader(file)
+}
+
+func scanFile(file *os.File, kind imgutil.Kind) ([]Finding, error) {
+	var findings []Finding
+	var err error
 	switch kind {
-	case imgutil.KindJPEG, imgutil.KindTIFF:
-		analysis, err := analyzeExif(file)
-		if err != nil {
-			return nil, err
-		}
-		return detailsFromExif(analysis), nil
+	case imgutil.KindJPEG:
+		findings, err = scanJPEGMetadata(file)
+	case imgutil.KindTIFF:
+		findings, err = analyzeExif(file)
 	case imgutil.KindPNG:
-		analysis, err := scanPNGMetadata(file)
-		if err != nil {
-			return nil, err
-		}
-		return detailsFromPNG(analysis), nil
+		findings, err = scanPNGMetadata(file)
+	case imgutil.KindWebP:
+		findings, err = scanWebPMetadata(file)
+	case imgutil.KindHEIF:
+		findings, err = scanHEIFMetadata(file)
 	default:
 		return nil, nil
 	}
-}
+	if err != nil {
+		return nil, err
+	}
 
-func detailsFromExif(analysis ExifAnalysis) []ScanDetail {
-	details := []ScanDetail{}
-	if len(analysis.GPSValues) > 0 {
-		details = append(details, ScanDetail{Category: "GPS", Values: analysis.GPSValues})
+	for i := range findings {
+		findings[i].Format = kind.String()
 	}
-	if len(analysis.ModelValues) > 0 {
-		details = append(details, ScanDetail{Category: "Device Model", Values: analysis.ModelValues})
+	return findings, nil
+}
+
+func cleanFile(file *os.File, job Job, kind imgutil.Kind, opts Options) (int64, error) {
+	srcInfo, err := file.Stat()
+	if err != nil {
+		return 0, withStage(StageOpen, err)
 	}
-	if len(analysis.TimestampValues) > 0 {
-		details = append(details, ScanDetail{Category: "Timestamp", Values: analysis.TimestampValues})
+
+	destPath, destDir, err := resolveDestination(job, opts)
+	if err != nil {
+		return 0, withStage(StageReplace, err)
 	}
-	if len(analysis.SerialValues) > 0 {
-		details = append(details, ScanDetail{Category: "Serial Number", Values: analysis.SerialValues})
+
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return 0, withStage(StageReplace, err)
 	}
-	return details
-}
 
-func detailsFromPNG(analysis PngAnalysis) []ScanDetail {
-	details := []ScanDetail{}
-	if len(analysis.GPSValues) > 0 {
-		details = append(details, ScanDetail{Category: "GPS", Values: analysis.GPSValues})
+	tmpFile, err := os.CreateTemp(destDir, "bleach-*.tmp")
+	if err != nil {
+		return 0, withStage(StageReplace, err)
 	}
-	if len(analysis.ModelValues) > 0 {
-		details = append(details, ScanDetail{Category: "Device Model", Values: analysis.ModelValues})
+	defer os.Remove(tmpFile.Name())
+
+	if err := tmpFile.Chmod(srcInfo.Mode()); err != nil {
+		_ = tmpFile.Close()
+		return 0, withStage(StageReplace, err)
+	}
+
+	policy := opts.stripPolicy()
+	var src io.Reader = file
+	var original []byte
+	keepOriginal := opts.Vault != nil || opts.Journal != nil
+	captureTimes := opts.Times != nil && opts.Times.Mode == TimesCapture
+	if opts.ApplyOrientation || keepOriginal || opts.Verify || captureTimes {
+		if original, err = io.ReadAll(file); err != nil {
+			_ = tmpFile.Close()
+			return 0, withStage(StageOpen, err)
+		}
+		src = bytes.NewReader(original)
+	}
+	// reference is what the cleaned file's pixels must match.
+	reference := original
+	if opts.ApplyOrientation {
+		policy = orientationPolicy(kind, policy)
+		if kind == imgutil.KindJPEG || kind == imgutil.KindPNG {
+			data, err := orientFile(kind, original)
+			if err != nil {
+				_ = tmpFile.Close()
+				return 0, err
+			}
+			src = bytes.NewReader(data)
+			reference = data
+		}
 	}
-	if len(analysis.TimestampValues) > 0 {
-		details = append(details, ScanDetail{Category: "Timestamp", Values: analysis.TimestampValues})
+
+	// Re-encoded, stamped, verified, vaulted and journaled files are
+	// stripped into memory first, since re-encoding and stamping edit the
+	// stripped output and the rest compare it with the original.
+	reencode := opts.Reencode.applies(kind)
+	var dst io.Writer = tmpFile
+	var stripped bytes.Buffer
+	buffered := reencode || len(opts.Stamp) > 0 || keepOriginal || opts.Verify || opts.Rename != nil
+	if buffered {
+		dst = &stripped
 	}
-	return details
-}
 
-func countLeaks(file *os.File, kind imgutil.Kind) (int, error) {
+	var stripErr error
 	switch kind {
-	case imgutil.KindJPEG, imgutil.KindTIFF:
-		analysis, err := analyzeExif(file)
-		if err != nil {
-			return 0, err
-		}
-		return countExifLeaks(analysis), nil
+	case imgutil.KindJPEG:
+		stripErr = stripJPEG(src, dst, policy)
 	case imgutil.KindPNG:
-		analysis, err := scanPNGMetadata(file)
-		if err != nil {
-			return 0, err
-		}
-		return countPNGLeaks(analysis), nil
+		stripErr = stripPNG(src, dst, policy)
+	case imgutil.KindTIFF:
+		stripErr = stripTIFF(src, dst, policy)
+	case imgutil.KindWebP:
+		stripErr = stripWebP(src, dst, policy)
+	case imgutil.KindHEIF:
+		stripErr = stripHEIF(src, dst, policy)
 	default:
-		return 0, nil
+		stripErr = fmt.Errorf("%w type", errUnsupported)
 	}
-}
 
-func countExifLeaks(analysis ExifAnalysis) int {
-	total := len(analysis.GPSValues) + len(analysis.ModelValues) + len(analysis.TimestampValues) + len(analysis.SerialValues)
-	if total > 0 {
-		return total
-	}
-	if analysis.HasGPS {
-		total++
+	if stripErr != nil {
+		_ = tmpFile.Close()
+		return 0, stripErr
 	}
-	if analysis.HasModel {
-		total++
+
+	var renamed string
+	if buffered {
+		data := stripped.Bytes()
+		// outKind is the cleaned file's format, which re-encoding may
+		// change.
+		outKind := kind
+		if reencode {
+			if outKind = opts.Reencode.target(kind); outKind != kind {
+				if opts.InPlace {
+					_ = tmpFile.Close()
+					return 0, withStage(StageReencode, fmt.Errorf("%w in-place conversion from %s to %s", errUnsupported, kind, outKind))
+				}
+				destPath = withKindExtension(destPath, outKind)
+			}
+			if data, err = opts.Reencode.apply(kind, data); err != nil {
+				_ = tmpFile.Close()
+				return 0, withStage(StageReencode, err)
+			}
+			// New pixels cannot match the original's, so verification
+			// only checks that they decode.
+			reference = nil
+		}
+		if len(opts.Stamp) > 0 && canStamp(outKind) {
+			if data, err = stampFile(outKind, data, opts.Stamp); err != nil {
+				_ = tmpFile.Close()
+				return 0, err
+			}
+		}
+		if opts.Rename != nil {
+			renamed = opts.Rename.name(job, outKind, data)
+			destPath = filepath.Join(opts.OutputDir, renamed)
+		}
+		if opts.Verify {
+			if err := verifyClean(outKind, reference, data, policy); err != nil {
+				_ = tmpFile.Close()
+				return 0, withStage(StageVerify, err)
+			}
+		}
+		if opts.Vault != nil {
+			if err := opts.Vault.add(outKind, job.RelPath, original, data); err != nil {
+				_ = tmpFile.Close()
+				return 0, withStage(StageVault, err)
+			}
+		}
+		if opts.Journal != nil {
+			if err := opts.Journal.add(outKind, job.Path, original, data); err != nil {
+				_ = tmpFile.Close()
+				return 0, withStage(StageJournal, err)
+			}
+		}
+		if _, err := tmpFile.Write(data); err != nil {
+			_ = tmpFile.Close()
+			return 0, withStage(StageReplace, err)
+		}
 	}
-	if analysis.HasTimestamp {
-		total++
+
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return 0, withStage(StageReplace, err)
 	}
-	if analysis.SerialCount > 0 {
-		total++
+	if err := tmpFile.Close(); err != nil {
+		return 0, withStage(StageReplace, err)
 	}
-	return total
-}
-
-func countPNGLeaks(analysis PngAnalysis) int {
-	total := len(analysis.GPSValues) + len(analysis.ModelValues) + len(analysis.TimestampValues)
-	if total > 0 {
-		return total
+	if opts.PreserveXattrs {
+		if err := copyXattrs(job.Path, tmpFile.Name()); err != nil {
+			return 0, withStage(StageReplace, err)
+		}
 	}
-	if analysis.HasGPS {
-		total++
+	if opts.Times != nil {
+		var findings []Finding
+		if captureTimes {
+			// A file that no longer scans has no capture time to copy.
+			findings, _ = scanBytes(kind, original)
+		}
+		if atime, mtime, ok := opts.Times.times(srcInfo, findings); ok {
+			if err := os.Chtimes(tmpFile.Name(), atime, mtime); err != nil {
+				return 0, withStage(StageReplace, err)
+			}
+		}
 	}
-	if analysis.HasModel {
-		total++
+
+	if err := replaceFile(tmpFile.Name(), destPath); err != nil {
+		return 0, withStage(StageReplace, err)
 	}
-	if analysis.HasTimestamp {
-		total++
+	if opts.Rename != nil {
+		opts.Rename.record(job.RelPath, renamed)
 	}
-	return total
-}
 
-func cleanFile(file *os.File, job Job, kind imgutil.Kind, opts Options) (int64, error) {
-	if kind == imgutil.KindTIFF {
-		return 0, fmt.Errorf("TIFF stripping not implemented")
+	outInfo, err := os.Stat(destPath)
+	if err != nil {
+		return 0, withStage(StageReplace, err)
 	}
 
+	return srcInfo.Size() - outInfo.Size(), nil
+}
+
+// restoreFile rebuilds the original of a cleaned file from opts.Journal or
+// opts.Vault and writes it like cleanFile writes its output.
+func restoreFile(file *os.File, job Job, kind imgutil.Kind, opts Options) error {
 	srcInfo, err := file.Stat()
 	if err != nil {
-		return 0, err
+		return withStage(StageOpen, err)
+	}
+	cleaned, err := io.ReadAll(file)
+	if err != nil {
+		return withStage(StageOpen, err)
+	}
+	var original []byte
+	if opts.Journal != nil {
+		original, err = opts.Journal.restore(kind, job.Path, cleaned)
+	} else {
+		original, err = opts.Vault.restore(kind, job.RelPath, cleaned)
+	}
+	if err != nil {
+		return err
 	}
 
 	destPath, destDir, err := resolveDestination(job, opts)
 	if err != nil {
-		return 0, err
+		return withStage(StageReplace, err)
 	}
-
 	if err := os.MkdirAll(destDir, 0o755); err != nil {
-		return 0, err
+		return withStage(StageReplace, err)
 	}
-
 	tmpFile, err := os.CreateTemp(destDir, "bleach-*.tmp")
 	if err != nil {
-		return 0, err
+		return withStage(StageReplace, err)
 	}
 	defer os.Remove(tmpFile.Name())
 
 	if err := tmpFile.Chmod(srcInfo.Mode()); err != nil {
 		_ = tmpFile.Close()
-		return 0, err
+		return withStage(StageReplace, err)
 	}
-
-	var stripErr error
-	switch kind {
-	case imgutil.KindJPEG:
-		stripErr = stripJPEG(file, tmpFile, opts.PreserveICC)
-	case imgutil.KindPNG:
-		stripErr = stripPNG(file, tmpFile, opts.PreserveICC)
-	default:
-		stripErr = fmt.Errorf("unsupported type")
-	}
-
-	if stripErr != nil {
+	if _, err := tmpFile.Write(original); err != nil {
 		_ = tmpFile.Close()
-		return 0, stripErr
+		return withStage(StageReplace, err)
 	}
-
 	if err := tmpFile.Sync(); err != nil {
 		_ = tmpFile.Close()
-		return 0, err
+		return withStage(StageReplace, err)
 	}
 	if err := tmpFile.Close(); err != nil {
-		return 0, err
+		return withStage(StageReplace, err)
 	}
+	return withStage(StageReplace, replaceFile(tmpFile.Name(), destPath))
+}
 
-	if err := replaceFile(tmpFile.Name(), destPath); err != nil {
-		return 0, err
+// verifyFile checks the cleaned counterpart of an original file: the file
+// at opts.OutputDir itself when that is a file, or the file at the same
+// relative path under it. The options are those of the clean: re-encoded
+// files are looked up under their new extension and only checked to
+// decode, and opts.Rename, read from the clean's mapping, finds renamed
+// files.
+func verifyFile(file *os.File, job Job, kind imgutil.Kind, opts Options) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return withStage(StageOpen, err)
+	}
+	original, err := io.ReadAll(file)
+	if err != nil {
+		return withStage(StageOpen, err)
 	}
 
-	outInfo, err := os.Stat(destPath)
+	outKind := opts.cleanedKind(kind)
+	reference := original
+	if opts.Reencode.applies(kind) {
+		reference = nil
+	}
+
+	cleanedPath := opts.OutputDir
+	if info, err := os.Stat(cleanedPath); err != nil || info.IsDir() {
+		rel := withKindExtension(job.RelPath, outKind)
+		if outKind == kind {
+			rel = job.RelPath
+		}
+		if opts.Rename != nil {
+			renamed, ok := opts.Rename.renamed(job.RelPath)
+			if !ok {
+				return fmt.Errorf("%w: not in the rename mapping", errVerify)
+			}
+			rel = renamed
+		}
+		cleanedPath = filepath.Join(opts.OutputDir, rel)
+	}
+	cleaned, err := os.ReadFile(cleanedPath)
 	if err != nil {
-		return 0, err
+		return withStage(StageOpen, err)
+	}
+	if cleanedKind, _ := imgutil.DetectHeader(cleaned); cleanedKind != outKind {
+		return fmt.Errorf("%w: cleaned file is %s, expected %s", errVerify, cleanedKind, outKind)
 	}
 
-	return srcInfo.Size() - outInfo.Size(), nil
+	policy := opts.stripPolicy()
+	if opts.ApplyOrientation {
+		policy = orientationPolicy(kind, policy)
+		if reference != nil && (kind == imgutil.KindJPEG || kind == imgutil.KindPNG) {
+			if reference, err = orientFile(kind, original); err != nil {
+				return err
+			}
+		}
+	}
+	return verifyClean(outKind, reference, cleaned, policy)
 }
 
 func resolveDestination(job Job, opts Options) (string, string, error) {
 	if opts.InPlace {
+		if opts.Rename != nil {
+			return "", "", fmt.Errorf("renaming needs an output directory")
+		}
 		destDir := filepath.Dir(job.Path)
 		return job.Path, destDir, nil
 	}
@@ -431,6 +688,10 @@ func resolveDestination(job Job, opts Options) (string, string, error) {
 	}
 
 	destPath := filepath.Join(opts.OutputDir, job.RelPath)
+	if opts.Rename != nil && opts.Rename.Flatten {
+		// cleanFile names the file; only the directory matters here.
+		destPath = filepath.Join(opts.OutputDir, filepath.Base(job.RelPath))
+	}
 	if filepath.Clean(destPath) == filepath.Clean(job.Path) {
 		return "", "", fmt.Errorf("output path resolves to input path; use --inplace or a different --output")
 	}
@@ -0,0 +1,364 @@
+package processor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	"bleach/pkg/imgutil"
+)
+
+// Reencode regenerates the pixel data of cleaned files with bleach's own
+// encoder settings, so quantization and Huffman tables, PNG filters and
+// zlib parameters no longer point to the camera or app that wrote them.
+type Reencode struct {
+	// Formats lists the formats to re-encode: JPEG and PNG, plus WebP and
+	// TIFF when Format converts them.
+	Formats []imgutil.Kind
+	// JPEGQuality is the quality of re-encoded JPEGs, 1 to 100.
+	JPEGQuality int
+	// PNGCompression is the zlib level of re-encoded PNGs.
+	PNGCompression png.CompressionLevel
+	// Noise adds up to ±Noise levels of random noise to every color sample,
+	// to frustrate sensor noise (PRNU) matching.
+	Noise int
+	// MaxDimension scales images down so neither side exceeds it; 0 keeps
+	// their size.
+	MaxDimension int
+	// Format converts images to JPEG or PNG; KindUnknown keeps their format.
+	// Converted files carry no metadata but their ICC profile, when the
+	// strip kept it.
+	Format imgutil.Kind
+	// ToSRGB converts images with a matrix/TRC ICC profile to sRGB and
+	// drops the profile.
+	ToSRGB bool
+}
+
+const (
+	DefaultJPEGQuality = 90
+	MaxReencodeNoise   = 16
+)
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// ParseReencodeFormats parses format names for Reencode.Formats; "all"
+// selects every format that can be re-encoded.
+func ParseReencodeFormats(names []string) ([]imgutil.Kind, error) {
+	var kinds []imgutil.Kind
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "all":
+			kinds = append(kinds, imgutil.KindJPEG, imgutil.KindPNG)
+		case "jpeg", "jpg":
+			kinds = append(kinds, imgutil.KindJPEG)
+		case "png":
+			kinds = append(kinds, imgutil.KindPNG)
+		default:
+			return nil, fmt.Errorf("invalid re-encode format %q (want jpeg, png or all)", name)
+		}
+	}
+	return kinds, nil
+}
+
+// ParsePNGCompression parses "default", "none", "fast" or "best".
+func ParsePNGCompression(s string) (png.CompressionLevel, error) {
+	level, ok := pngCompressionLevels[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid PNG compression %q (want default, none, fast or best)", s)
+	}
+	return level, nil
+}
+
+// Validate checks the encoder settings.
+func (r *Reencode) Validate() error {
+	if r.JPEGQuality < 1 || r.JPEGQuality > 100 {
+		return fmt.Errorf("invalid JPEG quality %d: must be 1 to 100", r.JPEGQuality)
+	}
+	if r.Noise < 0 || r.Noise > MaxReencodeNoise {
+		return fmt.Errorf("invalid noise %d: must be 0 to %d", r.Noise, MaxReencodeNoise)
+	}
+	if r.MaxDimension < 0 {
+		return fmt.Errorf("invalid max dimension %d", r.MaxDimension)
+	}
+	if r.Format != imgutil.KindUnknown && r.Format != imgutil.KindJPEG && r.Format != imgutil.KindPNG {
+		return fmt.Errorf("cannot convert images to %s (want jpeg or png)", r.Format)
+	}
+	for _, kind := range r.Formats {
+		if kind != imgutil.KindJPEG && kind != imgutil.KindPNG && r.Format == imgutil.KindUnknown {
+			return fmt.Errorf("%s images can only be re-encoded when converted to jpeg or png", kind)
+		}
+	}
+	return nil
+}
+
+func (r *Reencode) applies(kind imgutil.Kind) bool {
+	return r != nil && slices.Contains(r.Formats, kind)
+}
+
+// target is the format kind is re-encoded to.
+func (r *Reencode) target(kind imgutil.Kind) imgutil.Kind {
+	if r.Format != imgutil.KindUnknown {
+		return r.Format
+	}
+	return kind
+}
+
+// apply re-encodes a stripped file. Files that keep their format carry
+// over the metadata the strip kept; converted files only their ICC profile.
+func (r *Reencode) apply(kind imgutil.Kind, data []byte) ([]byte, error) {
+	if kind == imgutil.KindPNG {
+		chunks, _, err := splitPNGChunks(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			if chunk.name == "acTL" {
+				return nil, fmt.Errorf("%w animated PNG re-encoding", errUnsupported)
+			}
+		}
+	}
+	decode := imageDecoders[kind]
+	if decode == nil {
+		return nil, fmt.Errorf("%w re-encoding for %s", errUnsupported, kind)
+	}
+	img, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	target := r.target(kind)
+	var profile []byte
+	if r.ToSRGB || target != kind {
+		if profile, err = extractICC(kind, data); err != nil {
+			return nil, err
+		}
+	}
+	if r.ToSRGB && profile != nil {
+		parsed, err := parseICCProfile(profile)
+		if err != nil {
+			return nil, fmt.Errorf("converting to sRGB: %w", err)
+		}
+		if !parsed.isSRGB() {
+			img = parsed.toSRGB(img)
+		}
+		profile = nil
+	}
+	img = r.noisy(r.resize(img))
+
+	switch {
+	case target != kind:
+		return r.encode(target, img, profile)
+	case kind == imgutil.KindJPEG:
+		return r.reencodeJPEG(data, img)
+	case kind == imgutil.KindPNG:
+		return r.reencodePNG(data, img)
+	}
+	return nil, fmt.Errorf("%w re-encoding for %s", errUnsupported, kind)
+}
+
+// reencodeJPEG encodes img and copies the APPn and COM segments of the
+// stripped file in front of it. MPF secondary images are dropped with their
+// index, and the Adobe segment, which describes the old color transform, is
+// not copied; neither is an ICC profile ToSRGB replaced.
+func (r *Reencode) reencodeJPEG(data []byte, decoded image.Image) ([]byte, error) {
+	img, err := parseJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, decoded, &jpeg.Options{Quality: r.JPEGQuality}); err != nil {
+		return nil, err
+	}
+
+	out := []byte{0xff, 0xd8}
+	_, _, hasMPF := findMPF(img)
+	for _, seg := range img.Segments {
+		isApp := seg.Marker >= 0xe0 && seg.Marker <= 0xef
+		switch {
+		case !isApp && seg.Marker != 0xfe:
+			continue
+		case seg.Marker == 0xe2 && hasPrefix(seg.Payload, jpegMPFHeader),
+			seg.Marker == 0xee && hasPrefix(seg.Payload, jpegAdobe),
+			seg.Marker == 0xe2 && hasPrefix(seg.Payload, jpegICCHeader) && r.ToSRGB:
+			continue
+		}
+		out = append(out, data[seg.Start:seg.End]...)
+	}
+	out = append(out, encoded.Bytes()[2:]...)
+	if !hasMPF {
+		out = append(out, data[img.End:]...)
+	}
+	return out, nil
+}
+
+// reencodePNG replaces the pixels of the stripped file with img. ToSRGB
+// drops the color space chunks along with the profile.
+func (r *Reencode) reencodePNG(data []byte, img image.Image) ([]byte, error) {
+	chunks, trailer, err := splitPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if r.ToSRGB {
+		chunks = slices.DeleteFunc(chunks, func(chunk pngChunk) bool {
+			return chunk.name == "iCCP" || chunk.name == "gAMA" || chunk.name == "cHRM"
+		})
+	}
+	return replacePNGPixels(chunks, trailer, img, &png.Encoder{CompressionLevel: r.PNGCompression}, false)
+}
+
+// encode writes img as a new JPEG or PNG file with nothing but profile, if
+// set. Transparent images are flattened onto white for JPEG.
+func (r *Reencode) encode(kind imgutil.Kind, img image.Image, profile []byte) ([]byte, error) {
+	var encoded bytes.Buffer
+	if kind == imgutil.KindPNG {
+		if err := (&png.Encoder{CompressionLevel: r.PNGCompression}).Encode(&encoded, img); err != nil {
+			return nil, err
+		}
+		if profile == nil {
+			return encoded.Bytes(), nil
+		}
+		chunks, trailer, err := splitPNGChunks(encoded.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(profile)
+		zw.Close()
+		iccp := pngChunk{name: "iCCP", data: append([]byte("ICC Profile\x00\x00"), compressed.Bytes()...)}
+		out := append([]byte{}, pngSignature...)
+		for _, chunk := range slices.Insert(chunks, 1, iccp) {
+			out = append(out, pngChunkBytes(chunk.name, chunk.data)...)
+		}
+		return append(out, trailer...), nil
+	}
+
+	if opaque, ok := img.(interface{ Opaque() bool }); !ok || !opaque.Opaque() {
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = flat
+	}
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: r.JPEGQuality}); err != nil {
+		return nil, err
+	}
+	if profile == nil {
+		return encoded.Bytes(), nil
+	}
+	segments, err := jpegICCSegments(profile)
+	if err != nil {
+		return nil, err
+	}
+	out := []byte{0xff, 0xd8}
+	for _, payload := range segments {
+		out = append(out, jpegSegmentBytes(0xe2, payload)...)
+	}
+	return append(out, encoded.Bytes()[2:]...), nil
+}
+
+// resize scales img down to fit MaxDimension, keeping its aspect ratio.
+func (r *Reencode) resize(img image.Image) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if r.MaxDimension == 0 || max(w, h) <= r.MaxDimension {
+		return img
+	}
+	scale := float64(r.MaxDimension) / float64(max(w, h))
+	w = max(1, int(math.Round(float64(w)*scale)))
+	h = max(1, int(math.Round(float64(h)*scale)))
+
+	var out draw.Image
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		out = image.NewRGBA64(image.Rect(0, 0, w, h))
+	default:
+		out = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	draw.CatmullRom.Scale(out, out.Bounds(), img, b, draw.Src, nil)
+	return out
+}
+
+// withKindExtension gives path the extension of kind, unless it already
+// has one of its usual extensions.
+func withKindExtension(path string, kind imgutil.Kind) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch kind {
+	case imgutil.KindJPEG:
+		if ext == ".jpg" || ext == ".jpeg" {
+			return path
+		}
+		return strings.TrimSuffix(path, filepath.Ext(path)) + ".jpg"
+	case imgutil.KindPNG:
+		if ext == ".png" {
+			return path
+		}
+		return strings.TrimSuffix(path, filepath.Ext(path)) + ".png"
+	}
+	return path
+}
+
+// noisy returns img with Noise applied, as 8-bit gray, 16-bit gray, 8-bit
+// or 16-bit NRGBA depending on the source, so the PNG encoder keeps its bit
+// depth. Alpha is left alone.
+func (r *Reencode) noisy(img image.Image) image.Image {
+	if r.Noise == 0 {
+		return img
+	}
+	b := img.Bounds()
+	var out draw.Image
+	var pix []byte
+	var channels, colors, depth int
+	switch img.(type) {
+	case *image.Gray:
+		m := image.NewGray(b)
+		out, pix, channels, colors, depth = m, m.Pix, 1, 1, 1
+	case *image.Gray16:
+		m := image.NewGray16(b)
+		out, pix, channels, colors, depth = m, m.Pix, 1, 1, 2
+	case *image.RGBA64, *image.NRGBA64:
+		m := image.NewNRGBA64(b)
+		out, pix, channels, colors, depth = m, m.Pix, 4, 3, 2
+	default:
+		m := image.NewNRGBA(b)
+		out, pix, channels, colors, depth = m, m.Pix, 4, 3, 1
+	}
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	scale := 1
+	if depth == 2 {
+		scale = 257
+	}
+	maxValue := 1<<(8*depth) - 1
+	for i := 0; i < len(pix); i += channels * depth {
+		for c := 0; c < colors; c++ {
+			at := i + c*depth
+			v := int(pix[at])
+			if depth == 2 {
+				v = v<<8 | int(pix[at+1])
+			}
+			v = min(max(v+(rand.IntN(2*r.Noise+1)-r.Noise)*scale, 0), maxValue)
+			if depth == 2 {
+				pix[at], pix[at+1] = byte(v>>8), byte(v)
+			} else {
+				pix[at] = byte(v)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,267 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bleach/pkg/imgutil"
+)
+
+// Rename gives cleaned files new names so that names like
+// IMG_20240103_155606.jpg do not leak the capture time, and records the
+// mapping back to the originals.
+type Rename struct {
+	// Template is the new base name without extension. {seq} is the file's
+	// number in walk order and {hash} the SHA-256 of the cleaned file;
+	// {seq:N} pads to N digits and {hash:N} keeps N hex digits.
+	Template string
+	// Flatten writes every file directly into the output directory instead
+	// of mirroring the input's directories.
+	Flatten bool
+
+	mu      sync.Mutex
+	entries []RenameEntry
+	// claimed holds the lowercased names given out so far.
+	claimed map[string]bool
+	// loaded maps originals to new names for a mapping read back by
+	// LoadRenameMapping.
+	loaded map[string]string
+}
+
+// RenameEntry maps an input path to its cleaned file, both relative and
+// slash separated.
+type RenameEntry struct {
+	Original string `json:"original"`
+	Renamed  string `json:"renamed"`
+}
+
+var renamePlaceholder = regexp.MustCompile(`\{(seq|hash)(?::(\d+))?\}`)
+
+// ParseRename parses "hash", "sequence" or "template:<pattern>".
+func ParseRename(spec string) (*Rename, error) {
+	mode, arg, _ := strings.Cut(spec, ":")
+	switch {
+	case spec == "hash":
+		return &Rename{Template: "{hash:16}"}, nil
+	case spec == "sequence":
+		return &Rename{Template: "{seq:6}"}, nil
+	case mode == "template":
+		r := &Rename{Template: arg}
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("invalid rename mode %q (want hash, sequence or template:<pattern>)", spec)
+}
+
+func (r *Rename) validate() error {
+	if strings.ContainsAny(r.Template, `/\`) || strings.Contains(r.Template, "..") {
+		return fmt.Errorf("invalid rename template %q: must be a file name", r.Template)
+	}
+	matches := renamePlaceholder.FindAllStringSubmatch(r.Template, -1)
+	if len(matches) == 0 {
+		return fmt.Errorf("invalid rename template %q: needs {seq} or {hash} to keep names unique", r.Template)
+	}
+	if rest := renamePlaceholder.ReplaceAllString(r.Template, ""); strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("invalid rename template %q: unknown placeholder (want {seq}, {seq:N}, {hash} or {hash:N})", r.Template)
+	}
+	for _, m := range matches {
+		if m[2] == "" {
+			continue
+		}
+		width, _ := strconv.Atoi(m[2])
+		if (m[1] == "seq" && (width < 1 || width > 12)) || (m[1] == "hash" && (width < 4 || width > 64)) {
+			return fmt.Errorf("invalid rename template %q: width out of range in %s", r.Template, m[0])
+		}
+	}
+	return nil
+}
+
+// numbers reports whether the template uses {seq}, which needs jobs
+// numbered in walk order.
+func (r *Rename) numbers() bool {
+	return r != nil && strings.Contains(r.Template, "{seq")
+}
+
+// sequence numbers images in walk order while workers sniff files in
+// parallel. Jobs are settled in walk order: each waits until every earlier
+// job has been settled, which holds as long as jobs are handed out in order
+// and every job is settled once.
+type sequence struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	next  int
+	count int
+}
+
+func newSequence() *sequence {
+	s := &sequence{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// settle records whether the job at index is an image and returns its
+// number, or 0 when it is not or s is nil.
+func (s *sequence) settle(index int, image bool) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.next != index {
+		s.cond.Wait()
+	}
+	s.next++
+	s.cond.Broadcast()
+	if !image {
+		return 0
+	}
+	s.count++
+	return s.count
+}
+
+// name returns the cleaned file's path relative to the output directory.
+func (r *Rename) name(job Job, kind imgutil.Kind, data []byte) string {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	base := renamePlaceholder.ReplaceAllStringFunc(r.Template, func(placeholder string) string {
+		m := renamePlaceholder.FindStringSubmatch(placeholder)
+		width, _ := strconv.Atoi(m[2])
+		if m[1] == "seq" {
+			return fmt.Sprintf("%0*d", width, job.Seq)
+		}
+		if width == 0 {
+			width = 16
+		}
+		return hash[:width]
+	})
+	name := withKindExtension(base+strings.ToLower(filepath.Ext(job.RelPath)), kind)
+	if !r.Flatten {
+		name = filepath.Join(filepath.Dir(job.RelPath), name)
+	}
+	return r.claim(name)
+}
+
+// claim reserves name for one file, adding -2, -3, ... before the extension
+// when an earlier file took it, as happens when two inputs clean to the same
+// bytes under a {hash} template.
+func (r *Rename) claim(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.claimed == nil {
+		r.claimed = map[string]bool{}
+	}
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	claimed := name
+	for n := 2; r.claimed[strings.ToLower(claimed)]; n++ {
+		claimed = fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+	r.claimed[strings.ToLower(claimed)] = true
+	return claimed
+}
+
+func (r *Rename) record(original, renamed string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, RenameEntry{Original: filepath.ToSlash(original), Renamed: filepath.ToSlash(renamed)})
+}
+
+// Mapping returns the files renamed so far, sorted by original path.
+func (r *Rename) Mapping() []RenameEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := append([]RenameEntry(nil), r.entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Original < entries[j].Original })
+	return entries
+}
+
+// LoadRenameMapping reads a mapping written by WriteMapping, so verify
+// can find the files a clean renamed.
+func LoadRenameMapping(path string) (*Rename, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []RenameEntry
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else {
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for i, row := range rows {
+			if len(row) != 2 {
+				return nil, fmt.Errorf("%s: line %d: want original,renamed", path, i+1)
+			}
+			if i == 0 && row[0] == "original" && row[1] == "renamed" {
+				continue
+			}
+			entries = append(entries, RenameEntry{Original: row[0], Renamed: row[1]})
+		}
+	}
+	loaded := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		loaded[entry.Original] = entry.Renamed
+	}
+	return &Rename{loaded: loaded}, nil
+}
+
+// renamed returns the new name of an input path in a loaded mapping.
+func (r *Rename) renamed(original string) (string, bool) {
+	renamed, ok := r.loaded[filepath.ToSlash(original)]
+	return filepath.FromSlash(renamed), ok
+}
+
+// WriteMapping writes Mapping to path as JSON when it ends in .json and as
+// CSV otherwise. The file is only readable by its owner, since it undoes
+// the anonymization.
+func (r *Rename) WriteMapping(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "bleach-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	entries := r.Mapping()
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		enc := json.NewEncoder(tmp)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(entries)
+	} else {
+		w := csv.NewWriter(tmp)
+		_ = w.Write([]string{"original", "renamed"})
+		for _, entry := range entries {
+			_ = w.Write([]string{entry.Original, entry.Renamed})
+		}
+		w.Flush()
+		err = w.Error()
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return replaceFile(tmp.Name(), path)
+}
@@ -2,67 +2,1970 @@ package processor
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"hash/crc32"
 	"image"
 	"image/color"
+	"image/jpeg"
 	"image/png"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	exif "github.com/dsoprea/go-exif/v3"
 
 	"bleach/pkg/imgutil"
 )
 
-func TestScanCleanJPEG(t *testing.T) {
+func TestScanCleanJPEG(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.jpg")
+
+	if err := buildJPEGWithExif(src); err != nil {
+		t.Fatalf("build JPEG: %v", err)
+	}
+
+	details := scanDetails(t, src, imgutil.KindJPEG)
+	if !hasDetail(details, "Device Model") || !hasDetail(details, "Timestamp") {
+		t.Fatalf("expected model and timestamp details, got: %#v", details)
+	}
+
+	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindJPEG); err != nil {
+		t.Fatalf("clean JPEG: %v", err)
+	}
+
+	cleaned := filepath.Join(dir, "out", "sample.jpg")
+	cleanDetails := scanDetails(t, cleaned, imgutil.KindJPEG)
+	if len(cleanDetails) != 0 {
+		t.Fatalf("expected no details after clean, got: %#v", cleanDetails)
+	}
+}
+
+func TestScanCleanPNG(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.png")
+
+	if err := buildPNGWithMetadata(src); err != nil {
+		t.Fatalf("build PNG: %v", err)
+	}
+
+	details := scanDetails(t, src, imgutil.KindPNG)
+	if !hasDetail(details, "Device Model") || !hasDetail(details, "Timestamp") {
+		t.Fatalf("expected model and timestamp details, got: %#v", details)
+	}
+
+	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindPNG); err != nil {
+		t.Fatalf("clean PNG: %v", err)
+	}
+
+	cleaned := filepath.Join(dir, "out", "sample.png")
+	cleanDetails := scanDetails(t, cleaned, imgutil.KindPNG)
+	if len(cleanDetails) != 0 {
+		t.Fatalf("expected no details after clean, got: %#v", cleanDetails)
+	}
+}
+
+func TestStripPNGRejectsOversizedChunk(t *testing.T) {
+	shift, err := ParseTimeRewrite("shift:1h")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	keepText, err := ParsePolicy([]byte("tags: {Author: keep}"))
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	keepText.Time = shift
+	for _, length := range []uint32{0x7FFFFFF0, 0x80000000} {
+		hostile := append([]byte{}, pngSignature...)
+		hostile = binary.BigEndian.AppendUint32(hostile, length)
+		hostile = append(hostile, "tEXtAuthor\x00x"...)
+		for _, policy := range []*Policy{nil, keepText} {
+			if err := stripPNG(bytes.NewReader(hostile), io.Discard, policy); err == nil {
+				t.Fatalf("length %#x: expected an oversized chunk to be rejected", length)
+			}
+		}
+	}
+}
+
+func TestScanCleanTIFF(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.tif")
+
+	if err := buildTIFFWithMetadata(src); err != nil {
+		t.Fatalf("build TIFF: %v", err)
+	}
+
+	details := scanDetails(t, src, imgutil.KindTIFF)
+	if !hasDetail(details, "Device Model") || !hasDetail(details, "Timestamp") {
+		t.Fatalf("expected model and timestamp details, got: %#v", details)
+	}
+
+	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindTIFF); err != nil {
+		t.Fatalf("clean TIFF: %v", err)
+	}
+
+	cleaned := filepath.Join(dir, "out", "sample.tif")
+	cleanDetails := scanDetails(t, cleaned, imgutil.KindTIFF)
+	if len(cleanDetails) != 0 {
+		t.Fatalf("expected no details after clean, got: %#v", cleanDetails)
+	}
+
+	data, err := os.ReadFile(cleaned)
+	if err != nil {
+		t.Fatalf("read cleaned: %v", err)
+	}
+	if !bytes.Contains(data, tiffTestPixels) {
+		t.Fatalf("expected strip data to survive clean")
+	}
+}
+
+func TestScanCleanWebP(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.webp")
+
+	if err := buildWebPWithMetadata(src); err != nil {
+		t.Fatalf("build WebP: %v", err)
+	}
+
+	details := scanDetails(t, src, imgutil.KindWebP)
+	if !hasDetail(details, "Device Model") || !hasDetail(details, "Timestamp") || !hasDetail(details, "GPS") {
+		t.Fatalf("expected model, timestamp and GPS details, got: %#v", details)
+	}
+
+	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindWebP); err != nil {
+		t.Fatalf("clean WebP: %v", err)
+	}
+
+	cleaned := filepath.Join(dir, "out", "sample.webp")
+	cleanDetails := scanDetails(t, cleaned, imgutil.KindWebP)
+	if len(cleanDetails) != 0 {
+		t.Fatalf("expected no details after clean, got: %#v", cleanDetails)
+	}
+
+	data, err := os.ReadFile(cleaned)
+	if err != nil {
+		t.Fatalf("read cleaned: %v", err)
+	}
+	if got := binary.LittleEndian.Uint32(data[4:8]); int(got) != len(data)-8 {
+		t.Fatalf("expected RIFF size %d, got %d", len(data)-8, got)
+	}
+	if flags := data[20]; flags&(webpFlagEXIF|webpFlagXMP|webpFlagICC) != 0 {
+		t.Fatalf("expected VP8X metadata flags cleared, got %#x", flags)
+	}
+
+	for _, riffSize := range []uint32{16, 0xFFFFFFFF} {
+		hostile := append([]byte("RIFF\x00\x00\x00\x00WEBPEXIF\xff\xff\xff\xff"), 1, 2, 3, 4)
+		binary.LittleEndian.PutUint32(hostile[4:8], riffSize)
+		if _, err := readWebPChunks(bytes.NewReader(hostile)); err == nil {
+			t.Fatalf("RIFF size %#x: expected an oversized chunk to be rejected", riffSize)
+		}
+		if err := stripWebP(bytes.NewReader(hostile), io.Discard, nil); err == nil {
+			t.Fatalf("RIFF size %#x: expected strip to reject an oversized chunk", riffSize)
+		}
+	}
+}
+
+func TestScanCleanHEIF(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.heic")
+
+	if err := buildHEIFWithMetadata(src); err != nil {
+		t.Fatalf("build HEIF: %v", err)
+	}
+
+	details := scanDetails(t, src, imgutil.KindHEIF)
+	if !hasDetail(details, "Device Model") || !hasDetail(details, "Timestamp") {
+		t.Fatalf("expected model and timestamp details, got: %#v", details)
+	}
+
+	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindHEIF); err != nil {
+		t.Fatalf("clean HEIF: %v", err)
+	}
+
+	cleaned := filepath.Join(dir, "out", "sample.heic")
+	cleanDetails := scanDetails(t, cleaned, imgutil.KindHEIF)
+	if len(cleanDetails) != 0 {
+		t.Fatalf("expected no details after clean, got: %#v", cleanDetails)
+	}
+
+	data, err := os.ReadFile(cleaned)
+	if err != nil {
+		t.Fatalf("read cleaned: %v", err)
+	}
+	heif, err := parseHEIF(data)
+	if err != nil {
+		t.Fatalf("parse cleaned: %v", err)
+	}
+	if len(heif.items) != 1 || heif.items[0].Type != "hvc1" {
+		t.Fatalf("expected only the coded image item, got: %#v", heif.items)
+	}
+	coded, err := heif.itemData(1)
+	if err != nil {
+		t.Fatalf("read coded item: %v", err)
+	}
+	if !bytes.Equal(coded, heifTestCoded) {
+		t.Fatalf("coded image data changed: %q", coded)
+	}
+}
+
+func TestScanCleanMPO(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.jpg")
+
+	if err := buildMPOWithExif(src); err != nil {
+		t.Fatalf("build MPO: %v", err)
+	}
+
+	details := scanDetails(t, src, imgutil.KindJPEG)
+	if !hasDetail(details, "Embedded Image") || !hasDetail(details, "Device Model") {
+		t.Fatalf("expected embedded image and model details, got: %#v", details)
+	}
+
+	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindJPEG); err != nil {
+		t.Fatalf("clean MPO: %v", err)
+	}
+
+	cleaned := filepath.Join(dir, "out", "sample.jpg")
+	cleanDetails := scanDetails(t, cleaned, imgutil.KindJPEG)
+	if hasDetail(cleanDetails, "Device Model") || hasDetail(cleanDetails, "Timestamp") {
+		t.Fatalf("expected no EXIF details after clean, got: %#v", cleanDetails)
+	}
+
+	data, err := os.ReadFile(cleaned)
+	if err != nil {
+		t.Fatalf("read cleaned: %v", err)
+	}
+	img, err := parseJPEG(data)
+	if err != nil {
+		t.Fatalf("parse cleaned: %v", err)
+	}
+	index, base, ok := findMPF(img)
+	if !ok {
+		t.Fatalf("expected MPF segment to survive clean")
+	}
+	if int(index.entries[0].Size) != img.End {
+		t.Fatalf("expected primary size %d, got %d", img.End, index.entries[0].Size)
+	}
+	secondary, err := mpSecondaryImages(data, index, base, img.End)
+	if err != nil || len(secondary) != 1 {
+		t.Fatalf("expected one secondary image, got %v (%v)", secondary, err)
+	}
+	embedded := data[secondary[0].Start:secondary[0].End]
+	if !bytes.HasPrefix(embedded, []byte{0xff, 0xd8}) || bytes.Contains(embedded, []byte("Exif\x00\x00")) {
+		t.Fatalf("expected stripped secondary JPEG, got %x", embedded)
+	}
+
+	gapped := filepath.Join(dir, "gapped.jpg")
+	if err := buildMPO(gapped, true, []byte("hidden note")); err != nil {
+		t.Fatalf("build MPO: %v", err)
+	}
+	if details := scanDetails(t, gapped, imgutil.KindJPEG); !hasDetail(details, "Trailer") {
+		t.Fatalf("expected the gap before the secondary image reported, got: %#v", details)
+	}
+	original, err := os.ReadFile(gapped)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for _, keep := range []bool{false, true} {
+		var policy *Policy
+		if keep {
+			policy = policy.withContainerRule("Trailer", ActionKeep)
+		}
+		out, err := stripJPEGBytes(original, policy)
+		if err != nil {
+			t.Fatalf("keep %v: strip: %v", keep, err)
+		}
+		img, err := parseJPEG(out)
+		if err != nil {
+			t.Fatalf("keep %v: parse: %v", keep, err)
+		}
+		index, base, _ := findMPF(img)
+		secondary, err := mpSecondaryImages(out, index, base, img.End)
+		if err != nil || len(secondary) != 1 || !bytes.HasPrefix(out[secondary[0].Start:], []byte{0xff, 0xd8}) {
+			t.Fatalf("keep %v: expected a valid MPF offset, got %v (%v)", keep, secondary, err)
+		}
+		if kept := bytes.Contains(out, []byte("hidden note")); kept != keep {
+			t.Fatalf("keep %v: expected the gap kept only with trailers, got %v", keep, kept)
+		}
+	}
+
+	// EXIF after the primary image is not reported as the primary's.
+	bare := filepath.Join(dir, "bare.jpg")
+	if err := buildMPO(bare, false, nil); err != nil {
+		t.Fatalf("build MPO: %v", err)
+	}
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, image.NewGray(image.Rect(0, 0, 1, 1)), nil); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	appended := filepath.Join(dir, "appended.jpg")
+	if err := buildJPEGWithExif(appended); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	withExif, err := os.ReadFile(appended)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := os.WriteFile(appended, append(plain.Bytes(), withExif...), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, path := range []string{bare, appended} {
+		for _, f := range scanDetails(t, path, imgutil.KindJPEG) {
+			if strings.HasPrefix(f.Container, "APP1:Exif") {
+				t.Fatalf("%s: expected no primary EXIF, got %#v", filepath.Base(path), f)
+			}
+		}
+	}
+}
+
+func TestStripHEIFLargeMdat(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "large.heic")
+	if err := buildHEIF(src, true); err != nil {
+		t.Fatalf("build HEIF: %v", err)
+	}
+	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindHEIF); err != nil {
+		t.Fatalf("clean HEIF: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "out", "large.heic"))
+	if err != nil {
+		t.Fatalf("read cleaned: %v", err)
+	}
+	heif, err := parseHEIF(data)
+	if err != nil {
+		t.Fatalf("parse cleaned: %v", err)
+	}
+	coded, err := heif.itemData(1)
+	if err != nil || !bytes.Equal(coded, heifTestCoded) {
+		t.Fatalf("expected the image item to survive at its remapped offset, got %x (%v)", coded, err)
+	}
+	if details := scanDetails(t, filepath.Join(dir, "out", "large.heic"), imgutil.KindHEIF); len(details) != 0 {
+		t.Fatalf("expected no details after clean, got: %#v", details)
+	}
+}
+
+func TestCleanCountsKeptTrailer(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	withTrailer := append(plain.Bytes(), "PK\x03\x04appended archive"...)
+	if err := os.WriteFile(filepath.Join(src, "sample.jpg"), withTrailer, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	summary, _, err := Run(context.Background(), src, Options{Mode: ModeScan}, nil)
+	if err != nil || summary.Leaks != 1 {
+		t.Fatalf("expected the trailer reported as a leak, got %d (%v)", summary.Leaks, err)
+	}
+	summary, _, err = Run(context.Background(), src, Options{Mode: ModeClean, OutputDir: filepath.Join(dir, "out"), KeepTrailers: true, Verify: true}, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("clean: %v %#v", err, summary.Failures)
+	}
+	if summary.Leaks != 0 {
+		t.Fatalf("expected a kept trailer not to count as a leak, got %d", summary.Leaks)
+	}
+}
+
+func TestJPEGSegmentPolicy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.jpg")
+
+	segment := func(marker byte, payload string) []byte {
+		out := []byte{0xff, marker}
+		out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+		return append(out, payload...)
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xd8})
+	buf.Write(segment(0xe0, "JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00"))
+	buf.Write(segment(0xe0, "JFXX\x00\x10thumb"))
+	buf.Write(segment(0xec, "Ducky\x00\x01\x00\x04\x00\x00\x00\x50"))
+	buf.Write(segment(0xfe, "Taken at Alice's house"))
+	buf.Write(segment(0xee, "Adobe\x00\x64\x00\x00\x00\x00\x01"))
+	buf.Write([]byte{0xff, 0xd9})
+	if err := os.WriteFile(src, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	details := scanDetails(t, src, imgutil.KindJPEG)
+	if got := countCategory(details, CategorySegment); got != 3 {
+		t.Fatalf("expected 3 non-standard segments, got: %#v", details)
+	}
+
+	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindJPEG); err != nil {
+		t.Fatalf("clean JPEG: %v", err)
+	}
+
+	cleaned, err := os.ReadFile(filepath.Join(dir, "out", "sample.jpg"))
+	if err != nil {
+		t.Fatalf("read cleaned: %v", err)
+	}
+	for _, keep := range []string{"JFIF", "Adobe"} {
+		if !bytes.Contains(cleaned, []byte(keep)) {
+			t.Fatalf("expected %s segment to be kept", keep)
+		}
+	}
+	for _, drop := range []string{"JFXX", "Ducky", "Alice"} {
+		if bytes.Contains(cleaned, []byte(drop)) {
+			t.Fatalf("expected %s segment to be dropped", drop)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	dir := t.TempDir()
+	trailer := []byte("PK\x03\x04secret-archive")
+
+	jpegPath := filepath.Join(dir, "sample.jpg")
+	pngPath := filepath.Join(dir, "sample.png")
+	if err := buildJPEGWithExif(jpegPath); err != nil {
+		t.Fatalf("build JPEG: %v", err)
+	}
+	if err := buildPNGWithMetadata(pngPath); err != nil {
+		t.Fatalf("build PNG: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		kind imgutil.Kind
+	}{
+		{jpegPath, imgutil.KindJPEG},
+		{pngPath, imgutil.KindPNG},
+	} {
+		data, err := os.ReadFile(tc.path)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if err := os.WriteFile(tc.path, append(data, trailer...), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		details := scanDetails(t, tc.path, tc.kind)
+		if !hasDetail(details, "Trailer") {
+			t.Fatalf("%s: expected trailer detail, got: %#v", tc.kind, details)
+		}
+
+		for _, keep := range []bool{false, true} {
+			outDir := filepath.Join(dir, fmt.Sprintf("out-%t", keep))
+			file, err := os.Open(tc.path)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			job := Job{Path: tc.path, RelPath: filepath.Base(tc.path), Display: filepath.Base(tc.path)}
+			_, err = cleanFile(file, job, tc.kind, Options{Mode: ModeClean, OutputDir: outDir, KeepTrailers: keep})
+			file.Close()
+			if err != nil {
+				t.Fatalf("%s: clean: %v", tc.kind, err)
+			}
+
+			cleaned, err := os.ReadFile(filepath.Join(outDir, filepath.Base(tc.path)))
+			if err != nil {
+				t.Fatalf("read cleaned: %v", err)
+			}
+			if got := bytes.HasSuffix(cleaned, trailer); got != keep {
+				t.Fatalf("%s: keep=%t but trailer present=%t", tc.kind, keep, got)
+			}
+		}
+	}
+
+	// Zero padding is reported as Padding and is not a leak; a trailer
+	// that only describes itself as padding is.
+	padded := filepath.Join(dir, "padded.jpg")
+	if err := buildJPEGWithExif(padded); err != nil {
+		t.Fatalf("build JPEG: %v", err)
+	}
+	data, err := os.ReadFile(padded)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := os.WriteFile(padded, append(data, make([]byte, 64)...), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var padding *Finding
+	for _, f := range scanDetails(t, padded, imgutil.KindJPEG) {
+		if f.Category == CategoryTrailer {
+			padding = &f
+		}
+	}
+	if padding == nil || padding.TagName != paddingTagName || padding.Leak() {
+		t.Fatalf("expected a Padding finding that is not a leak, got %#v", padding)
+	}
+	spoofed := Finding{Category: CategoryTrailer, TagName: trailerTagName, Value: "64 bytes, zero padding"}
+	if !spoofed.Leak() {
+		t.Fatal("expected a Trailer finding to be a leak whatever its value")
+	}
+}
+
+func TestRunReportsFailures(t *testing.T) {
+	dir := t.TempDir()
+	if err := buildJPEGWithExif(filepath.Join(dir, "good.jpg")); err != nil {
+		t.Fatalf("build JPEG: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.jpg"), []byte("\xff\xd8\xff\xe1\x00\x40Exif"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	summary, _, err := Run(context.Background(), dir, Options{Mode: ModeClean, OutputDir: filepath.Join(t.TempDir(), "out")}, nil)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if summary.Errors != 1 || len(summary.Failures) != 1 {
+		t.Fatalf("expected one failure, got %d errors: %#v", summary.Errors, summary.Failures)
+	}
+	failure := summary.Failures[0]
+	if failure.Path != "broken.jpg" || failure.Stage != StageStrip || failure.Cause != CauseTruncated {
+		t.Fatalf("unexpected failure: %#v", failure)
+	}
+
+	bigTIFF := []byte("II\x2b\x00\x08\x00\x00\x00")
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{stripPNG(bytes.NewReader([]byte("not a png")), io.Discard, nil), CauseMalformed},
+		{stripTIFF(bytes.NewReader(bigTIFF), io.Discard, nil), CauseUnsupported},
+		{fmt.Errorf("strip: %w", fmt.Errorf("%w JPEG segment", errTruncated)), CauseTruncated},
+		// Causes come from the wrapped error, not from words in the message.
+		{errors.New("invalid, truncated and unsupported"), CauseOther},
+	} {
+		if got := classifyError(tc.err); got != tc.want {
+			t.Fatalf("%v: expected cause %q, got %q", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		if err := buildJPEGWithExif(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("build JPEG: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	outDir := filepath.Join(t.TempDir(), "out")
+	summary, _, err := Run(ctx, dir, Options{Mode: ModeClean, OutputDir: outDir}, nil)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if !summary.Canceled || summary.Processed != 0 {
+		t.Fatalf("expected canceled run with nothing processed, got %#v", summary)
+	}
+	if len(summary.Unprocessed) != 2 || summary.Unprocessed[0] != "a.jpg" || summary.Unprocessed[1] != "b.jpg" {
+		t.Fatalf("unexpected unprocessed list: %v", summary.Unprocessed)
+	}
+	if _, err := os.Stat(outDir); !os.IsNotExist(err) {
+		t.Fatalf("expected no output, got %v", err)
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+tags:
+  Copyright: keep
+categories:
+  timestamp: strip
+containers:
+  jpeg:
+    COM: keep
+  png:
+    tIME: keep
+`))
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+
+	dir := t.TempDir()
+	pngPath := filepath.Join(dir, "sample.png")
+	if err := buildPNGWithMetadata(pngPath); err != nil {
+		t.Fatalf("build PNG: %v", err)
+	}
+	data, err := os.ReadFile(pngPath)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	insertAt := len(data) - 12
+	withCopyright := append([]byte{}, data[:insertAt]...)
+	withCopyright = append(withCopyright, buildPNGChunk("tEXt", []byte("Copyright\x00ACME Legal"))...)
+	withCopyright = append(withCopyright, data[insertAt:]...)
+	if err := os.WriteFile(pngPath, withCopyright, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	jpegPath := filepath.Join(dir, "sample.jpg")
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xfe, 0x00, 0x08, 'h', 'e', 'l', 'l', 'o', '!', 0xff, 0xec, 0x00, 0x08, 'D', 'u', 'c', 'k', 'y', 0x00, 0xff, 0xd9}
+	if err := os.WriteFile(jpegPath, jpeg, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	outDir := filepath.Join(dir, "out")
+	for _, tc := range []struct {
+		path string
+		kind imgutil.Kind
+	}{
+		{pngPath, imgutil.KindPNG},
+		{jpegPath, imgutil.KindJPEG},
+	} {
+		file, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		job := Job{Path: tc.path, RelPath: filepath.Base(tc.path), Display: filepath.Base(tc.path)}
+		_, err = cleanFile(file, job, tc.kind, Options{Mode: ModeClean, OutputDir: outDir, Policy: policy})
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: clean: %v", tc.kind, err)
+		}
+	}
+
+	cleanedPNG, err := os.ReadFile(filepath.Join(outDir, "sample.png"))
+	if err != nil {
+		t.Fatalf("read cleaned: %v", err)
+	}
+	if !bytes.Contains(cleanedPNG, []byte("ACME Legal")) {
+		t.Fatalf("expected Copyright text chunk to be kept")
+	}
+	if bytes.Contains(cleanedPNG, []byte("tIME")) {
+		t.Fatalf("expected the Timestamp category rule to override the tIME container rule")
+	}
+	if bytes.Contains(cleanedPNG, []byte("TestCam")) || bytes.Contains(cleanedPNG, []byte("eXIf")) {
+		t.Fatalf("expected Model text and eXIf chunks to be dropped")
+	}
+
+	cleanedJPEG, err := os.ReadFile(filepath.Join(outDir, "sample.jpg"))
+	if err != nil {
+		t.Fatalf("read cleaned: %v", err)
+	}
+	if !bytes.Contains(cleanedJPEG, []byte("hello!")) || bytes.Contains(cleanedJPEG, []byte("Ducky")) {
+		t.Fatalf("expected COM kept and Ducky dropped, got %q", cleanedJPEG)
+	}
+
+	// Keep rules rewrite EXIF instead of dropping it, and clean only counts
+	// what it removes.
+	exifDir := filepath.Join(dir, "exif")
+	if err := os.MkdirAll(exifDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	block := (&exifBlock{order: binary.LittleEndian, entries: []exifEntry{
+		{IFD: "IFD", Tag: 0x0110, Type: 2, Count: 8, Value: []byte("TestCam\x00")},
+		{IFD: "IFD", Tag: tiffTagCopyright, Type: 2, Count: 11, Value: []byte("ACME Legal\x00")},
+		{IFD: exifPathExif, Tag: exifTagDateTimeOriginal, Type: 2, Count: 20, Value: []byte("2024:01:02 03:04:05\x00")},
+	}}).encode()
+	withExif := append([]byte{0xff, 0xd8}, jpegSegmentBytes(0xe1, append([]byte("Exif\x00\x00"), block...))...)
+	if err := os.WriteFile(filepath.Join(exifDir, "sample.jpg"), append(withExif, 0xff, 0xd9), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	keepDevice, err := ParsePolicy([]byte("tags: {Copyright: keep}\ncategories: {Device Model: keep}"))
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	summary, _, err := Run(context.Background(), exifDir, Options{Mode: ModeClean, OutputDir: filepath.Join(dir, "exif-out"), Policy: keepDevice}, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("clean: %v %#v", err, summary.Failures)
+	}
+	cleanedExif, err := os.ReadFile(filepath.Join(dir, "exif-out", "sample.jpg"))
+	if err != nil {
+		t.Fatalf("read cleaned: %v", err)
+	}
+	if !bytes.Contains(cleanedExif, []byte("ACME Legal")) || !bytes.Contains(cleanedExif, []byte("TestCam")) || bytes.Contains(cleanedExif, []byte("2024:01:02")) {
+		t.Fatalf("expected Copyright and Model kept and DateTimeOriginal dropped, got %q", cleanedExif)
+	}
+	if summary.Leaks != 1 {
+		t.Fatalf("expected only DateTimeOriginal counted as a leak, got %d", summary.Leaks)
+	}
+
+	heif := []Finding{{Container: "Exif item 1/IFD", TagName: "Model", Category: CategoryDevice}}
+	if got := keepDevice.strippedFindings(imgutil.KindHEIF, heif); len(got) != 1 {
+		t.Fatalf("expected HEIF EXIF, which is dropped whole, to stay counted")
+	}
+	xmp := []Finding{{Container: "APP1/XMP", TagName: "Model", Category: CategoryDevice}}
+	if got := keepDevice.strippedFindings(imgutil.KindJPEG, xmp); len(got) != 1 {
+		t.Fatalf("expected XMP, which is dropped whole, to stay counted")
+	}
+
+	for _, bad := range []string{"tags: {Copyright: maybe}", "categories: {Weather: keep}", "containers: {gif: {COM: keep}}", "unknown: 1"} {
+		if _, err := ParsePolicy([]byte(bad)); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRewriteExif(t *testing.T) {
+	short := func(v uint16) []byte { return binary.LittleEndian.AppendUint16(nil, v) }
+	ascii := func(v string) exifEntry {
+		return exifEntry{Type: 2, Count: uint32(len(v) + 1), Value: append([]byte(v), 0)}
+	}
+	entry := func(ifd string, tag uint16, e exifEntry) exifEntry {
+		e.IFD, e.Tag = ifd, tag
+		return e
+	}
+	source := (&exifBlock{order: binary.LittleEndian, entries: []exifEntry{
+		entry(exifPathIFD0, 0x0110, ascii("TestCam")),
+		entry(exifPathIFD0, 0x0112, exifEntry{Type: 3, Count: 1, Value: short(6)}),
+		entry(exifPathIFD0, 0x8298, ascii("ACME Legal")),
+		entry(exifPathExif, 0xa001, exifEntry{Type: 3, Count: 1, Value: short(1)}),
+		entry(exifPathExif, 0x9003, ascii("2024:01:02 03:04:05")),
+		entry(exifPathGPS, 0x0001, exifEntry{Type: 2, Count: 2, Value: []byte("N\x00")}),
+	}}).encode()
+
+	dir := t.TempDir()
+	jpegPath := filepath.Join(dir, "sample.jpg")
+	exifPayload := append([]byte("Exif\x00\x00"), source...)
+	jpegData := append([]byte{0xff, 0xd8}, jpegSegmentBytes(0xe1, exifPayload)...)
+	if err := os.WriteFile(jpegPath, append(jpegData, 0xff, 0xd9), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pngPath := filepath.Join(dir, "sample.png")
+	if err := buildPNGWithMetadata(pngPath); err != nil {
+		t.Fatalf("build PNG: %v", err)
+	}
+	pngData, err := os.ReadFile(pngPath)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	pngData = append(pngData[:len(pngData)-12:len(pngData)-12], append(pngChunkBytes("eXIf", source), pngData[len(pngData)-12:]...)...)
+	if err := os.WriteFile(pngPath, pngData, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	policy, err := ParsePolicy([]byte("tags: {Copyright: keep}"))
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	outDir := filepath.Join(dir, "out")
+	for _, tc := range []struct {
+		path string
+		kind imgutil.Kind
+	}{
+		{jpegPath, imgutil.KindJPEG},
+		{pngPath, imgutil.KindPNG},
+	} {
+		file, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		job := Job{Path: tc.path, RelPath: filepath.Base(tc.path), Display: filepath.Base(tc.path)}
+		_, err = cleanFile(file, job, tc.kind, Options{Mode: ModeClean, OutputDir: outDir, RewriteExif: true, Policy: policy})
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: clean: %v", tc.kind, err)
+		}
+
+		cleaned, err := os.ReadFile(filepath.Join(outDir, filepath.Base(tc.path)))
+		if err != nil {
+			t.Fatalf("read cleaned: %v", err)
+		}
+		rawExif, err := exif.SearchAndExtractExif(cleaned)
+		if err != nil {
+			t.Fatalf("%s: expected rewritten EXIF: %v", tc.kind, err)
+		}
+		tags, _, err := exif.GetFlatExifData(rawExif, nil)
+		if err != nil {
+			t.Fatalf("%s: parse rewritten EXIF: %v", tc.kind, err)
+		}
+		got := map[string]bool{}
+		for _, tag := range tags {
+			got[tag.TagName] = true
+		}
+		for _, name := range []string{"Orientation", "ColorSpace", "Copyright"} {
+			if !got[name] {
+				t.Fatalf("%s: expected %s to be kept, got %v", tc.kind, name, got)
+			}
+		}
+		for _, name := range []string{"Model", "DateTimeOriginal", "GPSLatitudeRef"} {
+			if got[name] {
+				t.Fatalf("%s: expected %s to be dropped", tc.kind, name)
+			}
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// Orientation 6: the stored left half (red) belongs at the top.
+	orientation := (&exifBlock{order: binary.LittleEndian, entries: []exifEntry{
+		{IFD: exifPathIFD0, Tag: tiffTagOrientation, Type: 3, Count: 1, Value: binary.LittleEndian.AppendUint16(nil, 6)},
+		{IFD: exifPathIFD0, Tag: 0x0110, Type: 2, Count: 8, Value: []byte("TestCam\x00")},
+	}}).encode()
+	src := image.NewRGBA(image.Rect(0, 0, 37, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 37; x++ {
+			c := color.RGBA{R: 0xff, A: 0xff}
+			if x >= 16 {
+				c = color.RGBA{B: 0xff, A: 0xff}
+			}
+			src.Set(x, y, c)
+		}
+	}
+
+	dir := t.TempDir()
+	var jpegBuf bytes.Buffer
+	if err := jpeg.Encode(&jpegBuf, src, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	jpegData := append([]byte{0xff, 0xd8}, jpegSegmentBytes(0xe1, append([]byte("Exif\x00\x00"), orientation...))...)
+	jpegData = append(jpegData, jpegBuf.Bytes()[2:]...)
+	jpegPath := filepath.Join(dir, "sample.jpg")
+	if err := os.WriteFile(jpegPath, jpegData, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, src); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	pngData := pngBuf.Bytes()
+	pngData = append(pngData[:len(pngData)-12:len(pngData)-12], append(pngChunkBytes("eXIf", orientation), pngData[len(pngData)-12:]...)...)
+	pngPath := filepath.Join(dir, "sample.png")
+	if err := os.WriteFile(pngPath, pngData, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	outDir := filepath.Join(dir, "out")
+	for _, tc := range []struct {
+		path string
+		kind imgutil.Kind
+		// The JPEG's partial MCU row lands on the flipped axis and is
+		// trimmed.
+		width, height int
+	}{
+		{jpegPath, imgutil.KindJPEG, 16, 37},
+		{pngPath, imgutil.KindPNG, 20, 37},
+	} {
+		file, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		job := Job{Path: tc.path, RelPath: filepath.Base(tc.path), Display: filepath.Base(tc.path)}
+		_, err = cleanFile(file, job, tc.kind, Options{Mode: ModeClean, OutputDir: outDir, ApplyOrientation: true})
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: clean: %v", tc.kind, err)
+		}
+
+		cleaned, err := os.ReadFile(filepath.Join(outDir, filepath.Base(tc.path)))
+		if err != nil {
+			t.Fatalf("read cleaned: %v", err)
+		}
+		if _, err := exif.SearchAndExtractExif(cleaned); err == nil {
+			t.Fatalf("%s: expected EXIF to be stripped", tc.kind)
+		}
+		img, _, err := image.Decode(bytes.NewReader(cleaned))
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tc.kind, err)
+		}
+		if b := img.Bounds(); b.Dx() != tc.width || b.Dy() != tc.height {
+			t.Fatalf("%s: expected %dx%d, got %dx%d", tc.kind, tc.width, tc.height, b.Dx(), b.Dy())
+		}
+		for _, p := range []struct {
+			x, y int
+			red  bool
+		}{{4, 4, true}, {tc.width - 4, 12, true}, {4, tc.height - 4, false}} {
+			r, _, b, _ := img.At(p.x, p.y).RGBA()
+			if (r > b) != p.red {
+				t.Fatalf("%s: unexpected color at %d,%d", tc.kind, p.x, p.y)
+			}
+		}
+	}
+}
+
+func TestCoarsenGPS(t *testing.T) {
+	rational := func(values ...uint32) exifEntry {
+		e := exifEntry{IFD: exifPathGPS, Type: tiffTypeRational, Count: uint32(len(values) / 2)}
+		for _, v := range values {
+			e.Value = binary.LittleEndian.AppendUint32(e.Value, v)
+		}
+		return e
+	}
+	ref := func(v string) exifEntry {
+		return exifEntry{IFD: exifPathGPS, Type: tiffTypeASCII, Count: 2, Value: []byte(v + "\x00")}
+	}
+	tagged := func(tag uint16, e exifEntry) exifEntry {
+		e.Tag = tag
+		return e
+	}
+	source := (&exifBlock{order: binary.LittleEndian, entries: []exifEntry{
+		tagged(gpsTagLatitudeRef, ref("N")),
+		tagged(gpsTagLatitude, rational(37, 1, 46, 1, 3012, 100)),
+		tagged(gpsTagLongitudeRef, ref("W")),
+		tagged(gpsTagLongitude, rational(122, 1, 25, 1, 990, 100)),
+		tagged(0x0006, rational(5230, 100)),
+		tagged(0x0007, rational(13, 1, 4, 1, 5, 1)),
+		tagged(0x000d, rational(12, 1)),
+	}}).encode()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.jpg")
+	payload := append([]byte("Exif\x00\x00"), source...)
+	data := append(append([]byte{0xff, 0xd8}, jpegSegmentBytes(0xe1, payload)...), 0xff, 0xd9)
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	outDir := filepath.Join(dir, "out")
+	job := Job{Path: src, RelPath: "sample.jpg", Display: "sample.jpg"}
+	_, err = cleanFile(file, job, imgutil.KindJPEG, Options{Mode: ModeClean, OutputDir: outDir, CoarsenGPS: "1km"})
+	file.Close()
+	if err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+
+	findings := scanDetails(t, filepath.Join(outDir, "sample.jpg"), imgutil.KindJPEG)
+	got := map[string]string{}
+	for _, f := range findings {
+		got[f.TagName] = f.Value
+	}
+	if got["GPSLatitude"] != "37.780000" || got["GPSLongitude"] != "122.420000" || got["GPSLongitudeRef"] != "W" {
+		t.Fatalf("expected position rounded to 0.01 degrees, got %v", got)
+	}
+	for _, name := range []string{"GPSAltitude", "GPSTimeStamp", "GPSSpeed"} {
+		if _, ok := got[name]; ok {
+			t.Fatalf("expected %s to be dropped", name)
+		}
+	}
+
+	insights := buildInsights(imgutil.KindJPEG, findings)
+	if len(insights) == 0 || insights[0].Message != "Approx location: 37.78, -122.42 (coarsened to ~1km)" {
+		t.Fatalf("expected precision in location insight, got %v", insights)
+	}
+
+	if _, err := ParsePolicy([]byte("exif: {gps: 5km}")); err == nil {
+		t.Fatalf("expected unknown GPS precision to be rejected")
+	}
+}
+
+func TestTimeRewrite(t *testing.T) {
+	shift, err := ParseTimeRewrite("shift:-1d2h")
+	if err != nil || shift.Shift != -26*time.Hour {
+		t.Fatalf("expected -26h shift, got %v, %v", shift, err)
+	}
+	random, err := ParseTimeRewrite("randomize-within:1h")
+	if err != nil || random.Shift < -time.Hour || random.Shift > time.Hour {
+		t.Fatalf("expected shift within 1h, got %v, %v", random, err)
+	}
+	for _, spec := range []string{"shift:1500ms", "randomize-within:0s", "date", "date-only:1h"} {
+		if _, err := ParseTimeRewrite(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.png")
+	if err := buildPNGWithMetadata(src); err != nil {
+		t.Fatalf("build png: %v", err)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	outDir := filepath.Join(dir, "out")
+	job := Job{Path: src, RelPath: "sample.png", Display: "sample.png"}
+	_, err = cleanFile(file, job, imgutil.KindPNG, Options{Mode: ModeClean, OutputDir: outDir, Time: shift})
+	file.Close()
+	if err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range scanDetails(t, filepath.Join(outDir, "sample.png"), imgutil.KindPNG) {
+		got[f.TagName] = f.Value
+	}
+	if got["DateTime"] != "2024-01-01 01:04:05" || got["tIME"] != "2024-01-01 01:04:05" {
+		t.Fatalf("expected timestamps shifted by -26h, got %v", got)
+	}
+	if _, ok := got["Model"]; ok {
+		t.Fatalf("expected device tags to stay stripped, got %v", got)
+	}
+
+	packet := `<rdf:Description xmp:CreateDate="2024-01-02T03:04:05+02:00" exif:OffsetTime="+02:00">` +
+		`<exif:DateTimeOriginal>2024-01-02T03:04:05.120</exif:DateTimeOriginal><dc:title>2024-01-02</dc:title></rdf:Description>`
+	want := `<rdf:Description xmp:CreateDate="2024-01-02" exif:OffsetTime="">` +
+		`<exif:DateTimeOriginal>2024-01-02</exif:DateTimeOriginal><dc:title>2024-01-02</dc:title></rdf:Description>`
+	if out := string((&TimeRewrite{DateOnly: true}).rewriteXMP([]byte(packet))); out != want {
+		t.Fatalf("unexpected XMP rewrite:\n%s", out)
+	}
+}
+
+func TestReencode(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 24, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			src.Set(x, y, color.RGBA{R: uint8(x * 10), G: uint8(y * 15), B: 0x80, A: 0xff})
+		}
+	}
+	orientation := (&exifBlock{order: binary.LittleEndian, entries: []exifEntry{
+		{IFD: exifPathIFD0, Tag: tiffTagOrientation, Type: 3, Count: 1, Value: binary.LittleEndian.AppendUint16(nil, 3)},
+		{IFD: exifPathIFD0, Tag: 0x0110, Type: 2, Count: 8, Value: []byte("TestCam\x00")},
+	}}).encode()
+
+	dir := t.TempDir()
+	var jpegBuf bytes.Buffer
+	if err := jpeg.Encode(&jpegBuf, src, &jpeg.Options{Quality: 97}); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	jpegData := append([]byte{0xff, 0xd8}, jpegSegmentBytes(0xe1, append([]byte("Exif\x00\x00"), orientation...))...)
+	jpegData = append(jpegData, jpegSegmentBytes(0xfe, []byte("made by TestCam"))...)
+	jpegData = append(jpegData, jpegBuf.Bytes()[2:]...)
+	if err := os.WriteFile(filepath.Join(dir, "sample.jpg"), jpegData, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var pngBuf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&pngBuf, src); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	pngData := pngBuf.Bytes()
+	pngData = append(pngData[:len(pngData)-12:len(pngData)-12], append(pngChunkBytes("tEXt", []byte("Model\x00TestCam")), pngData[len(pngData)-12:]...)...)
+	if err := os.WriteFile(filepath.Join(dir, "sample.png"), pngData, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	formats, err := ParseReencodeFormats([]string{"all"})
+	if err != nil {
+		t.Fatalf("parse formats: %v", err)
+	}
+	if _, err := ParseReencodeFormats([]string{"webp"}); err == nil {
+		t.Fatalf("expected webp to be rejected")
+	}
+	reencode := &Reencode{Formats: formats, JPEGQuality: 60, PNGCompression: png.BestCompression, Noise: 3}
+	outDir := filepath.Join(dir, "out")
+	opts := Options{Mode: ModeClean, OutputDir: outDir, Reencode: reencode, RewriteExif: true, Verify: true, Stamp: Stamp{"Copyright": "ACME"}}
+	summary, _, err := Run(context.Background(), dir, opts, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("clean: %v %#v", err, summary.Failures)
+	}
+
+	cleanedJPEG, err := os.ReadFile(filepath.Join(outDir, "sample.jpg"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	img, err := parseJPEG(cleanedJPEG)
+	if err != nil {
+		t.Fatalf("parse cleaned JPEG: %v", err)
+	}
+	var quant, exifData []byte
+	for _, seg := range img.Segments {
+		switch {
+		case seg.Marker == 0xdb && quant == nil:
+			quant = seg.Payload
+		case seg.Marker == 0xe1 && hasPrefix(seg.Payload, jpegExifHeader):
+			exifData = seg.Payload[len(jpegExifHeader):]
+		}
+	}
+	original, _ := parseJPEG(jpegData)
+	for _, seg := range original.Segments {
+		if seg.Marker == 0xdb && bytes.Equal(seg.Payload, quant) {
+			t.Fatalf("expected new quantization tables")
+		}
+	}
+	if exifOrientation(exifData) != 3 || !bytes.Contains(cleanedJPEG, []byte("ACME")) {
+		t.Fatalf("expected kept EXIF orientation and stamp in re-encoded JPEG")
+	}
+	if bytes.Contains(cleanedJPEG, []byte("TestCam")) {
+		t.Fatalf("expected comment and model to be stripped")
+	}
+
+	cleanedPNG, err := os.ReadFile(filepath.Join(outDir, "sample.png"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(cleanedPNG))
+	if err != nil {
+		t.Fatalf("decode cleaned PNG: %v", err)
+	}
+	if decoded.Bounds() != src.Bounds() || bytes.Contains(cleanedPNG, []byte("TestCam")) || len(cleanedPNG) >= len(pngData) {
+		t.Fatalf("unexpected re-encoded PNG (%d bytes, was %d)", len(cleanedPNG), len(pngData))
+	}
+	changed := false
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			r1, g1, b1, _ := src.At(x, y).RGBA()
+			r2, g2, b2, _ := decoded.At(x, y).RGBA()
+			for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+				if d < -3 || d > 3 {
+					t.Fatalf("noise out of range at (%d, %d): %d", x, y, d)
+				}
+				changed = changed || d != 0
+			}
+		}
+	}
+	if !changed {
+		t.Fatalf("expected noise to change some pixels")
+	}
+}
+
+func TestStamp(t *testing.T) {
+	stamp := Stamp{}
+	for _, field := range []string{"copyright=ACME Corp", "xmpRights:WebStatement=https://acme.example/license"} {
+		if err := stamp.Set(field); err != nil {
+			t.Fatalf("set %q: %v", field, err)
+		}
+	}
+	if err := stamp.Set("Make=ACME"); err == nil {
+		t.Fatalf("expected unknown stamp field to be rejected")
+	}
+
+	simpleWebP := func(path string) error {
+		var body bytes.Buffer
+		body.WriteString("WEBP")
+		body.Write(buildRIFFChunk("VP8L", []byte{0x2f, 0x03, 0xc0, 0x00, 0x10}))
+		var buf bytes.Buffer
+		buf.WriteString("RIFF")
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(body.Len()))
+		buf.Write(body.Bytes())
+		return os.WriteFile(path, buf.Bytes(), 0o644)
+	}
+	cases := []struct {
+		name  string
+		kind  imgutil.Kind
+		build func(string) error
+	}{
+		{"sample.jpg", imgutil.KindJPEG, buildJPEGWithExif},
+		{"sample.png", imgutil.KindPNG, buildPNGWithMetadata},
+		{"sample.tif", imgutil.KindTIFF, buildTIFFWithMetadata},
+		{"sample.webp", imgutil.KindWebP, buildWebPWithMetadata},
+		{"simple.webp", imgutil.KindWebP, simpleWebP},
+	}
+	for _, tc := range cases {
+		dir := t.TempDir()
+		src := filepath.Join(dir, tc.name)
+		if err := tc.build(src); err != nil {
+			t.Fatalf("build %s: %v", tc.name, err)
+		}
+		file, err := os.Open(src)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		outDir := filepath.Join(dir, "out")
+		job := Job{Path: src, RelPath: tc.name, Display: tc.name}
+		_, err = cleanFile(file, job, tc.kind, Options{Mode: ModeClean, OutputDir: outDir, Stamp: stamp})
+		file.Close()
+		if err != nil {
+			t.Fatalf("clean %s: %v", tc.name, err)
+		}
+
+		cleaned := filepath.Join(outDir, tc.name)
+		data, err := os.ReadFile(cleaned)
+		if err != nil {
+			t.Fatalf("read cleaned: %v", err)
+		}
+		for _, want := range []string{"ACME Corp", "<xmpRights:WebStatement>https://acme.example/license<"} {
+			if !bytes.Contains(data, []byte(want)) {
+				t.Fatalf("%s: expected %q in stamped output", tc.name, want)
+			}
+		}
+		if findings := scanDetails(t, cleaned, tc.kind); len(findings) != 0 {
+			t.Fatalf("%s: expected only stamped fields, got %v", tc.name, findings)
+		}
+		if tc.kind == imgutil.KindWebP {
+			if string(data[12:16]) != "VP8X" || data[20]&(webpFlagEXIF|webpFlagXMP) != webpFlagEXIF|webpFlagXMP {
+				t.Fatalf("%s: expected VP8X with EXIF and XMP flags", tc.name)
+			}
+			if got := binary.LittleEndian.Uint32(data[4:8]); int(got) != len(data)-8 {
+				t.Fatalf("%s: expected RIFF size %d, got %d", tc.name, len(data)-8, got)
+			}
+		}
+		if tc.kind == imgutil.KindTIFF {
+			// Stamping again replaces IFD0 rather than leaving the old one
+			// behind.
+			again, err := stampTIFF(data, Stamp{"Copyright": "Other Corp"})
+			if err != nil {
+				t.Fatalf("restamp: %v", err)
+			}
+			if bytes.Contains(again, []byte("ACME Corp")) || !bytes.Contains(again, []byte("Other Corp")) {
+				t.Fatalf("expected the old IFD0 to be replaced")
+			}
+			if err := verifyClean(imgutil.KindTIFF, data, again, nil); err != nil {
+				t.Fatalf("restamped TIFF: %v", err)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	heif := filepath.Join(dir, "sample.heic")
+	if err := buildHEIFWithMetadata(heif); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	summary, _, err := Run(context.Background(), heif, Options{Mode: ModeClean, OutputDir: filepath.Join(dir, "out"), Stamp: stamp}, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("clean HEIF: %v %#v", err, summary.Failures)
+	}
+	if len(summary.Warnings) != 1 || summary.Warnings[0].Stage != StageStamp {
+		t.Fatalf("expected a stamp warning for HEIF, got %#v", summary.Warnings)
+	}
+}
+
+func TestVault(t *testing.T) {
+	dir := t.TempDir()
+	vaultPath := filepath.Join(dir, "removed.vault")
+	passphrase := []byte("correct horse")
+	vault, err := OpenVault(vaultPath, passphrase)
+	if err != nil {
+		t.Fatalf("open vault: %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		kind  imgutil.Kind
+		build func(string) error
+	}{
+		{"sample.png", imgutil.KindPNG, buildPNGWithMetadata},
+		{"sample.tif", imgutil.KindTIFF, buildTIFFWithMetadata},
+		{"sample.webp", imgutil.KindWebP, buildWebPWithMetadata},
+		{"sample.mpo", imgutil.KindJPEG, buildMPOWithExif},
+		// twin.png cleans to the same bytes as sample.png.
+		{"twin.png", imgutil.KindPNG, func(path string) error {
+			if err := buildPNGWithMetadata(path); err != nil {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			insertAt := len(data) - 12
+			out := append([]byte{}, data[:insertAt]...)
+			out = append(out, buildPNGChunk("tEXt", []byte("Artist\x00Someone"))...)
+			return os.WriteFile(path, append(out, data[insertAt:]...), 0o644)
+		}},
+	}
+	srcDir, cleanDir, restoreDir := filepath.Join(dir, "src"), filepath.Join(dir, "clean"), filepath.Join(dir, "restored")
+	if err := os.MkdirAll(srcDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, tc := range cases {
+		src := filepath.Join(srcDir, tc.name)
+		if err := tc.build(src); err != nil {
+			t.Fatalf("build %s: %v", tc.name, err)
+		}
+		file, err := os.Open(src)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		job := Job{Path: src, RelPath: tc.name, Display: tc.name}
+		_, err = cleanFile(file, job, tc.kind, Options{Mode: ModeClean, OutputDir: cleanDir, Vault: vault})
+		file.Close()
+		if err != nil {
+			t.Fatalf("clean %s: %v", tc.name, err)
+		}
+	}
+	if err := vault.Close(); err != nil {
+		t.Fatalf("close vault: %v", err)
+	}
+
+	if _, err := ReadVault(vaultPath, []byte("wrong")); !errors.Is(err, errVaultPassphrase) {
+		t.Fatalf("expected wrong passphrase error, got %v", err)
+	}
+	data, err := os.ReadFile(vaultPath)
+	if err != nil {
+		t.Fatalf("read vault file: %v", err)
+	}
+	hostile := filepath.Join(dir, "hostile.vault")
+	if err := os.WriteFile(hostile, append(data, 0xFF, 0xFF, 0xFF, 0xFF), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := ReadVault(hostile, passphrase); err == nil {
+		t.Fatal("expected an error for a record larger than the vault")
+	}
+	vault, err = ReadVault(vaultPath, passphrase)
+	if err != nil {
+		t.Fatalf("read vault: %v", err)
+	}
+	summary, _, err := Run(context.Background(), cleanDir, Options{Mode: ModeRestore, OutputDir: restoreDir, Vault: vault}, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("restore: %v %#v", err, summary.Failures)
+	}
+	for _, tc := range cases {
+		original, _ := os.ReadFile(filepath.Join(srcDir, tc.name))
+		restored, err := os.ReadFile(filepath.Join(restoreDir, tc.name))
+		if err != nil {
+			t.Fatalf("read restored: %v", err)
+		}
+		if !bytes.Equal(original, restored) {
+			t.Fatalf("%s: restored file differs from the original", tc.name)
+		}
+	}
+
+	unknown := filepath.Join(dir, "unknown.jpg")
+	if err := buildJPEGWithExif(unknown); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	summary, _, err = Run(context.Background(), unknown, Options{Mode: ModeRestore, OutputDir: restoreDir, Vault: vault}, nil)
+	if err != nil || summary.Errors != 1 || summary.Failures[0].Stage != StageRestore {
+		t.Fatalf("expected restore failure for a file not in the vault, got %v %#v", err, summary.Failures)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	photos, journalDir := filepath.Join(dir, "photos"), filepath.Join(dir, "journal")
+	if err := os.MkdirAll(photos, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	builds := map[string]func(string) error{
+		"sample.png":  buildPNGWithMetadata,
+		"sample.tif":  buildTIFFWithMetadata,
+		"sample.webp": buildWebPWithMetadata,
+	}
+	originals := map[string][]byte{}
+	for name, build := range builds {
+		path := filepath.Join(photos, name)
+		if err := build(path); err != nil {
+			t.Fatalf("build %s: %v", name, err)
+		}
+		originals[path], _ = os.ReadFile(path)
+	}
+
+	journal, err := OpenJournal(journalDir)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	summary, _, err := Run(context.Background(), photos, Options{Mode: ModeClean, InPlace: true, Journal: journal}, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("clean: %v %#v", err, summary.Failures)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatalf("close journal: %v", err)
+	}
+	runs, err := JournalRuns(journalDir)
+	if err != nil || len(runs) != 1 || runs[0] != journal.Run() || journal.Recorded() != len(builds) {
+		t.Fatalf("expected one run with %d files, got %v (%d files, err %v)", len(builds), runs, journal.Recorded(), err)
+	}
+
+	journal, err = ReadJournal(journalDir, runs[0])
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+	summary, _, err = RunFiles(context.Background(), journal.Paths(), Options{Mode: ModeRestore, InPlace: true, Journal: journal}, nil)
+	if err != nil || summary.Errors != 0 || summary.Processed != len(builds) {
+		t.Fatalf("restore: %v %#v", err, summary)
+	}
+	for path, original := range originals {
+		restored, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read restored: %v", err)
+		}
+		if !bytes.Equal(original, restored) {
+			t.Fatalf("%s: restored file differs from the original", path)
+		}
+	}
+
+	// The files are originals again, so the journal no longer matches them.
+	summary, _, _ = Run(context.Background(), photos, Options{Mode: ModeRestore, InPlace: true, Journal: journal}, nil)
+	if summary.Errors != len(builds) {
+		t.Fatalf("expected changed files to be reported, got %#v", summary)
+	}
+
+	if pruned, err := PruneJournal(journalDir, time.Now().Add(-time.Hour)); err != nil || len(pruned) != 0 {
+		t.Fatalf("expected recent run to be kept, got %v %v", pruned, err)
+	}
+	if pruned, err := PruneJournal(journalDir, time.Now().Add(time.Hour)); err != nil || len(pruned) != 1 {
+		t.Fatalf("expected run to be pruned, got %v %v", pruned, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	photos, outDir := filepath.Join(dir, "photos"), filepath.Join(dir, "out")
+	if err := os.MkdirAll(photos, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for name, build := range map[string]func(string) error{
+		"sample.png":  buildPNGWithMetadata,
+		"sample.tif":  buildTIFFWithMetadata,
+		"sample.webp": buildWebPWithMetadata,
+		"sample.heic": buildHEIFWithMetadata,
+		"sample.mpo":  buildMPOWithExif,
+	} {
+		if err := build(filepath.Join(photos, name)); err != nil {
+			t.Fatalf("build %s: %v", name, err)
+		}
+	}
+
+	summary, _, err := Run(context.Background(), photos, Options{Mode: ModeClean, OutputDir: outDir, Verify: true}, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("clean --verify: %v %#v", err, summary.Failures)
+	}
+	summary, _, err = Run(context.Background(), photos, Options{Mode: ModeVerify, OutputDir: outDir}, nil)
+	if err != nil || summary.Errors != 0 || summary.Processed != 5 {
+		t.Fatalf("verify: %v %#v", err, summary)
+	}
+	summary, _, err = Run(context.Background(), photos, Options{Mode: ModeVerify, OutputDir: photos}, nil)
+	if err != nil || summary.Errors != 5 || summary.Failures[0].Cause != CauseUnverified {
+		t.Fatalf("expected originals to fail verification, got %v %#v", err, summary.Failures)
+	}
+
+	original, err := os.ReadFile(filepath.Join(photos, "sample.png"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	cleaned, err := os.ReadFile(filepath.Join(outDir, "sample.png"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	corrupt := append([]byte{}, cleaned...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := verifyClean(imgutil.KindPNG, original, corrupt, nil); err == nil || !strings.Contains(err.Error(), "invalid structure") {
+		t.Fatalf("expected structure error, got %v", err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.RGBA{G: 0xff, A: 0xff})
+	var other bytes.Buffer
+	if err := png.Encode(&other, img); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := verifyClean(imgutil.KindPNG, original, other.Bytes(), nil); err == nil || !strings.Contains(err.Error(), "pixels differ") {
+		t.Fatalf("expected pixel error, got %v", err)
+	}
+
+	// Metadata a container rule keeps is not reported as remaining.
+	inPlace := filepath.Join(dir, "inplace.png")
+	if err := os.WriteFile(inPlace, original, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	policy := &Policy{Containers: map[string]map[string]Action{"png": {"tEXt": ActionKeep}}}
+	if _, _, err := Run(context.Background(), inPlace, Options{Mode: ModeClean, InPlace: true, Verify: true, Policy: policy}, nil); err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+	if data, _ := os.ReadFile(inPlace); bytes.Equal(data, original) || !bytes.Contains(data, []byte("TestCam")) {
+		t.Fatalf("expected the clean to pass verification and keep tEXt")
+	}
+
+	// Verify takes the clean's options: kept trailers, converted and
+	// renamed files.
+	batch, batchOut := filepath.Join(dir, "batch"), filepath.Join(dir, "batch-out")
+	if err := os.MkdirAll(filepath.Join(batch, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := buildPNGWithMetadata(filepath.Join(batch, "sub", "photo.png")); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(batch, "motion.jpg"), append(plain.Bytes(), "PK\x03\x04video"...), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rename, err := ParseRename("sequence")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	rename.Flatten = true
+	opts := Options{
+		Mode:         ModeClean,
+		OutputDir:    batchOut,
+		KeepTrailers: true,
+		Reencode:     &Reencode{Formats: []imgutil.Kind{imgutil.KindPNG}, Format: imgutil.KindJPEG, JPEGQuality: 85},
+		Rename:       rename,
+	}
+	if summary, _, err := Run(context.Background(), batch, opts, nil); err != nil || summary.Errors != 0 {
+		t.Fatalf("clean: %v %#v", err, summary.Failures)
+	}
+	mapPath := filepath.Join(dir, "map.csv")
+	if err := rename.WriteMapping(mapPath); err != nil {
+		t.Fatalf("write mapping: %v", err)
+	}
+	if opts.Rename, err = LoadRenameMapping(mapPath); err != nil {
+		t.Fatalf("load mapping: %v", err)
+	}
+	opts.Mode = ModeVerify
+	summary, _, err = Run(context.Background(), batch, opts, nil)
+	if err != nil || summary.Errors != 0 || summary.Processed != 2 {
+		t.Fatalf("verify with the clean's options: %v %#v", err, summary)
+	}
+	opts.KeepTrailers = false
+	if summary, _, _ = Run(context.Background(), batch, opts, nil); summary.Errors != 1 {
+		t.Fatalf("expected the kept trailer reported without --keep-trailers, got %#v", summary.Failures)
+	}
+}
+
+func TestPreset(t *testing.T) {
+	presets, err := ParsePresets([]byte(`
+presets:
+  thumbs:
+    max_dimension: 16
+    format: png
+    icc: keep
+    policy:
+      categories:
+        Device Model: keep
+`))
+	if err != nil {
+		t.Fatalf("parse presets: %v", err)
+	}
+	thumbs := presets["thumbs"]
+	if thumbs.MaxDimension != 16 || thumbs.Format != imgutil.KindPNG || thumbs.ICC != ICCKeep || thumbs.Policy.Categories[CategoryDevice] != ActionKeep {
+		t.Fatalf("unexpected preset %#v", thumbs)
+	}
+	if _, err := ParsePresets([]byte("presets:\n  bad:\n    icc: p3\n")); err == nil {
+		t.Fatalf("expected invalid icc to be rejected")
+	}
+
+	srgbTRC := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		srgbTRC = binary.BigEndian.AppendUint32(srgbTRC, uint32(int32(math.Round(v*65536))))
+	}
+	for name, trc := range map[string][]byte{"sRGB": srgbTRC, "gamma 2.2": iccGammaCurve(2.2), "linear": iccGammaCurve(1)} {
+		parsed, err := parseICCProfile(buildICCProfile(srgbColorants, trc))
+		if err != nil {
+			t.Fatalf("%s: parse profile: %v", name, err)
+		}
+		if parsed.isSRGB() != (name == "sRGB") {
+			t.Fatalf("%s: unexpected isSRGB %v", name, parsed.isSRGB())
+		}
+	}
+
+	// A linear-light profile with sRGB primaries: converting mid gray to
+	// sRGB brightens it.
+	src := image.NewGray(image.Rect(0, 0, 40, 20))
+	for i := range src.Pix {
+		src.Pix[i] = 128
+	}
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, src); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	var profile bytes.Buffer
+	zw := zlib.NewWriter(&profile)
+	zw.Write(buildICCProfile(srgbColorants, iccGammaCurve(1)))
+	zw.Close()
+	chunks, trailer, err := splitPNGChunks(pngBuf.Bytes())
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	chunks = slices.Insert(chunks, 1,
+		pngChunk{name: "iCCP", data: append([]byte("linear\x00\x00"), profile.Bytes()...)},
+		pngChunk{name: "tEXt", data: []byte("Model\x00TestCam")})
+	pngData := append([]byte{}, pngSignature...)
+	for _, chunk := range chunks {
+		pngData = append(pngData, pngChunkBytes(chunk.name, chunk.data)...)
+	}
 	dir := t.TempDir()
-	src := filepath.Join(dir, "sample.jpg")
+	photos := filepath.Join(dir, "photos")
+	if err := os.MkdirAll(photos, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(photos, "gray.png"), append(pngData, trailer...), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
 
-	if err := buildJPEGWithExif(src); err != nil {
-		t.Fatalf("build JPEG: %v", err)
+	web := filepath.Join(dir, "web")
+	opts := Options{Mode: ModeClean, OutputDir: web}
+	Preset{MaxDimension: 16, Format: imgutil.KindJPEG, ICC: ICCSRGB, JPEGQuality: 95, Verify: true}.Apply(&opts)
+	summary, _, err := Run(context.Background(), photos, opts, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("clean: %v %#v", err, summary.Failures)
+	}
+	if _, err := os.Stat(filepath.Join(web, "gray.png")); !os.IsNotExist(err) {
+		t.Fatalf("expected no PNG output, got %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(web, "gray.jpg"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if bytes.Contains(data, jpegICCHeader) || bytes.Contains(data, []byte("TestCam")) {
+		t.Fatalf("expected profile and text to be dropped")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(16, 8) {
+		t.Fatalf("expected 16x8, got %v", size)
+	}
+	if y, _, _, _ := img.At(8, 4).RGBA(); y>>8 < 184 || y>>8 > 192 {
+		t.Fatalf("expected gray converted to about 188, got %d", y>>8)
 	}
 
-	details := scanDetails(t, src, imgutil.KindJPEG)
-	if !hasDetail(details, "Device Model") || !hasDetail(details, "Timestamp") {
-		t.Fatalf("expected model and timestamp details, got: %#v", details)
+	keep := filepath.Join(dir, "keep")
+	opts = Options{Mode: ModeClean, OutputDir: keep}
+	thumbs.Apply(&opts)
+	if summary, _, err := Run(context.Background(), photos, opts, nil); err != nil || summary.Errors != 0 {
+		t.Fatalf("clean: %v %#v", err, summary.Failures)
+	}
+	data, err = os.ReadFile(filepath.Join(keep, "gray.png"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if kept, err := extractICC(imgutil.KindPNG, data); err != nil || !bytes.Equal(kept, buildICCProfile(srgbColorants, iccGammaCurve(1))) {
+		t.Fatalf("expected profile to be kept, got %v", err)
+	}
+	if !bytes.Contains(data, []byte("TestCam")) {
+		t.Fatalf("expected the preset policy to keep the model")
+	}
+	if img, err = png.Decode(bytes.NewReader(data)); err != nil || img.Bounds().Dx() != 16 {
+		t.Fatalf("expected a 16 pixel wide PNG, got %v", err)
 	}
+	if y, _, _, _ := img.At(8, 4).RGBA(); y>>8 != 128 {
+		t.Fatalf("expected unconverted gray, got %d", y>>8)
+	}
+}
 
-	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindJPEG); err != nil {
-		t.Fatalf("clean JPEG: %v", err)
+func TestFileMetadata(t *testing.T) {
+	for spec, want := range map[string]time.Time{
+		"epoch":            time.Unix(0, 0),
+		"epoch:1600000000": time.Unix(1600000000, 0),
+		"epoch:2020-05-01": time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		times, err := ParseFileTimes(spec)
+		if err != nil || times.Mode != TimesFixed || !times.Fixed.Equal(want) {
+			t.Fatalf("%s: unexpected %#v (err %v)", spec, times, err)
+		}
+	}
+	for _, spec := range []string{"now", "epoch:yesterday", "exif:1"} {
+		if _, err := ParseFileTimes(spec); err == nil {
+			t.Fatalf("%s: expected an error", spec)
+		}
 	}
 
-	cleaned := filepath.Join(dir, "out", "sample.jpg")
-	cleanDetails := scanDetails(t, cleaned, imgutil.KindJPEG)
-	if len(cleanDetails) != 0 {
-		t.Fatalf("expected no details after clean, got: %#v", cleanDetails)
+	dir := t.TempDir()
+	photos := filepath.Join(dir, "photos")
+	if err := os.MkdirAll(photos, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	captured := (&exifBlock{order: binary.LittleEndian, entries: []exifEntry{
+		{IFD: exifPathExif, Tag: exifTagDateTimeOriginal, Type: 2, Count: 20, Value: []byte("2024:01:02 03:04:05\x00")},
+	}}).encode()
+	jpegData := append([]byte{0xff, 0xd8}, jpegSegmentBytes(0xe1, append([]byte("Exif\x00\x00"), captured...))...)
+	path := filepath.Join(photos, "sample.jpg")
+	if err := os.WriteFile(path, append(jpegData, 0xff, 0xd9), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	old := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"preserve", old},
+		{"epoch", time.Unix(0, 0)},
+		{"exif", time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)},
+	} {
+		times, err := ParseFileTimes(tc.spec)
+		if err != nil {
+			t.Fatalf("parse %s: %v", tc.spec, err)
+		}
+		outDir := filepath.Join(dir, tc.spec)
+		if _, _, err := Run(context.Background(), photos, Options{Mode: ModeClean, OutputDir: outDir, Times: times}, nil); err != nil {
+			t.Fatalf("clean: %v", err)
+		}
+		info, err := os.Stat(filepath.Join(outDir, "sample.jpg"))
+		if err != nil || !info.ModTime().Equal(tc.want) {
+			t.Fatalf("%s: expected mtime %v, got %v (err %v)", tc.spec, tc.want, info.ModTime(), err)
+		}
+	}
+
+	if err := setXattr(path, "user.xdg.origin.url", []byte("https://example.com/p.jpg")); err != nil {
+		t.Skipf("extended attributes not available: %v", err)
+	}
+	_, reports, err := Run(context.Background(), photos, Options{Mode: ModeScan}, nil)
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("scan: %v", err)
+	}
+	if countCategory(reports[0].Findings, CategoryFilesystem) != 1 {
+		t.Fatalf("expected an xattr finding, got %#v", reports[0].Findings)
+	}
+	for _, preserve := range []bool{false, true} {
+		outDir := filepath.Join(dir, fmt.Sprintf("xattrs-%v", preserve))
+		summary, _, err := Run(context.Background(), photos, Options{Mode: ModeClean, OutputDir: outDir, PreserveXattrs: preserve}, nil)
+		if err != nil || summary.Errors != 0 {
+			t.Fatalf("clean: %v %#v", err, summary.Failures)
+		}
+		attrs, err := listXattrs(filepath.Join(outDir, "sample.jpg"))
+		if err != nil || (len(attrs) == 1) != preserve {
+			t.Fatalf("preserve %v: unexpected attributes %v (err %v)", preserve, attrs, err)
+		}
 	}
 }
 
-func TestScanCleanPNG(t *testing.T) {
+func TestRename(t *testing.T) {
+	for _, spec := range []string{"random", "template:plain", "template:{date}-{seq}", "template:../{seq}", "template:{hash:2}"} {
+		if _, err := ParseRename(spec); err == nil {
+			t.Fatalf("%s: expected an error", spec)
+		}
+	}
+
 	dir := t.TempDir()
-	src := filepath.Join(dir, "sample.png")
+	photos := filepath.Join(dir, "photos")
+	if err := os.MkdirAll(filepath.Join(photos, "Alice's birthday"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := buildPNGWithMetadata(filepath.Join(photos, "Alice's birthday", "IMG_20240103_155606.png")); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if err := buildJPEGWithExif(filepath.Join(photos, "PXL_20240103.JPG")); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(photos, "PXL_20240103.xmp"), []byte("<x:xmpmeta/>"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
 
-	if err := buildPNGWithMetadata(src); err != nil {
-		t.Fatalf("build PNG: %v", err)
+	rename, err := ParseRename("template:photo-{seq:3}")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	rename.Flatten = true
+	outDir := filepath.Join(dir, "out")
+	summary, _, err := Run(context.Background(), photos, Options{Mode: ModeClean, OutputDir: outDir, Rename: rename}, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("clean: %v %#v", err, summary.Failures)
+	}
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, " ") != "photo-001.png photo-002.jpg" {
+		t.Fatalf("unexpected outputs %v", names)
 	}
 
-	details := scanDetails(t, src, imgutil.KindPNG)
-	if !hasDetail(details, "Device Model") || !hasDetail(details, "Timestamp") {
-		t.Fatalf("expected model and timestamp details, got: %#v", details)
+	mapPath := filepath.Join(dir, "map.json")
+	if err := rename.WriteMapping(mapPath); err != nil {
+		t.Fatalf("write mapping: %v", err)
+	}
+	data, err := os.ReadFile(mapPath)
+	if err != nil {
+		t.Fatalf("read mapping: %v", err)
+	}
+	var mapping []RenameEntry
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		t.Fatalf("decode mapping: %v", err)
+	}
+	want := []RenameEntry{
+		{Original: "Alice's birthday/IMG_20240103_155606.png", Renamed: "photo-001.png"},
+		{Original: "PXL_20240103.JPG", Renamed: "photo-002.jpg"},
+	}
+	if !slices.Equal(mapping, want) {
+		t.Fatalf("unexpected mapping %#v", mapping)
 	}
 
-	if err := cleanToOutput(t, src, filepath.Join(dir, "out"), imgutil.KindPNG); err != nil {
-		t.Fatalf("clean PNG: %v", err)
+	hashed, err := ParseRename("hash")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	hashDir := filepath.Join(dir, "hashed")
+	if _, _, err := Run(context.Background(), photos, Options{Mode: ModeClean, OutputDir: hashDir, Rename: hashed}, nil); err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+	for _, entry := range hashed.Mapping() {
+		cleaned, err := os.ReadFile(filepath.Join(hashDir, entry.Renamed))
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		sum := sha256.Sum256(cleaned)
+		if want := hex.EncodeToString(sum[:8]); !strings.HasPrefix(filepath.Base(entry.Renamed), want) || filepath.Dir(entry.Renamed) != filepath.Dir(entry.Original) {
+			t.Fatalf("expected %s named after its hash in its directory, got %s", entry.Original, entry.Renamed)
+		}
 	}
 
-	cleaned := filepath.Join(dir, "out", "sample.png")
-	cleanDetails := scanDetails(t, cleaned, imgutil.KindPNG)
-	if len(cleanDetails) != 0 {
-		t.Fatalf("expected no details after clean, got: %#v", cleanDetails)
+	// Two inputs that clean to the same bytes both keep a file.
+	twins := filepath.Join(dir, "twins")
+	if err := os.MkdirAll(twins, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, name := range []string{"a.png", "b.png"} {
+		if err := buildPNGWithMetadata(filepath.Join(twins, name)); err != nil {
+			t.Fatalf("build: %v", err)
+		}
+	}
+	hashed, _ = ParseRename("hash")
+	hashed.Flatten = true
+	twinDir := filepath.Join(dir, "twins-out")
+	if _, _, err := Run(context.Background(), twins, Options{Mode: ModeClean, OutputDir: twinDir, Rename: hashed}, nil); err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+	entries, err = os.ReadDir(twinDir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	mapped := hashed.Mapping()
+	if len(entries) != 2 || len(mapped) != 2 || mapped[0].Renamed == mapped[1].Renamed {
+		t.Fatalf("expected two distinct outputs, got %d files and mapping %#v", len(entries), mapped)
+	}
+
+	// Images are numbered in walk order however the workers interleave,
+	// and other files take no number.
+	many := filepath.Join(dir, "many")
+	if err := os.MkdirAll(many, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for i := 0; i < 30; i++ {
+		path := filepath.Join(many, fmt.Sprintf("f%02d.png", i))
+		if i%3 == 0 {
+			err = os.WriteFile(path+".txt", []byte("note"), 0o644)
+		} else {
+			err = buildPNGWithMetadata(path)
+		}
+		if err != nil {
+			t.Fatalf("build: %v", err)
+		}
+	}
+	numbered, _ := ParseRename("sequence")
+	if _, _, err := Run(context.Background(), many, Options{Mode: ModeClean, OutputDir: filepath.Join(dir, "many-out"), Rename: numbered}, nil); err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+	mapped = numbered.Mapping()
+	if len(mapped) != 20 {
+		t.Fatalf("expected 20 numbered images, got %d", len(mapped))
+	}
+	for i, entry := range mapped {
+		if want := fmt.Sprintf("%06d.png", i+1); entry.Renamed != want {
+			t.Fatalf("expected %s as %s, got %s", entry.Original, want, entry.Renamed)
+		}
+	}
+}
+
+func TestFilenameFindings(t *testing.T) {
+	saved := currentUsernames
+	currentUsernames = func() []string { return []string{"alice"} }
+	defer func() { currentUsernames = saved }()
+
+	cases := []struct {
+		path string
+		want []string
+	}{
+		{"IMG_20240103_155606.jpg", []string{"FilenameDevice=Android phone", "FilenameTime=2024:01:03 15:56:06"}},
+		{"PXL_20240103_155606123.MP.jpg", []string{"FilenameDevice=Google Pixel", "FilenameTime=2024:01:03 15:56:06"}},
+		{"Screenshot 2024-01-03 at 3.56.06\u202fPM.png", []string{"FilenameDevice=Mac", "FilenameSource=screenshot", "FilenameTime=2024:01:03 15:56:06"}},
+		{"Screenshot_20240103-155606.png", []string{"FilenameDevice=Android phone", "FilenameSource=screenshot", "FilenameTime=2024:01:03 15:56:06"}},
+		{"IMG-20240103-WA0007.jpg", []string{"FilenameSource=WhatsApp", "FilenameTime=2024:01:03"}},
+		{"DJI_0001.JPG", []string{"FilenameDevice=DJI drone"}},
+		{"2024-01-03 Lisbon/photo.jpg", []string{"FilenameTime=2024:01:03"}},
+		{"backup/home/alice/Pictures/p.png", []string{"HomePath=home/alice", "Username=alice"}},
+		{"Alice trip/IMG_1234.HEIC", []string{"Username=alice", "FilenameDevice=iPhone or Canon camera"}},
+		{"20241399_000000.jpg", nil},
+		{"photo-000001.jpg", nil},
+	}
+	for _, tc := range cases {
+		var got []string
+		for _, f := range filenameFindings(tc.path) {
+			if f.Category != CategoryFilename {
+				t.Fatalf("%s: unexpected category %q", tc.path, f.Category)
+			}
+			got = append(got, f.TagName+"="+f.RawValue)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.path, tc.want, got)
+		}
+	}
+
+	dir := t.TempDir()
+	var plain bytes.Buffer
+	if err := png.Encode(&plain, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "PXL_20240103_155606123.png"), plain.Bytes(), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := buildJPEGWithExif(filepath.Join(dir, "IMG_20240103_155606.jpg")); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	summary, reports, err := Run(context.Background(), dir, Options{Mode: ModeScan, Insights: true}, nil)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	// The PNG holds no metadata and the JPEG two EXIF values; names are
+	// reported but never counted as leaks.
+	if summary.Leaks != 2 {
+		t.Fatalf("expected only the JPEG's EXIF counted as leaks, got %d", summary.Leaks)
+	}
+	insights := map[string][]string{}
+	for _, report := range reports {
+		for _, insight := range report.Insights {
+			insights[report.Path] = append(insights[report.Path], insight.Message)
+		}
+	}
+	pixel := strings.Join(insights["PXL_20240103_155606123.png"], "\n")
+	if !strings.Contains(pixel, "Device: Google Pixel (smartphone, from file name)") || !strings.Contains(pixel, "Captured: 2024-01-03 15:56:06 (from file name, timezone unknown)") {
+		t.Fatalf("expected device and capture time from the file name, got %q", pixel)
+	}
+	if exif := strings.Join(insights["IMG_20240103_155606.jpg"], "\n"); strings.Contains(exif, "from file name") {
+		t.Fatalf("expected EXIF to take precedence over the file name, got %q", exif)
+	}
+
+	cleanDir := filepath.Join(dir, "out")
+	summary, _, err = Run(context.Background(), dir, Options{Mode: ModeClean, OutputDir: cleanDir}, nil)
+	if err != nil || summary.Errors != 0 {
+		t.Fatalf("clean: %v %#v", err, summary.Failures)
+	}
+	if summary.Leaks != 2 {
+		t.Fatalf("expected clean to count only the JPEG's EXIF, got %d", summary.Leaks)
+	}
+	summary, reports, err = Run(context.Background(), cleanDir, Options{Mode: ModeScan}, nil)
+	if err != nil {
+		t.Fatalf("rescan: %v", err)
+	}
+	if summary.Leaks != 0 || len(reports) == 0 {
+		t.Fatalf("expected a cleaned tree to have no leaks despite its names, got %d", summary.Leaks)
+	}
+}
+
+func TestFindingsLocateValues(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.jpg")
+	if err := buildJPEGWithExif(src); err != nil {
+		t.Fatalf("build JPEG: %v", err)
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	findings := scanDetails(t, src, imgutil.KindJPEG)
+	var model *Finding
+	for i := range findings {
+		if findings[i].TagName == "Model" {
+			model = &findings[i]
+		}
+	}
+	if model == nil {
+		t.Fatalf("expected Model finding, got: %#v", findings)
+	}
+	if model.Format != "jpeg" || model.TagID != 0x0110 || model.Category != CategoryDevice || model.Container != "APP1:Exif/IFD" {
+		t.Fatalf("unexpected Model finding: %#v", model)
+	}
+	if got := string(data[model.Offset : model.Offset+model.Length]); got != "TestCam\x00" {
+		t.Fatalf("expected offset to locate value, got %q", got)
+	}
+
+	insights := buildInsights(imgutil.KindJPEG, findings)
+	if len(insights) == 0 || insights[0].Message != "Device: TestCam" {
+		t.Fatalf("expected device insight from findings, got: %#v", insights)
 	}
 }
 
-func scanDetails(t *testing.T, path string, kind imgutil.Kind) []ScanDetail {
+func scanDetails(t *testing.T, path string, kind imgutil.Kind) []Finding {
 	t.Helper()
 
 	file, err := os.Open(path)
@@ -78,13 +1981,18 @@ func scanDetails(t *testing.T, path string, kind imgutil.Kind) []ScanDetail {
 	return details
 }
 
-func hasDetail(details []ScanDetail, category string) bool {
-	for _, detail := range details {
-		if detail.Category == category && len(detail.Values) > 0 {
-			return true
+func hasDetail(findings []Finding, category string) bool {
+	return countCategory(findings, category) > 0
+}
+
+func countCategory(findings []Finding, category string) int {
+	total := 0
+	for _, finding := range findings {
+		if finding.Category == category {
+			total++
 		}
 	}
-	return false
+	return total
 }
 
 func cleanToOutput(t *testing.T, srcPath, outDir string, kind imgutil.Kind) error {
@@ -143,6 +2051,245 @@ func buildExifTIFF() []byte {
 	return tiff.Bytes()
 }
 
+var tiffTestPixels = []byte{0x11, 0x22, 0x33, 0x44}
+
+func buildTIFFWithMetadata(path string) error {
+	type entry struct {
+		tag   uint16
+		typ   uint16
+		count uint32
+		value uint32
+	}
+
+	model := []byte("TestCam\x00")
+	stamp := []byte("2024:01:02 03:04:05\x00")
+	entries := []entry{
+		{0x0100, 3, 1, 2},
+		{0x0101, 3, 1, 2},
+		{0x0102, 3, 1, 8},
+		{0x0103, 3, 1, 1},
+		{0x0106, 3, 1, 1},
+		{0x0110, 2, uint32(len(model)), 0},
+		{0x0111, 4, 1, 0},
+		{0x0115, 3, 1, 1},
+		{0x0116, 3, 1, 2},
+		{0x0117, 4, 1, uint32(len(tiffTestPixels))},
+		{0x0132, 2, uint32(len(stamp)), 0},
+	}
+
+	ifdSize := 2 + len(entries)*12 + 4
+	modelOffset := uint32(8 + ifdSize)
+	stampOffset := modelOffset + uint32(len(model))
+	pixelOffset := stampOffset + uint32(len(stamp))
+	entries[5].value = modelOffset
+	entries[6].value = pixelOffset
+	entries[10].value = stampOffset
+
+	var tiff bytes.Buffer
+	tiff.Write([]byte{0x49, 0x49, 0x2a, 0x00})
+	_ = binary.Write(&tiff, binary.LittleEndian, uint32(8))
+	_ = binary.Write(&tiff, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		_ = binary.Write(&tiff, binary.LittleEndian, e.tag)
+		_ = binary.Write(&tiff, binary.LittleEndian, e.typ)
+		_ = binary.Write(&tiff, binary.LittleEndian, e.count)
+		if e.typ == 3 {
+			_ = binary.Write(&tiff, binary.LittleEndian, uint16(e.value))
+			_ = binary.Write(&tiff, binary.LittleEndian, uint16(0))
+		} else {
+			_ = binary.Write(&tiff, binary.LittleEndian, e.value)
+		}
+	}
+	_ = binary.Write(&tiff, binary.LittleEndian, uint32(0))
+	tiff.Write(model)
+	tiff.Write(stamp)
+	tiff.Write(tiffTestPixels)
+
+	return os.WriteFile(path, tiff.Bytes(), 0o644)
+}
+
+func buildWebPWithMetadata(path string) error {
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:exif="http://ns.adobe.com/exif/1.0/" ` +
+		`xmp:CreateDate="2024-01-02T03:04:05" exif:GPSLatitude="43,51.79N"/></rdf:RDF></x:xmpmeta>`
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	body.Write(buildRIFFChunk("VP8X", []byte{webpFlagICC | webpFlagEXIF | webpFlagXMP, 0, 0, 0, 0, 0, 0, 0, 0, 0}))
+	body.Write(buildRIFFChunk("ICCP", []byte("fake-icc")))
+	body.Write(buildRIFFChunk("VP8L", []byte{0x2f, 0x00, 0x00, 0x00, 0x00}))
+	body.Write(buildRIFFChunk("EXIF", buildExifTIFF()))
+	body.Write(buildRIFFChunk("XMP ", []byte(xmp)))
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(body.Len()))
+	buf.Write(body.Bytes())
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+func buildRIFFChunk(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+var heifTestCoded = []byte("HVC-CODED-IMAGE-DATA")
+
+func buildHEIFWithMetadata(path string) error {
+	return buildHEIF(path, false)
+}
+
+// buildHEIF writes a HEIF with EXIF and XMP items, giving its mdat a
+// 64-bit largesize header when large is set.
+func buildHEIF(path string, large bool) error {
+	exifItem := append([]byte{0, 0, 0, 6}, []byte("Exif\x00\x00")...)
+	exifItem = append(exifItem, buildExifTIFF()...)
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:tiff="http://ns.adobe.com/tiff/1.0/"><tiff:Model>TestCam</tiff:Model></rdf:Description></rdf:RDF></x:xmpmeta>`)
+
+	infe := func(id uint16, itemType string, contentType string) []byte {
+		payload := []byte{2, 0, 0, 0}
+		payload = binary.BigEndian.AppendUint16(payload, id)
+		payload = append(payload, 0, 0)
+		payload = append(payload, itemType...)
+		payload = append(payload, 0)
+		if contentType != "" {
+			payload = append(payload, contentType...)
+			payload = append(payload, 0)
+		}
+		return appendBox(nil, "infe", payload)
+	}
+
+	iinf := []byte{0, 0, 0, 0, 0, 3}
+	iinf = append(iinf, infe(1, "hvc1", "")...)
+	iinf = append(iinf, infe(2, "Exif", "")...)
+	iinf = append(iinf, infe(3, "mime", "application/rdf+xml")...)
+
+	cdsc := []byte{0, 2, 0, 1, 0, 1}
+	iref := appendBox([]byte{0, 0, 0, 0}, "cdsc", cdsc)
+
+	ipma := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 1, 0x81}
+	iprp := appendBox(nil, "ipco", appendBox(nil, "ispe", make([]byte, 12)))
+	iprp = appendBox(iprp, "ipma", ipma)
+
+	ftyp := appendBox(nil, "ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+
+	buildMeta := func(offsets [3]uint32) []byte {
+		iloc := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 3}
+		lengths := [3]int{len(heifTestCoded), len(exifItem), len(xmp)}
+		for i := 0; i < 3; i++ {
+			iloc = binary.BigEndian.AppendUint16(iloc, uint16(i+1))
+			iloc = append(iloc, 0, 0, 0, 1)
+			iloc = binary.BigEndian.AppendUint32(iloc, offsets[i])
+			iloc = binary.BigEndian.AppendUint32(iloc, uint32(lengths[i]))
+		}
+		meta := []byte{0, 0, 0, 0}
+		meta = appendBox(meta, "hdlr", append(make([]byte, 8), []byte("pict\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")...))
+		meta = appendBox(meta, "pitm", []byte{0, 0, 0, 0, 0, 1})
+		meta = appendBox(meta, "iinf", iinf)
+		meta = appendBox(meta, "iloc", iloc)
+		meta = appendBox(meta, "iref", iref)
+		meta = appendBox(meta, "iprp", iprp)
+		return appendBox(nil, "meta", meta)
+	}
+
+	mdatHeader := 8
+	if large {
+		mdatHeader = 16
+	}
+	mdatStart := uint32(len(ftyp) + len(buildMeta([3]uint32{})) + mdatHeader)
+	offsets := [3]uint32{
+		mdatStart + uint32(len(exifItem)),
+		mdatStart,
+		mdatStart + uint32(len(exifItem)+len(heifTestCoded)),
+	}
+
+	var mdat []byte
+	mdat = append(mdat, exifItem...)
+	mdat = append(mdat, heifTestCoded...)
+	mdat = append(mdat, xmp...)
+
+	out := append([]byte{}, ftyp...)
+	out = append(out, buildMeta(offsets)...)
+	if large {
+		out = binary.BigEndian.AppendUint32(out, 1)
+		out = append(out, "mdat"...)
+		out = binary.BigEndian.AppendUint64(out, uint64(len(mdat)+16))
+		out = append(out, mdat...)
+	} else {
+		out = appendBox(out, "mdat", mdat)
+	}
+	return os.WriteFile(path, out, 0o644)
+}
+
+func buildMPOWithExif(path string) error {
+	return buildMPO(path, true, nil)
+}
+
+// buildMPO writes an MPO whose secondary image has EXIF and follows gap.
+// The primary image has EXIF when primaryExif is set.
+func buildMPO(path string, primaryExif bool, gap []byte) error {
+	exif := append([]byte("Exif\x00\x00"), buildExifTIFF()...)
+	segment := func(marker byte, payload []byte) []byte {
+		out := []byte{0xff, marker}
+		out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+		return append(out, payload...)
+	}
+
+	var secondary []byte
+	secondary = append(secondary, 0xff, 0xd8)
+	secondary = append(secondary, segment(0xe1, exif)...)
+	secondary = append(secondary, 0xff, 0xd9)
+
+	buildMPF := func(primarySize, secondaryOffset uint32) []byte {
+		mpf := append([]byte{}, "MPF\x00"...)
+		mpf = append(mpf, 'I', 'I', 0x2a, 0x00)
+		mpf = binary.LittleEndian.AppendUint32(mpf, 8)
+		mpf = binary.LittleEndian.AppendUint16(mpf, 1)
+		mpf = binary.LittleEndian.AppendUint16(mpf, mpTagEntry)
+		mpf = binary.LittleEndian.AppendUint16(mpf, 7)
+		mpf = binary.LittleEndian.AppendUint32(mpf, 32)
+		mpf = binary.LittleEndian.AppendUint32(mpf, 26)
+		mpf = binary.LittleEndian.AppendUint32(mpf, 0)
+		mpf = binary.LittleEndian.AppendUint32(mpf, 0x20030000)
+		mpf = binary.LittleEndian.AppendUint32(mpf, primarySize)
+		mpf = binary.LittleEndian.AppendUint32(mpf, 0)
+		mpf = append(mpf, 0, 0, 0, 0)
+		mpf = binary.LittleEndian.AppendUint32(mpf, 0x00020002)
+		mpf = binary.LittleEndian.AppendUint32(mpf, uint32(len(secondary)))
+		mpf = binary.LittleEndian.AppendUint32(mpf, secondaryOffset)
+		return append(mpf, 0, 0, 0, 0)
+	}
+
+	sos := []byte{0x01, 0x01, 0x00, 0x00, 0x3f, 0x00}
+	scan := []byte{0x12, 0xff, 0x00, 0x34, 0xff, 0xd0, 0x56}
+	buildPrimary := func(mpf []byte) []byte {
+		var primary []byte
+		primary = append(primary, 0xff, 0xd8)
+		if primaryExif {
+			primary = append(primary, segment(0xe1, exif)...)
+		}
+		primary = append(primary, segment(0xe2, mpf)...)
+		primary = append(primary, segment(0xda, sos)...)
+		primary = append(primary, scan...)
+		return append(primary, 0xff, 0xd9)
+	}
+
+	size := uint32(len(buildPrimary(buildMPF(0, 0))))
+	mpfBase := uint32(2 + 4 + 4)
+	if primaryExif {
+		mpfBase += uint32(4 + len(exif))
+	}
+	primary := buildPrimary(buildMPF(size, size-mpfBase+uint32(len(gap))))
+	return os.WriteFile(path, append(append(primary, gap...), secondary...), 0o644)
+}
+
 func buildPNGWithMetadata(path string) error {
 	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
 	img.Set(0, 0, color.RGBA{R: 0xff, A: 0xff})
@@ -170,6 +2317,45 @@ func buildPNGWithMetadata(path string) error {
 	return os.WriteFile(path, out, 0o644)
 }
 
+// buildICCProfile builds a matrix/TRC RGB profile with the given D50
+// colorants and the same tone curve for every channel.
+func buildICCProfile(colorants [3][3]float64, trc []byte) []byte {
+	fixed := func(v float64) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(v*65536))))
+	}
+	names := []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"}
+	var tags [][]byte
+	for c := 0; c < 3; c++ {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for row := 0; row < 3; row++ {
+			xyz = append(xyz, fixed(colorants[row][c])...)
+		}
+		tags = append(tags, xyz)
+	}
+	tags = append(tags, trc, trc, trc)
+	header := make([]byte, 128)
+	copy(header[16:], "RGB XYZ ")
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	offset := 128 + 4 + 12*len(tags)
+	var body []byte
+	for i, tag := range tags {
+		table = append(table, names[i]...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(body)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(tag)))
+		body = append(body, tag...)
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+	}
+	profile := append(append(header, table...), body...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func iccGammaCurve(gamma float64) []byte {
+	return binary.BigEndian.AppendUint16([]byte("curv\x00\x00\x00\x00\x00\x00\x00\x01"), uint16(gamma*256))
+}
+
 func buildPNGChunk(chunkType string, data []byte) []byte {
 	chunkTypeBytes := []byte(chunkType)
 	length := uint32(len(data))
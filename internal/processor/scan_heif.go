@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+func scanHEIFMetadata(rs io.ReadSeeker) ([]Finding, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	heif, err := parseHEIF(data)
+	if err != nil {
+		if errors.Is(err, errNoHEIFMeta) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var findings []Finding
+	for _, item := range heif.items {
+		switch {
+		case isHEIFExifItem(item):
+			payload, err := heif.itemData(item.ID)
+			if err != nil {
+				return findings, err
+			}
+			tiff, ok := heifExifTIFF(payload)
+			if !ok {
+				continue
+			}
+			exifFindings, err := analyzeExif(bytes.NewReader(tiff))
+			if err != nil {
+				return findings, err
+			}
+			container := fmt.Sprintf("Exif item %d", item.ID)
+			findings = append(findings, relocateFindings(exifFindings, container, heif.itemOffset(item.ID, int64(len(payload)-len(tiff))))...)
+		case isHEIFXMPItem(item):
+			payload, err := heif.itemData(item.ID)
+			if err != nil {
+				return findings, err
+			}
+			container := fmt.Sprintf("mime item %d", item.ID)
+			findings = append(findings, relocateFindings(xmpFindings(payload), container, heif.itemOffset(item.ID, 0))...)
+		}
+	}
+
+	return findings, nil
+}
+
+// heifExifTIFF skips the exif_tiff_header_offset prefix of a HEIF Exif item.
+func heifExifTIFF(payload []byte) ([]byte, bool) {
+	if len(payload) < 4 {
+		return nil, false
+	}
+	offset := uint64(binary.BigEndian.Uint32(payload[0:4]))
+	if 4+offset > uint64(len(payload)) {
+		return nil, false
+	}
+	return payload[4+offset:], true
+}
@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+func scanJPEGMetadata(rs io.ReadSeeker) ([]Finding, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the primary image is searched for its EXIF block, so EXIF in
+	// secondary MPF images or a trailer is not reported twice. A JPEG we
+	// cannot walk is still searched whole rather than failing the scan.
+	img, walkErr := parseJPEG(data)
+	primary := data
+	if walkErr == nil && img.End > 0 {
+		primary = data[:img.End]
+	}
+	findings, err := analyzeExif(bytes.NewReader(primary))
+	if err != nil {
+		return nil, err
+	}
+	findings = relocateFindings(findings, "APP1:Exif", 0)
+	if walkErr != nil {
+		return findings, nil
+	}
+
+	findings = append(findings, jpegSegmentFindings(img)...)
+
+	var secondary []mpImage
+	if index, base, ok := findMPF(img); ok {
+		secondary, _ = mpSecondaryImages(data, index, base, img.End)
+	}
+
+	end := img.End
+	for _, image := range secondary {
+		if gap := trailerFromBytes(data[end:image.Start], int64(end)); gap != nil {
+			findings = append(findings, *gap)
+		}
+		end = image.End
+		container := fmt.Sprintf("MPImage%d", image.Number)
+		embeddedData := data[image.Start:image.End]
+
+		embedded, err := analyzeExif(bytes.NewReader(embeddedData))
+		if err != nil {
+			embedded = nil
+		}
+		embedded = relocateFindings(embedded, "APP1:Exif", 0)
+		if embeddedImg, err := parseJPEG(embeddedData); err == nil {
+			embedded = append(embedded, jpegSegmentFindings(embeddedImg)...)
+		}
+
+		description := fmt.Sprintf("%s, %d bytes", mpImageType(image.Entry.Attribute), image.End-image.Start)
+		if countFindingLeaks(embedded) > 0 {
+			description += ", has EXIF"
+		}
+		findings = append(findings, Finding{
+			Container: "APP2:MPF",
+			TagID:     NoTagID,
+			TagName:   container,
+			RawValue:  description,
+			Value:     description,
+			Offset:    int64(image.Start),
+			Length:    int64(image.End - image.Start),
+			Category:  CategoryEmbedded,
+		})
+		findings = append(findings, relocateFindings(embedded, container, int64(image.Start))...)
+	}
+
+	if trailer := trailerFromBytes(data[end:], int64(end)); trailer != nil {
+		findings = append(findings, *trailer)
+	}
+
+	return findings, nil
+}
+
+func jpegSegmentFindings(img jpegImage) []Finding {
+	var findings []Finding
+	for _, seg := range img.Segments {
+		if seg.Marker == 0xe1 && hasPrefix(seg.Payload, jpegXmpHeader) {
+			packet := seg.Payload[len(jpegXmpHeader):]
+			findings = append(findings, relocateFindings(xmpFindings(packet), "APP1", int64(seg.Start+4+len(jpegXmpHeader)))...)
+			continue
+		}
+		if isStandardJPEGSegment(seg.Marker, seg.Payload) {
+			continue
+		}
+		name, description := describeJPEGSegment(seg.Marker, seg.Payload)
+		findings = append(findings, Finding{
+			Container: name,
+			TagID:     int(seg.Marker),
+			TagName:   name,
+			RawValue:  description,
+			Value:     description,
+			Offset:    int64(seg.Start),
+			Length:    int64(seg.End - seg.Start),
+			Category:  CategorySegment,
+		})
+	}
+	return findings
+}
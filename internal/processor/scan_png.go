@@ -5,108 +5,120 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"strings"
 )
 
-type PngAnalysis struct {
-	HasGPS          bool
-	HasModel        bool
-	HasTimestamp    bool
-	GPSValues       []string
-	ModelValues     []string
-	TimestampValues []string
-}
-
-func scanPNGMetadata(rs io.ReadSeeker) (PngAnalysis, error) {
-	analysis := PngAnalysis{}
+func scanPNGMetadata(rs io.ReadSeeker) ([]Finding, error) {
+	var findings []Finding
 
 	if _, err := rs.Seek(0, io.SeekStart); err != nil {
-		return analysis, err
+		return nil, err
 	}
 
 	br := bufio.NewReader(rs)
 
 	sig := make([]byte, 8)
 	if _, err := io.ReadFull(br, sig); err != nil {
-		return analysis, err
+		return nil, err
 	}
 	if !bytesEqual(sig, pngSignature) {
-		return analysis, errors.New("invalid PNG signature")
+		return nil, fmt.Errorf("%w PNG signature", errMalformed)
 	}
 
+	pos := int64(len(sig))
 	for {
 		lenBuf := make([]byte, 4)
 		if _, err := io.ReadFull(br, lenBuf); err != nil {
 			if err == io.EOF {
-				return analysis, nil
+				return findings, nil
 			}
-			return analysis, err
+			return findings, err
 		}
 		length := binary.BigEndian.Uint32(lenBuf)
 
 		chunkType := make([]byte, 4)
 		if _, err := io.ReadFull(br, chunkType); err != nil {
-			return analysis, err
+			return findings, err
 		}
 
 		chunkName := string(chunkType)
+		dataOffset := pos + 8
+		pos = dataOffset + int64(length) + 4
 
 		switch chunkName {
 		case "tEXt", "zTXt", "iTXt":
 			data := make([]byte, length)
 			if _, err := io.ReadFull(br, data); err != nil {
-				return analysis, err
+				return findings, err
 			}
 			if _, err := io.CopyN(io.Discard, br, 4); err != nil {
-				return analysis, err
+				return findings, err
 			}
 			key, value := extractPNGText(chunkName, data)
 			if key != "" {
-				applyKeyToPngAnalysis(&analysis, key, value)
+				if finding, ok := pngTextFinding(chunkName, key, value); ok {
+					finding.Offset = dataOffset
+					finding.Length = int64(length)
+					findings = append(findings, finding)
+				}
 			}
 		case "tIME":
-			analysis.HasTimestamp = true
 			if length == 7 {
 				timeData := make([]byte, 7)
 				if _, err := io.ReadFull(br, timeData); err != nil {
-					return analysis, err
+					return findings, err
 				}
 				if _, err := io.CopyN(io.Discard, br, 4); err != nil {
-					return analysis, err
+					return findings, err
 				}
 				ts := formatPNGTime(timeData)
 				if ts != "" {
-					analysis.TimestampValues = appendUnique(analysis.TimestampValues, "tIME="+ts)
+					findings = append(findings, Finding{
+						Container: "tIME",
+						TagID:     NoTagID,
+						TagName:   "tIME",
+						RawValue:  ts,
+						Value:     ts,
+						Offset:    dataOffset,
+						Length:    int64(length),
+						Category:  CategoryTimestamp,
+					})
 				}
 			} else {
 				if _, err := io.CopyN(io.Discard, br, int64(length)+4); err != nil {
-					return analysis, err
+					return findings, err
 				}
 			}
 		case "eXIf":
 			exifData := make([]byte, length)
 			if _, err := io.ReadFull(br, exifData); err != nil {
-				return analysis, err
+				return findings, err
 			}
 			if _, err := io.CopyN(io.Discard, br, 4); err != nil {
-				return analysis, err
+				return findings, err
 			}
-			exifAnalysis, err := analyzeExif(bytes.NewReader(exifData))
+			exifFindings, err := analyzeExif(bytes.NewReader(exifData))
 			if err != nil {
-				return analysis, err
+				return findings, err
 			}
-			mergeExifIntoPNG(&analysis, exifAnalysis)
+			findings = append(findings, relocateFindings(exifFindings, "eXIf", dataOffset)...)
 		default:
 			if _, err := io.CopyN(io.Discard, br, int64(length)+4); err != nil {
-				return analysis, err
+				return findings, err
 			}
 		}
 
 		if chunkName == "IEND" {
-			return analysis, nil
+			trailer, err := trailerFromReader(br, pos)
+			if err != nil {
+				return findings, err
+			}
+			if trailer != nil {
+				findings = append(findings, *trailer)
+			}
+			return findings, nil
 		}
 	}
 }
@@ -194,20 +206,32 @@ func parsePNGiTxt(data []byte) (string, string) {
 	return key, sanitizeValue(string(textBytes))
 }
 
-func applyKeyToPngAnalysis(analysis *PngAnalysis, key string, value string) {
-	lower := strings.ToLower(key)
-	entry := fmtKeyValue(key, value)
-	if strings.Contains(lower, "gps") || strings.Contains(lower, "latitude") || strings.Contains(lower, "longitude") {
-		analysis.HasGPS = true
-		analysis.GPSValues = appendUnique(analysis.GPSValues, entry)
-	}
-	if strings.Contains(lower, "model") || strings.Contains(lower, "make") {
-		analysis.HasModel = true
-		analysis.ModelValues = appendUnique(analysis.ModelValues, entry)
+func pngTextFinding(chunkName string, key string, value string) (Finding, bool) {
+	category := classifyPNGTextKey(key)
+	if category == "" {
+		return Finding{}, false
 	}
-	if strings.Contains(lower, "date") || strings.Contains(lower, "time") {
-		analysis.HasTimestamp = true
-		analysis.TimestampValues = appendUnique(analysis.TimestampValues, entry)
+	return Finding{
+		Container: chunkName,
+		TagID:     NoTagID,
+		TagName:   key,
+		RawValue:  value,
+		Value:     value,
+		Category:  category,
+	}, true
+}
+
+func classifyPNGTextKey(key string) string {
+	lower := strings.ToLower(key)
+	switch {
+	case strings.Contains(lower, "gps") || strings.Contains(lower, "latitude") || strings.Contains(lower, "longitude"):
+		return CategoryGPS
+	case strings.Contains(lower, "model") || strings.Contains(lower, "make"):
+		return CategoryDevice
+	case strings.Contains(lower, "date") || strings.Contains(lower, "time"):
+		return CategoryTimestamp
+	default:
+		return ""
 	}
 }
 
@@ -232,25 +256,3 @@ func formatPNGTime(data []byte) string {
 	second := data[6]
 	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", year, month, day, hour, minute, second)
 }
-
-func mergeExifIntoPNG(analysis *PngAnalysis, exifAnalysis ExifAnalysis) {
-	if exifAnalysis.HasGPS {
-		analysis.HasGPS = true
-	}
-	if exifAnalysis.HasModel {
-		analysis.HasModel = true
-	}
-	if exifAnalysis.HasTimestamp {
-		analysis.HasTimestamp = true
-	}
-	analysis.GPSValues = appendUniqueSlice(analysis.GPSValues, exifAnalysis.GPSValues)
-	analysis.ModelValues = appendUniqueSlice(analysis.ModelValues, exifAnalysis.ModelValues)
-	analysis.TimestampValues = appendUniqueSlice(analysis.TimestampValues, exifAnalysis.TimestampValues)
-}
-
-func appendUniqueSlice(values []string, incoming []string) []string {
-	for _, value := range incoming {
-		values = appendUnique(values, value)
-	}
-	return values
-}
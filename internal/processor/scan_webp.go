@@ -0,0 +1,97 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+var (
+	riffSignature = []byte("RIFF")
+	webpSignature = []byte("WEBP")
+)
+
+type webpChunk struct {
+	Name   string
+	Data   []byte
+	Offset int64
+}
+
+func readWebPChunks(r io.Reader) ([]webpChunk, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytesEqual(header[0:4], riffSignature) || !bytesEqual(header[8:12], webpSignature) {
+		return nil, fmt.Errorf("%w WebP signature", errMalformed)
+	}
+	riffSize := binary.LittleEndian.Uint32(header[4:8])
+	if riffSize < 4 {
+		return nil, fmt.Errorf("%w RIFF size", errMalformed)
+	}
+
+	body := &io.LimitedReader{R: r, N: int64(riffSize) - 4}
+	var chunks []webpChunk
+	pos := int64(len(header))
+	for {
+		chunkHeader := make([]byte, 8)
+		if _, err := io.ReadFull(body, chunkHeader); err != nil {
+			if err == io.EOF {
+				return chunks, nil
+			}
+			return nil, err
+		}
+		size := binary.LittleEndian.Uint32(chunkHeader[4:8])
+		if int64(size)+int64(size%2) > body.N {
+			return nil, fmt.Errorf("%w WebP chunk %q: larger than the RIFF body", errTruncated, string(chunkHeader[0:4]))
+		}
+		// The RIFF size can lie too, so the buffer grows with the bytes
+		// actually read rather than the declared size.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, body, int64(size)); err != nil {
+			return nil, fmt.Errorf("%w WebP chunk %q: %w", errTruncated, string(chunkHeader[0:4]), err)
+		}
+		data := buf.Bytes()
+		if size%2 != 0 {
+			if _, err := io.CopyN(io.Discard, body, 1); err != nil {
+				return nil, fmt.Errorf("%w WebP chunk %q: %w", errTruncated, string(chunkHeader[0:4]), err)
+			}
+		}
+		chunks = append(chunks, webpChunk{Name: string(chunkHeader[0:4]), Data: data, Offset: pos + 8})
+		pos += 8 + int64(size) + int64(size%2)
+	}
+}
+
+func scanWebPMetadata(rs io.ReadSeeker) ([]Finding, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	chunks, err := readWebPChunks(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []Finding
+	for _, chunk := range chunks {
+		switch chunk.Name {
+		case "EXIF":
+			data := chunk.Data
+			base := chunk.Offset
+			if hasPrefix(data, jpegExifHeader) {
+				data = data[len(jpegExifHeader):]
+				base += int64(len(jpegExifHeader))
+			}
+			exifFindings, err := analyzeExif(bytes.NewReader(data))
+			if err != nil {
+				return findings, err
+			}
+			findings = append(findings, relocateFindings(exifFindings, "EXIF", base)...)
+		case "XMP ":
+			findings = append(findings, relocateFindings(xmpFindings(chunk.Data), "", chunk.Offset)...)
+		}
+	}
+
+	return findings, nil
+}
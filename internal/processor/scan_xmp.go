@@ -0,0 +1,115 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+const (
+	xmpRDFNamespace  = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmpMetaNamespace = "adobe:ns:meta/"
+)
+
+type xmpProperty struct {
+	Name  string
+	Value string
+}
+
+func parseXMP(data []byte) []xmpProperty {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	var props []xmpProperty
+	var stack []string
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return props
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			for _, attr := range t.Attr {
+				if isXMPStructural(attr.Name) {
+					continue
+				}
+				if value := sanitizeValue(attr.Value); value != "" {
+					props = append(props, xmpProperty{Name: attr.Name.Local, Value: value})
+				}
+			}
+			if isXMPStructural(t.Name) {
+				stack = append(stack, "")
+			} else {
+				stack = append(stack, t.Name.Local)
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			value := sanitizeValue(string(t))
+			if value == "" {
+				continue
+			}
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i] != "" {
+					props = append(props, xmpProperty{Name: stack[i], Value: value})
+					break
+				}
+			}
+		}
+	}
+}
+
+func isXMPStructural(name xml.Name) bool {
+	switch {
+	case name.Space == "xmlns" || name.Local == "xmlns":
+		return true
+	case name.Space == xmpRDFNamespace || name.Space == xmpMetaNamespace:
+		return true
+	case name.Space == "xml" || name.Space == "http://www.w3.org/XML/1998/namespace":
+		return true
+	default:
+		return false
+	}
+}
+
+// xmpFindings reports the privacy-relevant properties of an XMP packet. Each
+// finding spans the whole packet, since properties have no fixed position.
+func xmpFindings(packet []byte) []Finding {
+	var findings []Finding
+	for _, prop := range parseXMP(packet) {
+		category := classifyXMPProperty(prop.Name)
+		if category == "" {
+			continue
+		}
+		findings = append(findings, Finding{
+			Container: "XMP",
+			TagID:     NoTagID,
+			TagName:   prop.Name,
+			RawValue:  prop.Value,
+			Value:     prop.Value,
+			Offset:    0,
+			Length:    int64(len(packet)),
+			Category:  category,
+		})
+	}
+	return findings
+}
+
+func classifyXMPProperty(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(name, "GPS"):
+		return CategoryGPS
+	case name == "Make" || name == "Model" || name == "CameraModelName":
+		return CategoryDevice
+	case strings.Contains(lower, "serial"):
+		return CategorySerial
+	case strings.HasPrefix(name, "DateTime") || strings.HasSuffix(name, "Date") || name == "DateCreated":
+		return CategoryTimestamp
+	default:
+		return ""
+	}
+}
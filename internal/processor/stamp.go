@@ -0,0 +1,435 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+
+	"bleach/pkg/imgutil"
+)
+
+// Stamp holds the fields clean --set writes into cleaned files, keyed by
+// the names in StampKeys.
+type Stamp map[string]string
+
+// stampExifTags are the EXIF fields a stamp can set. They are written as
+// IFD0 tags, or as iTXt chunks with the matching PNG keyword.
+var stampExifTags = []struct {
+	name       string
+	tag        uint16
+	pngKeyword string
+}{
+	{"Artist", tiffTagArtist, "Author"},
+	{"Copyright", tiffTagCopyright, "Copyright"},
+	{"ImageDescription", tiffTagImageDescription, "Description"},
+}
+
+type xmpForm int
+
+const (
+	xmpSimple xmpForm = iota
+	xmpAlt
+	xmpSeq
+)
+
+// stampXMPProperties are the XMP fields a stamp can set, with the RDF form
+// their schema requires.
+var stampXMPProperties = []struct {
+	name string
+	form xmpForm
+}{
+	{"dc:creator", xmpSeq},
+	{"dc:rights", xmpAlt},
+	{"dc:title", xmpAlt},
+	{"dc:description", xmpAlt},
+	{"xmpRights:Marked", xmpSimple},
+	{"xmpRights:UsageTerms", xmpAlt},
+	{"xmpRights:WebStatement", xmpSimple},
+	{"photoshop:Credit", xmpSimple},
+	{"photoshop:Source", xmpSimple},
+}
+
+var xmpNamespaces = map[string]string{
+	"dc":        "http://purl.org/dc/elements/1.1/",
+	"xmpRights": "http://ns.adobe.com/xap/1.0/rights/",
+	"photoshop": "http://ns.adobe.com/photoshop/1.0/",
+}
+
+// StampKeys lists the field names a Stamp accepts.
+func StampKeys() []string {
+	var keys []string
+	for _, field := range stampExifTags {
+		keys = append(keys, field.name)
+	}
+	for _, property := range stampXMPProperties {
+		keys = append(keys, property.name)
+	}
+	return keys
+}
+
+// Set parses a Key=Value field and adds it to s. Keys are matched
+// case-insensitively against StampKeys.
+func (s Stamp) Set(field string) error {
+	key, value, ok := strings.Cut(field, "=")
+	if !ok {
+		return fmt.Errorf("invalid field %q (want Key=Value)", field)
+	}
+	if strings.ContainsRune(value, 0) {
+		return fmt.Errorf("invalid field %q: value contains a NUL byte", field)
+	}
+	for _, name := range StampKeys() {
+		if strings.EqualFold(name, strings.TrimSpace(key)) {
+			s[name] = value
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown field %q (want one of %s)", key, strings.Join(StampKeys(), ", "))
+}
+
+// exifEntries returns the stamp's EXIF fields as IFD0 ASCII entries.
+func (s Stamp) exifEntries() []exifEntry {
+	var entries []exifEntry
+	for _, field := range stampExifTags {
+		if value, ok := s[field.name]; ok {
+			entries = append(entries, exifEntry{IFD: exifPathIFD0, Tag: field.tag, Type: tiffTypeASCII, Count: uint32(len(value) + 1), Value: append([]byte(value), 0)})
+		}
+	}
+	return entries
+}
+
+// exif returns a TIFF-structured EXIF block with the stamp's EXIF fields
+// merged into existing, which may be nil. existing is returned as it is when
+// the stamp has no EXIF fields.
+func (s Stamp) exif(existing []byte) ([]byte, error) {
+	entries := s.exifEntries()
+	if len(entries) == 0 {
+		return existing, nil
+	}
+	block := &exifBlock{order: binary.BigEndian}
+	if existing != nil {
+		parsed, err := parseExifBlock(existing)
+		if err != nil {
+			return nil, err
+		}
+		block = parsed
+	}
+	stamped := map[uint16]bool{}
+	for _, entry := range entries {
+		stamped[entry.Tag] = true
+	}
+	block.filter(func(entry exifEntry) bool {
+		return entry.IFD != exifPathIFD0 || !stamped[entry.Tag]
+	})
+	block.entries = append(block.entries, entries...)
+	return block.encode(), nil
+}
+
+// xmp returns an XMP packet holding the stamp's XMP fields, or nil when it
+// has none.
+func (s Stamp) xmp() []byte {
+	var props bytes.Buffer
+	used := map[string]bool{}
+	for _, property := range stampXMPProperties {
+		value, ok := s[property.name]
+		if !ok {
+			continue
+		}
+		prefix, _, _ := strings.Cut(property.name, ":")
+		used[prefix] = true
+
+		var escaped bytes.Buffer
+		_ = xml.EscapeText(&escaped, []byte(value))
+		fmt.Fprintf(&props, "   <%s>", property.name)
+		switch property.form {
+		case xmpAlt:
+			fmt.Fprintf(&props, `<rdf:Alt><rdf:li xml:lang="x-default">%s</rdf:li></rdf:Alt>`, escaped.String())
+		case xmpSeq:
+			fmt.Fprintf(&props, "<rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq>", escaped.String())
+		default:
+			props.Write(escaped.Bytes())
+		}
+		fmt.Fprintf(&props, "</%s>\n", property.name)
+	}
+	if props.Len() == 0 {
+		return nil
+	}
+
+	prefixes := make([]string, 0, len(used))
+	for prefix := range used {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	var out bytes.Buffer
+	out.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	out.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	out.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	out.WriteString("  <rdf:Description rdf:about=\"\"")
+	for _, prefix := range prefixes {
+		fmt.Fprintf(&out, "\n    xmlns:%s=\"%s\"", prefix, xmpNamespaces[prefix])
+	}
+	out.WriteString(">\n")
+	out.Write(props.Bytes())
+	out.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return out.Bytes()
+}
+
+// canStamp reports whether stampFile can write into files of kind. HEIF
+// files are left unstamped.
+func canStamp(kind imgutil.Kind) bool {
+	switch kind {
+	case imgutil.KindJPEG, imgutil.KindPNG, imgutil.KindTIFF, imgutil.KindWebP:
+		return true
+	}
+	return false
+}
+
+// stampFile writes the stamp's fields into a cleaned file. EXIF fields are
+// merged into an EXIF block the clean kept; XMP fields replace any XMP
+// packet it kept.
+func stampFile(kind imgutil.Kind, data []byte, s Stamp) ([]byte, error) {
+	switch kind {
+	case imgutil.KindJPEG:
+		return stampJPEG(data, s)
+	case imgutil.KindPNG:
+		return stampPNG(data, s)
+	case imgutil.KindTIFF:
+		return stampTIFF(data, s)
+	case imgutil.KindWebP:
+		return stampWebP(data, s)
+	default:
+		return nil, fmt.Errorf("%w metadata stamping for %s", errUnsupported, kind)
+	}
+}
+
+// stampJPEG writes the stamp as APP1 segments after SOI and any APP0
+// segments, or after the EXIF segment it merged into. MPF secondary images
+// are left unstamped.
+func stampJPEG(data []byte, s Stamp) ([]byte, error) {
+	img, err := parseJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+	xmp := s.xmp()
+	if xmp != nil && len(jpegXmpHeader)+len(xmp)+2 > 0xffff {
+		return nil, fmt.Errorf("%w stamp: XMP packet too large for a JPEG segment", errUnsupported)
+	}
+
+	var segments [][]byte
+	insertAt := -1
+	exifDone := len(s.exifEntries()) == 0
+	for _, seg := range img.Segments {
+		if insertAt < 0 && seg.Marker != 0xd8 && seg.Marker != 0xe0 {
+			insertAt = len(segments)
+		}
+		switch {
+		case seg.Marker == 0xe1 && hasPrefix(seg.Payload, jpegExifHeader) && !exifDone:
+			tiff, err := s.exif(seg.Payload[len(jpegExifHeader):])
+			if err != nil {
+				return nil, err
+			}
+			payload := append(append([]byte{}, jpegExifHeader...), tiff...)
+			if len(payload)+2 > 0xffff {
+				return nil, fmt.Errorf("%w stamp: EXIF block too large for a JPEG segment", errUnsupported)
+			}
+			segments = append(segments, jpegSegmentBytes(seg.Marker, payload))
+			insertAt = len(segments)
+			exifDone = true
+			continue
+		case seg.Marker == 0xe1 && hasPrefix(seg.Payload, jpegXmpHeader) && xmp != nil:
+			continue
+		}
+		segments = append(segments, data[seg.Start:seg.End])
+	}
+
+	var inserted [][]byte
+	if !exifDone {
+		tiff, err := s.exif(nil)
+		if err != nil {
+			return nil, err
+		}
+		payload := append(append([]byte{}, jpegExifHeader...), tiff...)
+		if len(payload)+2 > 0xffff {
+			return nil, fmt.Errorf("%w stamp: EXIF block too large for a JPEG segment", errUnsupported)
+		}
+		inserted = append(inserted, jpegSegmentBytes(0xe1, payload))
+	}
+	if xmp != nil {
+		inserted = append(inserted, jpegSegmentBytes(0xe1, append(append([]byte{}, jpegXmpHeader...), xmp...)))
+	}
+	segments = append(segments[:insertAt], append(inserted, segments[insertAt:]...)...)
+
+	primary := bytes.Join(segments, nil)
+	return replaceJPEGPrimary(data, img, primary, nil)
+}
+
+// stampPNG writes the stamp as iTXt chunks after IHDR: EXIF fields under
+// their PNG keywords, XMP fields as an XML:com.adobe.xmp packet. Text chunks
+// with the same keywords are replaced.
+func stampPNG(data []byte, s Stamp) ([]byte, error) {
+	chunks, trailer, err := splitPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].name != "IHDR" {
+		return nil, fmt.Errorf("%w PNG: missing IHDR chunk", errMalformed)
+	}
+
+	var stamped []pngChunk
+	replaced := map[string]bool{}
+	for _, field := range stampExifTags {
+		if value, ok := s[field.name]; ok {
+			stamped = append(stamped, pngChunk{name: "iTXt", data: pngITXt(field.pngKeyword, []byte(value))})
+			replaced[field.pngKeyword] = true
+		}
+	}
+	if xmp := s.xmp(); xmp != nil {
+		stamped = append(stamped, pngChunk{name: "iTXt", data: pngITXt(pngXMPKeyword, xmp)})
+		replaced[pngXMPKeyword] = true
+	}
+
+	out := append([]byte{}, pngSignature...)
+	out = append(out, pngChunkBytes(chunks[0].name, chunks[0].data)...)
+	for _, chunk := range stamped {
+		out = append(out, pngChunkBytes(chunk.name, chunk.data)...)
+	}
+	for _, chunk := range chunks[1:] {
+		if isPNGTextChunk(chunk.name) {
+			if key, _ := extractPNGText(chunk.name, chunk.data); replaced[key] {
+				continue
+			}
+		}
+		out = append(out, pngChunkBytes(chunk.name, chunk.data)...)
+	}
+	return append(out, trailer...), nil
+}
+
+func pngITXt(keyword string, text []byte) []byte {
+	out := append([]byte(keyword), 0, 0, 0, 0, 0)
+	return append(out, text...)
+}
+
+// stampTIFF rewrites the file with the stamp's tags merged into IFD0,
+// replacing tags of the same name.
+func stampTIFF(data []byte, s Stamp) ([]byte, error) {
+	if !isTIFFHeader(data) || len(data) < 8 {
+		return nil, fmt.Errorf("%w TIFF header", errMalformed)
+	}
+	order := binary.ByteOrder(binary.BigEndian)
+	if data[0] == 'I' {
+		order = binary.LittleEndian
+	}
+
+	var stamped []tiffEntry
+	for _, entry := range s.exifEntries() {
+		stamped = append(stamped, tiffEntry{tag: entry.Tag, typ: entry.Type, count: entry.Count, data: entry.Value})
+	}
+	if xmp := s.xmp(); xmp != nil {
+		stamped = append(stamped, tiffEntry{tag: tiffTagXMP, typ: 1, count: uint32(len(xmp)), data: xmp})
+	}
+	t := &tiffRewriter{src: data, order: order, copyAll: true, stamp: stamped, visited: map[uint32]bool{}}
+	return t.rewrite()
+}
+
+// stampWebP writes the stamp as EXIF and "XMP " chunks. Simple WebP files
+// get a VP8X header, which is required for metadata chunks.
+func stampWebP(data []byte, s Stamp) ([]byte, error) {
+	chunks, err := readWebPChunks(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []webpChunk
+	exifDone := len(s.exifEntries()) == 0
+	xmp := s.xmp()
+	for _, chunk := range chunks {
+		switch {
+		case chunk.Name == "EXIF" && !exifDone:
+			payload := chunk.Data
+			prefix := 0
+			if hasPrefix(payload, jpegExifHeader) {
+				prefix = len(jpegExifHeader)
+			}
+			tiff, err := s.exif(payload[prefix:])
+			if err != nil {
+				return nil, err
+			}
+			chunk.Data = append(append([]byte{}, payload[:prefix]...), tiff...)
+			exifDone = true
+		case chunk.Name == "XMP " && xmp != nil:
+			continue
+		}
+		out = append(out, chunk)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w WebP: missing image chunk", errMalformed)
+	}
+	if out[0].Name != "VP8X" {
+		vp8x, err := webpVP8X(out[0])
+		if err != nil {
+			return nil, err
+		}
+		out = append([]webpChunk{vp8x}, out...)
+	}
+
+	// Metadata chunks go after the image data, as the container spec
+	// recommends.
+	if !exifDone {
+		tiff, err := s.exif(nil)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, webpChunk{Name: "EXIF", Data: tiff})
+	}
+	if xmp != nil {
+		out = append(out, webpChunk{Name: "XMP ", Data: xmp})
+	}
+
+	var buf bytes.Buffer
+	if err := writeWebP(&buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+const webpFlagAlpha = 0x10
+
+// webpVP8X builds the extended-format header for a simple WebP file from
+// its VP8 or VP8L image chunk.
+func webpVP8X(image webpChunk) (webpChunk, error) {
+	var width, height uint32
+	var flags byte
+	switch image.Name {
+	case "VP8 ":
+		if len(image.Data) < 10 || image.Data[3] != 0x9d || image.Data[4] != 0x01 || image.Data[5] != 0x2a {
+			return webpChunk{}, fmt.Errorf("%w WebP VP8 frame header", errMalformed)
+		}
+		width = uint32(binary.LittleEndian.Uint16(image.Data[6:8]) & 0x3fff)
+		height = uint32(binary.LittleEndian.Uint16(image.Data[8:10]) & 0x3fff)
+	case "VP8L":
+		if len(image.Data) < 5 || image.Data[0] != 0x2f {
+			return webpChunk{}, fmt.Errorf("%w WebP VP8L header", errMalformed)
+		}
+		bits := binary.LittleEndian.Uint32(image.Data[1:5])
+		width = bits&0x3fff + 1
+		height = (bits>>14)&0x3fff + 1
+		if bits>>28&1 != 0 {
+			flags |= webpFlagAlpha
+		}
+	default:
+		return webpChunk{}, fmt.Errorf("%w WebP image chunk %q", errUnsupported, image.Name)
+	}
+	if width == 0 || height == 0 {
+		return webpChunk{}, fmt.Errorf("%w WebP image size", errMalformed)
+	}
+
+	data := make([]byte, 10)
+	data[0] = flags
+	put24 := func(b []byte, v uint32) { b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16) }
+	put24(data[4:7], width-1)
+	put24(data[7:10], height-1)
+	return webpChunk{Name: "VP8X", Data: data}, nil
+}
@@ -0,0 +1,537 @@
+package processor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"bleach/pkg/imgutil"
+)
+
+type byteRange struct {
+	start uint64
+	end   uint64
+}
+
+func stripHEIF(r io.Reader, w io.Writer, policy *Policy) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	heif, err := parseHEIF(data)
+	if err != nil {
+		if errors.Is(err, errNoHEIFMeta) {
+			_, err = w.Write(data)
+			return err
+		}
+		return err
+	}
+
+	removed := map[uint32]bool{}
+	for _, item := range heif.items {
+		switch {
+		case isHEIFExifItem(item):
+			removed[item.ID] = !policy.keepBlock(imgutil.KindHEIF, false, "Exif")
+		case isHEIFXMPItem(item):
+			removed[item.ID] = !policy.keepBlock(imgutil.KindHEIF, false, "XMP")
+		}
+	}
+
+	out, err := heif.rewrite(removed, policy.keepBlock(imgutil.KindHEIF, false, "colr", "ICC"))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func (f *heifFile) rewrite(removed map[uint32]bool, keepICC bool) ([]byte, error) {
+	data := append([]byte{}, f.data...)
+
+	var fileCuts, idatCuts []byteRange
+	var kept []byteRange
+	for _, loc := range f.locations {
+		if loc.ConstructionMethod > 1 {
+			continue
+		}
+		for _, extent := range loc.Extents {
+			if extent.Length == 0 {
+				continue
+			}
+			rng := byteRange{start: loc.BaseOffset + extent.Offset, end: loc.BaseOffset + extent.Offset + extent.Length}
+			if loc.ConstructionMethod == 1 {
+				if removed[loc.ItemID] && f.idat != nil {
+					idatCuts = append(idatCuts, rng)
+				}
+				continue
+			}
+			if removed[loc.ItemID] {
+				fileCuts = append(fileCuts, rng)
+			} else {
+				kept = append(kept, rng)
+			}
+		}
+	}
+
+	// Metadata that is shared with image items or lives outside an mdat box
+	// cannot be cut without corrupting the file, so it is zeroed instead.
+	var mdatCuts []byteRange
+	for _, cut := range fileCuts {
+		if cut.end > uint64(len(data)) {
+			return nil, fmt.Errorf("%w HEIF item extent: out of range", errMalformed)
+		}
+		if !overlapsAny(cut, kept) && f.insideMdat(cut) {
+			mdatCuts = append(mdatCuts, cut)
+			continue
+		}
+		for i := cut.start; i < cut.end; i++ {
+			data[i] = 0
+		}
+	}
+	mdatCuts = mergeRanges(mdatCuts)
+	idatCuts = mergeRanges(idatCuts)
+
+	removedProps, err := f.removedProperties(keepICC)
+	if err != nil {
+		return nil, err
+	}
+
+	build := func(delta int64) ([]byte, error) {
+		var children []byte
+		for _, child := range f.children {
+			raw := data[child.Start:child.End]
+			payload := data[child.payloadStart():child.End]
+			switch child.Type {
+			case "iinf":
+				children = appendBox(children, "iinf", f.buildIINF(payload, removed))
+			case "iloc":
+				iloc, err := f.buildILOC(removed, func(method uint8, offset uint64) uint64 {
+					if method == 1 {
+						return offset - cutBefore(idatCuts, offset)
+					}
+					mapped := int64(offset - cutBefore(mdatCuts, offset))
+					if offset >= uint64(f.meta.End) {
+						mapped += delta
+					}
+					return uint64(mapped)
+				})
+				if err != nil {
+					return nil, err
+				}
+				children = appendBox(children, "iloc", iloc)
+			case "iref":
+				iref, err := buildIREF(payload, removed)
+				if err != nil {
+					return nil, err
+				}
+				children = appendBox(children, "iref", iref)
+			case "iprp":
+				iprp, err := buildIPRP(data, child, removed, removedProps)
+				if err != nil {
+					return nil, err
+				}
+				children = appendBox(children, "iprp", iprp)
+			case "idat":
+				children = appendBox(children, "idat", cutRanges(payload, idatCuts))
+			default:
+				children = append(children, raw...)
+			}
+		}
+		return appendBox(nil, "meta", append(append([]byte{}, f.metaHeader[len(f.metaHeader)-4:]...), children...)), nil
+	}
+
+	// The iloc field sizes are fixed, so a first pass with no shift yields
+	// the final meta size.
+	meta, err := build(0)
+	if err != nil {
+		return nil, err
+	}
+	delta := int64(len(meta)) - int64(f.meta.End-f.meta.Start)
+	if delta != 0 {
+		if meta, err = build(delta); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, 0, len(data))
+	for _, box := range f.boxes {
+		switch {
+		case box.Start == f.meta.Start:
+			out = append(out, meta...)
+		case box.Type == "mdat" && hasCutWithin(mdatCuts, box):
+			payload := data[box.payloadStart():box.End]
+			local := make([]byteRange, 0, len(mdatCuts))
+			for _, cut := range mdatCuts {
+				if cut.start >= uint64(box.payloadStart()) && cut.end <= uint64(box.End) {
+					local = append(local, byteRange{start: cut.start - uint64(box.payloadStart()), end: cut.end - uint64(box.payloadStart())})
+				}
+			}
+			out = appendBoxLike(out, box, cutRanges(payload, local))
+		default:
+			out = append(out, data[box.Start:box.End]...)
+		}
+	}
+
+	return out, nil
+}
+
+func (f *heifFile) insideMdat(rng byteRange) bool {
+	for _, box := range f.boxes {
+		if box.Type == "mdat" && rng.start >= uint64(box.payloadStart()) && rng.end <= uint64(box.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *heifFile) buildIINF(payload []byte, removed map[uint32]bool) []byte {
+	out := append([]byte{}, payload[:4]...)
+	var entries []byte
+	count := 0
+	for _, item := range f.items {
+		if removed[item.ID] {
+			continue
+		}
+		entries = append(entries, item.Raw...)
+		count++
+	}
+	if f.iinfVersion == 0 {
+		out = binary.BigEndian.AppendUint16(out, uint16(count))
+	} else {
+		out = binary.BigEndian.AppendUint32(out, uint32(count))
+	}
+	return append(out, entries...)
+}
+
+func (f *heifFile) buildILOC(removed map[uint32]bool, remap func(method uint8, offset uint64) uint64) ([]byte, error) {
+	offsetSize, lengthSize := 4, 4
+	if uint64(len(f.data)) > 0xffffffff {
+		offsetSize = 8
+	}
+	for _, loc := range f.locations {
+		for _, extent := range loc.Extents {
+			if extent.Length > 0xffffffff {
+				lengthSize = 8
+			}
+		}
+		if loc.BaseOffset > 0xffffffff {
+			offsetSize = 8
+		}
+	}
+
+	out := []byte{f.ilocVersion, 0, 0, 0}
+	out = append(out, byte(offsetSize<<4|lengthSize), byte(offsetSize<<4|f.indexSize))
+
+	var locations []heifLocation
+	for _, loc := range f.locations {
+		if !removed[loc.ItemID] {
+			locations = append(locations, loc)
+		}
+	}
+	if f.ilocVersion < 2 {
+		out = binary.BigEndian.AppendUint16(out, uint16(len(locations)))
+	} else {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(locations)))
+	}
+
+	for _, loc := range locations {
+		if f.ilocVersion < 2 {
+			out = binary.BigEndian.AppendUint16(out, uint16(loc.ItemID))
+		} else {
+			out = binary.BigEndian.AppendUint32(out, loc.ItemID)
+		}
+		if f.ilocVersion == 1 || f.ilocVersion == 2 {
+			out = binary.BigEndian.AppendUint16(out, uint16(loc.ConstructionMethod))
+		}
+		out = binary.BigEndian.AppendUint16(out, loc.DataRefIndex)
+
+		base := loc.BaseOffset
+		if loc.ConstructionMethod <= 1 {
+			base = 0
+		}
+		out = putUint(out, offsetSize, base)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(loc.Extents)))
+		for _, extent := range loc.Extents {
+			if f.indexSize > 0 {
+				out = putUint(out, f.indexSize, extent.Index)
+			}
+			offset := extent.Offset
+			if loc.ConstructionMethod <= 1 {
+				offset = remap(loc.ConstructionMethod, loc.BaseOffset+extent.Offset)
+			}
+			if offsetSize == 4 && offset > 0xffffffff {
+				return nil, fmt.Errorf("%w HEIF extent offset: overflow", errMalformed)
+			}
+			out = putUint(out, offsetSize, offset)
+			out = putUint(out, lengthSize, extent.Length)
+		}
+	}
+	return out, nil
+}
+
+func buildIREF(payload []byte, removed map[uint32]bool) ([]byte, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("%w iref box", errMalformed)
+	}
+	version := payload[0]
+	out := append([]byte{}, payload[:4]...)
+
+	refs, err := readBMFFBoxes(payload, 4, len(payload))
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		r := bmffReader{data: payload[ref.payloadStart():ref.End]}
+		readID := func() uint32 {
+			if version == 0 {
+				return uint32(r.u16())
+			}
+			return r.u32()
+		}
+		from := readID()
+		count := int(r.u16())
+		var to []uint32
+		for i := 0; i < count; i++ {
+			id := readID()
+			if !removed[id] {
+				to = append(to, id)
+			}
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("%w iref entry: %w", errMalformed, r.err)
+		}
+		if removed[from] || len(to) == 0 {
+			continue
+		}
+
+		var entry []byte
+		appendID := func(id uint32) {
+			if version == 0 {
+				entry = binary.BigEndian.AppendUint16(entry, uint16(id))
+			} else {
+				entry = binary.BigEndian.AppendUint32(entry, id)
+			}
+		}
+		appendID(from)
+		entry = binary.BigEndian.AppendUint16(entry, uint16(len(to)))
+		for _, id := range to {
+			appendID(id)
+		}
+		out = appendBox(out, ref.Type, entry)
+	}
+	return out, nil
+}
+
+// removedProperties returns the 1-based ipco indices of ICC colour
+// properties that should be dropped.
+func (f *heifFile) removedProperties(keepICC bool) (map[int]bool, error) {
+	removed := map[int]bool{}
+	if keepICC {
+		return removed, nil
+	}
+	for _, child := range f.children {
+		if child.Type != "iprp" {
+			continue
+		}
+		boxes, err := readBMFFBoxes(f.data, child.payloadStart(), child.End)
+		if err != nil {
+			return nil, err
+		}
+		for _, box := range boxes {
+			if box.Type != "ipco" {
+				continue
+			}
+			props, err := readBMFFBoxes(f.data, box.payloadStart(), box.End)
+			if err != nil {
+				return nil, err
+			}
+			for i, prop := range props {
+				if prop.Type != "colr" || prop.End-prop.payloadStart() < 4 {
+					continue
+				}
+				switch string(f.data[prop.payloadStart() : prop.payloadStart()+4]) {
+				case "prof", "rICC":
+					removed[i+1] = true
+				}
+			}
+		}
+	}
+	return removed, nil
+}
+
+func buildIPRP(data []byte, iprp bmffBox, removedItems map[uint32]bool, removedProps map[int]bool) ([]byte, error) {
+	boxes, err := readBMFFBoxes(data, iprp.payloadStart(), iprp.End)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for _, box := range boxes {
+		switch box.Type {
+		case "ipco":
+			props, err := readBMFFBoxes(data, box.payloadStart(), box.End)
+			if err != nil {
+				return nil, err
+			}
+			var payload []byte
+			for i, prop := range props {
+				if !removedProps[i+1] {
+					payload = append(payload, data[prop.Start:prop.End]...)
+				}
+			}
+			out = appendBox(out, "ipco", payload)
+		case "ipma":
+			ipma, err := buildIPMA(data[box.payloadStart():box.End], removedItems, removedProps)
+			if err != nil {
+				return nil, err
+			}
+			out = appendBox(out, "ipma", ipma)
+		default:
+			out = append(out, data[box.Start:box.End]...)
+		}
+	}
+	return out, nil
+}
+
+func buildIPMA(payload []byte, removedItems map[uint32]bool, removedProps map[int]bool) ([]byte, error) {
+	r := bmffReader{data: payload}
+	version := r.u8()
+	flags := r.bytes(3)
+	wide := len(flags) == 3 && flags[2]&1 != 0
+	count := r.u32()
+
+	var removedIndexes []int
+	for index := range removedProps {
+		removedIndexes = append(removedIndexes, index)
+	}
+	sort.Ints(removedIndexes)
+
+	var entries []byte
+	kept := uint32(0)
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		var id uint32
+		if version < 1 {
+			id = uint32(r.u16())
+		} else {
+			id = r.u32()
+		}
+		n := int(r.u8())
+		var assocs []uint16
+		for j := 0; j < n; j++ {
+			var essential bool
+			var index int
+			if wide {
+				v := r.u16()
+				essential, index = v&0x8000 != 0, int(v&0x7fff)
+			} else {
+				v := r.u8()
+				essential, index = v&0x80 != 0, int(v&0x7f)
+			}
+			if removedProps[index] {
+				continue
+			}
+			index -= sort.SearchInts(removedIndexes, index)
+			v := uint16(index)
+			if essential {
+				if wide {
+					v |= 0x8000
+				} else {
+					v |= 0x80
+				}
+			}
+			assocs = append(assocs, v)
+		}
+		if removedItems[id] {
+			continue
+		}
+
+		if version < 1 {
+			entries = binary.BigEndian.AppendUint16(entries, uint16(id))
+		} else {
+			entries = binary.BigEndian.AppendUint32(entries, id)
+		}
+		entries = append(entries, byte(len(assocs)))
+		for _, v := range assocs {
+			if wide {
+				entries = binary.BigEndian.AppendUint16(entries, v)
+			} else {
+				entries = append(entries, byte(v))
+			}
+		}
+		kept++
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w ipma box: %w", errMalformed, r.err)
+	}
+
+	out := append([]byte{}, payload[:4]...)
+	out = binary.BigEndian.AppendUint32(out, kept)
+	return append(out, entries...), nil
+}
+
+func mergeRanges(ranges []byteRange) []byteRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := []byteRange{ranges[0]}
+	for _, rng := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if rng.start <= last.end {
+			if rng.end > last.end {
+				last.end = rng.end
+			}
+			continue
+		}
+		merged = append(merged, rng)
+	}
+	return merged
+}
+
+func overlapsAny(rng byteRange, others []byteRange) bool {
+	for _, other := range others {
+		if rng.start < other.end && other.start < rng.end {
+			return true
+		}
+	}
+	return false
+}
+
+func cutBefore(cuts []byteRange, offset uint64) uint64 {
+	var total uint64
+	for _, cut := range cuts {
+		if cut.end <= offset {
+			total += cut.end - cut.start
+		}
+	}
+	return total
+}
+
+func hasCutWithin(cuts []byteRange, box bmffBox) bool {
+	for _, cut := range cuts {
+		if cut.start >= uint64(box.payloadStart()) && cut.end <= uint64(box.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func cutRanges(payload []byte, cuts []byteRange) []byte {
+	out := make([]byte, 0, len(payload))
+	pos := uint64(0)
+	for _, cut := range cuts {
+		if cut.start > uint64(len(payload)) {
+			break
+		}
+		end := cut.end
+		if end > uint64(len(payload)) {
+			end = uint64(len(payload))
+		}
+		out = append(out, payload[pos:cut.start]...)
+		pos = end
+	}
+	return append(out, payload[pos:]...)
+}
@@ -1,10 +1,11 @@
 package processor
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/binary"
-	"fmt"
 	"io"
+
+	"bleach/pkg/imgutil"
 )
 
 var (
@@ -12,132 +13,129 @@ var (
 	jpegXmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
 	jpegPhotoshop  = []byte("Photoshop 3.0\x00")
 	jpegICCHeader  = []byte("ICC_PROFILE\x00")
+	jpegJFIFHeader = []byte("JFIF\x00")
+	jpegAdobe      = []byte("Adobe")
 )
 
-func stripJPEG(r io.Reader, w io.Writer, preserveICC bool) error {
-	br := bufio.NewReader(r)
-	bw := bufio.NewWriter(w)
-
-	soi := make([]byte, 2)
-	if _, err := io.ReadFull(br, soi); err != nil {
+func stripJPEG(r io.Reader, w io.Writer, policy *Policy) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
 		return err
 	}
-	if soi[0] != 0xff || soi[1] != 0xd8 {
-		return fmt.Errorf("invalid JPEG SOI")
-	}
-	if _, err := bw.Write(soi); err != nil {
+
+	out, err := stripJPEGBytes(data, policy)
+	if err != nil {
 		return err
 	}
+	_, err = w.Write(out)
+	return err
+}
 
-	for {
-		markerPrefix, err := br.ReadByte()
-		if err != nil {
-			return err
-		}
-		for markerPrefix != 0xff {
-			markerPrefix, err = br.ReadByte()
-			if err != nil {
-				return err
-			}
-		}
-
-		marker, err := br.ReadByte()
-		if err != nil {
-			return err
-		}
-		for marker == 0xff {
-			marker, err = br.ReadByte()
-			if err != nil {
-				return err
+func stripJPEGBytes(data []byte, policy *Policy) ([]byte, error) {
+	img, err := parseJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+	keepTrailer := policy.keepBlock(imgutil.KindJPEG, false, "Trailer")
+
+	var out bytes.Buffer
+	mpfBase := -1
+	var index *mpIndex
+	for _, seg := range img.Segments {
+		if seg.Marker == 0xe1 && hasPrefix(seg.Payload, jpegExifHeader) && policy.rewritesExif() &&
+			!policy.keepBlock(imgutil.KindJPEG, false, jpegSegmentRuleNames(seg.Marker, seg.Payload)...) {
+			// EXIF that cannot be parsed is dropped rather than kept.
+			if payload, err := rewriteExifPayload(seg.Payload, policy); err == nil && payload != nil && len(payload)+2 <= 0xffff {
+				out.Write(jpegSegmentBytes(seg.Marker, payload))
 			}
+			continue
 		}
-
-		if marker == 0xd9 { // EOI
-			if _, err := bw.Write([]byte{0xff, 0xd9}); err != nil {
-				return err
-			}
-			break
+		if shouldDropJPEGSegment(seg.Marker, seg.Payload, policy) {
+			continue
 		}
-
-		if marker == 0xda { // SOS
-			if _, err := bw.Write([]byte{0xff, marker}); err != nil {
-				return err
+		if seg.Marker == 0xe1 && hasPrefix(seg.Payload, jpegXmpHeader) && policy.timeRewrite() != nil {
+			payload := policy.timeRewrite().rewriteXMP(seg.Payload)
+			if len(payload)+2 <= 0xffff {
+				out.Write(jpegSegmentBytes(seg.Marker, payload))
 			}
-			if _, err := io.Copy(bw, br); err != nil {
-				return err
-			}
-			break
+			continue
 		}
-
-		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
-			if _, err := bw.Write([]byte{0xff, marker}); err != nil {
-				return err
+		if index == nil && seg.Marker == 0xe2 {
+			if parsed, ok := parseMPF(seg.Payload); ok {
+				index = parsed
+				mpfBase = out.Len() + 4 + len(jpegMPFHeader)
 			}
-			continue
 		}
+		out.Write(data[seg.Start:seg.End])
+	}
+	primarySize := out.Len()
 
-		lenBuf := make([]byte, 2)
-		if _, err := io.ReadFull(br, lenBuf); err != nil {
-			return err
+	if index == nil || len(index.entries) < 2 {
+		if keepTrailer {
+			out.Write(data[img.End:])
 		}
-		segLen := int(binary.BigEndian.Uint16(lenBuf))
-		if segLen < 2 {
-			return fmt.Errorf("invalid JPEG segment length")
-		}
-		payloadLen := segLen - 2
-		if marker == 0xe1 || marker == 0xe2 || marker == 0xed {
-			payload := make([]byte, payloadLen)
-			if _, err := io.ReadFull(br, payload); err != nil {
-				return err
-			}
-
-			if shouldDropJPEGSegment(marker, payload, preserveICC) {
-				continue
-			}
+		return out.Bytes(), nil
+	}
 
-			if _, err := bw.Write([]byte{0xff, marker}); err != nil {
-				return err
-			}
-			if _, err := bw.Write(lenBuf); err != nil {
-				return err
-			}
-			if _, err := bw.Write(payload); err != nil {
-				return err
-			}
-			continue
-		}
+	_, origBase, _ := findMPF(img)
+	secondary, err := mpSecondaryImages(data, index, origBase, img.End)
+	if err != nil {
+		return nil, err
+	}
 
-		if _, err := bw.Write([]byte{0xff, marker}); err != nil {
-			return err
+	pos := img.End
+	for _, image := range secondary {
+		// Bytes between the images are no part of any, like a trailer.
+		if keepTrailer {
+			out.Write(data[pos:image.Start])
 		}
-		if _, err := bw.Write(lenBuf); err != nil {
-			return err
-		}
-		if _, err := io.CopyN(bw, br, int64(payloadLen)); err != nil {
-			return err
+		stripped, err := stripJPEGBytes(data[image.Start:image.End], policy)
+		if err != nil {
+			return nil, err
 		}
+		newOffset := out.Len() - mpfBase
+		out.Write(stripped)
+		patchMPEntry(out.Bytes(), index, mpfBase, image.Number-1, uint32(len(stripped)), uint32(newOffset))
+		pos = image.End
+	}
+	if keepTrailer {
+		out.Write(data[pos:])
 	}
 
-	return bw.Flush()
+	patchMPEntry(out.Bytes(), index, mpfBase, 0, uint32(primarySize), 0)
+	return out.Bytes(), nil
 }
 
-func shouldDropJPEGSegment(marker byte, payload []byte, preserveICC bool) bool {
-	switch marker {
-	case 0xe1:
-		if hasPrefix(payload, jpegExifHeader) || hasPrefix(payload, jpegXmpHeader) {
-			return true
-		}
-	case 0xed:
-		if hasPrefix(payload, jpegPhotoshop) {
-			return true
-		}
-	case 0xe2:
-		if !preserveICC && hasPrefix(payload, jpegICCHeader) {
-			return true
-		}
+func patchMPEntry(out []byte, index *mpIndex, mpfBase int, entry int, size uint32, offset uint32) {
+	// entryPos is relative to the MPF payload; mpfBase already skips the
+	// "MPF\0" identifier.
+	pos := mpfBase - len(jpegMPFHeader) + index.entries[entry].entryPos
+	index.order.PutUint32(out[pos+4:pos+8], size)
+	index.order.PutUint32(out[pos+8:pos+12], offset)
+}
+
+// shouldDropJPEGSegment keeps the APPn segments needed to render the image
+// (JFIF, Adobe color transform and MPF index) and drops comments and every
+// other application segment unless the policy keeps them.
+func shouldDropJPEGSegment(marker byte, payload []byte, policy *Policy) bool {
+	switch {
+	case marker == 0xfe:
+		return !policy.keepBlock(imgutil.KindJPEG, false, "COM")
+	case marker == 0xe0 && hasPrefix(payload, jpegJFIFHeader),
+		marker == 0xe2 && hasPrefix(payload, jpegMPFHeader),
+		marker == 0xee && hasPrefix(payload, jpegAdobe):
+		return false
+	case marker >= 0xe0 && marker <= 0xef:
+		return !policy.keepBlock(imgutil.KindJPEG, false, jpegSegmentRuleNames(marker, payload)...)
+	default:
+		return false
 	}
+}
 
-	return false
+func jpegSegmentBytes(marker byte, payload []byte) []byte {
+	out := []byte{0xff, marker}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	return append(out, payload...)
 }
 
 func hasPrefix(buf, prefix []byte) bool {
@@ -2,14 +2,27 @@ package processor
 
 import (
 	"bufio"
+	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+
+	"bleach/pkg/imgutil"
 )
 
 var pngSignature = []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a}
 
-func stripPNG(r io.Reader, w io.Writer, preserveICC bool) error {
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+const (
+	// pngMaxChunkLength is the largest length the PNG specification allows.
+	pngMaxChunkLength   = 1<<31 - 1
+	pngMaxKeywordLength = 79
+)
+
+func stripPNG(r io.Reader, w io.Writer, policy *Policy) error {
 	br := bufio.NewReader(r)
 	bw := bufio.NewWriter(w)
 
@@ -18,7 +31,7 @@ func stripPNG(r io.Reader, w io.Writer, preserveICC bool) error {
 		return err
 	}
 	if !bytesEqual(sig, pngSignature) {
-		return fmt.Errorf("invalid PNG signature")
+		return fmt.Errorf("%w PNG signature", errMalformed)
 	}
 	if _, err := bw.Write(sig); err != nil {
 		return err
@@ -40,12 +53,46 @@ func stripPNG(r io.Reader, w io.Writer, preserveICC bool) error {
 		}
 		chunkName := string(typeBuf)
 
-		if shouldDropPNGChunk(chunkName, preserveICC) {
+		if length > pngMaxChunkLength {
+			return fmt.Errorf("%w PNG chunk %q length %d", errMalformed, chunkName, length)
+		}
+
+		if chunkName == "eXIf" && policy.rewritesExif() && !policy.keepBlock(imgutil.KindPNG, false, chunkName, "Exif") {
+			data, err := readPNGChunkData(br, length)
+			if err != nil {
+				return err
+			}
+			// EXIF that cannot be parsed is dropped rather than kept.
+			if tiff, err := rewriteExif(data, policy); err == nil && tiff != nil {
+				if _, err := bw.Write(pngChunkBytes(chunkName, tiff)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Text chunks are judged by their keyword, which is all that is
+		// peeked; dropped chunks are never buffered.
+		var keyword []byte
+		if isPNGTextChunk(chunkName) {
+			keyword, _ = br.Peek(int(min(length, pngMaxKeywordLength+1)))
+		}
+		if !keepPNGChunk(chunkName, keyword, policy) {
 			if _, err := io.CopyN(io.Discard, br, int64(length)+4); err != nil {
+				return unexpectedEOF(err)
+			}
+			continue
+		}
+
+		if policy.timeRewrite() != nil && (isPNGTextChunk(chunkName) || chunkName == "tIME") {
+			data, err := readPNGChunkData(br, length)
+			if err != nil {
 				return err
 			}
-			if chunkName == "IEND" {
-				break
+			if rewritten, ok := rewritePNGTimeChunk(chunkName, data, policy.timeRewrite()); ok {
+				if _, err := bw.Write(pngChunkBytes(chunkName, rewritten)); err != nil {
+					return err
+				}
 			}
 			continue
 		}
@@ -57,10 +104,15 @@ func stripPNG(r io.Reader, w io.Writer, preserveICC bool) error {
 			return err
 		}
 		if _, err := io.CopyN(bw, br, int64(length)+4); err != nil {
-			return err
+			return unexpectedEOF(err)
 		}
 
 		if chunkName == "IEND" {
+			if policy.keepBlock(imgutil.KindPNG, false, "Trailer") {
+				if _, err := io.Copy(bw, br); err != nil {
+					return err
+				}
+			}
 			break
 		}
 	}
@@ -68,17 +120,168 @@ func stripPNG(r io.Reader, w io.Writer, preserveICC bool) error {
 	return bw.Flush()
 }
 
-func shouldDropPNGChunk(chunkName string, preserveICC bool) bool {
+// readPNGChunkData reads a chunk's data and CRC and returns the data. The
+// buffer grows with the bytes actually read, so a forged length cannot
+// force a large allocation.
+func readPNGChunkData(r io.Reader, length uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)+4); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes()[:length], nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// rewritePNGTimeChunk applies a time rewrite to a kept tIME or text chunk.
+// Text chunks holding XMP or a Timestamp keyword are rewritten; ok is false
+// when such a chunk holds no date that can be parsed and has to be dropped.
+func rewritePNGTimeChunk(chunkName string, data []byte, r *TimeRewrite) ([]byte, bool) {
+	if chunkName == "tIME" {
+		out, err := r.rewritePNGTime(data)
+		return out, err == nil
+	}
+
+	key, _ := extractPNGText(chunkName, data)
+	isXMP := key == pngXMPKeyword
+	if !isXMP && classifyPNGTextKey(key) != CategoryTimestamp {
+		return data, true
+	}
+	prefix, text, ok := decodePNGText(chunkName, data)
+	if !ok {
+		return nil, false
+	}
+	if isXMP {
+		return encodePNGText(chunkName, prefix, r.rewriteXMP(text)), true
+	}
+	value, ok := r.rewriteText(string(text))
+	if !ok {
+		return nil, false
+	}
+	return encodePNGText(chunkName, prefix, []byte(value)), true
+}
+
+// decodePNGText splits a text chunk into the header that precedes its text
+// and the uncompressed text. iTXt headers are returned with the compression
+// flag cleared, as encodePNGText writes their text uncompressed.
+func decodePNGText(chunkName string, data []byte) ([]byte, []byte, bool) {
+	keyEnd := indexByte(data, 0)
+	if keyEnd <= 0 {
+		return nil, nil, false
+	}
 	switch chunkName {
-	case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+	case "tEXt":
+		return data[:keyEnd+1], data[keyEnd+1:], true
+	case "zTXt":
+		if keyEnd+1 >= len(data) || data[keyEnd+1] != 0 {
+			return nil, nil, false
+		}
+		text, err := inflate(data[keyEnd+2:])
+		return data[:keyEnd+2], text, err == nil
+	case "iTXt":
+		if keyEnd+2 >= len(data) {
+			return nil, nil, false
+		}
+		compressed := data[keyEnd+1] != 0
+		rest := data[keyEnd+3:]
+		langEnd := indexByte(rest, 0)
+		if langEnd < 0 {
+			return nil, nil, false
+		}
+		transEnd := indexByte(rest[langEnd+1:], 0)
+		if transEnd < 0 {
+			return nil, nil, false
+		}
+		headerEnd := keyEnd + 3 + langEnd + 1 + transEnd + 1
+		header := append([]byte{}, data[:headerEnd]...)
+		header[keyEnd+1], header[keyEnd+2] = 0, 0
+		text := data[headerEnd:]
+		if compressed {
+			if data[keyEnd+2] != 0 {
+				return nil, nil, false
+			}
+			var err error
+			if text, err = inflate(text); err != nil {
+				return nil, nil, false
+			}
+		}
+		return header, text, true
+	}
+	return nil, nil, false
+}
+
+func encodePNGText(chunkName string, header, text []byte) []byte {
+	out := append([]byte{}, header...)
+	if chunkName != "zTXt" {
+		return append(out, text...)
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(text)
+	zw.Close()
+	return append(out, buf.Bytes()...)
+}
+
+func inflate(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// keepPNGChunk keeps critical chunks and drops text, EXIF, time and ICC
+// chunks unless the policy keeps them. data is only set for text chunks.
+func keepPNGChunk(chunkName string, data []byte, policy *Policy) bool {
+	if isCriticalPNGChunk(chunkName) {
 		return true
+	}
+	switch chunkName {
+	case "tEXt", "zTXt", "iTXt":
+		key := pngTextKeyword(data)
+		return policy.keepItem(imgutil.KindPNG, key, classifyPNGTextKey(key), false, chunkName)
+	case "tIME":
+		return policy.keepItem(imgutil.KindPNG, chunkName, CategoryTimestamp, false, chunkName)
+	case "eXIf":
+		return policy.keepBlock(imgutil.KindPNG, false, chunkName, "Exif")
 	case "iCCP":
-		return !preserveICC
+		return policy.keepBlock(imgutil.KindPNG, false, chunkName, "ICC")
 	default:
-		return false
+		return policy.keepBlock(imgutil.KindPNG, true, chunkName)
 	}
 }
 
+// pngTextKeyword returns the keyword that starts every text chunk, from as
+// much of the chunk as is given.
+func pngTextKeyword(data []byte) string {
+	idx := indexByte(data, 0)
+	if idx <= 0 {
+		return ""
+	}
+	return string(data[:idx])
+}
+
+func isPNGTextChunk(chunkName string) bool {
+	return chunkName == "tEXt" || chunkName == "zTXt" || chunkName == "iTXt"
+}
+
+func isCriticalPNGChunk(chunkName string) bool {
+	return len(chunkName) == 4 && chunkName[0] >= 'A' && chunkName[0] <= 'Z'
+}
+
+func pngChunkBytes(chunkName string, data []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	out = append(out, chunkName...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[4:]))
+}
+
 func bytesEqual(a, b []byte) bool {
 	if len(a) != len(b) {
 		return false
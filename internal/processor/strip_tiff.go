@@ -0,0 +1,506 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"bleach/pkg/imgutil"
+)
+
+const (
+	tiffTagDocumentName     = 0x010d
+	tiffTagImageDescription = 0x010e
+	tiffTagMake             = 0x010f
+	tiffTagModel            = 0x0110
+	tiffTagStripOffsets     = 0x0111
+	tiffTagOrientation      = 0x0112
+	tiffTagStripByteCounts  = 0x0117
+	tiffTagPageName         = 0x011d
+	tiffTagFreeOffsets      = 0x0120
+	tiffTagFreeByteCounts   = 0x0121
+	tiffTagSoftware         = 0x0131
+	tiffTagDateTime         = 0x0132
+	tiffTagArtist           = 0x013b
+	tiffTagHostComputer     = 0x013c
+	tiffTagTileOffsets      = 0x0144
+	tiffTagTileByteCounts   = 0x0145
+	tiffTagSubIFDs          = 0x014a
+	tiffTagJPEGIF           = 0x0201
+	tiffTagJPEGIFLength     = 0x0202
+	tiffTagXMP              = 0x02bc
+	tiffTagCopyright        = 0x8298
+	tiffTagIPTC             = 0x83bb
+	tiffTagPhotoshop        = 0x8649
+	tiffTagExifIFD          = 0x8769
+	tiffTagICCProfile       = 0x8773
+	tiffTagGPSIFD           = 0x8825
+	tiffTagInteropIFD       = 0xa005
+)
+
+const (
+	tiffTypeASCII    = 2
+	tiffTypeShort    = 3
+	tiffTypeLong     = 4
+	tiffTypeRational = 5
+	tiffTypeIFD      = 13
+)
+
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// tiffOffsetTags pairs each tag holding data offsets with the tag holding the
+// matching byte counts.
+var tiffOffsetTags = map[uint16]uint16{
+	tiffTagStripOffsets: tiffTagStripByteCounts,
+	tiffTagTileOffsets:  tiffTagTileByteCounts,
+	tiffTagJPEGIF:       tiffTagJPEGIFLength,
+}
+
+type tiffTextTag struct {
+	name string
+	keep bool
+}
+
+// tiffTextTags are the descriptive IFD tags a policy can keep or strip by
+// name, with their built-in decision.
+var tiffTextTags = map[uint16]tiffTextTag{
+	tiffTagDocumentName:     {name: "DocumentName", keep: true},
+	tiffTagImageDescription: {name: "ImageDescription"},
+	tiffTagMake:             {name: "Make"},
+	tiffTagModel:            {name: "Model"},
+	tiffTagPageName:         {name: "PageName", keep: true},
+	tiffTagSoftware:         {name: "Software"},
+	tiffTagDateTime:         {name: "DateTime"},
+	tiffTagArtist:           {name: "Artist"},
+	tiffTagHostComputer:     {name: "HostComputer"},
+	tiffTagCopyright:        {name: "Copyright", keep: true},
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+type tiffRewriter struct {
+	src     []byte
+	order   binary.ByteOrder
+	out     bytes.Buffer
+	policy  *Policy
+	visited map[uint32]bool
+
+	// copyAll keeps every tag the file has, ignoring policy, for rewriting
+	// a file that is already stripped. stamp holds tags that replace their
+	// namesakes in IFD0.
+	copyAll bool
+	stamp   []tiffEntry
+}
+
+func stripTIFF(r io.Reader, w io.Writer, policy *Policy) error {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(src) < 8 {
+		return fmt.Errorf("%w TIFF header", errMalformed)
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case src[0] == 'I' && src[1] == 'I':
+		order = binary.LittleEndian
+	case src[0] == 'M' && src[1] == 'M':
+		order = binary.BigEndian
+	default:
+		return fmt.Errorf("%w TIFF byte order", errMalformed)
+	}
+	switch order.Uint16(src[2:4]) {
+	case 42:
+	case 43:
+		return fmt.Errorf("%w BigTIFF file", errUnsupported)
+	default:
+		return fmt.Errorf("%w TIFF magic", errMalformed)
+	}
+
+	t := &tiffRewriter{src: src, order: order, policy: policy, visited: map[uint32]bool{}}
+	out, err := t.rewrite()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// rewrite writes a new file from the IFD chain of src, relocating image
+// data and out-of-line values.
+func (t *tiffRewriter) rewrite() ([]byte, error) {
+	t.out.Write(t.src[:4])
+	t.out.Write([]byte{0, 0, 0, 0})
+
+	first, err := t.writeChain(t.order.Uint32(t.src[4:8]))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(t.out.Len()) > 0xffffffff {
+		return nil, fmt.Errorf("%w TIFF output: exceeds 4GiB", errUnsupported)
+	}
+	t.order.PutUint32(t.out.Bytes()[4:8], first)
+	return t.out.Bytes(), nil
+}
+
+// dropsTag reports whether tag is left out of the rewritten file.
+func (t *tiffRewriter) dropsTag(tag uint16) bool {
+	if t.copyAll {
+		// Free space is not carried over.
+		return tag == tiffTagFreeOffsets || tag == tiffTagFreeByteCounts
+	}
+	return shouldDropTIFFTag(tag, t.policy)
+}
+
+func shouldDropTIFFTag(tag uint16, policy *Policy) bool {
+	switch tag {
+	case tiffTagExifIFD, tiffTagGPSIFD, tiffTagInteropIFD,
+		tiffTagFreeOffsets, tiffTagFreeByteCounts:
+		// The IFDs and free space these point to are not carried over, so
+		// no policy can keep them.
+		return true
+	case tiffTagXMP:
+		return !policy.keepBlock(imgutil.KindTIFF, false, "XMP")
+	case tiffTagIPTC:
+		return !policy.keepBlock(imgutil.KindTIFF, false, "IPTC")
+	case tiffTagPhotoshop:
+		return !policy.keepBlock(imgutil.KindTIFF, false, "Photoshop", "IPTC")
+	case tiffTagICCProfile:
+		return !policy.keepBlock(imgutil.KindTIFF, false, "ICC")
+	}
+	if text, ok := tiffTextTags[tag]; ok {
+		return !policy.keepItem(imgutil.KindTIFF, text.name, classifyExifTag(text.name, "IFD"), text.keep)
+	}
+	return false
+}
+
+func (t *tiffRewriter) writeChain(offset uint32) (uint32, error) {
+	var first uint32
+	patchPos := -1
+	for offset != 0 {
+		newOffset, nextPos, next, err := t.writeIFD(offset)
+		if err != nil {
+			return 0, err
+		}
+		if patchPos < 0 {
+			first = newOffset
+		} else {
+			t.order.PutUint32(t.out.Bytes()[patchPos:patchPos+4], newOffset)
+		}
+		patchPos = nextPos
+		offset = next
+	}
+	return first, nil
+}
+
+func (t *tiffRewriter) readEntries(offset uint32) ([]tiffEntry, uint32, error) {
+	if t.visited[offset] {
+		return nil, 0, fmt.Errorf("%w TIFF IFD: loop at offset %d", errMalformed, offset)
+	}
+	t.visited[offset] = true
+
+	start := uint64(offset)
+	if start+2 > uint64(len(t.src)) {
+		return nil, 0, fmt.Errorf("%w TIFF IFD offset: out of range", errMalformed)
+	}
+	count := uint64(t.order.Uint16(t.src[start : start+2]))
+	end := start + 2 + count*12
+	if end+4 > uint64(len(t.src)) {
+		return nil, 0, fmt.Errorf("%w TIFF IFD", errTruncated)
+	}
+
+	entries := make([]tiffEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		raw := t.src[start+2+i*12 : start+2+(i+1)*12]
+		entry := tiffEntry{
+			tag:   t.order.Uint16(raw[0:2]),
+			typ:   t.order.Uint16(raw[2:4]),
+			count: t.order.Uint32(raw[4:8]),
+		}
+		size, ok := tiffTypeSizes[entry.typ]
+		if !ok {
+			// Unknown types cannot be relocated safely; drop them.
+			continue
+		}
+		total := uint64(size) * uint64(entry.count)
+		if total <= 4 {
+			entry.data = append([]byte{}, raw[8:8+total]...)
+		} else {
+			valueOffset := uint64(t.order.Uint32(raw[8:12]))
+			if valueOffset+total > uint64(len(t.src)) {
+				return nil, 0, fmt.Errorf("%w TIFF tag %#04x: value out of range", errMalformed, entry.tag)
+			}
+			entry.data = t.src[valueOffset : valueOffset+total]
+		}
+		entries = append(entries, entry)
+	}
+
+	next := t.order.Uint32(t.src[end : end+4])
+	return entries, next, nil
+}
+
+func (t *tiffRewriter) writeIFD(offset uint32) (uint32, int, uint32, error) {
+	entries, next, err := t.readEntries(offset)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if t.stamp != nil {
+		// The first IFD written is IFD0.
+		entries = mergeTIFFEntries(entries, t.stamp)
+		t.stamp = nil
+	}
+
+	byTag := make(map[uint16]tiffEntry, len(entries))
+	for _, entry := range entries {
+		byTag[entry.tag] = entry
+	}
+
+	kept := make([]tiffEntry, 0, len(entries))
+	for _, entry := range entries {
+		if path := exifSubIFDPath(entry.tag); path != "" && (t.copyAll || t.policy.rewritesExif()) {
+			newOffset, ok, err := t.writeExifIFD(entry, path)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			if ok {
+				kept = append(kept, t.longEntry(entry.tag, []uint32{newOffset}))
+			}
+			continue
+		}
+		if t.dropsTag(entry.tag) {
+			continue
+		}
+		if t.policy.timeRewrite() != nil {
+			var ok bool
+			if entry, ok = t.rewriteTime(entry); !ok {
+				continue
+			}
+		}
+
+		if countTag, ok := tiffOffsetTags[entry.tag]; ok {
+			counts, ok := byTag[countTag]
+			if !ok {
+				return 0, 0, 0, fmt.Errorf("%w TIFF tag %#04x: missing byte counts", errMalformed, entry.tag)
+			}
+			relocated, err := t.copyBlobs(entry, counts)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			entry = relocated
+		}
+
+		if entry.tag == tiffTagSubIFDs {
+			offsets, err := t.values(entry)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			newOffsets := make([]uint32, 0, len(offsets))
+			for _, sub := range offsets {
+				newOffset, err := t.writeChain(sub)
+				if err != nil {
+					return 0, 0, 0, err
+				}
+				newOffsets = append(newOffsets, newOffset)
+			}
+			entry = t.longEntry(entry.tag, newOffsets)
+			entry.typ = tiffTypeIFD
+		}
+
+		kept = append(kept, entry)
+	}
+
+	ifdStart, nextPos := t.emitIFD(kept)
+	return uint32(ifdStart), nextPos, next, nil
+}
+
+// writeExifIFD copies the tags of an Exif or GPS IFD that the policy keeps
+// during an EXIF rewrite. ok is false when none are kept.
+func (t *tiffRewriter) writeExifIFD(pointer tiffEntry, path string) (uint32, bool, error) {
+	offsets, err := t.values(pointer)
+	if err != nil || len(offsets) != 1 {
+		return 0, false, err
+	}
+	entries, _, err := t.readEntries(offsets[0])
+	if err != nil {
+		return 0, false, err
+	}
+
+	entries = t.transformExifEntries(entries, path)
+
+	var kept []tiffEntry
+	for _, entry := range entries {
+		if entry.tag != tiffTagInteropIFD && (t.copyAll || t.policy.keepExifTag(path, exifTagName(path, entry.tag))) {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == 0 {
+		return 0, false, nil
+	}
+	ifdStart, _ := t.emitIFD(kept)
+	return uint32(ifdStart), true, nil
+}
+
+// rewriteTime applies the policy's time rewrite to the DateTime and XMP
+// tags. ok is false when DateTime cannot be parsed and has to be dropped.
+func (t *tiffRewriter) rewriteTime(entry tiffEntry) (tiffEntry, bool) {
+	switch entry.tag {
+	case tiffTagDateTime:
+		value, ok := t.policy.Time.exifDate(entry.data)
+		if !ok {
+			return entry, false
+		}
+		entry.data, entry.count = value, uint32(len(value))
+	case tiffTagXMP:
+		if tiffTypeSizes[entry.typ] == 1 {
+			entry.data = t.policy.Time.rewriteXMP(entry.data)
+			entry.count = uint32(len(entry.data))
+		}
+	}
+	return entry, true
+}
+
+// transformExifEntries applies the GPS coarsening and time rewrite of
+// rewriteExif to the entries of one IFD.
+func (t *tiffRewriter) transformExifEntries(entries []tiffEntry, path string) []tiffEntry {
+	decimals, coarsen := t.policy.gpsDecimals()
+	coarsen = coarsen && path == exifPathGPS
+	if !coarsen && t.policy.timeRewrite() == nil {
+		return entries
+	}
+
+	converted := make([]exifEntry, 0, len(entries))
+	for _, entry := range entries {
+		converted = append(converted, exifEntry{IFD: path, Tag: entry.tag, Type: entry.typ, Count: entry.count, Value: entry.data})
+	}
+	if coarsen {
+		converted = coarsenGPSEntries(t.order, converted, decimals)
+	}
+	if r := t.policy.timeRewrite(); r != nil {
+		converted = r.rewriteExifEntries(t.order, converted)
+	}
+	out := make([]tiffEntry, 0, len(converted))
+	for _, entry := range converted {
+		out = append(out, tiffEntry{tag: entry.Tag, typ: entry.Type, count: entry.Count, data: entry.Value})
+	}
+	return out
+}
+
+// mergeTIFFEntries returns entries with added in place of the entries that
+// share their tags.
+func mergeTIFFEntries(entries, added []tiffEntry) []tiffEntry {
+	replaced := map[uint16]bool{}
+	for _, entry := range added {
+		replaced[entry.tag] = true
+	}
+	merged := append([]tiffEntry{}, added...)
+	for _, entry := range entries {
+		if !replaced[entry.tag] {
+			merged = append(merged, entry)
+		}
+	}
+	return merged
+}
+
+// emitIFD writes an IFD with its out-of-line values and returns its offset
+// and the position of its next-IFD field.
+func (t *tiffRewriter) emitIFD(kept []tiffEntry) (int, int) {
+	sort.Slice(kept, func(i, j int) bool { return kept[i].tag < kept[j].tag })
+
+	t.align()
+	ifdStart := t.out.Len()
+	dataStart := ifdStart + 2 + len(kept)*12 + 4
+	if dataStart%2 != 0 {
+		dataStart++
+	}
+
+	ifd := make([]byte, dataStart-ifdStart)
+	t.order.PutUint16(ifd[0:2], uint16(len(kept)))
+	var extra []byte
+	for i, entry := range kept {
+		raw := ifd[2+i*12 : 2+(i+1)*12]
+		t.order.PutUint16(raw[0:2], entry.tag)
+		t.order.PutUint16(raw[2:4], entry.typ)
+		t.order.PutUint32(raw[4:8], entry.count)
+		if len(entry.data) <= 4 {
+			copy(raw[8:12], entry.data)
+			continue
+		}
+		t.order.PutUint32(raw[8:12], uint32(dataStart+len(extra)))
+		extra = append(extra, entry.data...)
+		if len(extra)%2 != 0 {
+			extra = append(extra, 0)
+		}
+	}
+
+	t.out.Write(ifd)
+	t.out.Write(extra)
+	return ifdStart, ifdStart + 2 + len(kept)*12
+}
+
+func (t *tiffRewriter) copyBlobs(offsets tiffEntry, counts tiffEntry) (tiffEntry, error) {
+	offsetValues, err := t.values(offsets)
+	if err != nil {
+		return offsets, err
+	}
+	countValues, err := t.values(counts)
+	if err != nil {
+		return offsets, err
+	}
+	if len(offsetValues) != len(countValues) {
+		return offsets, fmt.Errorf("%w TIFF tag %#04x: %d offsets but %d byte counts", errMalformed, offsets.tag, len(offsetValues), len(countValues))
+	}
+
+	newOffsets := make([]uint32, len(offsetValues))
+	for i, offset := range offsetValues {
+		end := uint64(offset) + uint64(countValues[i])
+		if end > uint64(len(t.src)) {
+			return offsets, fmt.Errorf("%w TIFF image data: out of range", errMalformed)
+		}
+		t.align()
+		newOffsets[i] = uint32(t.out.Len())
+		t.out.Write(t.src[offset:end])
+	}
+
+	return t.longEntry(offsets.tag, newOffsets), nil
+}
+
+func (t *tiffRewriter) values(entry tiffEntry) ([]uint32, error) {
+	values := make([]uint32, 0, entry.count)
+	switch entry.typ {
+	case tiffTypeShort:
+		for i := 0; i+2 <= len(entry.data); i += 2 {
+			values = append(values, uint32(t.order.Uint16(entry.data[i:i+2])))
+		}
+	case tiffTypeLong, tiffTypeIFD:
+		for i := 0; i+4 <= len(entry.data); i += 4 {
+			values = append(values, t.order.Uint32(entry.data[i:i+4]))
+		}
+	default:
+		return nil, fmt.Errorf("%w TIFF offset type", errMalformed)
+	}
+	return values, nil
+}
+
+func (t *tiffRewriter) longEntry(tag uint16, values []uint32) tiffEntry {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		t.order.PutUint32(data[i*4:i*4+4], value)
+	}
+	return tiffEntry{tag: tag, typ: tiffTypeLong, count: uint32(len(values)), data: data}
+}
+
+func (t *tiffRewriter) align() {
+	if t.out.Len()%2 != 0 {
+		t.out.WriteByte(0)
+	}
+}
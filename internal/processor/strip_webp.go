@@ -0,0 +1,115 @@
+package processor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"bleach/pkg/imgutil"
+)
+
+const (
+	webpFlagICC  = 0x20
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+func stripWebP(r io.Reader, w io.Writer, policy *Policy) error {
+	chunks, err := readWebPChunks(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+
+	kept := make([]webpChunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		if chunk.Name == "EXIF" && policy.rewritesExif() && !policy.keepBlock(imgutil.KindWebP, false, chunk.Name, "Exif") {
+			// EXIF that cannot be parsed is dropped rather than kept.
+			data, err := rewriteExifPayload(chunk.Data, policy)
+			if err != nil || data == nil {
+				continue
+			}
+			chunk.Data = data
+		} else if !keepWebPChunk(chunk.Name, policy) {
+			continue
+		} else if chunk.Name == "XMP " && policy.timeRewrite() != nil {
+			chunk.Data = policy.timeRewrite().rewriteXMP(chunk.Data)
+		}
+		kept = append(kept, chunk)
+	}
+
+	return writeWebP(w, kept)
+}
+
+// writeWebP writes chunks as a WebP file, with the VP8X metadata flags set to
+// match the chunks present.
+func writeWebP(w io.Writer, chunks []webpChunk) error {
+	present := map[string]bool{}
+	for _, chunk := range chunks {
+		present[chunk.Name] = true
+	}
+	flags := []struct {
+		chunk string
+		flag  byte
+	}{{"EXIF", webpFlagEXIF}, {"XMP ", webpFlagXMP}, {"ICCP", webpFlagICC}}
+
+	riffSize := uint32(4)
+	for i, chunk := range chunks {
+		if chunk.Name == "VP8X" && len(chunk.Data) > 0 {
+			data := append([]byte{}, chunk.Data...)
+			for _, f := range flags {
+				if present[f.chunk] {
+					data[0] |= f.flag
+				} else {
+					data[0] &^= f.flag
+				}
+			}
+			chunks[i].Data = data
+		}
+		riffSize += 8 + uint32(len(chunk.Data)) + uint32(len(chunk.Data)%2)
+	}
+
+	bw := bufio.NewWriter(w)
+	header := make([]byte, 12)
+	copy(header[0:4], riffSignature)
+	binary.LittleEndian.PutUint32(header[4:8], riffSize)
+	copy(header[8:12], webpSignature)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		chunkHeader := make([]byte, 8)
+		copy(chunkHeader[0:4], chunk.Name)
+		binary.LittleEndian.PutUint32(chunkHeader[4:8], uint32(len(chunk.Data)))
+		if _, err := bw.Write(chunkHeader); err != nil {
+			return err
+		}
+		if _, err := bw.Write(chunk.Data); err != nil {
+			return err
+		}
+		if len(chunk.Data)%2 != 0 {
+			if err := bw.WriteByte(0); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// keepWebPChunk keeps the image chunks and drops EXIF, XMP and ICC chunks
+// unless the policy keeps them.
+func keepWebPChunk(chunkName string, policy *Policy) bool {
+	switch chunkName {
+	case "VP8 ", "VP8L", "VP8X", "ALPH", "ANIM", "ANMF":
+		return true
+	case "EXIF":
+		return policy.keepBlock(imgutil.KindWebP, false, chunkName, "Exif")
+	case "XMP ":
+		return policy.keepBlock(imgutil.KindWebP, false, chunkName, "XMP")
+	case "ICCP":
+		return policy.keepBlock(imgutil.KindWebP, false, chunkName, "ICC")
+	default:
+		return policy.keepBlock(imgutil.KindWebP, true, chunkName)
+	}
+}
@@ -0,0 +1,317 @@
+package processor
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeRewrite moves or truncates the timestamps clean keeps. One rewrite is
+// applied to every file of a run, so a shift keeps the relative order of
+// photos.
+type TimeRewrite struct {
+	// DateOnly truncates every time to midnight of its day.
+	DateOnly bool
+	// Shift is added to every timestamp. It is a whole number of seconds.
+	Shift time.Duration
+}
+
+const exifDateLayout = "2006:01:02 15:04:05"
+
+const (
+	exifTagDateTimeOriginal    = 0x9003
+	exifTagDateTimeDigitized   = 0x9004
+	exifTagOffsetTime          = 0x9010
+	exifTagOffsetTimeDigitized = 0x9012
+	exifTagSubSecTime          = 0x9290
+	exifTagSubSecTimeDigitized = 0x9292
+)
+
+// textTimeLayouts are the date formats recognized in XMP and PNG text, from
+// most to least precise.
+var textTimeLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	exifDateLayout,
+	time.RFC1123Z,
+	time.RFC1123,
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// ParseTimeRewrite parses "date-only", "shift:<duration>" or
+// "randomize-within:<window>". Durations accept Go syntax plus a leading
+// day count, as in "-2d12h". A randomized shift is drawn once here, so every
+// file cleaned with the result moves by the same amount.
+func ParseTimeRewrite(spec string) (*TimeRewrite, error) {
+	mode, arg, _ := strings.Cut(spec, ":")
+	switch {
+	case mode == "date-only" && arg == "":
+		return &TimeRewrite{DateOnly: true}, nil
+	case mode == "shift":
+		shift, err := parseTimeDuration(arg)
+		if err != nil {
+			return nil, err
+		}
+		return &TimeRewrite{Shift: shift}, nil
+	case mode == "randomize-within":
+		window, err := parseTimeDuration(arg)
+		if err != nil {
+			return nil, err
+		}
+		if window <= 0 {
+			return nil, fmt.Errorf("invalid time window %q: must be positive", arg)
+		}
+		seconds := int64(window / time.Second)
+		n, err := rand.Int(rand.Reader, big.NewInt(2*seconds+1))
+		if err != nil {
+			return nil, err
+		}
+		return &TimeRewrite{Shift: time.Duration(n.Int64()-seconds) * time.Second}, nil
+	}
+	return nil, fmt.Errorf("invalid time mode %q (want date-only, shift:<duration> or randomize-within:<window>)", spec)
+}
+
+func parseTimeDuration(s string) (time.Duration, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(s, "+"), "-")
+	negative := strings.HasPrefix(s, "-")
+
+	var d time.Duration
+	if days, after, ok := strings.Cut(rest, "d"); ok {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+		rest = after
+	}
+	if rest != "" {
+		parsed, err := time.ParseDuration(rest)
+		if err != nil || parsed < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d += parsed
+	} else if d == 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid duration %q: must be whole seconds", s)
+	}
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
+
+// UnmarshalYAML lets a policy set the mode as a string, e.g. `time: date-only`.
+func (r *TimeRewrite) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var spec string
+	if err := unmarshal(&spec); err != nil {
+		return err
+	}
+	parsed, err := ParseTimeRewrite(spec)
+	if err != nil {
+		return err
+	}
+	*r = *parsed
+	return nil
+}
+
+func (r *TimeRewrite) apply(t time.Time) time.Time {
+	if r.DateOnly {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	return t.Add(r.Shift)
+}
+
+// rewriteText applies r to a date in one of textTimeLayouts. Time zones are
+// dropped, as they pin down where the photo was taken; date-only results of
+// ISO 8601 dates lose their time part entirely.
+func (r *TimeRewrite) rewriteText(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range textTimeLayouts {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		out := layout
+		for _, zone := range []string{"Z07:00", " -0700", " MST"} {
+			out = strings.TrimSuffix(out, zone)
+		}
+		if i := strings.Index(out, "T15"); r.DateOnly && i >= 0 {
+			out = out[:i]
+		}
+		return r.apply(t).Format(out), true
+	}
+	return "", false
+}
+
+// rewriteExifEntries applies r to the date tags of an EXIF block. Dates that
+// cannot be parsed are dropped, and so are the tags that would give the
+// original time away: OffsetTime* pin the time zone, and SubSecTime* are
+// meaningless once times are truncated.
+func (r *TimeRewrite) rewriteExifEntries(order binary.ByteOrder, entries []exifEntry) []exifEntry {
+	out := make([]exifEntry, 0, len(entries))
+	gpsDate, gpsTime := -1, -1
+	for _, entry := range entries {
+		switch {
+		case entry.IFD == exifPathIFD0 && entry.Tag == tiffTagDateTime,
+			entry.IFD == exifPathExif && (entry.Tag == exifTagDateTimeOriginal || entry.Tag == exifTagDateTimeDigitized):
+			value, ok := r.exifDate(entry.Value)
+			if !ok {
+				continue
+			}
+			entry.Value, entry.Count = value, uint32(len(value))
+		case entry.IFD == exifPathExif && entry.Tag >= exifTagOffsetTime && entry.Tag <= exifTagOffsetTimeDigitized:
+			continue
+		case entry.IFD == exifPathExif && entry.Tag >= exifTagSubSecTime && entry.Tag <= exifTagSubSecTimeDigitized:
+			if r.DateOnly {
+				continue
+			}
+		case entry.IFD == exifPathGPS && entry.Tag == gpsTagDateStamp:
+			gpsDate = len(out)
+		case entry.IFD == exifPathGPS && entry.Tag == gpsTagTimeStamp:
+			gpsTime = len(out)
+		}
+		out = append(out, entry)
+	}
+	if gpsDate < 0 && gpsTime < 0 {
+		return out
+	}
+
+	drop := map[int]bool{}
+	if !r.rewriteGPSTime(order, out, gpsDate, gpsTime) {
+		drop[gpsDate], drop[gpsTime] = true, true
+	}
+	kept := out[:0]
+	for i, entry := range out {
+		if !drop[i] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+func (r *TimeRewrite) exifDate(value []byte) ([]byte, bool) {
+	t, err := time.Parse(exifDateLayout, strings.TrimSpace(strings.TrimRight(string(value), "\x00")))
+	if err != nil {
+		return nil, false
+	}
+	return append([]byte(r.apply(t).Format(exifDateLayout)), 0), true
+}
+
+// rewriteGPSTime applies r to GPSDateStamp and GPSTimeStamp as a single UTC
+// instant, updating entries in place. A time without a date is shifted
+// around the clock.
+func (r *TimeRewrite) rewriteGPSTime(order binary.ByteOrder, entries []exifEntry, dateIdx, timeIdx int) bool {
+	t := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if dateIdx >= 0 {
+		date, err := time.Parse("2006:01:02", strings.TrimRight(string(entries[dateIdx].Value), "\x00"))
+		if err != nil {
+			return false
+		}
+		t = date
+	}
+	if timeIdx >= 0 {
+		entry := entries[timeIdx]
+		if entry.Type != tiffTypeRational || entry.Count != 3 || len(entry.Value) != 24 {
+			return false
+		}
+		var hms [3]float64
+		for i := range hms {
+			num, den := order.Uint32(entry.Value[i*8:]), order.Uint32(entry.Value[i*8+4:])
+			if den == 0 {
+				return false
+			}
+			hms[i] = float64(num) / float64(den)
+		}
+		t = t.Add(time.Duration((hms[0]*3600 + hms[1]*60 + hms[2]) * float64(time.Second)))
+	}
+
+	t = r.apply(t)
+	if dateIdx >= 0 {
+		value := append([]byte(t.Format("2006:01:02")), 0)
+		entries[dateIdx].Value, entries[dateIdx].Count = value, uint32(len(value))
+	}
+	if timeIdx >= 0 {
+		seconds := float64(t.Second()) + float64(t.Nanosecond())/1e9
+		value := make([]byte, 24)
+		order.PutUint32(value[0:], uint32(t.Hour()))
+		order.PutUint32(value[4:], 1)
+		order.PutUint32(value[8:], uint32(t.Minute()))
+		order.PutUint32(value[12:], 1)
+		order.PutUint32(value[16:], uint32(math.Round(seconds*1000)))
+		order.PutUint32(value[20:], 1000)
+		entries[timeIdx].Value = value
+	}
+	return true
+}
+
+// rewritePNGTime applies r to a tIME chunk, which holds UTC.
+func (r *TimeRewrite) rewritePNGTime(data []byte) ([]byte, error) {
+	if len(data) != 7 {
+		return nil, fmt.Errorf("%w PNG tIME chunk", errMalformed)
+	}
+	t := time.Date(int(binary.BigEndian.Uint16(data[0:2])), time.Month(data[2]), int(data[3]),
+		int(data[4]), int(data[5]), int(data[6]), 0, time.UTC)
+	t = r.apply(t)
+	out := binary.BigEndian.AppendUint16(nil, uint16(t.Year()))
+	return append(out, byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second())), nil
+}
+
+var (
+	xmpTimeAttr    = regexp.MustCompile(`([A-Za-z][\w.-]*:([\w.-]+))(\s*=\s*)("[^"]*"|'[^']*')`)
+	xmpTimeElement = regexp.MustCompile(`<([A-Za-z][\w.-]*:([\w.-]+))(\s[^<>]*)?>([^<]*)</`)
+)
+
+// rewriteXMP applies r to the date properties of an XMP packet, written as
+// either attributes or elements. OffsetTime* values are emptied, as are
+// SubSecTime* values in date-only mode.
+func (r *TimeRewrite) rewriteXMP(packet []byte) []byte {
+	value := func(name, old string) string {
+		switch {
+		case strings.HasPrefix(name, "OffsetTime"):
+			return ""
+		case strings.HasPrefix(name, "SubSecTime"):
+			if r.DateOnly {
+				return ""
+			}
+			return old
+		case strings.Contains(name, "Date") || strings.Contains(name, "Time") || name == "when":
+			if rewritten, ok := r.rewriteText(old); ok {
+				return rewritten
+			}
+		}
+		return old
+	}
+
+	packet = xmpTimeAttr.ReplaceAllFunc(packet, func(match []byte) []byte {
+		m := xmpTimeAttr.FindSubmatch(match)
+		quoted := m[4]
+		inner := string(quoted[1 : len(quoted)-1])
+		rewritten := value(string(m[2]), inner)
+		if rewritten == inner {
+			return match
+		}
+		return []byte(string(m[1]) + string(m[3]) + string(quoted[0]) + rewritten + string(quoted[0]))
+	})
+	return xmpTimeElement.ReplaceAllFunc(packet, func(match []byte) []byte {
+		m := xmpTimeElement.FindSubmatch(match)
+		inner := string(m[4])
+		rewritten := value(string(m[2]), inner)
+		if rewritten == inner {
+			return match
+		}
+		return []byte("<" + string(m[1]) + string(m[3]) + ">" + rewritten + "</")
+	})
+}
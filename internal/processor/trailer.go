@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+)
+
+const trailerProbeSize = 16
+
+// Trailer findings are named Trailer, or Padding when the trailer is only
+// zero bytes, which is structural rather than a leak.
+const (
+	trailerTagName = "Trailer"
+	paddingTagName = "Padding"
+)
+
+const zeroPaddingSignature = "zero padding"
+
+func trailerSignature(head []byte, tail []byte) string {
+	switch {
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		return "MP4/QuickTime video (ftyp)"
+	case hasPrefix(head, []byte("PK\x03\x04")), hasPrefix(head, []byte("PK\x05\x06")):
+		return "ZIP archive (PK)"
+	case hasPrefix(head, []byte("SEFH")), len(tail) >= 4 && string(tail[len(tail)-4:]) == "SEFT":
+		return "Samsung SEFT trailer"
+	case hasPrefix(head, []byte{0xff, 0xd8, 0xff}):
+		return "JPEG image"
+	case hasPrefix(head, pngSignature):
+		return "PNG image"
+	case isZeroPadding(head) && isZeroPadding(tail):
+		return zeroPaddingSignature
+	default:
+		return "unrecognized data"
+	}
+}
+
+func isZeroPadding(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// trailerFinding reports data found after the logical end of an image. head
+// and tail are the first and last bytes of the trailer.
+func trailerFinding(head []byte, tail []byte, offset int64, size int64) *Finding {
+	signature := trailerSignature(head, tail)
+	description := fmt.Sprintf("%d bytes, %s", size, signature)
+	name := trailerTagName
+	if signature == zeroPaddingSignature {
+		name = paddingTagName
+	}
+	return &Finding{
+		Container: "trailer",
+		TagID:     NoTagID,
+		TagName:   name,
+		RawValue:  description,
+		Value:     description,
+		Offset:    offset,
+		Length:    size,
+		Category:  CategoryTrailer,
+	}
+}
+
+// trailerFromBytes reports trailer, which starts at offset in the file.
+func trailerFromBytes(trailer []byte, offset int64) *Finding {
+	if len(trailer) == 0 {
+		return nil
+	}
+	head := trailer
+	if len(head) > trailerProbeSize {
+		head = head[:trailerProbeSize]
+	}
+	tail := trailer
+	if len(tail) > trailerProbeSize {
+		tail = tail[len(tail)-trailerProbeSize:]
+	}
+	return trailerFinding(head, tail, offset, int64(len(trailer)))
+}
+
+// trailerFromReader inspects everything left in r without buffering it.
+func trailerFromReader(r io.Reader, offset int64) (*Finding, error) {
+	head := make([]byte, trailerProbeSize)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	size := int64(n)
+	tail := append([]byte{}, head...)
+	buf := make([]byte, 32*1024)
+	for {
+		m, err := r.Read(buf)
+		if m > 0 {
+			size += int64(m)
+			tail = append(tail, buf[:m]...)
+			if len(tail) > trailerProbeSize {
+				tail = tail[len(tail)-trailerProbeSize:]
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return trailerFinding(head, tail, offset, size), nil
+}
@@ -1,60 +1,142 @@
 package processor
 
+import "bleach/pkg/imgutil"
+
 type Mode int
 
 const (
 	ModeScan Mode = iota
 	ModeClean
+	ModeRestore
+	ModeVerify
 )
 
 type Options struct {
-	Mode        Mode
-	InPlace     bool
-	OutputDir   string
-	PreserveICC bool
-	Insights    bool
+	Mode         Mode
+	InPlace      bool
+	OutputDir    string
+	PreserveICC  bool
+	KeepTrailers bool
+	Insights     bool
+
+	// Policy overrides the built-in strip rules; nil keeps them.
+	Policy *Policy
+
+	// RewriteExif rebuilds EXIF blocks with only the ExifAllow tags
+	// (DefaultExifAllow when empty) instead of dropping them.
+	RewriteExif bool
+	ExifAllow   []string
+
+	// CoarsenGPS rewrites EXIF and keeps the GPS position rounded to one of
+	// GPSPrecisions.
+	CoarsenGPS string
+
+	// ApplyOrientation rotates JPEG and PNG pixels to match their EXIF
+	// Orientation before the tag is stripped.
+	ApplyOrientation bool
+
+	// Time rewrites the timestamps clean keeps; it overrides the policy's
+	// own time mode.
+	Time *TimeRewrite
+
+	// Reencode, when set, regenerates the pixel data of the formats it
+	// names after stripping.
+	Reencode *Reencode
+
+	// Stamp, when not empty, is written into every cleaned file after
+	// stripping.
+	Stamp Stamp
+
+	// Verify checks every cleaned file before it replaces anything: no
+	// findings the policy removes, a valid structure and unchanged pixels.
+	// Files that fail are left as they were and reported.
+	Verify bool
+
+	// Vault, when set, receives what clean removes from every file; in
+	// ModeRestore it supplies the originals.
+	Vault *Vault
+
+	// Journal, when set, records how to undo every file clean changes; in
+	// ModeRestore it supplies the originals of the files it recorded and
+	// takes precedence over Vault.
+	Journal *Journal
+
+	// Times, when set, gives cleaned files the original's times, a fixed
+	// time or the capture time; otherwise they keep the time of writing.
+	Times *FileTimes
+
+	// PreserveXattrs copies the original's extended attributes onto the
+	// cleaned file; otherwise the cleaned file has none.
+	PreserveXattrs bool
+
+	// Rename, when set, names cleaned files by its template instead of
+	// after their originals, and records the mapping. In ModeVerify, a
+	// mapping read with LoadRenameMapping finds the renamed files.
+	Rename *Rename
+
+	// Results, when set, receives every supported file's result as soon as
+	// it is collected. Run does not close it.
+	Results chan<- Result
 }
 
 type Job struct {
 	Path    string
 	RelPath string
 	Display string
+
+	// Seq numbers the supported files of a run in walk order, from 1. It is
+	// only set when Options.Rename uses {seq}.
+	Seq int
+
+	// index is the job's position in walk order, from 0.
+	index int
 }
 
 type Result struct {
 	Path       string
 	RelPath    string
 	Display    string
+	Kind       imgutil.Kind
 	Supported  bool
+	Skipped    bool
 	Err        error
+	Warnings   []FileError
 	Leaks      int
 	BytesSaved int64
-	Report     []ScanDetail
+	Findings   []Finding
 	Insights   []ScanInsight
 }
 
 type Summary struct {
-	Total      int
-	Processed  int
-	Errors     int
-	Leaks      int
-	BytesSaved int64
+	Total      int   `json:"total"`
+	Processed  int   `json:"processed"`
+	Errors     int   `json:"errors"`
+	Leaks      int   `json:"leaks"`
+	BytesSaved int64 `json:"bytes_saved"`
+
+	// Failures lists every file counted in Errors, in collection order.
+	Failures []FileError `json:"failures,omitempty"`
+
+	// Warnings lists steps skipped for files that were still processed,
+	// such as stamping a format that cannot be stamped.
+	Warnings []FileError `json:"warnings,omitempty"`
+
+	// Canceled is set when the context was canceled before every file was
+	// processed; Unprocessed then lists the files that were never opened.
+	Canceled    bool     `json:"canceled,omitempty"`
+	Unprocessed []string `json:"unprocessed,omitempty"`
 }
 
 type ScanReport struct {
 	Path     string
-	Details  []ScanDetail
+	Findings []Finding
 	Insights []ScanInsight
-}
-
-type ScanDetail struct {
-	Category string
-	Values   []string
+	Err      error
 }
 
 type ScanInsight struct {
-	Kind    string
-	Message string
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
 }
 
 type ProgressUpdate struct {
@@ -64,3 +146,40 @@ type ProgressUpdate struct {
 	LeakDelta       int
 	BytesSavedDelta int64
 }
+
+// stripPolicy folds the PreserveICC, KeepTrailers, RewriteExif, CoarsenGPS
+// and Time switches into Policy, and rewrites EXIF when a tag or category
+// rule keeps something.
+// Explicit policy rules take precedence over the switches.
+func (o Options) stripPolicy() *Policy {
+	policy := o.Policy
+	if o.PreserveICC {
+		policy = policy.withContainerRule("ICC", ActionKeep)
+	}
+	if o.KeepTrailers {
+		policy = policy.withContainerRule("Trailer", ActionKeep)
+	}
+	if o.RewriteExif || len(o.ExifAllow) > 0 || (policy.keepsItems() && !policy.rewritesExif()) {
+		policy = policy.withExifRewrite(o.ExifAllow)
+	}
+	if o.CoarsenGPS != "" {
+		policy = policy.withGPSPrecision(o.CoarsenGPS)
+	}
+	rewrite := o.Time
+	if rewrite == nil {
+		rewrite = policy.timeRewrite()
+	}
+	if rewrite != nil {
+		policy = policy.withTimeRewrite(rewrite)
+	}
+	return policy
+}
+
+// cleanedKind is the format clean writes a file of kind as, which
+// re-encoding may change.
+func (o Options) cleanedKind(kind imgutil.Kind) imgutil.Kind {
+	if o.Reencode.applies(kind) {
+		return o.Reencode.target(kind)
+	}
+	return kind
+}
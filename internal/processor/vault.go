@@ -0,0 +1,397 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"bleach/pkg/imgutil"
+)
+
+// A vault file starts with a header (magic, KDF salt and iteration count,
+// and a sealed check value that verifies the passphrase) followed by
+// length-prefixed records, each sealed with AES-256-GCM under its own nonce.
+const (
+	vaultMagic      = "BLEACHV1"
+	vaultSaltSize   = 16
+	vaultIterations = 600_000
+	vaultCheck      = "bleach vault"
+)
+
+var errVaultPassphrase = errors.New("wrong vault passphrase")
+
+// Vault is an encrypted archive of the metadata clean removed, from which
+// the original files can be rebuilt byte for byte.
+type Vault struct {
+	mu   sync.Mutex
+	file *os.File
+	aead cipher.AEAD
+	aad  []byte
+	// records holds the records of a read vault by cleaned file hash. Files
+	// that clean to the same bytes share a hash, so each has a slice.
+	records map[string][]vaultRecord
+}
+
+// vaultRecord rebuilds one original from its cleaned file: Ops list the
+// original's units in order, each either a unit of the cleaned file or
+// bytes clean removed or changed.
+type vaultRecord struct {
+	Path     string    `json:"path"`
+	Original string    `json:"original_sha256"`
+	Cleaned  string    `json:"cleaned_sha256"`
+	Ops      []vaultOp `json:"ops"`
+}
+
+// vaultOp copies unit Ref of the cleaned file, or writes Data when set.
+type vaultOp struct {
+	Ref  int    `json:"ref,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// OpenVault opens the vault at path for adding records, creating it when it
+// does not exist.
+func OpenVault(path string, passphrase []byte) (*Vault, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	v := &Vault{file: file}
+	if info.Size() == 0 {
+		err = v.writeHeader(passphrase)
+	} else {
+		err = v.readHeader(io.NewSectionReader(file, 0, info.Size()), passphrase)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// ReadVault loads every record of the vault at path for restoring.
+func ReadVault(path string, passphrase []byte) (*Vault, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	v := &Vault{records: map[string][]vaultRecord{}}
+	r := bytes.NewReader(data)
+	if err := v.readHeader(r, passphrase); err != nil {
+		return nil, err
+	}
+	for r.Len() > 0 {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, fmt.Errorf("truncated vault record: %w", err)
+		}
+		if int64(size) > int64(r.Len()) {
+			return nil, errors.New("truncated vault record")
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return nil, fmt.Errorf("truncated vault record: %w", err)
+		}
+		plain, err := v.open(sealed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vault record: %w", err)
+		}
+		var record vaultRecord
+		if err := json.Unmarshal(plain, &record); err != nil {
+			return nil, fmt.Errorf("invalid vault record: %w", err)
+		}
+		v.records[record.Cleaned] = append(v.records[record.Cleaned], record)
+	}
+	return v, nil
+}
+
+// Close closes a vault opened with OpenVault.
+func (v *Vault) Close() error {
+	if v.file == nil {
+		return nil
+	}
+	return v.file.Close()
+}
+
+func (v *Vault) writeHeader(passphrase []byte) error {
+	salt := make([]byte, vaultSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	header := append([]byte(vaultMagic), salt...)
+	header = binary.BigEndian.AppendUint32(header, vaultIterations)
+	if err := v.deriveKey(passphrase, header); err != nil {
+		return err
+	}
+	sealed, err := v.seal([]byte(vaultCheck))
+	if err != nil {
+		return err
+	}
+	if _, err := v.file.Write(append(header, sealed...)); err != nil {
+		return err
+	}
+	return v.file.Sync()
+}
+
+func (v *Vault) readHeader(r io.Reader, passphrase []byte) error {
+	header := make([]byte, len(vaultMagic)+vaultSaltSize+4)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(vaultMagic)]) != vaultMagic {
+		return errors.New("invalid vault header")
+	}
+	if err := v.deriveKey(passphrase, header); err != nil {
+		return err
+	}
+	check := make([]byte, v.aead.NonceSize()+len(vaultCheck)+v.aead.Overhead())
+	if _, err := io.ReadFull(r, check); err != nil {
+		return errors.New("truncated vault header")
+	}
+	if plain, err := v.open(check); err != nil || string(plain) != vaultCheck {
+		return errVaultPassphrase
+	}
+	return nil
+}
+
+// deriveKey sets up the cipher from the passphrase and the salt and
+// iteration count in header, which is also bound to every record.
+func (v *Vault) deriveKey(passphrase []byte, header []byte) error {
+	salt := header[len(vaultMagic) : len(vaultMagic)+vaultSaltSize]
+	iterations := binary.BigEndian.Uint32(header[len(vaultMagic)+vaultSaltSize:])
+	if iterations == 0 || iterations > 100*vaultIterations {
+		return errors.New("invalid vault iteration count")
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, int(iterations), 32)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if v.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	v.aad = append([]byte{}, header...)
+	return nil
+}
+
+func (v *Vault) seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return v.aead.Seal(nonce, nonce, plain, v.aad), nil
+}
+
+func (v *Vault) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < v.aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	nonce := sealed[:v.aead.NonceSize()]
+	return v.aead.Open(nil, nonce, sealed[len(nonce):], v.aad)
+}
+
+// add records how to rebuild original from cleaned. The record is synced to
+// disk before returning, so an in-place clean never loses data the vault
+// was meant to hold.
+func (v *Vault) add(kind imgutil.Kind, path string, original, cleaned []byte) error {
+	if bytes.Equal(original, cleaned) {
+		return nil
+	}
+	plain, err := json.Marshal(newVaultRecord(kind, path, original, cleaned))
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	sealed, err := v.seal(plain)
+	if err != nil {
+		return err
+	}
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))
+	if _, err := v.file.Write(append(out, sealed...)); err != nil {
+		return err
+	}
+	return v.file.Sync()
+}
+
+// restore rebuilds the original of a cleaned file at path, relative to the
+// folder being restored. When several originals cleaned to the same bytes,
+// the latest record for path decides.
+func (v *Vault) restore(kind imgutil.Kind, path string, cleaned []byte) ([]byte, error) {
+	records := v.records[sha256Hex(cleaned)]
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no vault record matches this file: %w", fs.ErrNotExist)
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if filepath.ToSlash(records[i].Path) == filepath.ToSlash(path) {
+			return records[i].rebuild(kind, cleaned)
+		}
+	}
+	original := records[0].Original
+	for _, record := range records[1:] {
+		if record.Original != original {
+			return nil, fmt.Errorf("%d different originals clean to this file and none was at %s", len(records), filepath.ToSlash(path))
+		}
+	}
+	return records[len(records)-1].rebuild(kind, cleaned)
+}
+
+func newVaultRecord(kind imgutil.Kind, path string, original, cleaned []byte) vaultRecord {
+	return vaultRecord{
+		Path:     path,
+		Original: sha256Hex(original),
+		Cleaned:  sha256Hex(cleaned),
+		Ops:      vaultDelta(kind, original, cleaned),
+	}
+}
+
+// rebuild applies the record to cleaned and checks the result against the
+// original's hash.
+func (r vaultRecord) rebuild(kind imgutil.Kind, cleaned []byte) ([]byte, error) {
+	units := vaultUnits(kind, cleaned)
+	var out []byte
+	for _, op := range r.Ops {
+		if op.Data != nil {
+			out = append(out, op.Data...)
+			continue
+		}
+		if op.Ref < 0 || op.Ref >= len(units) {
+			return nil, fmt.Errorf("%w vault record: unit out of range", errMalformed)
+		}
+		out = append(out, units[op.Ref]...)
+	}
+	if sha256Hex(out) != r.Original {
+		return nil, fmt.Errorf("%w vault record: restored file does not match the original hash", errMalformed)
+	}
+	return out, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// vaultDelta expresses original as units of cleaned, in order, and the bytes
+// between them. Units clean kept as they were become references; removed or
+// rewritten ones are stored.
+func vaultDelta(kind imgutil.Kind, original, cleaned []byte) []vaultOp {
+	index := map[[sha256.Size]byte][]int{}
+	for i, unit := range vaultUnits(kind, cleaned) {
+		sum := sha256.Sum256(unit)
+		index[sum] = append(index[sum], i)
+	}
+
+	var ops []vaultOp
+	next := 0
+	for _, unit := range vaultUnits(kind, original) {
+		ref := -1
+		for _, i := range index[sha256.Sum256(unit)] {
+			if i >= next {
+				ref = i
+				break
+			}
+		}
+		if ref >= 0 {
+			ops = append(ops, vaultOp{Ref: ref})
+			next = ref + 1
+			continue
+		}
+		if n := len(ops); n > 0 && ops[n-1].Data != nil {
+			ops[n-1].Data = append(ops[n-1].Data, unit...)
+		} else {
+			ops = append(ops, vaultOp{Data: append([]byte{}, unit...)})
+		}
+	}
+	return ops
+}
+
+// vaultUnits splits a file into the pieces clean keeps or removes whole:
+// JPEG segments (including the images of multi-picture files), PNG chunks
+// and WebP chunks. Other formats are a single unit. The units always add up
+// to data.
+func vaultUnits(kind imgutil.Kind, data []byte) [][]byte {
+	var units [][]byte
+	switch kind {
+	case imgutil.KindJPEG:
+		units = jpegUnits(data)
+	case imgutil.KindPNG:
+		units = chunkUnits(data, len(pngSignature), func(header []byte) int {
+			return 12 + int(binary.BigEndian.Uint32(header[0:4]))
+		})
+	case imgutil.KindWebP:
+		units = chunkUnits(data, 12, func(header []byte) int {
+			size := int(binary.LittleEndian.Uint32(header[4:8]))
+			return 8 + size + size%2
+		})
+	default:
+		units = [][]byte{data}
+	}
+	return units
+}
+
+func jpegUnits(data []byte) [][]byte {
+	var units [][]byte
+	pos := 0
+	for pos < len(data) {
+		if img, err := parseJPEG(data[pos:]); err == nil && img.End > 0 {
+			cursor := 0
+			for _, seg := range img.Segments {
+				if seg.Start > cursor {
+					units = append(units, data[pos+cursor:pos+seg.Start])
+				}
+				units = append(units, data[pos+seg.Start:pos+seg.End])
+				cursor = seg.End
+			}
+			pos += img.End
+			continue
+		}
+		end := len(data)
+		if next := bytes.Index(data[pos+1:], []byte{0xff, 0xd8}); next >= 0 {
+			end = pos + 1 + next
+		}
+		units = append(units, data[pos:end])
+		pos = end
+	}
+	return units
+}
+
+// chunkUnits splits data into a header of headerSize bytes, the chunks that
+// follow it, and whatever is left once a chunk does not fit.
+func chunkUnits(data []byte, headerSize int, chunkSize func(header []byte) int) [][]byte {
+	if len(data) < headerSize {
+		return [][]byte{data}
+	}
+	units := [][]byte{data[:headerSize]}
+	pos := headerSize
+	for pos+8 <= len(data) {
+		size := chunkSize(data[pos : pos+8])
+		if size < 8 || pos+size > len(data) {
+			break
+		}
+		units = append(units, data[pos:pos+size])
+		pos += size
+	}
+	if pos < len(data) {
+		units = append(units, data[pos:])
+	}
+	return units
+}
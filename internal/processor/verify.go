@@ -0,0 +1,277 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+
+	"bleach/pkg/imgutil"
+)
+
+// errVerify marks the errors of a failed verification.
+var errVerify = errors.New("verification failed")
+
+// verifyClean checks that cleaned is a clean and intact copy of reference:
+// the scanner finds nothing policy would have removed, the file's structure
+// is valid, and it decodes to the same pixels. HEIF has no decoder here, so
+// its coded image items are compared byte for byte instead. A nil reference
+// only checks that cleaned decodes.
+func verifyClean(kind imgutil.Kind, reference, cleaned []byte, policy *Policy) error {
+	findings, err := scanBytes(kind, cleaned)
+	if err != nil {
+		return fmt.Errorf("%w: rescan: %v", errVerify, err)
+	}
+	var remaining []string
+	for _, f := range policy.strippedFindings(kind, findings) {
+		if f.Leak() {
+			remaining = append(remaining, f.Category+" "+f.TagName)
+		}
+	}
+	if len(remaining) > 0 {
+		return fmt.Errorf("%w: %d findings remain (%s)", errVerify, len(remaining), strings.Join(remaining, ", "))
+	}
+
+	if err := checkStructure(kind, cleaned); err != nil {
+		return fmt.Errorf("%w: invalid structure: %v", errVerify, err)
+	}
+	if kind == imgutil.KindHEIF {
+		return compareHEIFImages(reference, cleaned)
+	}
+	return comparePixels(kind, reference, cleaned)
+}
+
+func scanBytes(kind imgutil.Kind, data []byte) ([]Finding, error) {
+	r := bytes.NewReader(data)
+	switch kind {
+	case imgutil.KindJPEG:
+		return scanJPEGMetadata(r)
+	case imgutil.KindTIFF:
+		return analyzeExif(r)
+	case imgutil.KindPNG:
+		return scanPNGMetadata(r)
+	case imgutil.KindWebP:
+		return scanWebPMetadata(r)
+	case imgutil.KindHEIF:
+		return scanHEIFMetadata(r)
+	}
+	return nil, nil
+}
+
+// keepsFinding reports whether a finding sits in something p keeps on
+// purpose: a container kept by a rule, or GPS coarsened rather than removed.
+func (p *Policy) keepsFinding(kind imgutil.Kind, f Finding) bool {
+	if p == nil {
+		return false
+	}
+	if f.Category == CategoryGPS && p.Exif != nil && p.Exif.GPS != "" {
+		return true
+	}
+	block, _, _ := strings.Cut(f.Container, "/")
+	names := []string{block}
+	if prefix, suffix, ok := strings.Cut(block, ":"); ok {
+		names = append(names, prefix, suffix)
+	}
+	if f.Category == CategoryTrailer {
+		// Trailer findings sit in a "trailer" container; rules name it
+		// "Trailer".
+		names = append(names, "Trailer")
+	}
+	action, ok := p.containerRule(kind, names)
+	return ok && action == ActionKeep
+}
+
+func checkStructure(kind imgutil.Kind, data []byte) error {
+	switch kind {
+	case imgutil.KindJPEG:
+		img, err := parseJPEG(data)
+		if err != nil {
+			return err
+		}
+		if img.End == 0 {
+			return errors.New("missing JPEG EOI marker")
+		}
+	case imgutil.KindPNG:
+		return checkPNGChunks(data)
+	case imgutil.KindWebP:
+		if _, err := readWebPChunks(bytes.NewReader(data)); err != nil {
+			return err
+		}
+		if size := int(binary.LittleEndian.Uint32(data[4:8])); size+8 > len(data) {
+			return errors.New("RIFF size exceeds the file")
+		}
+	case imgutil.KindTIFF:
+		if len(data) < 8 {
+			return errors.New("TIFF header too short")
+		}
+		order := tiffByteOrder(data)
+		if order == nil {
+			return errors.New("invalid TIFF byte order")
+		}
+		if offset := order.Uint32(data[4:8]); offset < 8 || int(offset) >= len(data) {
+			return errors.New("IFD0 offset out of range")
+		}
+	case imgutil.KindHEIF:
+		_, err := parseHEIF(data)
+		return err
+	}
+	return nil
+}
+
+func tiffByteOrder(data []byte) binary.ByteOrder {
+	switch string(data[0:2]) {
+	case "II":
+		return binary.LittleEndian
+	case "MM":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// checkPNGChunks walks the chunks of a PNG file, checking their CRCs and
+// that it starts with IHDR and ends with IEND.
+func checkPNGChunks(data []byte) error {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return errors.New("invalid PNG signature")
+	}
+	pos := len(pngSignature)
+	first := true
+	for {
+		if pos+12 > len(data) {
+			return errors.New("missing PNG IEND chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if length > len(data)-pos-12 {
+			return errors.New("truncated PNG chunk")
+		}
+		name := string(data[pos+4 : pos+8])
+		if first && name != "IHDR" {
+			return errors.New("PNG does not start with IHDR")
+		}
+		first = false
+		end := pos + 8 + length
+		if crc32.ChecksumIEEE(data[pos+4:end]) != binary.BigEndian.Uint32(data[end:end+4]) {
+			return fmt.Errorf("invalid CRC in PNG chunk %q", name)
+		}
+		pos = end + 4
+		if name == "IEND" {
+			return nil
+		}
+	}
+}
+
+var imageDecoders = map[imgutil.Kind]func(io.Reader) (image.Image, error){
+	imgutil.KindJPEG: jpeg.Decode,
+	imgutil.KindPNG:  png.Decode,
+	imgutil.KindWebP: webp.Decode,
+	imgutil.KindTIFF: tiff.Decode,
+}
+
+// comparePixels decodes both files and compares their pixels. A reference
+// the decoders do not support (such as animated WebP or compressed TIFF
+// variants) is not compared.
+func comparePixels(kind imgutil.Kind, reference, cleaned []byte) error {
+	decode := imageDecoders[kind]
+	if decode == nil {
+		return nil
+	}
+	got, err := decode(bytes.NewReader(cleaned))
+	if reference == nil {
+		if err != nil {
+			return fmt.Errorf("%w: cleaned image does not decode: %v", errVerify, err)
+		}
+		return nil
+	}
+	want, wantErr := decode(bytes.NewReader(reference))
+	if wantErr != nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: cleaned image does not decode: %v", errVerify, err)
+	}
+	if want.Bounds() != got.Bounds() {
+		return fmt.Errorf("%w: image size changed from %v to %v", errVerify, want.Bounds().Size(), got.Bounds().Size())
+	}
+	if samePixels(want, got) {
+		return nil
+	}
+	bounds := want.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, a1 := want.At(x, y).RGBA()
+			r2, g2, b2, a2 := got.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return fmt.Errorf("%w: pixels differ at (%d, %d)", errVerify, x, y)
+			}
+		}
+	}
+	return nil
+}
+
+// samePixels is a fast path for images of the same concrete type with
+// identical sample buffers, which is what the decoders return for the same
+// coded data.
+func samePixels(want, got image.Image) bool {
+	switch w := want.(type) {
+	case *image.YCbCr:
+		g, ok := got.(*image.YCbCr)
+		return ok && w.SubsampleRatio == g.SubsampleRatio && w.YStride == g.YStride && w.CStride == g.CStride &&
+			bytes.Equal(w.Y, g.Y) && bytes.Equal(w.Cb, g.Cb) && bytes.Equal(w.Cr, g.Cr)
+	case *image.NRGBA:
+		g, ok := got.(*image.NRGBA)
+		return ok && w.Stride == g.Stride && bytes.Equal(w.Pix, g.Pix)
+	case *image.RGBA:
+		g, ok := got.(*image.RGBA)
+		return ok && w.Stride == g.Stride && bytes.Equal(w.Pix, g.Pix)
+	case *image.Gray:
+		g, ok := got.(*image.Gray)
+		return ok && w.Stride == g.Stride && bytes.Equal(w.Pix, g.Pix)
+	case *image.CMYK:
+		g, ok := got.(*image.CMYK)
+		return ok && w.Stride == g.Stride && bytes.Equal(w.Pix, g.Pix)
+	}
+	return false
+}
+
+// compareHEIFImages checks that every item of reference other than EXIF
+// and XMP metadata has the same data in cleaned.
+func compareHEIFImages(reference, cleaned []byte) error {
+	want, err := parseHEIF(reference)
+	if err != nil {
+		return nil
+	}
+	got, err := parseHEIF(cleaned)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errVerify, err)
+	}
+	gotItems := map[uint32]bool{}
+	for _, item := range got.items {
+		gotItems[item.ID] = true
+	}
+	for _, item := range want.items {
+		if isHEIFExifItem(item) || isHEIFXMPItem(item) {
+			continue
+		}
+		wantData, err := want.itemData(item.ID)
+		if err != nil {
+			continue
+		}
+		if !gotItems[item.ID] {
+			return fmt.Errorf("%w: HEIF item %d is missing", errVerify, item.ID)
+		}
+		gotData, err := got.itemData(item.ID)
+		if err != nil || !bytes.Equal(wantData, gotData) {
+			return fmt.Errorf("%w: HEIF item %d changed", errVerify, item.ID)
+		}
+	}
+	return nil
+}
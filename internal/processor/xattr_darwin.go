@@ -0,0 +1,26 @@
+package processor
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// errNoXattr is the error for an attribute removed while being read.
+var errNoXattr = unix.ENOATTR
+
+// reportXattr keeps every attribute, such as com.apple.quarantine and
+// com.apple.metadata:kMDItemWhereFroms, except the kernel's own provenance
+// tracking.
+func reportXattr(name string) bool {
+	return name != "com.apple.provenance"
+}
+
+func fileAtime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atimespec.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,26 @@
+package processor
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// errNoXattr is the error for an attribute removed while being read.
+var errNoXattr = unix.ENODATA
+
+// reportXattr keeps the user namespace; security and system attributes
+// (SELinux labels, ACLs) describe access, not the file's history.
+func reportXattr(name string) bool {
+	return strings.HasPrefix(name, "user.")
+}
+
+func fileAtime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package processor
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var errXattrUnsupported = errors.New("extended attributes not supported")
+
+func listXattrs(path string) ([]xattr, error) {
+	return nil, errXattrUnsupported
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
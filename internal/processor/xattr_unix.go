@@ -0,0 +1,70 @@
+//go:build linux || darwin
+
+package processor
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+var errXattrUnsupported = errors.New("extended attributes not supported")
+
+// listXattrs returns the extended attributes of path that describe the
+// file, as filtered by reportXattr.
+func listXattrs(path string) ([]xattr, error) {
+	names, err := readXattr(func(buf []byte) (int, error) { return unix.Listxattr(path, buf) })
+	if err != nil {
+		return nil, err
+	}
+	var attrs []xattr
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 || !reportXattr(string(name)) {
+			continue
+		}
+		value, err := readXattr(func(buf []byte) (int, error) { return unix.Getxattr(path, string(name), buf) })
+		if errors.Is(err, errNoXattr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, xattr{name: string(name), value: value})
+	}
+	return attrs, nil
+}
+
+// readXattr calls read with a buffer of the size it asks for, retrying when
+// the attribute grows in between.
+func readXattr(read func([]byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		return buf[:n], nil
+	}
+}
+
+func setXattr(path, name string, value []byte) error {
+	return xattrError(unix.Setxattr(path, name, value, 0))
+}
+
+func xattrError(err error) error {
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+		return errXattrUnsupported
+	}
+	return err
+}
@@ -14,6 +14,7 @@ import (
 
 type Model struct {
 	updates    <-chan processor.ProgressUpdate
+	cancel     func()
 	started    time.Time
 	width      int
 	total      int
@@ -22,14 +23,18 @@ type Model struct {
 	leaks      int
 	bytesSaved int64
 	quitting   bool
+	canceling  bool
 }
 
 type doneMsg struct{}
 
 type updateMsg processor.ProgressUpdate
 
-func NewModel(updates <-chan processor.ProgressUpdate) Model {
-	return Model{updates: updates, started: time.Now()}
+// NewModel returns a progress model fed by updates. cancel, if non-nil, is
+// called when the user presses q or ctrl+c; the model keeps running until
+// updates is closed so in-flight files can finish.
+func NewModel(updates <-chan processor.ProgressUpdate, cancel func()) Model {
+	return Model{updates: updates, cancel: cancel, started: time.Now()}
 }
 
 func (m Model) Init() tea.Cmd {
@@ -48,6 +53,15 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case doneMsg:
 		m.quitting = true
 		return m, tea.Quit
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c":
+			if !m.canceling && m.cancel != nil {
+				m.canceling = true
+				m.cancel()
+			}
+		}
+		return m, nil
 	case tea.WindowSizeMsg:
 		m.width = msg.Width
 		return m, nil
@@ -88,6 +102,9 @@ func (m Model) View() string {
 		dimStyle.Render(fmt.Sprintf("Elapsed: %s", elapsed)),
 		renderBarLine(bar),
 	}
+	if m.canceling {
+		lines = append(lines, warnStyle.Render("Canceling: finishing in-flight files..."))
+	}
 
 	return strings.Join(lines, "\n")
 }
@@ -118,6 +135,7 @@ var (
 	keyStyle        = lipgloss.NewStyle().Foreground(ColorAccentAlt)
 	valueStyle      = lipgloss.NewStyle().Foreground(ColorInk).Bold(true)
 	dimStyle        = lipgloss.NewStyle().Foreground(ColorDim)
+	warnStyle       = lipgloss.NewStyle().Foreground(ColorWarn)
 	barFillStyle    = lipgloss.NewStyle().Foreground(ColorAccent)
 	barEmptyStyle   = lipgloss.NewStyle().Foreground(ColorDim)
 	barBracketStyle = lipgloss.NewStyle().Foreground(ColorDim)
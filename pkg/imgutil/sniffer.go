@@ -14,6 +14,8 @@ const (
 	KindJPEG
 	KindPNG
 	KindTIFF
+	KindWebP
+	KindHEIF
 )
 
 func (k Kind) String() string {
@@ -24,6 +26,10 @@ func (k Kind) String() string {
 		return "png"
 	case KindTIFF:
 		return "tiff"
+	case KindWebP:
+		return "webp"
+	case KindHEIF:
+		return "heif"
 	default:
 		return "unknown"
 	}
@@ -34,9 +40,26 @@ var (
 	jpegSig   = []byte{0xff, 0xd8, 0xff}
 	tiffSigLE = []byte{0x49, 0x49, 0x2a, 0x00}
 	tiffSigBE = []byte{0x4d, 0x4d, 0x00, 0x2a}
+	riffSig   = []byte("RIFF")
+	webpSig   = []byte("WEBP")
+	ftypSig   = []byte("ftyp")
 )
 
-// DetectHeader inspects the first 8 bytes of a file for known signatures.
+// heifBrands lists the ISOBMFF major brands handled as KindHEIF, which covers
+// both HEIC and AVIF still images.
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true, "mif1": true, "msf1": true,
+	"avif": true, "avis": true,
+}
+
+// HeaderSize is the number of leading bytes needed to recognize every
+// supported signature.
+const HeaderSize = 12
+
+// DetectHeader inspects the first bytes of a file for known signatures.
+// At least 8 bytes are required; container formats such as WebP and HEIF need
+// HeaderSize bytes to be recognized.
 func DetectHeader(header []byte) (Kind, error) {
 	if len(header) < 8 {
 		return KindUnknown, errors.New("header too short")
@@ -51,11 +74,17 @@ func DetectHeader(header []byte) (Kind, error) {
 	if hasPrefix(header, tiffSigLE) || hasPrefix(header, tiffSigBE) {
 		return KindTIFF, nil
 	}
+	if len(header) >= 12 && hasPrefix(header, riffSig) && hasPrefix(header[8:], webpSig) {
+		return KindWebP, nil
+	}
+	if len(header) >= 12 && hasPrefix(header[4:], ftypSig) && heifBrands[string(header[8:12])] {
+		return KindHEIF, nil
+	}
 
 	return KindUnknown, nil
 }
 
-// SniffFile reads the first 8 bytes of a file to determine its type.
+// SniffFile reads the header of a file to determine its type.
 func SniffFile(path string) (Kind, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -66,14 +95,15 @@ func SniffFile(path string) (Kind, error) {
 	return SniffReader(f)
 }
 
-// SniffReader reads the first 8 bytes from r and determines its type.
+// SniffReader reads up to HeaderSize bytes from r and determines its type.
 func SniffReader(r io.Reader) (Kind, error) {
-	header := make([]byte, 8)
-	if _, err := io.ReadFull(r, header); err != nil {
+	header := make([]byte, HeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
 		return KindUnknown, err
 	}
 
-	return DetectHeader(header)
+	return DetectHeader(header[:n])
 }
 
 func hasPrefix(buf, prefix []byte) bool {